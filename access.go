@@ -0,0 +1,185 @@
+package cow
+
+// Access policy on User-Agent and client OS.
+//
+//   accessRule = ua=*Googlebot* allow
+//   accessRule = ua=*bot* deny
+//   accessRule = os=windows auth
+//
+// Each accessRule option has one or more conditions followed by an action.
+// Conditions are ua, header and port like requestRule, and
+//
+//   os=name   operating system of the client guessed from its TCP SYN:
+//             linux (including Android), macos (including iOS) or windows.
+//             Linux only, the SYN is saved by the kernel
+//
+// Actions are:
+//
+//   allow  not denied by later rules, authentication is still required as
+//          usual
+//   deny   reply 403 and close the connection
+//   auth   require user name and password, even if the client address is
+//          in allowedClient
+//
+// Rules are checked in order for each request on http listeners before
+// authentication, the first matching rule wins. Requests matching no rule
+// are authenticated as usual. User-Agent is set by the client and the OS
+// guess is based on initial TTL and TCP options, both are easily forged, so
+// use them to keep crawlers and unwanted devices out, not attackers.
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+type accessAction int
+
+const (
+	accessNone accessAction = iota
+	accessAllow
+	accessDeny
+	accessAuth
+)
+
+type accessRule struct {
+	source string // option value
+	cond   []requestCond
+	os     string // empty if no os condition
+	action accessAction
+}
+
+var accessRules []*accessRule
+
+var accessOS = map[string]bool{"linux": true, "macos": true, "windows": true}
+
+func parseAccessRule(val string) (*accessRule, error) {
+	f := strings.Fields(val)
+	if len(f) < 2 {
+		return nil, errors.New("should be conditions and action")
+	}
+	ar := &accessRule{source: val}
+	var cond []string
+	for _, s := range f[:len(f)-1] {
+		if !strings.HasPrefix(strings.ToLower(s), "os=") {
+			cond = append(cond, s)
+			continue
+		}
+		if !synSaveSupported {
+			return nil, errors.New("os condition is only supported on Linux")
+		}
+		if ar.os = strings.ToLower(s[len("os="):]); !accessOS[ar.os] {
+			return nil, errors.New("os should be linux, macos or windows")
+		}
+	}
+	var err error
+	if ar.cond, err = parseRequestConds(cond, false); err != nil {
+		return nil, err
+	}
+	switch f[len(f)-1] {
+	case "allow":
+		ar.action = accessAllow
+	case "deny":
+		ar.action = accessDeny
+	case "auth":
+		ar.action = accessAuth
+	default:
+		return nil, errors.New("action should be allow, deny or auth, got " + f[len(f)-1])
+	}
+	return ar, nil
+}
+
+// accessSaveSYN returns whether http listeners should save SYN for os
+// conditions.
+func accessSaveSYN() bool {
+	for _, ar := range accessRules {
+		if ar.os != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func initAccessRule() {
+	for _, ar := range accessRules {
+		if ar.action == accessAuth && config.UserPasswd == "" && config.UserPasswdFile == "" &&
+			embedPassword == nil {
+			Fatal("accessRule", ar.source+": auth requires userPasswd or userPasswdFile")
+		}
+	}
+}
+
+// synOS guesses OS from IP and TCP header of SYN, returns empty string if
+// unknown.
+func synOS(syn []byte) string {
+	if len(syn) == 0 {
+		return ""
+	}
+	var ttl byte
+	var tcp []byte
+	switch syn[0] >> 4 {
+	case 4:
+		ihl := int(syn[0]&0xf) * 4
+		if ihl < 20 || len(syn) < ihl+20 {
+			return ""
+		}
+		ttl, tcp = syn[8], syn[ihl:]
+	case 6:
+		if len(syn) < 60 {
+			return ""
+		}
+		ttl, tcp = syn[7], syn[40:]
+	default:
+		return ""
+	}
+	switch {
+	case ttl > 128:
+		return ""
+	case ttl > 64:
+		return "windows"
+	}
+	off := int(tcp[12]>>4) * 4
+	if off < 20 || off > len(tcp) {
+		return ""
+	}
+	// Kinds of TCP options, macOS sends MSS, NOP, window scale first,
+	// Linux puts SACK permitted right after MSS.
+	var kind []byte
+	for opt := tcp[20:off]; len(opt) > 0 && opt[0] != 0 && len(kind) < 3; {
+		kind = append(kind, opt[0])
+		if opt[0] == 1 {
+			opt = opt[1:]
+			continue
+		}
+		if len(opt) < 2 || opt[1] < 2 || int(opt[1]) > len(opt) {
+			break
+		}
+		opt = opt[opt[1]:]
+	}
+	if string(kind) == "\x02\x01\x03" {
+		return "macos"
+	}
+	return "linux"
+}
+
+// clientOS returns OS of the client guessed from its SYN.
+func (c *clientConn) clientOS() string {
+	if !c.synRead {
+		c.synRead = true
+		c.synOS = synOS(savedSYN(c.Conn))
+		debug.Printf("cli(%s) os guessed from SYN: %q\n", c.RemoteAddr(), c.synOS)
+	}
+	return c.synOS
+}
+
+// matchAccessRule returns action of the first rule matching the request.
+func (c *clientConn) matchAccessRule(r *Request) accessAction {
+	_, port, _ := net.SplitHostPort(c.LocalAddr().String())
+	for _, ar := range accessRules {
+		if matchRequestConds(ar.cond, r, port) && (ar.os == "" || ar.os == c.clientOS()) {
+			debug.Printf("cli(%s) access rule %s\n", c.RemoteAddr(), ar.source)
+			return ar.action
+		}
+	}
+	return accessNone
+}
@@ -0,0 +1,113 @@
+package cow
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestParseAccessRule(t *testing.T) {
+	testData := []struct {
+		val    string
+		ncond  int
+		action accessAction
+	}{
+		{"ua=*bot* deny", 1, accessDeny},
+		{"ua=curl/* port=7777 auth", 2, accessAuth},
+		{"header:X-App=foo allow", 1, accessAllow},
+	}
+	for _, td := range testData {
+		ar, err := parseAccessRule(td.val)
+		if err != nil {
+			t.Errorf("%s: %v", td.val, err)
+			continue
+		}
+		if len(ar.cond) != td.ncond || ar.action != td.action {
+			t.Errorf("%s parsed wrong: %+v", td.val, ar)
+		}
+	}
+	for _, val := range []string{"deny", "ua=* block", "asn=15169 deny", "os=beos allow"} {
+		if _, err := parseAccessRule(val); err == nil {
+			t.Errorf("%s should fail", val)
+		}
+	}
+	if synSaveSupported {
+		if ar, err := parseAccessRule("os=Windows allow"); err != nil || ar.os != "windows" {
+			t.Error("os condition parsed wrong:", ar, err)
+		}
+	}
+}
+
+// TestAccessAllowAuth checks allow rule doesn't skip authentication.
+func TestAccessAllowAuth(t *testing.T) {
+	savedRequired, savedUser, savedAuthed := auth.required, auth.user, auth.authed
+	savedTmpl, savedRules := auth.template, accessRules
+	defer func() {
+		auth.required, auth.user, auth.authed = savedRequired, savedUser, savedAuthed
+		auth.template, accessRules = savedTmpl, savedRules
+	}()
+	auth.required = true
+	auth.template = template.Must(template.New("auth").Parse(
+		"HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"))
+	auth.user = map[string]*authUser{"alice": {passwd: "secret"}}
+	auth.authed = NewTimeoutSet(time.Hour)
+	ar, err := parseAccessRule("ua=curl/* allow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessRules = []*accessRule{ar}
+
+	proxy := testProxy(t)
+	defer proxy.Close()
+	c, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nUser-Agent: curl/8.0\r\n\r\n"
+	if _, err = c.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 407 {
+		t.Error("allowed request should still require authentication, got", resp.StatusCode)
+	}
+}
+
+// synPacket returns IPv4 and TCP header with ttl and TCP options.
+func synPacket(ttl byte, opt []byte) []byte {
+	b := make([]byte, 40, 40+len(opt))
+	b[0] = 0x45
+	b[8] = ttl
+	b[32] = byte((20+len(opt))/4) << 4
+	return append(b, opt...)
+}
+
+func TestSynOS(t *testing.T) {
+	linuxOpt := []byte{2, 4, 5, 0xb4, 4, 2, 8, 10, 0, 0, 0, 1, 0, 0, 0, 0, 1, 3, 3, 7}
+	macOpt := []byte{2, 4, 5, 0xb4, 1, 3, 3, 6, 1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 0, 4, 2, 0, 0}
+	winOpt := []byte{2, 4, 5, 0xb4, 1, 3, 3, 8, 1, 1, 4, 2}
+	testData := []struct {
+		syn []byte
+		os  string
+	}{
+		{synPacket(62, linuxOpt), "linux"},
+		{synPacket(64, macOpt), "macos"},
+		{synPacket(126, winOpt), "windows"},
+		{synPacket(250, linuxOpt), ""},
+		{nil, ""},
+		{[]byte{0x45, 0, 0}, ""},
+	}
+	for i, td := range testData {
+		if os := synOS(td.syn); os != td.os {
+			t.Errorf("%d: got %q, want %q", i, os, td.os)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package cow
+
+// Access log.
+//
+// If accessLog is set, one line is written for each request forwarded to
+// web server or parent proxy when it finishes:
+//
+//	time client user method URL status route duration [sni=name] [alpn=protos] [proc=name[pid]]
+//
+// For CONNECT tunnels, server name (SNI) and ALPN protocols offered in the
+// TLS ClientHello sent by the client are recorded when available, so tunnels
+// to IP address show the real destination. Nothing is decrypted.
+//
+// proc is the client process for connections from the local host, see
+// process.go.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var accessLog *log.Logger
+
+func initAccessLog() {
+	if config.AccessLog == "" {
+		return
+	}
+	f, err := os.OpenFile(expandTilde(config.AccessLog),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		Fatal("open access log:", err)
+	}
+	accessLog = log.New(f, "", log.LstdFlags)
+}
+
+// sniffClientHello records server name and ALPN protocols if data sent by
+// the client in tunnel is TLS ClientHello.
+func (r *Request) sniffClientHello(data []byte) {
+	if accessLog == nil || r.helloSniffed {
+		return
+	}
+	r.helloSniffed = true
+	host, alpn, err := parseClientHello(data)
+	if err != nil {
+		return
+	}
+	r.helloSNI = host
+	r.helloALPN = strings.Join(alpn, ",")
+}
+
+func logAccess(c *clientConn, r *Request, sv *serverConn, status int, start time.Time) {
+	if accessLog == nil {
+		return
+	}
+	user := c.user
+	if user == "" {
+		user = "-"
+	}
+	route := "-"
+	if sv != nil {
+		route = routeName(sv.Conn)
+	}
+	line := fmt.Sprintf("%s %s %s %s %d %s %v", c.RemoteAddr(), user, r.Method, r.URL,
+		status, route, time.Now().Sub(start)/time.Millisecond*time.Millisecond)
+	if r.helloSNI != "" {
+		line += " sni=" + r.helloSNI
+	}
+	if r.helloALPN != "" {
+		line += " alpn=" + r.helloALPN
+	}
+	if c.process != "" {
+		line += " proc=" + c.process
+	}
+	accessLog.Println(line)
+}
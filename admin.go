@@ -0,0 +1,318 @@
+package cow
+
+// Admin commands over unix socket.
+//
+// If adminSocket is set, cow listens on the unix socket for admin commands.
+// The client sends one command line, cow replies "OK" or "ERR message" in the
+// first line, followed by output of the command, then closes the connection.
+//
+// `cow ctl command` (or cow binary named cowctl) sends command to the running
+// cow using the adminSocket in config file.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const adminTimeout = 10 * time.Second
+
+var startTime = time.Now()
+
+type adminCmd struct {
+	args  string // argument synopsis
+	usage string
+	run   func(w io.Writer, args []string) error
+}
+
+var adminCmds map[string]adminCmd
+
+func init() {
+	adminCmds = map[string]adminCmd{
+		"status": {"", "show status of cow", adminStatus},
+		"reload": {"", "reload cow, same as -reload", adminReload},
+		"flush-dns": {"", "clear DNS cache", func(w io.Writer, args []string) error {
+			dnsCache.Lock()
+			n := len(dnsCache.entry)
+			dnsCache.entry = make(map[string]dnsEntry)
+			dnsCache.Unlock()
+			fmt.Fprintf(w, "%d entries removed\n", n)
+			return nil
+		}},
+		"list-connections": {"", "list client connections", adminListConn},
+		"block":            {"domain", "always use parent proxy for domain", adminUserSite(true)},
+		"direct":           {"domain", "always connect domain directly", adminUserSite(false)},
+		"parent":           {"list|enable|disable [server]", "list parent proxies, enable or disable one", adminParent},
+		"metrics":          {"[reset]", "show traffic counters, or start new accounting period", adminMetrics},
+		"memstats":         {"", "show memory allocation statistics", adminMemStats},
+		"graph":            {"[1m|5m|1h] [svg|json]", "show traffic of last hour, day or week", adminGraph},
+		"maintenance":      {"[on|off]", "show, enable or disable maintenance mode", adminMaintenance},
+		"authed":           {"[list|revoke ip|user]", "list authenticated client IPs, or revoke one", adminAuthed},
+	}
+}
+
+var adminListener net.Listener
+
+func initAdmin() {
+	if config.AdminSocket == "" {
+		return
+	}
+	// Remove stale socket left by previous cow. Pid file lock ensures no
+	// other cow is using it.
+	if c, err := net.Dial("unix", config.AdminSocket); err == nil {
+		c.Close()
+		Fatal("admin socket in use:", config.AdminSocket)
+	}
+	os.Remove(config.AdminSocket)
+	ln, err := net.Listen("unix", config.AdminSocket)
+	if err != nil {
+		Fatal("listen admin socket:", err)
+	}
+	// Only the user running cow can send commands.
+	if err = os.Chmod(config.AdminSocket, 0600); err != nil {
+		Fatal("chmod admin socket:", err)
+	}
+	adminListener = ln
+	cliConns.info = make(map[*clientConn]*cliConnInfo)
+	info.Println("admin socket", config.AdminSocket)
+}
+
+// runAdmin serves admin commands until quit. Closing the listener removes
+// the socket file.
+func runAdmin(quit <-chan struct{}) {
+	ln := adminListener
+	go func() {
+		<-quit
+		ln.Close()
+	}()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			errl.Println("admin socket accept:", err)
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		go serveAdmin(c)
+	}
+}
+
+func serveAdmin(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(adminTimeout))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		debug.Println("admin read command:", err)
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		fmt.Fprintln(c, "ERR empty command")
+		return
+	}
+	cmd, ok := adminCmds[args[0]]
+	if !ok {
+		fmt.Fprintln(c, "ERR unknown command", args[0])
+		return
+	}
+	info.Println("admin command:", strings.Join(args, " "))
+	var out bytes.Buffer
+	if err = cmd.run(&out, args[1:]); err != nil {
+		fmt.Fprintln(c, "ERR", err)
+		return
+	}
+	fmt.Fprintln(c, "OK")
+	c.Write(out.Bytes())
+}
+
+func adminStatus(w io.Writer, args []string) error {
+	fmt.Fprintln(w, "version:", version)
+	fmt.Fprintln(w, "pid:", os.Getpid())
+	fmt.Fprintln(w, "uptime:", time.Now().Sub(startTime)/time.Second*time.Second)
+	for _, p := range listenProxy {
+		fmt.Fprintln(w, "listen:", p.Addr())
+	}
+	cliConns.Lock()
+	fmt.Fprintln(w, "client connections:", len(cliConns.info))
+	cliConns.Unlock()
+	if inMaintenance() {
+		fmt.Fprintln(w, "maintenance: on")
+	}
+	parent := allParents()
+	disabled := 0
+	for _, p := range parent {
+		if parentDisabled(p.getServer()) {
+			disabled++
+		}
+	}
+	fmt.Fprintf(w, "parent proxies: %d, %d disabled\n", len(parent), disabled)
+	siteStat.vcLock.RLock()
+	fmt.Fprintln(w, "sites in stat:", len(siteStat.Vcnt))
+	siteStat.vcLock.RUnlock()
+	dnsCache.RLock()
+	fmt.Fprintln(w, "dns cache entries:", len(dnsCache.entry))
+	dnsCache.RUnlock()
+	return nil
+}
+
+func adminReload(w io.Writer, args []string) error {
+	if privilegeDropped {
+		return errNoRelaunch
+	}
+	if err := signalProcess(os.Getpid(), "reload"); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "reloading")
+	return nil
+}
+
+type connLine struct {
+	start time.Time
+	line  string
+}
+
+type byStart []connLine
+
+func (a byStart) Len() int           { return len(a) }
+func (a byStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byStart) Less(i, j int) bool { return a[i].start.Before(a[j].start) }
+
+func adminListConn(w io.Writer, args []string) error {
+	now := time.Now()
+	var lines []connLine
+	cliConns.Lock()
+	for c, ci := range cliConns.info {
+		age := now.Sub(ci.start) / time.Second * time.Second
+		process := ci.process
+		if process == "" {
+			process = "-"
+		}
+		lines = append(lines, connLine{ci.start,
+			fmt.Sprintf("%s\t%s\t%v\t%s", c.RemoteAddr(), process, age, ci.request)})
+	}
+	cliConns.Unlock()
+	sort.Sort(byStart(lines))
+	for _, l := range lines {
+		fmt.Fprintln(w, l.line)
+	}
+	return nil
+}
+
+func adminUserSite(blocked bool) func(w io.Writer, args []string) error {
+	return func(w io.Writer, args []string) error {
+		if len(args) != 1 {
+			return errors.New("domain required")
+		}
+		return siteStat.setUserSite(args[0], blocked)
+	}
+}
+
+func adminParent(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return errors.New("list, enable or disable required")
+	}
+	switch args[0] {
+	case "list":
+		for _, p := range allParents() {
+			state := "enabled"
+			if parentDisabled(p.getServer()) {
+				state = "disabled"
+			}
+			fmt.Fprintf(w, "%s\t%s\n", p.getServer(), state)
+		}
+		for _, g := range sortedProxyGroups() {
+			fmt.Fprintln(w, "group", g)
+		}
+		return nil
+	case "enable", "disable":
+		if len(args) != 2 {
+			return errors.New("parent server required")
+		}
+		return setParentDisabled(args[1], args[0] == "disable")
+	}
+	return errors.New("unknown parent command " + args[0])
+}
+
+func adminMemStats(w io.Writer, args []string) error {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	fmt.Fprintln(w, "mallocs:", ms.Mallocs)
+	fmt.Fprintln(w, "frees:", ms.Frees)
+	fmt.Fprintln(w, "total_alloc:", ms.TotalAlloc)
+	fmt.Fprintln(w, "heap_alloc:", ms.HeapAlloc)
+	fmt.Fprintln(w, "heap_objects:", ms.HeapObjects)
+	fmt.Fprintln(w, "sys:", ms.Sys)
+	fmt.Fprintln(w, "num_gc:", ms.NumGC)
+	fmt.Fprintln(w, "goroutines:", runtime.NumGoroutine())
+	return nil
+}
+
+// Client side.
+
+func isCowctl() bool {
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	return name == "cowctl"
+}
+
+func printCtlUsage() {
+	fmt.Println("Usage: cow [-rc rcfile] ctl command [args]")
+	fmt.Println("Commands:")
+	var names []string
+	for name := range adminCmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := adminCmds[name]
+		fmt.Printf("  %-18s %s\n", strings.TrimSpace(name+" "+cmd.args), cmd.usage)
+	}
+}
+
+// runCtl sends command to running cow and prints the output.
+func runCtl(args []string) error {
+	if len(args) == 0 || args[0] == "help" {
+		printCtlUsage()
+		return nil
+	}
+	return sendAdminCmd(os.Stdout, args)
+}
+
+// sendAdminCmd sends command to running cow and writes the output to w.
+func sendAdminCmd(w io.Writer, args []string) error {
+	if config.AdminSocket == "" {
+		return errors.New("adminSocket not specified")
+	}
+	c, err := net.DialTimeout("unix", config.AdminSocket, adminTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(adminTimeout))
+	if _, err = fmt.Fprintln(c, strings.Join(args, " ")); err != nil {
+		return err
+	}
+	rd := bufio.NewReader(c)
+	status, err := rd.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("read reply: %v", err)
+	}
+	status = strings.TrimSpace(status)
+	if status != "OK" {
+		return errors.New(strings.TrimSpace(strings.TrimPrefix(status, "ERR")))
+	}
+	_, err = io.Copy(w, rd)
+	return err
+}
@@ -0,0 +1,158 @@
+package cow
+
+// IP to ASN database for requestRule asn condition.
+//
+// asnFile is a text file, optionally gzip compressed, with one entry per
+// line in either format:
+//
+//   1.0.0.0	1.0.0.255	13335	US	CLOUDFLARENET   (iptoasn.com ip2asn TSV)
+//   1.0.0.0/24 13335                                   (prefix and ASN)
+//
+// ASN may have the "AS" prefix. Only entries of ASNs used in request rules
+// are loaded. Host names are resolved locally to check the ASN, the first
+// address is used.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type ipRange struct {
+	start, end net.IP // 16 byte form
+}
+
+func (ir ipRange) contains(ip net.IP) bool {
+	return bytes.Compare(ip, ir.start) >= 0 && bytes.Compare(ip, ir.end) <= 0
+}
+
+// asnRanges maps ASN used in request rules to its address ranges.
+var asnRanges map[uint32][]ipRange
+
+func parseASN(s string) (uint32, error) {
+	if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+		s = s[2:]
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, errors.New("invalid ASN " + s)
+	}
+	return uint32(n), nil
+}
+
+// parseASNLine returns address range and ASN in one line of asnFile.
+func parseASNLine(line string) (ipRange, uint32, error) {
+	f := strings.Fields(line)
+	if len(f) >= 2 && strings.Contains(f[0], "/") {
+		_, n, err := net.ParseCIDR(f[0])
+		if err != nil {
+			return ipRange{}, 0, err
+		}
+		asn, err := parseASN(f[1])
+		if err != nil {
+			return ipRange{}, 0, err
+		}
+		end := make(net.IP, len(n.IP))
+		for i := range n.IP {
+			end[i] = n.IP[i] | ^n.Mask[i]
+		}
+		return ipRange{n.IP.To16(), end.To16()}, asn, nil
+	}
+	if len(f) < 3 {
+		return ipRange{}, 0, errors.New("should be start end ASN or prefix ASN")
+	}
+	start, end := net.ParseIP(f[0]), net.ParseIP(f[1])
+	if start == nil || end == nil {
+		return ipRange{}, 0, errors.New("invalid address range")
+	}
+	asn, err := parseASN(f[2])
+	if err != nil {
+		return ipRange{}, 0, err
+	}
+	return ipRange{start.To16(), end.To16()}, asn, nil
+}
+
+// loadASN reads ranges of ASNs in used from r.
+func loadASN(r io.Reader, used map[uint32]bool, ranges map[uint32][]ipRange) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		ir, asn, err := parseASNLine(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		if used[asn] {
+			ranges[asn] = append(ranges[asn], ir)
+		}
+	}
+	return scanner.Err()
+}
+
+func loadASNFile(fpath string, used map[uint32]bool, ranges map[uint32][]ipRange) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(fpath, ".gz") {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	return loadASN(r, used, ranges)
+}
+
+func initASN(used map[uint32]bool) {
+	if len(config.ASNFile) == 0 {
+		Fatal("requestRule with asn condition requires asnFile")
+	}
+	asnRanges = make(map[uint32][]ipRange)
+	for _, fpath := range config.ASNFile {
+		if err := loadASNFile(fpath, used, asnRanges); err != nil {
+			Fatal("asn file", fpath+":", err)
+		}
+	}
+	for asn := range used {
+		if len(asnRanges[asn]) == 0 {
+			errl.Printf("AS%d not found in asn file\n", asn)
+		}
+	}
+}
+
+// hostASNMatch returns whether host belongs to one of asn.
+func hostASNMatch(host string, asn []uint32) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		addrs, err := lookupHost(host)
+		if err != nil || len(addrs) == 0 {
+			debug.Printf("asn lookup %s: %v\n", host, err)
+			return false
+		}
+		if ip = net.ParseIP(addrs[0]); ip == nil {
+			return false
+		}
+	}
+	ip = ip.To16()
+	for _, n := range asn {
+		for _, ir := range asnRanges[n] {
+			if ir.contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package cow
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseASNLine(t *testing.T) {
+	testData := []struct {
+		line       string
+		start, end string
+		asn        uint32
+	}{
+		{"1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET", "1.0.0.0", "1.0.0.255", 13335},
+		{"8.8.8.0/24 AS15169", "8.8.8.0", "8.8.8.255", 15169},
+		{"2001:4860::/32 15169", "2001:4860::", "2001:4860:ffff:ffff:ffff:ffff:ffff:ffff", 15169},
+	}
+	for _, td := range testData {
+		ir, asn, err := parseASNLine(td.line)
+		if err != nil {
+			t.Errorf("%s: %v", td.line, err)
+			continue
+		}
+		if asn != td.asn || !ir.start.Equal(net.ParseIP(td.start)) || !ir.end.Equal(net.ParseIP(td.end)) {
+			t.Errorf("%s parsed to %v-%v AS%d", td.line, ir.start, ir.end, asn)
+		}
+	}
+	for _, line := range []string{"1.0.0.0 13335", "1.0.0.0/33 13335", "a b 1", "1.0.0.0 1.0.0.255 x"} {
+		if _, _, err := parseASNLine(line); err == nil {
+			t.Errorf("%s should fail", line)
+		}
+	}
+}
+
+func TestHostASNMatch(t *testing.T) {
+	old := asnRanges
+	defer func() { asnRanges = old }()
+	asnRanges = make(map[uint32][]ipRange)
+	db := "# comment\n" +
+		"1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+		"8.8.4.0/24 15169\n" +
+		"8.8.8.0/24 15169\n" +
+		"2001:4860::/32 15169\n"
+	if err := loadASN(strings.NewReader(db), map[uint32]bool{15169: true}, asnRanges); err != nil {
+		t.Fatal(err)
+	}
+	if len(asnRanges) != 1 || len(asnRanges[15169]) != 3 {
+		t.Fatal("only used ASN should be loaded, got", asnRanges)
+	}
+	testData := []struct {
+		host  string
+		match bool
+	}{
+		{"8.8.8.8", true},
+		{"8.8.4.4", true},
+		{"8.8.9.1", false},
+		{"1.0.0.1", false},
+		{"2001:4860:4860::8888", true},
+		{"2001:4861::1", false},
+	}
+	for _, td := range testData {
+		if hostASNMatch(td.host, []uint32{13335, 15169}) != td.match {
+			t.Errorf("%s should match %v", td.host, td.match)
+		}
+	}
+	if err := loadASN(strings.NewReader("8.8.8.0/24\n"), nil, asnRanges); err == nil {
+		t.Error("invalid line should fail")
+	}
+}
@@ -1,11 +1,13 @@
-package main
+package cow
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/cyfdecyf/bufio"
+	"io"
 	"net"
 	"os"
 	"strconv"
@@ -20,9 +22,9 @@ const (
 <html>
 	<head> <title>COW Proxy</title> </head>
 	<body>
-		<h1>407 Proxy authentication required</h1>
+		<h1>407 %s</h1>
 		<hr />
-		Generated by <i>COW</i>
+		%s <i>COW</i>
 	</body>
 </html>
 `
@@ -43,11 +45,12 @@ type authUser struct {
 var auth struct {
 	required bool
 
-	user map[string]*authUser
+	user   map[string]*authUser
+	policy map[string]*userPolicy // nil if user has no policy
 
 	allowedClient []netAddr
 
-	authed *TimeoutSet // cache authenticated users based on ip
+	authed *TimeoutSet // cache authenticated user name based on ip
 
 	template *template.Template
 }
@@ -118,18 +121,26 @@ func parseAllowedClient(val string) {
 }
 
 func addUserPasswd(val string) {
-	if val == "" {
+	f := strings.Fields(val)
+	if len(f) == 0 {
 		return
 	}
-	user, au, err := parseUserPasswd(val)
-	debug.Println("user:", user, "port:", au.port)
+	user, au, err := parseUserPasswd(f[0])
 	if err != nil {
 		Fatal(err)
 	}
+	debug.Println("user:", user, "port:", au.port)
 	if _, ok := auth.user[user]; ok {
 		Fatal("duplicate user:", user)
 	}
 	auth.user[user] = au
+	if len(f) > 1 {
+		p, err := parseUserPolicy(f[1:])
+		if err != nil {
+			Fatal("user", user+":", err)
+		}
+		auth.policy[user] = p
+	}
 }
 
 func loadUserPasswdFile(file string) {
@@ -149,28 +160,48 @@ func loadUserPasswdFile(file string) {
 	f.Close()
 }
 
+// passwdMatch compares password in constant time.
+func (au *authUser) passwdMatch(passwd string) bool {
+	return subtle.ConstantTimeCompare([]byte(au.passwd), []byte(passwd)) == 1
+}
+
+// findAuthUser finds user in config, then password callback of embedding
+// program.
+func findAuthUser(user string) (*authUser, bool) {
+	if au, ok := auth.user[user]; ok {
+		return au, true
+	}
+	if embedPassword != nil {
+		if passwd, ok := embedPassword(user); ok {
+			return &authUser{passwd: passwd}, true
+		}
+	}
+	return nil, false
+}
+
 func initAuth() {
 	if config.UserPasswd != "" ||
 		config.UserPasswdFile != "" ||
-		config.AllowedClient != "" {
+		config.AllowedClient != "" || embedPassword != nil {
 		auth.required = true
 	} else {
 		return
 	}
 
 	auth.user = make(map[string]*authUser)
+	auth.policy = make(map[string]*userPolicy)
 
 	addUserPasswd(config.UserPasswd)
 	loadUserPasswdFile(config.UserPasswdFile)
 	parseAllowedClient(config.AllowedClient)
 
-	auth.authed = NewTimeoutSet(time.Duration(config.AuthTimeout) * time.Hour)
+	auth.authed = NewTimeoutSet(config.AuthTimeout)
 
 	rawTemplate := "HTTP/1.1 407 Proxy Authentication Required\r\n" +
 		"Proxy-Authenticate: Digest realm=\"" + authRealm + "\", nonce=\"{{.Nonce}}\", qop=\"auth\"\r\n" +
-		"Content-Type: text/html\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
 		"Cache-Control: no-cache\r\n" +
-		"Content-Length: " + fmt.Sprintf("%d", len(authRawBodyTmpl)) + "\r\n\r\n" + authRawBodyTmpl
+		"Content-Length: {{.Length}}\r\n\r\n{{.Body}}"
 	var err error
 	if auth.template, err = template.New("auth").Parse(rawTemplate); err != nil {
 		Fatal("internal error generating auth template:", err)
@@ -181,8 +212,9 @@ func initAuth() {
 // authentication is needed, and should be passed back on subsequent call.
 func Authenticate(conn *clientConn, r *Request) (err error) {
 	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-	if auth.authed.has(clientIP) {
-		debug.Printf("%s has already authed\n", clientIP)
+	if user, ok := auth.authed.get(clientIP); ok {
+		debug.Printf("%s has already authed as %s\n", clientIP, user)
+		conn.user = user
 		return
 	}
 	if authIP(clientIP) { // IP is allowed
@@ -190,11 +222,45 @@ func Authenticate(conn *clientConn, r *Request) (err error) {
 	}
 	err = authUserPasswd(conn, r)
 	if err == nil {
-		auth.authed.add(clientIP)
+		auth.authed.add(clientIP, conn.user)
 	}
 	return
 }
 
+// adminAuthed lists authenticated client IPs, or revokes authentication of
+// an IP or all IPs of a user, so the client must authenticate again.
+func adminAuthed(w io.Writer, args []string) error {
+	if !auth.required || auth.authed == nil {
+		return errors.New("authentication not enabled")
+	}
+	if len(args) == 0 || args[0] == "list" {
+		now := time.Now()
+		for _, e := range auth.authed.list() {
+			fmt.Fprintf(w, "%s\t%s\t%s\texpires in %v\n", e.Key, e.Value,
+				e.Added.Format("2006-01-02 15:04:05"),
+				auth.authed.expire(e).Sub(now)/time.Second*time.Second)
+		}
+		return nil
+	}
+	if args[0] != "revoke" || len(args) != 2 {
+		return errors.New("list or revoke <ip|user> required")
+	}
+	var n int
+	if net.ParseIP(args[1]) != nil {
+		if auth.authed.del(args[1]) {
+			n = 1
+		}
+	} else {
+		n = auth.authed.delValue(args[1])
+	}
+	if n == 0 {
+		return errors.New("not authenticated: " + args[1])
+	}
+	info.Printf("revoked authentication of %s, %d IP\n", args[1], n)
+	fmt.Fprintf(w, "%d revoked\n", n)
+	return nil
+}
+
 // authIP checks whether the client ip address matches one in allowedClient.
 // It uses a sequential search.
 func authIP(clientIP string) bool {
@@ -274,11 +340,15 @@ func authBasic(conn *clientConn, userPasswd string) error {
 	user := arr[0]
 	passwd := arr[1]
 
-	au, ok := auth.user[user]
-	if !ok || au.passwd != passwd {
+	au, ok := findAuthUser(user)
+	if !ok || !au.passwdMatch(passwd) {
 		return errAuthRequired
 	}
-	return authPort(conn, user, au)
+	if err = authPort(conn, user, au); err != nil {
+		return err
+	}
+	conn.user = user
+	return nil
 }
 
 func authDigest(conn *clientConn, r *Request, keyVal string) error {
@@ -297,7 +367,7 @@ func authDigest(conn *clientConn, r *Request, keyVal string) error {
 	}
 
 	user := authHeader["username"]
-	au, ok := auth.user[user]
+	au, ok := findAuthUser(user)
 	if !ok {
 		errl.Printf("cli(%s) auth: no such user: %s\n", conn.RemoteAddr(), authHeader["username"])
 		return errAuthRequired
@@ -320,6 +390,7 @@ func authDigest(conn *clientConn, r *Request, keyVal string) error {
 		errl.Printf("cli(%s) auth: digest not match, maybe password wrong", conn.RemoteAddr())
 		return errAuthRequired
 	}
+	conn.user = user
 	return nil
 }
 
@@ -336,11 +407,17 @@ func authUserPasswd(conn *clientConn, r *Request) (err error) {
 		// auth required to through the following
 	}
 
-	nonce := genNonce()
+	// Body is localized, so Content-Length is only known here.
+	body := fmt.Sprintf(authRawBodyTmpl, conn.locale.tr("Proxy authentication required"),
+		conn.locale.tr("Generated by"))
 	data := struct {
-		Nonce string
+		Nonce  string
+		Length int
+		Body   string
 	}{
-		nonce,
+		genNonce(),
+		len(body),
+		body,
 	}
 	buf := new(bytes.Buffer)
 	if err := auth.template.Execute(buf, data); err != nil {
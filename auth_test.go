@@ -1,8 +1,11 @@
-package main
+package cow
 
 import (
+	"bytes"
 	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseUserPasswd(t *testing.T) {
@@ -104,3 +107,39 @@ func TestAuthIP(t *testing.T) {
 		}
 	}
 }
+
+func TestAdminAuthed(t *testing.T) {
+	savedRequired, savedAuthed := auth.required, auth.authed
+	defer func() { auth.required, auth.authed = savedRequired, savedAuthed }()
+	auth.required = true
+	auth.authed = NewTimeoutSet(time.Hour)
+	auth.authed.add("10.0.0.1", "alice")
+	auth.authed.add("10.0.0.2", "bob")
+	auth.authed.add("10.0.0.3", "alice")
+
+	var out bytes.Buffer
+	if err := adminAuthed(&out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 ||
+		!strings.HasPrefix(lines[0], "10.0.0.1\talice\t") {
+		t.Errorf("wrong list:\n%s", out.String())
+	}
+	if err := adminAuthed(&out, []string{"revoke", "10.0.0.2"}); err != nil || auth.authed.has("10.0.0.2") {
+		t.Error("IP should be revoked:", err)
+	}
+	if err := adminAuthed(&out, []string{"revoke", "alice"}); err != nil ||
+		auth.authed.has("10.0.0.1") || auth.authed.has("10.0.0.3") {
+		t.Error("all IPs of user should be revoked:", err)
+	}
+	if err := adminAuthed(&out, []string{"revoke", "alice"}); err == nil {
+		t.Error("should fail revoking user not authenticated")
+	}
+
+	auth.authed = NewTimeoutSet(time.Millisecond)
+	auth.authed.add("10.0.0.1", "alice")
+	time.Sleep(2 * time.Millisecond)
+	if user, ok := auth.authed.get("10.0.0.1"); ok {
+		t.Error("entry should expire, got", user)
+	}
+}
@@ -0,0 +1,381 @@
+package cow
+
+// Benchmark a running cow.
+//
+//   cow [-rc rcfile] bench [-c 10] [-d 10s] [-n 0] [-mix get=1,connect=1] url
+//
+// Each of the c workers sends requests for url through the first http
+// listener in config (or -proxy) until duration d passes or n requests are
+// sent. Request types are chosen randomly by weights in mix:
+//
+//   get      GET with absolute URI, connection to cow is kept alive
+//   connect  CONNECT to url's host:port on a new connection, then GET url in
+//            the tunnel
+//
+// Throughput and latency percentiles of each type are reported. If
+// adminSocket is set, memory allocation of the running cow during the
+// benchmark is reported using the memstats admin command, which also
+// includes work not caused by the benchmark.
+//
+// Use a target close to cow, e.g. a web server in the LAN, to measure cow
+// instead of the network.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type benchType int
+
+const (
+	benchGet benchType = iota
+	benchConnect
+	nBenchType
+)
+
+var benchTypeName = [nBenchType]string{"get", "connect"}
+
+type benchConfig struct {
+	proxy    string
+	auth     string // Proxy-Authorization header line
+	url      *url.URL
+	conc     int
+	duration time.Duration
+	total    int
+	weight   [nBenchType]int
+}
+
+type benchResult struct {
+	latency [nBenchType][]time.Duration
+	errors  [nBenchType]int
+	bytes   int64
+	elapsed time.Duration
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+
+// percentile returns the p-th percentile of sorted durations.
+func percentile(d []time.Duration, p int) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	id := (len(d)*p + 99) / 100
+	if id > 0 {
+		id--
+	}
+	return d[id]
+}
+
+// parseBenchMix parses mix like "get=3,connect=1".
+func parseBenchMix(s string) (weight [nBenchType]int, err error) {
+	var sum int
+	for _, kv := range strings.Split(s, ",") {
+		f := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(f) != 2 {
+			return weight, errors.New("invalid mix " + kv)
+		}
+		n, err := strconv.Atoi(f[1])
+		if err != nil || n < 0 {
+			return weight, errors.New("invalid weight " + kv)
+		}
+		var found bool
+		for t, name := range benchTypeName {
+			if name == f[0] {
+				weight[t] = n
+				found = true
+			}
+		}
+		if !found {
+			return weight, errors.New("unknown request type " + f[0])
+		}
+		sum += n
+	}
+	if sum == 0 {
+		return weight, errors.New("all weights are 0")
+	}
+	return weight, nil
+}
+
+func (bc *benchConfig) pickType(rnd *rand.Rand) benchType {
+	var sum int
+	for _, w := range bc.weight {
+		sum += w
+	}
+	n := rnd.Intn(sum)
+	for t, w := range bc.weight {
+		if n < w {
+			return benchType(t)
+		}
+		n -= w
+	}
+	return benchGet
+}
+
+func (bc *benchConfig) hostPort() string {
+	host := bc.url.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+	return host
+}
+
+// benchConn is a connection to cow for get requests.
+type benchConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func (bc *benchConfig) dial() (*benchConn, error) {
+	c, err := net.DialTimeout("tcp", bc.proxy, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &benchConn{c, bufio.NewReader(c)}, nil
+}
+
+// get sends GET with uri on c and reads the response. Returns body size and
+// whether the connection can be reused.
+func (bc *benchConfig) get(c *benchConn, uri, auth string) (n int64, keep bool, err error) {
+	c.SetDeadline(time.Now().Add(readTimeout))
+	req := "GET " + uri + " HTTP/1.1\r\nHost: " + bc.url.Host + "\r\n" + auth + "\r\n"
+	if _, err = io.WriteString(c, req); err != nil {
+		return
+	}
+	resp, err := http.ReadResponse(c.rd, nil)
+	if err != nil {
+		return
+	}
+	n, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if err == nil && resp.StatusCode != 200 {
+		err = errors.New(resp.Status)
+	}
+	return n, err == nil && !resp.Close, err
+}
+
+func (bc *benchConfig) connect() (n int64, err error) {
+	c, err := bc.dial()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(readTimeout))
+	host := bc.hostPort()
+	if _, err = io.WriteString(c, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n"+bc.auth+"\r\n"); err != nil {
+		return
+	}
+	resp, err := http.ReadResponse(c.rd, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != 200 {
+		return 0, errors.New("CONNECT " + resp.Status)
+	}
+	n, _, err = bc.get(c, bc.url.RequestURI(), "")
+	return
+}
+
+func (bc *benchConfig) worker(id int, next func() bool, res *benchResult, mu *sync.Mutex) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
+	var c *benchConn
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+	var latency [nBenchType][]time.Duration
+	var errs [nBenchType]int
+	var nbytes int64
+	for next() {
+		t := bc.pickType(rnd)
+		start := time.Now()
+		var n int64
+		var err error
+		switch t {
+		case benchGet:
+			if c == nil {
+				c, err = bc.dial()
+			}
+			if err == nil {
+				var keep bool
+				n, keep, err = bc.get(c, bc.url.String(), bc.auth)
+				if !keep {
+					c.Close()
+					c = nil
+				}
+			}
+		case benchConnect:
+			n, err = bc.connect()
+		}
+		if err != nil {
+			errs[t]++
+			debug.Printf("bench %s: %v\n", benchTypeName[t], err)
+			continue
+		}
+		latency[t] = append(latency[t], time.Now().Sub(start))
+		nbytes += n
+	}
+	mu.Lock()
+	for t := range latency {
+		res.latency[t] = append(res.latency[t], latency[t]...)
+		res.errors[t] += errs[t]
+	}
+	res.bytes += nbytes
+	mu.Unlock()
+}
+
+func (bc *benchConfig) run() *benchResult {
+	var sent int
+	var mu sync.Mutex
+	deadline := time.Now().Add(bc.duration)
+	next := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if bc.total > 0 && sent >= bc.total || bc.duration > 0 && time.Now().After(deadline) {
+			return false
+		}
+		sent++
+		return true
+	}
+	res := &benchResult{}
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(bc.conc)
+	for i := 0; i < bc.conc; i++ {
+		go func(id int) {
+			bc.worker(id, next, res, &mu)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	res.elapsed = time.Now().Sub(start)
+	return res
+}
+
+func (res *benchResult) report(w io.Writer) {
+	var total, nerr int
+	for t := range res.latency {
+		total += len(res.latency[t])
+		nerr += res.errors[t]
+	}
+	sec := res.elapsed.Seconds()
+	fmt.Fprintf(w, "%d requests, %d errors in %v: %.1f req/s, %.2f MB/s\n", total, nerr,
+		res.elapsed/time.Millisecond*time.Millisecond, float64(total)/sec, float64(res.bytes)/sec/1e6)
+	fmt.Fprintf(w, "%-8s %8s %6s %10s %10s %10s %10s\n", "type", "requests", "errors", "p50", "p90", "p99", "max")
+	for t, lat := range res.latency {
+		if len(lat) == 0 && res.errors[t] == 0 {
+			continue
+		}
+		sort.Sort(durations(lat))
+		var max time.Duration
+		if len(lat) > 0 {
+			max = lat[len(lat)-1]
+		}
+		fmt.Fprintf(w, "%-8s %8d %6d %10v %10v %10v %10v\n", benchTypeName[t], len(lat), res.errors[t],
+			percentile(lat, 50), percentile(lat, 90), percentile(lat, 99), max)
+	}
+}
+
+// benchMemStats returns memstats of running cow, nil if not available.
+func benchMemStats() map[string]uint64 {
+	if config.AdminSocket == "" {
+		return nil
+	}
+	var b bytes.Buffer
+	if err := sendAdminCmd(&b, []string{"memstats"}); err != nil {
+		errl.Println("bench memstats:", err)
+		return nil
+	}
+	ms := make(map[string]uint64)
+	for _, line := range strings.Split(b.String(), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseUint(f[1], 10, 64); err == nil {
+			ms[strings.TrimSuffix(f[0], ":")] = n
+		}
+	}
+	return ms
+}
+
+func reportAlloc(w io.Writer, before, after map[string]uint64, nreq int) {
+	if before == nil || after == nil {
+		fmt.Fprintln(w, "set adminSocket to report memory allocation of cow")
+		return
+	}
+	if nreq == 0 {
+		nreq = 1
+	}
+	mallocs := after["mallocs"] - before["mallocs"]
+	alloc := after["total_alloc"] - before["total_alloc"]
+	fmt.Fprintf(w, "cow allocation: %d mallocs (%d/req), %d bytes (%d/req), %d GC, heap %d bytes, %d goroutines\n",
+		mallocs, mallocs/uint64(nreq), alloc, alloc/uint64(nreq),
+		after["num_gc"]-before["num_gc"], after["heap_alloc"], after["goroutines"])
+}
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	bc := &benchConfig{}
+	var mix, auth string
+	fs.IntVar(&bc.conc, "c", 10, "number of concurrent workers")
+	fs.DurationVar(&bc.duration, "d", 10*time.Second, "duration, 0 to run until n requests are sent")
+	fs.IntVar(&bc.total, "n", 0, "number of requests, 0 for no limit")
+	fs.StringVar(&mix, "mix", "get=1,connect=1", "weights of request types get and connect")
+	fs.StringVar(&bc.proxy, "proxy", localHttpProxyAddr(), "cow http listen address")
+	fs.StringVar(&auth, "auth", "", "user:password if cow requires authentication")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: cow bench [options] url")
+	}
+	var err error
+	if bc.url, err = url.Parse(fs.Arg(0)); err != nil || bc.url.Scheme != "http" || bc.url.Host == "" {
+		return errors.New("url should be http://host[:port]/path")
+	}
+	if bc.weight, err = parseBenchMix(mix); err != nil {
+		return err
+	}
+	if bc.proxy == "" {
+		return errors.New("no http listen address, use -proxy")
+	}
+	if bc.conc <= 0 || bc.duration <= 0 && bc.total <= 0 {
+		return errors.New("c should be positive, and d or n should be set")
+	}
+	if auth != "" {
+		bc.auth = "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(auth)) + "\r\n"
+	}
+
+	fmt.Printf("benchmark %s through %s with %d workers\n", bc.url, bc.proxy, bc.conc)
+	before := benchMemStats()
+	res := bc.run()
+	after := benchMemStats()
+	res.report(os.Stdout)
+	var nreq int
+	for _, lat := range res.latency {
+		nreq += len(lat)
+	}
+	reportAlloc(os.Stdout, before, after, nreq)
+	return nil
+}
@@ -0,0 +1,94 @@
+package cow
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	d := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	testData := []struct {
+		p        int
+		expected time.Duration
+	}{
+		{50, 5},
+		{90, 9},
+		{99, 10},
+		{100, 10},
+	}
+	for _, td := range testData {
+		if v := percentile(d, td.p); v != td.expected {
+			t.Errorf("p%d should be %d, got %d", td.p, td.expected, v)
+		}
+	}
+	if percentile(nil, 50) != 0 {
+		t.Error("percentile of empty list should be 0")
+	}
+}
+
+func TestParseBenchMix(t *testing.T) {
+	w, err := parseBenchMix("get=3, connect=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w[benchGet] != 3 || w[benchConnect] != 1 {
+		t.Errorf("wrong weights %v", w)
+	}
+	for _, s := range []string{"get", "get=-1", "post=1", "get=0,connect=0"} {
+		if _, err := parseBenchMix(s); err == nil {
+			t.Errorf("%s should return error", s)
+		}
+	}
+}
+
+// serveBenchProxy answers GET with a fixed body and accepts CONNECT, requests
+// in the tunnel are answered the same way.
+func serveBenchProxy(c net.Conn) {
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	for {
+		req, err := http.ReadRequest(rd)
+		if err != nil {
+			return
+		}
+		if req.Method == "CONNECT" {
+			c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			continue
+		}
+		c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+	}
+}
+
+func TestBenchRun(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveBenchProxy(c)
+		}
+	}()
+
+	u, _ := url.Parse("http://example.com/index.html")
+	bc := &benchConfig{proxy: ln.Addr().String(), url: u, conc: 4, total: 100}
+	bc.weight[benchGet] = 1
+	bc.weight[benchConnect] = 1
+	res := bc.run()
+	n := len(res.latency[benchGet]) + len(res.latency[benchConnect])
+	if n != 100 || res.errors[benchGet]+res.errors[benchConnect] != 0 {
+		t.Errorf("should finish 100 requests without error, got %d, errors %v", n, res.errors)
+	}
+	if res.bytes != 500 {
+		t.Errorf("should read 500 bytes, got %d", res.bytes)
+	}
+}
@@ -0,0 +1,164 @@
+package cow
+
+// Bind outgoing connections to a local address or network interface.
+//
+// On multi-homed hosts, bindAddr/bindInterface in config apply to direct
+// connections (including connections to upstream proxy), and the same
+// options after a parent proxy's address apply to connections to that
+// parent. This allows sending direct traffic out of one WAN and parent proxy
+// traffic out of another.
+//
+// On Linux, bindInterface uses SO_BINDTODEVICE, which requires root or
+// CAP_NET_RAW. On other systems, connections are bound to the first IPv4
+// address of the interface instead.
+//
+// Also on Linux, directMark and parentMark set fwmark (SO_MARK) on direct and
+// parent proxy connections, so policy routing can send them through different
+// routing tables. This avoids routing loop when cow runs on the same host as
+// a VPN which routes all traffic. Setting fwmark requires CAP_NET_ADMIN.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type bindOpt struct {
+	addr  string // local IP address
+	iface string // network interface name
+	mark  uint32 // fwmark, 0 means not set
+}
+
+// directBind is used for direct connections, nil if not configured.
+var directBind *bindOpt
+
+// sockOptBind is set if any parent binds to interface or sets fwmark.
+var sockOptBind bool
+
+func (b *bindOpt) genConfig() string {
+	var s string
+	if b == nil {
+		return s
+	}
+	if b.addr != "" {
+		s += " bindAddr=" + b.addr
+	}
+	if b.iface != "" {
+		s += " bindInterface=" + b.iface
+	}
+	if b.mark != 0 {
+		s += fmt.Sprintf(" mark=%#x", b.mark)
+	}
+	return s
+}
+
+func checkBindAddr(val string) error {
+	if net.ParseIP(val) == nil {
+		return errors.New("invalid IP address " + val)
+	}
+	return nil
+}
+
+func checkBindInterface(val string) error {
+	_, err := net.InterfaceByName(val)
+	return err
+}
+
+// parseMark parses fwmark in decimal or hex.
+func parseMark(val string) (uint32, error) {
+	if runtime.GOOS != "linux" {
+		return 0, errors.New("fwmark is only supported on Linux")
+	}
+	mark, err := strconv.ParseUint(val, 0, 32)
+	if err != nil {
+		return 0, errors.New("invalid fwmark " + val)
+	}
+	return uint32(mark), nil
+}
+
+// parseBindOpt parses options like "bindAddr=ip bindInterface=name mark=n".
+func parseBindOpt(opts []string) (*bindOpt, error) {
+	if len(opts) == 0 {
+		return nil, nil
+	}
+	b := &bindOpt{}
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid option %q", opt)
+		}
+		var err error
+		switch kv[0] {
+		case "bindAddr":
+			b.addr, err = kv[1], checkBindAddr(kv[1])
+		case "bindInterface":
+			b.iface, err = kv[1], checkBindInterface(kv[1])
+		case "mark":
+			b.mark, err = parseMark(kv[1])
+		default:
+			err = fmt.Errorf("unknown option %q", kv[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if b.iface != "" || b.mark != 0 {
+		sockOptBind = true
+	}
+	return b, nil
+}
+
+// dial connects to addr with the binding. nil binding is allowed. Zero
+// deadline means no timeout.
+func (b *bindOpt) dial(addr string, deadline time.Time) (net.Conn, error) {
+	if b == nil {
+		d := net.Dialer{Deadline: deadline}
+		return d.Dial("tcp", addr)
+	}
+	if b.iface != "" || b.mark != 0 {
+		return dialSocket(b, addr, deadline)
+	}
+	d := net.Dialer{
+		Deadline:  deadline,
+		LocalAddr: &net.TCPAddr{IP: net.ParseIP(b.addr)},
+	}
+	return d.Dial("tcp", addr)
+}
+
+// dialParent connects to parent proxy server. parentMark is used if the
+// parent doesn't specify its own mark.
+func dialParent(b *bindOpt, server string) (net.Conn, error) {
+	if config.ParentMark != 0 && (b == nil || b.mark == 0) {
+		nb := bindOpt{mark: config.ParentMark}
+		if b != nil {
+			nb = *b
+			nb.mark = config.ParentMark
+		}
+		b = &nb
+	}
+	start := time.Now()
+	c, err := b.dial(server, zeroTime)
+	if err != nil {
+		return nil, err
+	}
+	return timed(c, 0, start), nil
+}
+
+func deadlineOf(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return zeroTime
+	}
+	return time.Now().Add(timeout)
+}
+
+type dialTimeoutError struct{}
+
+func (dialTimeoutError) Error() string   { return "i/o timeout" }
+func (dialTimeoutError) Timeout() bool   { return true }
+func (dialTimeoutError) Temporary() bool { return true }
+
+var errDialTimeout net.Error = dialTimeoutError{}
@@ -0,0 +1,111 @@
+package cow
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// dialSocket connects to addr through the interface using SO_BINDTODEVICE,
+// and sets fwmark with SO_MARK. Go's net.Dialer can't set socket options
+// before connect, so the socket is created and connected with syscalls, then
+// converted to net.Conn.
+func dialSocket(b *bindOpt, addr string, deadline time.Time) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	if net.ParseIP(host) != nil {
+		ips = []string{host}
+	} else if ips, err = net.LookupHost(host); err != nil {
+		return nil, err
+	}
+	var c net.Conn
+	for _, ip := range ips {
+		if c, err = dialDevice(b, net.ParseIP(ip), portNum, deadline); err == nil {
+			return c, nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			break
+		}
+	}
+	return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+}
+
+func sockaddr(ip net.IP, port int) (family int, sa syscall.Sockaddr) {
+	if ip4 := ip.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip4)
+		return syscall.AF_INET, sa4
+	}
+	sa6 := &syscall.SockaddrInet6{Port: port}
+	copy(sa6.Addr[:], ip.To16())
+	return syscall.AF_INET6, sa6
+}
+
+func dialDevice(b *bindOpt, ip net.IP, port int, deadline time.Time) (net.Conn, error) {
+	family, sa := sockaddr(ip, port)
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "bind "+b.iface)
+	defer f.Close()
+
+	if b.iface != "" {
+		err = syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, b.iface)
+		if err != nil {
+			return nil, os.NewSyscallError("setsockopt SO_BINDTODEVICE", err)
+		}
+	}
+	if b.mark != 0 {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(b.mark))
+		if err != nil {
+			return nil, os.NewSyscallError("setsockopt SO_MARK", err)
+		}
+	}
+	if b.addr != "" {
+		lfamily, lsa := sockaddr(net.ParseIP(b.addr), 0)
+		if lfamily != family {
+			return nil, os.NewSyscallError("bind", syscall.EAFNOSUPPORT)
+		}
+		if err = syscall.Bind(fd, lsa); err != nil {
+			return nil, os.NewSyscallError("bind", err)
+		}
+	}
+	// Blocking connect with SO_SNDTIMEO as timeout. If interrupted by
+	// signal, connect again to wait for the pending connection.
+	for {
+		var tv syscall.Timeval
+		if !deadline.IsZero() {
+			d := deadline.Sub(time.Now())
+			if d <= 0 {
+				return nil, errDialTimeout
+			}
+			tv = syscall.NsecToTimeval(int64(d))
+		}
+		syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv)
+		err = syscall.Connect(fd, sa)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	switch err {
+	case nil, syscall.EISCONN:
+	case syscall.EINPROGRESS, syscall.EAGAIN:
+		return nil, errDialTimeout
+	default:
+		return nil, os.NewSyscallError("connect", err)
+	}
+	var tv syscall.Timeval
+	syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv)
+	return net.FileConn(f)
+}
@@ -0,0 +1,40 @@
+// +build !linux
+
+package cow
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// dialSocket binds to the first IPv4 address of the interface, as
+// SO_BINDTODEVICE is only available on Linux. fwmark is never set on other
+// systems.
+func dialSocket(b *bindOpt, addr string, deadline time.Time) (net.Conn, error) {
+	local := b.addr
+	if local == "" {
+		iface, err := net.InterfaceByName(b.iface)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				local = ipNet.IP.String()
+				break
+			}
+		}
+		if local == "" {
+			return nil, errors.New("no IPv4 address on interface " + b.iface)
+		}
+	}
+	d := net.Dialer{
+		Deadline:  deadline,
+		LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)},
+	}
+	return d.Dial("tcp", addr)
+}
@@ -0,0 +1,63 @@
+package cow
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestParseBindOpt(t *testing.T) {
+	b, err := parseBindOpt(nil)
+	if b != nil || err != nil {
+		t.Error("no option should return nil binding")
+	}
+
+	b, err = parseBindOpt([]string{"bindAddr=127.0.0.1"})
+	if err != nil {
+		t.Fatal("parse bindAddr:", err)
+	}
+	if b.addr != "127.0.0.1" || b.iface != "" {
+		t.Error("bindAddr parse error:", b)
+	}
+	if s := b.genConfig(); s != " bindAddr=127.0.0.1" {
+		t.Error("bind genConfig error:", s)
+	}
+
+	if runtime.GOOS == "linux" {
+		b, err = parseBindOpt([]string{"mark=0x10", "bindAddr=127.0.0.1"})
+		if err != nil || b.mark != 16 {
+			t.Error("mark parse error:", b, err)
+		}
+		if s := b.genConfig(); s != " bindAddr=127.0.0.1 mark=0x10" {
+			t.Error("bind genConfig with mark error:", s)
+		}
+	}
+
+	for _, opts := range [][]string{
+		{"bindAddr=no.such.ip"},
+		{"bindAddr"},
+		{"bindPort=80"},
+		{"mark=abc"},
+		{"bindInterface=nosuchiface0"},
+	} {
+		if _, err = parseBindOpt(opts); err == nil {
+			t.Error("should fail:", opts)
+		}
+	}
+}
+
+func TestParseProxyBind(t *testing.T) {
+	saved := parentProxy
+	defer func() { parentProxy = saved }()
+	parentProxy = &backupParentPool{}
+	parser := configParser{}
+	parser.ParseProxy("socks5://127.0.0.1:1080 bindAddr=127.0.0.1")
+
+	pool := parentProxy.(*backupParentPool)
+	sp, ok := pool.parent[0].ParentProxy.(*socksParent)
+	if !ok {
+		t.Fatal("parent socks proxy type wrong")
+	}
+	if sp.server != "127.0.0.1:1080" || sp.bind == nil || sp.bind.addr != "127.0.0.1" {
+		t.Error("proxy bind option parse error")
+	}
+}
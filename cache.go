@@ -0,0 +1,791 @@
+package cow
+
+// Cache for plain HTTP responses, following the shared cache rules of
+// RFC 7234. Only GET responses with Content-Length are cached. Entries are
+// evicted in LRU order when the total size exceeds the limit.
+//
+// There are two independent caches. Small responses are kept in memory so hot
+// objects are served without disk access, and the disk cache stores
+// responses up to cacheMaxObjectSize.
+//
+// Each disk cache entry is a file under cacheDir named by the SHA1 of the
+// request URL:
+//
+//   %08d\n          length of the JSON metadata
+//   metadata
+//   response header (status line and end-to-end headers)
+//   response body
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheSize          = 512 * 1024 * 1024
+	defaultCacheMaxObjectSize = 64 * 1024 * 1024
+
+	defaultMemCacheSize   = 16 * 1024 * 1024
+	memCacheMaxObjectSize = 64 * 1024
+
+	cacheMetaLenSize = 9 // "%08d\n"
+	cacheTmpPrefix   = "tmp"
+
+	// Upper limit for heuristic freshness computed from Last-Modified.
+	cacheMaxHeuristic = 24 * time.Hour
+)
+
+type cacheMeta struct {
+	Key          string
+	VaryAE       bool   `json:",omitempty"` // response has Vary: Accept-Encoding
+	AE           string `json:",omitempty"` // Accept-Encoding of the request
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+	Stored       int64  // unix time when response is received
+	Expire       int64  // unix time when response becomes stale
+	HeaderLen    int
+	BodyLen      int64
+}
+
+type cacheEntry struct {
+	cacheMeta
+	fname   string
+	dataOff int64  // offset of response header in file
+	data    []byte // header and body for in memory entry
+	size    int64  // file size, or data size for in memory entry
+	elem    *list.Element
+}
+
+func (e *cacheEntry) fresh() bool {
+	return time.Now().Unix() < e.Expire
+}
+
+func (e *cacheEntry) hasValidator() bool {
+	return e.ETag != "" || e.LastModified != ""
+}
+
+type respCache struct {
+	sync.Mutex
+	dir     string // empty for in memory cache
+	maxSize int64
+	size    int64
+	entries map[string]*cacheEntry
+	lru     *list.List // front is the most recently used
+}
+
+var diskCache, memCache respCache
+
+// cacheRequest is attached to requests whose response may be cached.
+type cacheRequest struct {
+	key   string
+	ae    string      // Accept-Encoding of the request
+	entry *cacheEntry // stale entry being revalidated by conditional request
+}
+
+func cacheEnabled() bool {
+	return diskCache.entries != nil || memCache.entries != nil
+}
+
+func (hc *respCache) init(dir string, maxSize int64) {
+	hc.dir = dir
+	hc.maxSize = maxSize
+	hc.entries = make(map[string]*cacheEntry)
+	hc.lru = list.New()
+}
+
+// cacheOf returns the cache containing e.
+func cacheOf(e *cacheEntry) *respCache {
+	if e.data != nil {
+		return &memCache
+	}
+	return &diskCache
+}
+
+func cacheFname(key string) string {
+	h := sha1.Sum([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func initHttpCache() {
+	if config.MemCacheSize > 0 {
+		memCache.init("", config.MemCacheSize)
+	}
+	if config.CacheDir == "" {
+		return
+	}
+	if err := os.MkdirAll(config.CacheDir, 0755); err != nil {
+		Fatal("cache dir:", err)
+	}
+	hc := &diskCache
+	hc.init(config.CacheDir, config.CacheSize)
+
+	files, err := ioutil.ReadDir(hc.dir)
+	if err != nil {
+		Fatal("read cache dir:", err)
+	}
+	// Use modification time to restore LRU order.
+	sort.Sort(byModTime(files))
+	for _, fi := range files {
+		fpath := path.Join(hc.dir, fi.Name())
+		if strings.HasPrefix(fi.Name(), cacheTmpPrefix) {
+			// left by interrupted store
+			os.Remove(fpath)
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		e, err := loadCacheEntry(fpath, fi.Size())
+		if err != nil {
+			errl.Printf("cache: remove %s: %v\n", fi.Name(), err)
+			os.Remove(fpath)
+			continue
+		}
+		e.elem = hc.lru.PushBack(e)
+		hc.entries[e.Key] = e
+		hc.size += e.size
+	}
+	hc.evict()
+	info.Printf("cache: %d entries, %d bytes\n", len(hc.entries), hc.size)
+}
+
+type byModTime []os.FileInfo
+
+func (a byModTime) Len() int           { return len(a) }
+func (a byModTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byModTime) Less(i, j int) bool { return a[i].ModTime().After(a[j].ModTime()) }
+
+func loadCacheEntry(fpath string, size int64) (*cacheEntry, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lenBuf [cacheMetaLenSize]byte
+	if _, err = io.ReadFull(f, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	metaLen, err := strconv.Atoi(string(lenBuf[:cacheMetaLenSize-1]))
+	if err != nil || metaLen <= 0 {
+		return nil, fmt.Errorf("invalid metadata length %q", lenBuf[:])
+	}
+	metaBuf := make([]byte, metaLen)
+	if _, err = io.ReadFull(f, metaBuf); err != nil {
+		return nil, err
+	}
+	e := &cacheEntry{
+		fname:   path.Base(fpath),
+		dataOff: int64(cacheMetaLenSize + metaLen),
+		size:    size,
+	}
+	if err = json.Unmarshal(metaBuf, &e.cacheMeta); err != nil {
+		return nil, err
+	}
+	if e.dataOff+int64(e.HeaderLen)+e.BodyLen != size || cacheFname(e.Key) != e.fname {
+		return nil, fmt.Errorf("corrupted entry")
+	}
+	return e, nil
+}
+
+// get returns entry for key and marks it as recently used.
+func (hc *respCache) get(key string) *cacheEntry {
+	hc.Lock()
+	defer hc.Unlock()
+	e, ok := hc.entries[key]
+	if !ok {
+		return nil
+	}
+	hc.lru.MoveToFront(e.elem)
+	return e
+}
+
+// removeLocked must be called with lock held.
+func (hc *respCache) removeLocked(e *cacheEntry) {
+	if hc.entries[e.Key] != e {
+		return
+	}
+	delete(hc.entries, e.Key)
+	hc.lru.Remove(e.elem)
+	hc.size -= e.size
+	if hc.dir == "" {
+		return
+	}
+	if err := os.Remove(path.Join(hc.dir, e.fname)); err != nil && !os.IsNotExist(err) {
+		errl.Println("cache: remove entry:", err)
+	}
+}
+
+func (hc *respCache) remove(key string) {
+	hc.Lock()
+	if e, ok := hc.entries[key]; ok {
+		debug.Println("cache: invalidate", key)
+		hc.removeLocked(e)
+	}
+	hc.Unlock()
+}
+
+// evict must be called with lock held.
+func (hc *respCache) evict() {
+	for hc.size > hc.maxSize {
+		back := hc.lru.Back()
+		if back == nil {
+			return
+		}
+		e := back.Value.(*cacheEntry)
+		debug.Println("cache: evict", e.Key)
+		hc.removeLocked(e)
+	}
+}
+
+// commit adds e to cache. For disk cache, the temporary file is renamed into
+// place.
+func (hc *respCache) commit(e *cacheEntry, tmpPath string) {
+	hc.Lock()
+	defer hc.Unlock()
+	if old, ok := hc.entries[e.Key]; ok {
+		// Don't remove file as it will be replaced by rename.
+		delete(hc.entries, old.Key)
+		hc.lru.Remove(old.elem)
+		hc.size -= old.size
+	}
+	if hc.dir != "" {
+		fpath := path.Join(hc.dir, e.fname)
+		if err := os.Rename(tmpPath, fpath); err != nil {
+			// Windows can't rename to existing file.
+			os.Remove(fpath)
+			if err = os.Rename(tmpPath, fpath); err != nil {
+				errl.Println("cache: store entry:", err)
+				os.Remove(tmpPath)
+				return
+			}
+		}
+	}
+	e.elem = hc.lru.PushFront(e)
+	hc.entries[e.Key] = e
+	hc.size += e.size
+	hc.evict()
+}
+
+// refresh updates freshness of entry after successful revalidation.
+func (hc *respCache) refresh(e *cacheEntry, expire int64) {
+	hc.Lock()
+	e.Stored = time.Now().Unix()
+	e.Expire = expire
+	hc.Unlock()
+	if hc.dir == "" {
+		return
+	}
+	// Let modification time reflect LRU order after restart.
+	now := time.Now()
+	os.Chtimes(path.Join(hc.dir, e.fname), now, now)
+}
+
+// Header parsing for cache related headers. COW only parses headers needed
+// for proxying, cache parses the raw header when necessary.
+
+// parseRawHeader returns header values keyed by lower case name. Status or
+// request line should not be included. Repeated headers are joined with ",".
+func parseRawHeader(raw []byte) map[string]string {
+	h := make(map[string]string)
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		id := bytes.IndexByte(line, ':')
+		if id <= 0 {
+			continue
+		}
+		name := strings.ToLower(string(bytes.TrimSpace(line[:id])))
+		val := string(bytes.TrimSpace(line[id+1:]))
+		if old, ok := h[name]; ok {
+			val = old + ", " + val
+		}
+		h[name] = val
+	}
+	return h
+}
+
+// parseCacheControl returns directives in lower case with their argument.
+func parseCacheControl(val string) map[string]string {
+	cc := make(map[string]string)
+	for _, d := range strings.Split(val, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		kv := strings.SplitN(d, "=", 2)
+		k := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) == 2 {
+			cc[k] = unquote(strings.TrimSpace(kv[1]))
+		} else {
+			cc[k] = ""
+		}
+	}
+	return cc
+}
+
+func ccSeconds(cc map[string]string, directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		// Invalid value should be treated as stale.
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// freshnessLifetime computes freshness lifetime of response according to
+// RFC 7234 section 4.2.1. explicit is false if heuristic is used.
+func freshnessLifetime(h map[string]string, cc map[string]string) (lifetime time.Duration, explicit bool) {
+	if d, ok := ccSeconds(cc, "s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := ccSeconds(cc, "max-age"); ok {
+		return d, true
+	}
+	date, err := http.ParseTime(h["date"])
+	if err != nil {
+		date = time.Now()
+	}
+	if v, ok := h["expires"]; ok {
+		exp, err := http.ParseTime(v)
+		if err != nil || exp.Before(date) {
+			return 0, true
+		}
+		return exp.Sub(date), true
+	}
+	if lm, err := http.ParseTime(h["last-modified"]); err == nil && lm.Before(date) {
+		lifetime = date.Sub(lm) / 10
+		if lifetime > cacheMaxHeuristic {
+			lifetime = cacheMaxHeuristic
+		}
+	}
+	return lifetime, false
+}
+
+// responseAge returns the Age header value.
+func responseAge(h map[string]string) time.Duration {
+	n, err := strconv.ParseInt(h["age"], 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// newCacheRequest returns non nil if the response to r may be served from or
+// stored into cache.
+func newCacheRequest(r *Request) (*cacheRequest, map[string]string) {
+	if r.Method != "GET" || r.URL.HostPort == "" || r.hasBody() {
+		return nil, nil
+	}
+	h := parseRawHeader(r.rawHeaderBody())
+	// Range request is not supported. Shared cache must not use response to
+	// request with Authorization (unless allowed by response, but keep
+	// things simple).
+	if _, ok := h["range"]; ok {
+		return nil, nil
+	}
+	if _, ok := h["authorization"]; ok {
+		return nil, nil
+	}
+	if _, ok := parseCacheControl(h["cache-control"])["no-store"]; ok {
+		return nil, nil
+	}
+	cr := &cacheRequest{key: "http://" + r.URL.HostPort + r.URL.Path}
+	cr.ae = h["accept-encoding"]
+	return cr, h
+}
+
+// clientRequiresValidation checks request cache control directives.
+func clientRequiresValidation(h map[string]string, e *cacheEntry) bool {
+	cc := parseCacheControl(h["cache-control"])
+	if _, ok := cc["no-cache"]; ok {
+		return true
+	}
+	if strings.Contains(strings.ToLower(h["pragma"]), "no-cache") {
+		return true
+	}
+	if maxAge, ok := ccSeconds(cc, "max-age"); ok {
+		age := time.Now().Sub(time.Unix(e.Stored, 0))
+		return age > maxAge
+	}
+	return false
+}
+
+// notModified evaluates client's conditional headers against cache entry.
+func notModified(h map[string]string, e *cacheEntry) bool {
+	if inm, ok := h["if-none-match"]; ok {
+		if e.ETag == "" {
+			return false
+		}
+		if inm == "*" {
+			return true
+		}
+		weak := strings.TrimPrefix(e.ETag, "W/")
+		for _, t := range strings.Split(inm, ",") {
+			if strings.TrimPrefix(strings.TrimSpace(t), "W/") == weak {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, ok := h["if-modified-since"]; ok && e.LastModified != "" {
+		t, err := http.ParseTime(ims)
+		lm, err2 := http.ParseTime(e.LastModified)
+		return err == nil && err2 == nil && !lm.After(t)
+	}
+	return false
+}
+
+func hasConditional(h map[string]string) bool {
+	for _, k := range []string{"if-none-match", "if-modified-since", "if-match",
+		"if-unmodified-since", "if-range"} {
+		if _, ok := h[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupCache decides how to handle request r with cache. It returns non
+// nil entry if the request can be served from cache. For stale entry with
+// validator, conditional headers are added to the request.
+func lookupCache(r *Request) *cacheEntry {
+	if r.Method != "GET" && r.Method != "HEAD" && r.URL.HostPort != "" {
+		// Unsafe methods invalidate cached response. (RFC 7234 section 4.4)
+		key := "http://" + r.URL.HostPort + r.URL.Path
+		memCache.remove(key)
+		diskCache.remove(key)
+		return nil
+	}
+	cr, h := newCacheRequest(r)
+	if cr == nil {
+		return nil
+	}
+	r.cache = cr
+	e := memCache.get(cr.key)
+	if e == nil {
+		e = diskCache.get(cr.key)
+	}
+	if e == nil || (e.VaryAE && e.AE != cr.ae) {
+		return nil
+	}
+	if e.fresh() && !clientRequiresValidation(h, e) {
+		return e
+	}
+	if e.hasValidator() && !hasConditional(h) {
+		cr.entry = e
+		var cond bytes.Buffer
+		if e.ETag != "" {
+			cond.WriteString("If-None-Match: " + e.ETag + CRLF)
+		}
+		if e.LastModified != "" {
+			cond.WriteString("If-Modified-Since: " + e.LastModified + CRLF)
+		}
+		r.insertHeader(cond.Bytes())
+		debug.Println("cache: revalidate", cr.key)
+	}
+	return nil
+}
+
+// openCacheEntry returns response header and a reader for body of e.
+func openCacheEntry(e *cacheEntry) (hdr []byte, body io.ReadCloser, err error) {
+	if e.data != nil {
+		return e.data[:e.HeaderLen], ioutil.NopCloser(bytes.NewReader(e.data[e.HeaderLen:])), nil
+	}
+	f, err := os.Open(path.Join(diskCache.dir, e.fname))
+	if err != nil {
+		diskCache.Lock()
+		diskCache.removeLocked(e)
+		diskCache.Unlock()
+		return
+	}
+	hdr = make([]byte, e.HeaderLen)
+	if _, err = f.Seek(e.dataOff, 0); err == nil {
+		_, err = io.ReadFull(f, hdr)
+	}
+	if err != nil {
+		f.Close()
+		return
+	}
+	return hdr, f, nil
+}
+
+// sendCacheEntry sends cached response to client. If client's conditional
+// request matches, 304 response is sent. Returns errCacheMiss if nothing has
+// been sent.
+func (c *clientConn) sendCacheEntry(r *Request, e *cacheEntry) (err error) {
+	hdr, body, err := openCacheEntry(e)
+	if err != nil {
+		errl.Println("cache: read entry:", err)
+		return errCacheMiss
+	}
+	defer body.Close()
+
+	id := bytes.IndexByte(hdr, '\n')
+	statusLine, hdrLines := hdr[:id+1], hdr[id+1:]
+	var reqHeader map[string]string
+	if r.raw != nil {
+		reqHeader = parseRawHeader(r.rawHeaderBody())
+	}
+	send304 := notModified(reqHeader, e)
+
+	buf := new(bytes.Buffer)
+	if send304 {
+		buf.WriteString("HTTP/1.1 304 Not Modified\r\n")
+		for _, line := range bytes.SplitAfter(hdrLines, []byte("\n")) {
+			if !bytes.HasPrefix(bytes.ToLower(line), []byte("content-length:")) {
+				buf.Write(line)
+			}
+		}
+	} else {
+		buf.Write(statusLine)
+		buf.Write(hdrLines)
+	}
+	fmt.Fprintf(buf, "Age: %d\r\n", time.Now().Unix()-e.Stored)
+	if config.DebugRouteHeader {
+		if e.data != nil {
+			buf.WriteString(headerCowRoute + ": CACHE; rule=memory" + CRLF)
+		} else {
+			buf.WriteString(headerCowRoute + ": CACHE; rule=disk" + CRLF)
+		}
+	}
+	if r.ConnectionKeepAlive {
+		buf.WriteString(fullHeaderConnectionKeepAlive)
+		buf.WriteString(fullKeepAliveHeader)
+	} else {
+		buf.WriteString(fullHeaderConnectionClose)
+	}
+	buf.WriteString(CRLF)
+	if _, err = c.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if send304 {
+		return nil
+	}
+	_, err = io.CopyN(c, body, e.BodyLen)
+	return err
+}
+
+// cacheWriter writes response body to client, and also stores it into disk
+// and memory cache.
+type cacheWriter struct {
+	w       io.Writer
+	f       *os.File      // nil if not stored in disk cache
+	buf     *bytes.Buffer // nil if not stored in memory cache
+	e       *cacheEntry
+	written int64
+}
+
+// Headers not stored in cache. Hop-by-hop headers are removed by COW except
+// those generated by COW.
+var cacheSkipHeader = map[string]bool{
+	"age":               true,
+	"connection":        true,
+	"keep-alive":        true,
+	"transfer-encoding": true,
+}
+
+// newCacheWriter returns nil if response is not cacheable.
+func newCacheWriter(w io.Writer, r *Request, rp *Response) *cacheWriter {
+	cr := r.cache
+	if rp.Chunking || rp.ContLen < 0 {
+		return nil
+	}
+	toDisk := diskCache.entries != nil && rp.ContLen <= config.CacheMaxObjectSize
+	toMem := memCache.entries != nil && rp.ContLen <= memCacheMaxObjectSize
+	if !toDisk && !toMem {
+		return nil
+	}
+	switch rp.Status {
+	case 200, 203, 300, 301, 410:
+	default:
+		return nil
+	}
+
+	raw := rp.rawResponse()
+	id := bytes.IndexByte(raw, '\n')
+	h := parseRawHeader(raw[id+1:])
+	cc := parseCacheControl(h["cache-control"])
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := cc[d]; ok {
+			return nil
+		}
+	}
+	if _, ok := h["set-cookie"]; ok {
+		return nil
+	}
+	varyAE := false
+	if v, ok := h["vary"]; ok {
+		if !strings.EqualFold(strings.TrimSpace(v), "accept-encoding") {
+			return nil
+		}
+		varyAE = true
+	}
+	lifetime, _ := freshnessLifetime(h, cc)
+	if _, ok := cc["no-cache"]; ok {
+		lifetime = 0
+	}
+	now := time.Now()
+	e := &cacheEntry{
+		cacheMeta: cacheMeta{
+			Key:          cr.key,
+			VaryAE:       varyAE,
+			ETag:         h["etag"],
+			LastModified: h["last-modified"],
+			Stored:       now.Unix(),
+			Expire:       now.Add(lifetime - responseAge(h)).Unix(),
+			BodyLen:      rp.ContLen,
+		},
+		fname: cacheFname(cr.key),
+	}
+	if varyAE {
+		e.AE = cr.ae
+	}
+	if !e.fresh() && !e.hasValidator() {
+		return nil
+	}
+
+	hdr := new(bytes.Buffer)
+	hdr.Write(raw[:id+1])
+	for _, line := range bytes.SplitAfter(raw[id+1:], []byte("\n")) {
+		cid := bytes.IndexByte(line, ':')
+		if cid <= 0 || cacheSkipHeader[strings.ToLower(string(line[:cid]))] {
+			continue
+		}
+		hdr.Write(line)
+	}
+	e.HeaderLen = hdr.Len()
+
+	cw := &cacheWriter{w: w, e: e}
+	if toMem {
+		cw.buf = bytes.NewBuffer(make([]byte, 0, e.HeaderLen+int(e.BodyLen)))
+		cw.buf.Write(hdr.Bytes())
+	}
+	if toDisk {
+		cw.f = createCacheFile(e, hdr.Bytes())
+	}
+	if cw.f == nil && cw.buf == nil {
+		return nil
+	}
+	return cw
+}
+
+// createCacheFile writes metadata and header of e to a temporary file, which
+// is renamed upon commit.
+func createCacheFile(e *cacheEntry, hdr []byte) *os.File {
+	meta, err := json.Marshal(&e.cacheMeta)
+	if err != nil {
+		errl.Println("cache: encode metadata:", err)
+		return nil
+	}
+	e.dataOff = int64(cacheMetaLenSize + len(meta))
+	e.size = e.dataOff + int64(e.HeaderLen) + e.BodyLen
+
+	f, err := ioutil.TempFile(diskCache.dir, cacheTmpPrefix)
+	if err != nil {
+		errl.Println("cache: create entry:", err)
+		return nil
+	}
+	fmt.Fprintf(f, "%08d\n", len(meta))
+	f.Write(meta)
+	if _, err = f.Write(hdr); err != nil {
+		errl.Println("cache: write entry:", err)
+		f.Close()
+		os.Remove(f.Name())
+		return nil
+	}
+	return f
+}
+
+func (cw *cacheWriter) abortFile() {
+	if cw.f != nil {
+		cw.f.Close()
+		os.Remove(cw.f.Name())
+		cw.f = nil
+	}
+}
+
+func (cw *cacheWriter) abort() {
+	cw.abortFile()
+	cw.buf = nil
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if n > 0 {
+		if cw.f != nil {
+			if _, werr := cw.f.Write(p[:n]); werr != nil {
+				errl.Println("cache: write entry:", werr)
+				cw.abortFile()
+			}
+		}
+		if cw.buf != nil {
+			cw.buf.Write(p[:n])
+		}
+		cw.written += int64(n)
+	}
+	return n, err
+}
+
+// finish adds the entry to cache if the complete body has been written.
+func (cw *cacheWriter) finish(err error) {
+	if err != nil || cw.written != cw.e.BodyLen {
+		cw.abort()
+		return
+	}
+	if cw.buf != nil {
+		me := &cacheEntry{cacheMeta: cw.e.cacheMeta, data: cw.buf.Bytes()}
+		me.size = int64(len(me.data))
+		debug.Println("cache: store in memory", me.Key)
+		memCache.commit(me, "")
+	}
+	if cw.f == nil {
+		return
+	}
+	if err = cw.f.Close(); err != nil {
+		errl.Println("cache: close entry:", err)
+		os.Remove(cw.f.Name())
+		return
+	}
+	debug.Println("cache: store", cw.e.Key)
+	diskCache.commit(cw.e, cw.f.Name())
+}
+
+// revalidated handles 304 response to conditional request generated by
+// lookupCache, returns the entry to send to client.
+func revalidated(r *Request, rp *Response) *cacheEntry {
+	if r.cache == nil || r.cache.entry == nil || rp.Status != 304 {
+		return nil
+	}
+	e := r.cache.entry
+	raw := rp.rawResponse()
+	h := parseRawHeader(raw[bytes.IndexByte(raw, '\n')+1:])
+	cc := parseCacheControl(h["cache-control"])
+	lifetime, explicit := freshnessLifetime(h, cc)
+	if !explicit {
+		// Keep the original lifetime.
+		lifetime = time.Duration(e.Expire-e.Stored) * time.Second
+	}
+	if _, ok := cc["no-cache"]; ok {
+		lifetime = 0
+	}
+	cacheOf(e).refresh(e, time.Now().Add(lifetime-responseAge(h)).Unix())
+	debug.Println("cache: revalidated", e.Key)
+	return e
+}
@@ -0,0 +1,98 @@
+package cow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFreshnessLifetime(t *testing.T) {
+	testData := []struct {
+		header   map[string]string
+		lifetime time.Duration
+		explicit bool
+	}{
+		{map[string]string{"cache-control": "max-age=60"}, time.Minute, true},
+		{map[string]string{"cache-control": "max-age=60, s-maxage=10"}, 10 * time.Second, true},
+		{map[string]string{"cache-control": "max-age=abc"}, 0, true},
+		{map[string]string{
+			"date":    "Mon, 02 Jan 2006 15:04:05 GMT",
+			"expires": "Mon, 02 Jan 2006 16:04:05 GMT",
+		}, time.Hour, true},
+		{map[string]string{
+			"date":    "Mon, 02 Jan 2006 15:04:05 GMT",
+			"expires": "0",
+		}, 0, true},
+		{map[string]string{
+			"date":          "Mon, 02 Jan 2006 15:04:05 GMT",
+			"last-modified": "Mon, 02 Jan 2006 05:04:05 GMT",
+		}, time.Hour, false},
+		{map[string]string{
+			"date":          "Mon, 02 Jan 2006 15:04:05 GMT",
+			"last-modified": "Mon, 02 Jan 2005 15:04:05 GMT",
+		}, cacheMaxHeuristic, false},
+		{map[string]string{}, 0, false},
+	}
+	for _, td := range testData {
+		lifetime, explicit := freshnessLifetime(td.header, parseCacheControl(td.header["cache-control"]))
+		if lifetime != td.lifetime || explicit != td.explicit {
+			t.Errorf("%v: lifetime should be %v explicit %v, got %v %v\n",
+				td.header, td.lifetime, td.explicit, lifetime, explicit)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	e := &cacheEntry{cacheMeta: cacheMeta{
+		ETag:         `W/"abc"`,
+		LastModified: "Mon, 02 Jan 2006 15:04:05 GMT",
+	}}
+	testData := []struct {
+		header map[string]string
+		nm     bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"if-none-match": `"abc"`}, true},
+		{map[string]string{"if-none-match": `"xyz", W/"abc"`}, true},
+		{map[string]string{"if-none-match": `"xyz"`}, false},
+		{map[string]string{"if-none-match": "*"}, true},
+		// If-None-Match takes precedence
+		{map[string]string{
+			"if-none-match":     `"xyz"`,
+			"if-modified-since": "Mon, 02 Jan 2006 15:04:05 GMT",
+		}, false},
+		{map[string]string{"if-modified-since": "Mon, 02 Jan 2006 15:04:05 GMT"}, true},
+		{map[string]string{"if-modified-since": "Mon, 02 Jan 2006 15:04:04 GMT"}, false},
+	}
+	for _, td := range testData {
+		if nm := notModified(td.header, e); nm != td.nm {
+			t.Errorf("%v: notModified should be %v\n", td.header, td.nm)
+		}
+	}
+}
+
+func TestMemCacheEvict(t *testing.T) {
+	var mc respCache
+	mc.init("", 10)
+	add := func(key string, size int) {
+		e := &cacheEntry{cacheMeta: cacheMeta{Key: key}, data: make([]byte, size)}
+		e.size = int64(size)
+		mc.commit(e, "")
+	}
+	add("a", 4)
+	add("b", 4)
+	mc.get("a") // a becomes most recently used
+	add("c", 4)
+	if mc.get("b") != nil {
+		t.Error("least recently used entry b should be evicted")
+	}
+	if mc.get("a") == nil || mc.get("c") == nil {
+		t.Error("entry a and c should be kept")
+	}
+	if mc.size != 8 {
+		t.Error("cache size should be 8, got", mc.size)
+	}
+	add("a", 7)
+	if mc.size != 7 || mc.get("c") != nil {
+		t.Error("replacing a should evict c, size", mc.size)
+	}
+}
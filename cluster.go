@@ -0,0 +1,288 @@
+package cow
+
+// Sharing learned state between cow instances.
+//
+//   clusterListen = 0.0.0.0:7790
+//   clusterPeer = 192.168.1.2:7790
+//   clusterSecret = a long random string
+//
+// On start up and every clusterInterval, cow connects to each peer and they
+// exchange learned site stat (sites not specified by user) and parent proxy
+// failure counts. Instances with clusterListen accept exchanges from peers,
+// so an instance behind NAT only needs clusterPeer. Messages are encrypted
+// and authenticated with AES-GCM using a key derived from clusterSecret, and
+// rejected if their timestamp is more than clusterMaxSkew off.
+//
+// Stat of a host is taken from the peer if the host is visited more recently
+// there and is not specified by user locally. Parent failure counts are used
+// for parent proxies with the same server address not yet connected by this
+// instance, so a fresh instance skips parent proxies known to be failing.
+// Only failures observed by the sending instance itself are sent, so stale
+// state doesn't bounce between peers.
+//
+// Only share with instances in the same network, an instance on a VPS abroad
+// finds every site accessible directly.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	clusterInterval = 5 * time.Minute
+	clusterTimeout  = 30 * time.Second
+	clusterMaxSkew  = 5 * time.Minute
+	clusterMaxMsg   = 16 << 20
+)
+
+type clusterState struct {
+	Time    int64                `json:"time"`
+	Site    map[string]*VisitCnt `json:"site"`
+	Parent  map[string]int       `json:"parent"` // server -> failure count
+	Standby bool                 `json:"standby,omitempty"`
+	Files   map[string][]byte    `json:"files,omitempty"` // config files for standby
+}
+
+var (
+	clusterAEAD     cipher.AEAD
+	clusterListener net.Listener
+)
+
+func newClusterAEAD(secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeClusterMsg encrypts v and writes it with 4 bytes length prefix.
+func writeClusterMsg(w io.Writer, aead cipher.AEAD, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(b)+aead.Overhead())
+	nonce := msg[4:]
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	msg = aead.Seal(msg, nonce, b, nil)
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)-4))
+	_, err = w.Write(msg)
+	return err
+}
+
+func readClusterMsg(r io.Reader, aead cipher.AEAD, v interface{}) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	ns := aead.NonceSize()
+	if n > clusterMaxMsg || int(n) < ns+aead.Overhead() {
+		return errors.New("invalid cluster message length")
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return err
+	}
+	b, err := aead.Open(nil, msg[:ns], msg[ns:], nil)
+	if err != nil {
+		return errors.New("cluster message authentication failed, check clusterSecret")
+	}
+	return json.Unmarshal(b, v)
+}
+
+// failParents returns parent proxies with failure count. Latency load
+// balance measures parent proxies itself, so nothing is shared for it.
+func failParents() []ParentWithFail {
+	switch pp := parentProxy.(type) {
+	case *backupParentPool:
+		return pp.parent
+	case *hashParentPool:
+		return pp.parent
+	}
+	return nil
+}
+
+func localClusterState() *clusterState {
+	st := &clusterState{
+		Time:   time.Now().Unix(),
+		Site:   make(map[string]*VisitCnt),
+		Parent: make(map[string]int),
+	}
+	siteStat.vcLock.RLock()
+	for host, vc := range siteStat.Vcnt {
+		if !vc.shouldNotSave() {
+			st.Site[host] = vc
+		}
+	}
+	siteStat.vcLock.RUnlock()
+	for _, p := range failParents() {
+		if p.tried {
+			st.Parent[p.getServer()] = p.fail
+		}
+	}
+	return st
+}
+
+// mergeClusterState takes state from peer, returns number of sites taken.
+func mergeClusterState(st *clusterState) (n int) {
+	for host, rvc := range st.Site {
+		if rvc == nil || rvc.Direct < 0 || rvc.Blocked < 0 || rvc.isStale() {
+			continue
+		}
+		if domain := host2Domain(host); domain != host {
+			if dmcnt := siteStat.get(domain); dmcnt != nil && dmcnt.userSpecified() {
+				continue
+			}
+		}
+		vc := siteStat.get(host)
+		if vc != nil && (vc.userSpecified() || !time.Time(rvc.Recent).After(time.Time(vc.Recent))) {
+			continue
+		}
+		siteStat.vcLock.Lock()
+		siteStat.Vcnt[host] = &VisitCnt{Direct: rvc.Direct, Blocked: rvc.Blocked, Recent: rvc.Recent}
+		siteStat.vcLock.Unlock()
+		if rvc.Blocked > 0 {
+			siteStat.hbhLock.Lock()
+			siteStat.hasBlockedHost[host2Domain(host)] = true
+			siteStat.hbhLock.Unlock()
+		}
+		n++
+	}
+	parent := failParents()
+	for i := range parent {
+		p := &parent[i]
+		if fail, ok := st.Parent[p.getServer()]; ok && !p.tried && fail >= 0 && fail <= maxFailCnt {
+			p.fail = fail
+		}
+	}
+	return
+}
+
+func receiveClusterState(peer string, st *clusterState) error {
+	if d := time.Now().Sub(time.Unix(st.Time, 0)); d > clusterMaxSkew || d < -clusterMaxSkew {
+		return errors.New("message time too far off, check clock")
+	}
+	n := mergeClusterState(st)
+	debug.Printf("cluster %s: %d sites, %d taken\n", peer, len(st.Site), n)
+	return nil
+}
+
+// exchangeClusterState sends local state to peer and takes the state of
+// peer, which is returned.
+func exchangeClusterState(peer string, local *clusterState) (*clusterState, error) {
+	c, err := net.DialTimeout("tcp", peer, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(clusterTimeout))
+	if err = writeClusterMsg(c, clusterAEAD, local); err != nil {
+		return nil, err
+	}
+	st := &clusterState{}
+	if err = readClusterMsg(c, clusterAEAD, st); err != nil {
+		return nil, err
+	}
+	return st, receiveClusterState(peer, st)
+}
+
+func serveClusterConn(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(clusterTimeout))
+	peer := c.RemoteAddr().String()
+	// Take local state before merging, so the peer's state isn't sent back.
+	local := localClusterState()
+	var st clusterState
+	if err := readClusterMsg(c, clusterAEAD, &st); err != nil {
+		errl.Printf("cluster peer %s: %v\n", peer, err)
+		return
+	}
+	if err := receiveClusterState(peer, &st); err != nil {
+		errl.Printf("cluster peer %s: %v\n", peer, err)
+		return
+	}
+	if st.Standby {
+		local.Files = primaryFiles()
+	}
+	if err := writeClusterMsg(c, clusterAEAD, local); err != nil {
+		debug.Printf("cluster peer %s: %v\n", peer, err)
+	}
+}
+
+// initCluster listens on clusterListen, should be called before dropping
+// privilege.
+func initCluster() {
+	if config.ClusterListen == "" && len(config.ClusterPeer) == 0 && config.StandbyOf == "" {
+		return
+	}
+	if config.ClusterSecret == "" {
+		Fatal("clusterListen, clusterPeer and standbyOf require clusterSecret")
+	}
+	var err error
+	if clusterAEAD, err = newClusterAEAD(config.ClusterSecret); err != nil {
+		Fatal("cluster:", err)
+	}
+	if config.ClusterListen != "" {
+		if clusterListener, err = net.Listen("tcp", config.ClusterListen); err != nil {
+			Fatal("listen cluster:", err)
+		}
+		info.Println("cluster listen", config.ClusterListen)
+	}
+}
+
+// runCluster serves and exchanges state with peers until quit.
+func runCluster(quit <-chan struct{}) {
+	if ln := clusterListener; ln != nil {
+		go func() {
+			<-quit
+			ln.Close()
+		}()
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					select {
+					case <-quit:
+						return
+					default:
+					}
+					errl.Println("cluster accept:", err)
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				go serveClusterConn(c)
+			}
+		}()
+	}
+	if config.StandbyOf != "" {
+		go runStandby(quit)
+	}
+	if len(config.ClusterPeer) == 0 {
+		return
+	}
+	for {
+		for _, peer := range config.ClusterPeer {
+			if _, err := exchangeClusterState(peer, localClusterState()); err != nil {
+				errl.Printf("cluster peer %s: %v\n", peer, err)
+			}
+		}
+		select {
+		case <-quit:
+			return
+		case <-time.After(clusterInterval):
+		}
+	}
+}
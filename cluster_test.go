@@ -0,0 +1,138 @@
+package cow
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClusterMsg(t *testing.T) {
+	aead, _ := newClusterAEAD("secret")
+	var b bytes.Buffer
+	if err := writeClusterMsg(&b, aead, &clusterState{Time: 42}); err != nil {
+		t.Fatal(err)
+	}
+	msg := b.Bytes()
+
+	var st clusterState
+	if err := readClusterMsg(bytes.NewReader(msg), aead, &st); err != nil || st.Time != 42 {
+		t.Errorf("read message: %v %+v", err, st)
+	}
+	other, _ := newClusterAEAD("other")
+	if err := readClusterMsg(bytes.NewReader(msg), other, &st); err == nil {
+		t.Error("message with different secret should fail")
+	}
+	msg[len(msg)-1] ^= 1
+	if err := readClusterMsg(bytes.NewReader(msg), aead, &st); err == nil {
+		t.Error("modified message should fail")
+	}
+}
+
+func TestMergeClusterState(t *testing.T) {
+	savedStat, savedPool := siteStat, parentProxy
+	defer func() { siteStat, parentProxy = savedStat, savedPool }()
+	siteStat = newSiteStat()
+	pool := &backupParentPool{}
+	pool.add(newHttpParent("1.2.3.4:8080"))
+	pool.add(newHttpParent("1.2.3.5:8080"))
+	pool.parent[1].tried = true
+	parentProxy = pool
+
+	today := Date(time.Now())
+	yesterday := Date(time.Now().Add(-24 * time.Hour))
+	siteStat.Vcnt["user.com"] = newVisitCnt(userCnt, 0)
+	siteStat.Vcnt["newer.com"] = &VisitCnt{Direct: 3, Recent: today}
+	siteStat.Vcnt["older.com"] = &VisitCnt{Direct: 3, Recent: yesterday}
+
+	n := mergeClusterState(&clusterState{
+		Site: map[string]*VisitCnt{
+			"user.com":      {Blocked: 2, Recent: today},
+			"www.user.com":  {Blocked: 2, Recent: today},
+			"newer.com":     {Blocked: 2, Recent: yesterday},
+			"older.com":     {Blocked: 2, Recent: today},
+			"new.com":       {Blocked: 1, Recent: today},
+			"stale.com":     {Direct: 1, Recent: Date(time.Now().Add(-siteStaleThreshold - 24*time.Hour))},
+			"negative.com":  {Direct: userCnt, Recent: today},
+			"www.other.com": {Direct: 5, Recent: today},
+		},
+		Parent: map[string]int{"1.2.3.4:8080": 5, "1.2.3.5:8080": 5},
+	})
+	if n != 3 {
+		t.Errorf("should take 3 sites, got %d", n)
+	}
+	if vc := siteStat.get("older.com"); vc.Blocked != 2 || vc.Direct != 0 {
+		t.Errorf("older.com should be taken from peer, got %+v", vc)
+	}
+	if vc := siteStat.get("newer.com"); vc.Direct != 3 {
+		t.Errorf("newer.com should be kept, got %+v", vc)
+	}
+	for _, host := range []string{"www.user.com", "stale.com", "negative.com"} {
+		if siteStat.get(host) != nil {
+			t.Errorf("%s should not be taken", host)
+		}
+	}
+	if !siteStat.get("user.com").AlwaysDirect() {
+		t.Error("user specified site should not change")
+	}
+	if !siteStat.hasBlockedHost["new.com"] {
+		t.Error("new.com should have blocked host")
+	}
+	if pool.parent[0].fail != 5 || pool.parent[1].fail != 0 {
+		t.Errorf("only parents not tried should take fail count, got %d %d",
+			pool.parent[0].fail, pool.parent[1].fail)
+	}
+
+	// Only failures observed locally are sent.
+	st := localClusterState()
+	if _, ok := st.Parent["1.2.3.4:8080"]; ok || len(st.Parent) != 1 {
+		t.Errorf("wrong parent state %v", st.Parent)
+	}
+	if st.Site["user.com"] != nil || st.Site["older.com"] == nil {
+		t.Error("should send learned sites only")
+	}
+}
+
+func TestExchangeClusterState(t *testing.T) {
+	savedStat, savedPool, savedAEAD := siteStat, parentProxy, clusterAEAD
+	defer func() { siteStat, parentProxy, clusterAEAD = savedStat, savedPool, savedAEAD }()
+	siteStat = newSiteStat()
+	parentProxy = &backupParentPool{}
+	clusterAEAD, _ = newClusterAEAD("secret")
+	siteStat.Vcnt["local.com"] = &VisitCnt{Direct: 1, Recent: Date(time.Now())}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var got clusterState
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if err = readClusterMsg(c, clusterAEAD, &got); err != nil {
+			return
+		}
+		writeClusterMsg(c, clusterAEAD, &clusterState{
+			Time: time.Now().Unix(),
+			Site: map[string]*VisitCnt{"peer.com": {Blocked: 1, Recent: Date(time.Now())}},
+		})
+	}()
+	if _, err = exchangeClusterState(ln.Addr().String(), localClusterState()); err != nil {
+		t.Fatal(err)
+	}
+	if vc := siteStat.get("peer.com"); vc == nil || vc.Blocked != 1 {
+		t.Errorf("peer.com should be taken, got %+v", vc)
+	}
+	if vc := got.Site["local.com"]; vc == nil || vc.Direct != 1 {
+		t.Errorf("local.com should be sent, got %+v", got.Site)
+	}
+
+	// Message with time too far off is rejected.
+	if err = receiveClusterState("peer", &clusterState{Time: time.Now().Add(-time.Hour).Unix()}); err == nil {
+		t.Error("old message should be rejected")
+	}
+}
@@ -0,0 +1,9 @@
+// Command cow is a HTTP proxy that detects blocked sites automatically and
+// uses parent proxies only for them.
+package main
+
+import "github.com/cyfdecyf/cow"
+
+func main() {
+	cow.Main()
+}
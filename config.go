@@ -1,9 +1,12 @@
-package main
+package cow
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path"
@@ -19,6 +22,8 @@ const (
 	version               = "0.9.8"
 	defaultListenAddr     = "127.0.0.1:7777"
 	defaultEstimateTarget = "example.com"
+
+	defaultStatSaveInterval = 5 * time.Minute
 )
 
 type LoadBalanceMode byte
@@ -29,6 +34,17 @@ const (
 	loadBalanceLatency
 )
 
+// Policy for plain HTTP requests whose Host header and absolute URI host
+// differ.
+type HostMismatchPolicy byte
+
+const (
+	hostMismatchAllow HostMismatchPolicy = iota
+	hostMismatchLog
+	hostMismatchRewrite
+	hostMismatchReject
+)
+
 // allow the same tunnel ports as polipo
 var defaultTunnelAllowedPort = []string{
 	"22", "80", "443", // ssh, http, https
@@ -42,6 +58,7 @@ var defaultTunnelAllowedPort = []string{
 type Config struct {
 	RcFile      string          // config file
 	LogFile     string          // path for log file
+	AccessLog   string          // path for access log
 	AlwaysProxy bool            // whether we should alwyas use parent proxy
 	LoadBalance LoadBalanceMode // select load balance mode
 
@@ -59,20 +76,123 @@ type Config struct {
 	DialTimeout time.Duration
 	ReadTimeout time.Duration
 
+	MaxRequestBody int64 // max request body size, 0 means unlimited
+
+	HostMismatch HostMismatchPolicy // Host header differs from absolute URI
+
+	HarFile     string   // record plain HTTP requests in HAR format
+	HarHost     []string // hosts to record, empty means all
+	HarBodySize int64    // max body size recorded
+
+	SegmentDownload int   // parallel connections for large downloads, 0 disables
+	SegmentMinSize  int64 // min body size of segmented downloads
+	ReplayQueue     int   // max requests queued for replay, 0 disables
+
+	StallTimeout time.Duration // max time without response body data, 0 disables
+
+	ConnectUDP bool // serve CONNECT-UDP requests
+
+	SslKeyLogFile string // SSLKEYLOGFILE for transport adapters
+
+	// bandwidth limits in bytes per second, 0 means unlimited
+	UploadLimit         int64
+	DownloadLimit       int64
+	ClientUploadLimit   int64
+	ClientDownloadLimit int64
+	UserUploadLimit     int64
+	UserDownloadLimit   int64
+	ParentUploadLimit   int64
+	ParentDownloadLimit int64
+
+	BandwidthSchedule []*bandwidthSchedule
+
+	ClientIdleTimeout time.Duration // idle keep-alive client connections
+	ServerIdleTimeout time.Duration // idle server connections in pool
+	TunnelIdleTimeout time.Duration // idle CONNECT tunnels, 0 means never
+
+	DnsPrefetch int           // number of frequently visited hosts to prefetch DNS
+	DnsCacheTTL time.Duration // how long DNS results are cached
+
+	PacDirectMax      int // max learned direct sites in PAC, 0 means no limit
+	PacDirectMinVisit int // min direct visits for a site to be in PAC
+
+	DnsCheckResolver []string     // resolvers to cross-check DNS answers
+	DnsPoisonIP      []*net.IPNet // answers taken as DNS poisoning
+
+	ASNFile []string // IP to ASN databases for requestRule
+
+	Tun []string // command and arguments of TUN program
+
 	Core         int
 	DetectSSLErr bool
+	SniRouting   bool // use TLS SNI to route CONNECT to IP address
+	BlockQUIC    bool // reject UDP 443 from ebpf intercepted processes
+
+	ClusterListen string   // address for cluster peers to exchange state
+	ClusterPeer   []string // cluster peers to exchange state with
+	ClusterSecret string   // shared secret of cluster peers
+	StandbyOf     string   // clusterListen address of primary, run as hot standby
+	ConfigSource  string   // etcd or Consul URL with config files
+
+	DebugRouteHeader bool // add X-Cow-Route header to responses
+	ServerTiming     bool // add Server-Timing header to responses
+
+	BindAddr      string // local IP address for direct connections
+	BindInterface string // network interface for direct connections
+	DirectMark    uint32 // fwmark for direct connections
+	ParentMark    uint32 // fwmark for parent proxy connections
+
+	SystemProxy   string // set OS X system proxy while running: "pac" or "http"
+	UpstreamProxy string // "auto" or PAC URL, upstream proxy for direct connections
+	RunAsUser     string // switch to this user after listening
+
+	Locale    string // locale for generated pages, empty means by Accept-Language
+	LocaleDir string // directory containing translation files
+
+	CacheDir           string // disk cache for HTTP responses, empty to disable
+	CacheSize          int64  // max total size of cached responses
+	CacheMaxObjectSize int64  // responses larger than this are not cached
+	MemCacheSize       int64  // in memory cache for small responses, 0 to disable
+
+	IcapReqmod      string // ICAP service URL for request modification
+	IcapRespmod     string // ICAP service URL for response modification
+	IcapBypass      bool   // pass traffic without scanning if ICAP server fails
+	IcapMaxBodySize int64  // larger responses are not sent to ICAP server
+
+	ConnHook      []string      // URLs or programs receiving connection events
+	HelperProgram string        // external program for routing and rewriting decisions
+	HelperTimeout time.Duration // how long to wait for helper reply
+
+	ScriptFile string // JavaScript file with routing and rewriting hooks
 
 	HttpErrorCode int
 
-	dir         string // directory containing config file
-	StatFile    string // Path for stat file
-	BlockedFile string // blocked sites specified by user
-	DirectFile  string // direct sites specified by user
+	MaintenancePage       string        // page sent in maintenance mode
+	MaintenanceRetryAfter time.Duration // Retry-After in maintenance mode
+
+	dir              string        // directory containing config file
+	StatFile         string        // Path for stat file
+	StatSaveInterval time.Duration // interval to save stat file
+	BlockedFile      string        // blocked sites specified by user
+	DirectFile       string        // direct sites specified by user
+	PidFile          string        // pid file locked while running
+	AdminSocket      string        // unix socket for admin commands
+	MetricsFile      string        // traffic counters saved across restarts
+	TlsSessionFile   string        // https parent sessions saved across restarts
 
 	// not configurable in config file
 	PrintVer        bool
-	EstimateTimeout bool   // Whether to run estimateTimeout().
-	EstimateTarget  string // Timeout estimate target site.
+	Update          bool     // run self update and exit
+	Stop            bool     // stop running cow
+	Reload          bool     // reload running cow
+	Ctl             []string // admin command to send to running cow
+	DumpRules       bool     // print effective rules and exit
+	CheckConfig     bool     // check config and exit
+	Import          string   // config of other clients to import
+	ExportRules     string   // print rule list in this format and exit
+	Bench           []string // benchmark arguments
+	EstimateTimeout bool     // Whether to run estimateTimeout().
+	EstimateTarget  string   // Timeout estimate target site.
 
 	// not config option
 	saveReqLine bool // for http and cow parent, should save request line from client
@@ -86,10 +206,22 @@ func printVersion() {
 }
 
 func initConfig(rcFile string) {
+	config.RcFile = rcFile
 	config.dir = path.Dir(rcFile)
 	config.BlockedFile = path.Join(config.dir, blockedFname)
 	config.DirectFile = path.Join(config.dir, directFname)
 	config.StatFile = path.Join(config.dir, statFname)
+	config.StatSaveInterval = defaultStatSaveInterval
+	config.PidFile = path.Join(config.dir, pidFname)
+	config.MetricsFile = path.Join(config.dir, metricsFname)
+	config.TlsSessionFile = path.Join(config.dir, tlsSessionFname)
+	config.LocaleDir = path.Join(config.dir, localeDirName)
+	config.CacheSize = defaultCacheSize
+	config.CacheMaxObjectSize = defaultCacheMaxObjectSize
+	config.MemCacheSize = defaultMemCacheSize
+	config.IcapBypass = true
+	config.IcapMaxBodySize = defaultIcapMaxBodySize
+	config.SegmentMinSize = defaultSegmentMinSize
 
 	config.DetectSSLErr = false
 	config.AlwaysProxy = false
@@ -97,6 +229,11 @@ func initConfig(rcFile string) {
 	config.AuthTimeout = 2 * time.Hour
 	config.DialTimeout = defaultDialTimeout
 	config.ReadTimeout = defaultReadTimeout
+	config.ClientIdleTimeout = defaultClientIdleTimeout
+	config.ServerIdleTimeout = defaultServerIdleTimeout
+	config.DnsCacheTTL = defaultDnsCacheTTL
+	config.HelperTimeout = defaultHelperTimeout
+	config.MaintenanceRetryAfter = defaultMaintenanceRetryAfter
 
 	config.TunnelAllowedPort = make(map[string]bool)
 	for _, port := range defaultTunnelAllowedPort {
@@ -120,16 +257,45 @@ func parseCmdLineConfig() *Config {
 	flag.StringVar(&c.LogFile, "logFile", "", "write output to file")
 	flag.BoolVar(&c.PrintVer, "version", false, "print version")
 	flag.BoolVar(&c.EstimateTimeout, "estimate", true, "enable/disable estimate timeout")
+	flag.BoolVar(&c.Stop, "stop", false, "stop the running cow using the same pid file")
+	flag.BoolVar(&c.Reload, "reload", false, "reload the running cow using the same pid file")
+	flag.BoolVar(&c.CheckConfig, "check", false, "check config file and exit")
+	flag.BoolVar(&c.DumpRules, "dump-rules", false, "print effective routing rules with source of each entry")
+	flag.StringVar(&c.ExportRules, "export-rules", "", "print rule list learned by cow: clash-proxy, clash-direct, surge-proxy or surge-direct")
+	flag.StringVar(&c.Import, "import", "", "import proxies and rules from Surge, Quantumult X or Clash config file")
+	initLogFlags()
 
 	flag.Parse()
 
-	if c.RcFile == "" {
+	// Subcommands don't need config file.
+	if flag.Arg(0) == "update" {
+		c.Update = true
+		return &c
+	}
+	if flag.Arg(0) == "bench" {
+		c.Bench = append([]string{}, flag.Args()[1:]...)
+	}
+	if isCowctl() {
+		c.Ctl = append([]string{}, flag.Args()...)
+	} else if flag.Arg(0) == "ctl" {
+		c.Ctl = append([]string{}, flag.Args()[1:]...)
+	}
+
+	rcGiven := c.RcFile != ""
+	if !rcGiven {
 		c.RcFile = getDefaultRcFile()
 	} else {
 		c.RcFile = expandTilde(c.RcFile)
 	}
+	if c.Import != "" {
+		// Import creates config file if not exist.
+		return &c
+	}
 	if err := isFileExists(c.RcFile); err != nil {
-		Fatal("fail to get config file:", err)
+		if rcGiven || !os.IsNotExist(err) || c.Ctl != nil || c.Bench != nil || c.Stop {
+			Fatal("fail to get config file:", err)
+		}
+		runSetupWizard(c.RcFile)
 	}
 	initConfig(c.RcFile)
 
@@ -160,6 +326,35 @@ func parseInt(val, msg string) (i int) {
 	return
 }
 
+// parseSize parses size with optional K, M, G suffix, e.g. 512M.
+func parseSize(val, msg string) int64 {
+	n, err := sizeValue(val)
+	if err != nil {
+		Fatalf("%s should be a size like 100M\n", msg)
+	}
+	return n
+}
+
+func sizeValue(val string) (int64, error) {
+	unit := int64(1)
+	switch strings.ToUpper(val[len(val)-1:]) {
+	case "K":
+		unit = 1024
+	case "M":
+		unit = 1024 * 1024
+	case "G":
+		unit = 1024 * 1024 * 1024
+	}
+	if unit != 1 {
+		val = val[:len(val)-1]
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size " + val)
+	}
+	return n * unit, nil
+}
+
 func parseDuration(val, msg string) (d time.Duration) {
 	var err error
 	if d, err = time.ParseDuration(val); err != nil {
@@ -182,16 +377,25 @@ func isUserPasswdValid(val string) bool {
 }
 
 // proxyParser provides functions to parse different types of parent proxy
-type proxyParser struct{}
+// proxyParser provides functions to parse different types of parent proxy.
+// bind is set if the proxy line has bindAddr/bindInterface options.
+// authScheme is "ntlm" if specified by auth option.
+type proxyParser struct {
+	bind       *bindOpt
+	authScheme string
+	udp        bool // parent supports CONNECT-UDP
+}
 
-func (p proxyParser) ProxySocks5(val string) {
+func (p proxyParser) ProxySocks5(val string) ParentProxy {
 	if err := checkServerAddr(val); err != nil {
 		Fatal("parent socks server", err)
 	}
-	parentProxy.add(newSocksParent(val))
+	parent := newSocksParent(val)
+	parent.bind = p.bind
+	return parent
 }
 
-func (pp proxyParser) ProxyHttp(val string) {
+func (pp proxyParser) ProxyHttp(val string) ParentProxy {
 	var userPasswd, server string
 
 	arr := strings.Split(val, "@")
@@ -210,9 +414,18 @@ func (pp proxyParser) ProxyHttp(val string) {
 
 	config.saveReqLine = true
 
+	if pp.authScheme == "ntlm" && userPasswd == "" {
+		Fatal("http parent", server, "NTLM authentication requires user and password")
+	}
+
 	parent := newHttpParent(server)
 	parent.initAuth(userPasswd)
-	parentProxy.add(parent)
+	if parent.auth != nil {
+		parent.auth.ntlm = pp.authScheme == "ntlm"
+	}
+	parent.bind = pp.bind
+	parent.connectUDP = pp.udp
+	return parent
 }
 
 // Parse method:passwd@server:port
@@ -242,17 +455,18 @@ func parseMethodPasswdServer(val string) (method, passwd, server string, err err
 }
 
 // parse shadowsocks proxy
-func (pp proxyParser) ProxySs(val string) {
+func (pp proxyParser) ProxySs(val string) ParentProxy {
 	method, passwd, server, err := parseMethodPasswdServer(val)
 	if err != nil {
 		Fatal("shadowsocks parent", err)
 	}
 	parent := newShadowsocksParent(server)
 	parent.initCipher(method, passwd)
-	parentProxy.add(parent)
+	parent.bind = pp.bind
+	return parent
 }
 
-func (pp proxyParser) ProxyCow(val string) {
+func (pp proxyParser) ProxyCow(val string) ParentProxy {
 	method, passwd, server, err := parseMethodPasswdServer(val)
 	if err != nil {
 		Fatal("cow parent", err)
@@ -264,7 +478,8 @@ func (pp proxyParser) ProxyCow(val string) {
 
 	config.saveReqLine = true
 	parent := newCowParent(server, method, passwd)
-	parentProxy.add(parent)
+	parent.bind = pp.bind
+	return parent
 }
 
 // listenParser provides functions to parse different types of listen addresses
@@ -302,26 +517,105 @@ func (lp listenParser) ListenCow(val string) {
 	addListenProxy(newCowProxy(method, passwd, addr))
 }
 
+func (lp listenParser) ListenEbpf(val string) {
+	if cmdHasListenAddr {
+		return
+	}
+	arr := strings.Fields(val)
+	if len(arr) != 2 {
+		Fatal("listen = ebpf:// should have address and bpf map path:", val)
+	}
+	if err := checkServerAddr(arr[0]); err != nil {
+		Fatal("listen ebpf server", err)
+	}
+	addListenProxy(newEbpfProxy(arr[0], arr[1]))
+}
+
+func (lp listenParser) ListenSocks5(val string) {
+	if cmdHasListenAddr {
+		return
+	}
+	if err := checkServerAddr(val); err != nil {
+		Fatal("listen socks5 server", err)
+	}
+	addListenProxy(newSocksProxy(val))
+}
+
+func (lp listenParser) ListenRedir(val string) {
+	if cmdHasListenAddr {
+		return
+	}
+	if err := checkServerAddr(val); err != nil {
+		Fatal("listen redir server", err)
+	}
+	addListenProxy(newRedirProxy(val))
+}
+
 // configParser provides functions to parse options in config file.
 type configParser struct{}
 
 func (p configParser) ParseProxy(val string) {
-	parser := reflect.ValueOf(proxyParser{})
-	zeroMethod := reflect.Value{}
+	// Options follow proxy address, separated by space.
+	f := strings.Fields(val)
+	if len(f) == 0 {
+		Fatal("empty proxy")
+	}
+	var authScheme string
+	var udp bool
+	var opts []string
+	for _, opt := range f[1:] {
+		if strings.HasPrefix(opt, "auth=") {
+			authScheme = strings.ToLower(opt[len("auth="):])
+			continue
+		}
+		if opt == "udp" {
+			udp = true
+			continue
+		}
+		opts = append(opts, opt)
+	}
+	if authScheme != "" && authScheme != "ntlm" {
+		Fatal("proxy", val+": unsupported auth scheme", authScheme)
+	}
+	bind, err := parseBindOpt(opts)
+	if err != nil {
+		Fatal("proxy", val+":", err)
+	}
 
-	arr := strings.Split(val, "://")
+	arr := strings.Split(f[0], "://")
 	if len(arr) != 2 {
 		Fatal("proxy has no protocol specified:", val)
 	}
-	protocol := arr[0]
-
-	methodName := "Proxy" + strings.ToUpper(protocol[0:1]) + protocol[1:]
-	method := parser.MethodByName(methodName)
-	if method == zeroMethod {
+	transport, ok := parentTransports[arr[0]]
+	if !ok {
 		Fatalf("no such protocol \"%s\"\n", arr[0])
 	}
-	args := []reflect.Value{reflect.ValueOf(arr[1])}
-	method.Call(args)
+	if udp && arr[0] != "http" {
+		Fatal("proxy", val+": udp option is only supported by http parent")
+	}
+	parentProxy.add(transport(proxyParser{bind, authScheme, udp}, arr[1]))
+}
+
+// ParseTransport registers protocol implemented by adapter program:
+// "name command args...".
+func (p configParser) ParseTransport(val string) {
+	f := strings.Fields(val)
+	if len(f) < 2 {
+		Fatal("transport should be name and command:", val)
+	}
+	name := f[0]
+	if _, ok := parentTransports[name]; ok {
+		Fatal("transport", name, "already exists")
+	}
+	if !isTransportName(name) {
+		Fatal("invalid transport name:", name)
+	}
+	f[1] = expandTilde(f[1])
+	parentTransports[name] = adapterTransport(name, f[1:])
+}
+
+func (p configParser) ParseSslKeyLogFile(val string) {
+	config.SslKeyLogFile = expandTilde(val)
 }
 
 func (p configParser) ParseListen(val string) {
@@ -356,6 +650,10 @@ func (p configParser) ParseLogFile(val string) {
 	config.LogFile = expandTilde(val)
 }
 
+func (p configParser) ParseAccessLog(val string) {
+	config.AccessLog = expandTilde(val)
+}
+
 func (p configParser) ParseAddrInPAC(val string) {
 	configNeedUpgrade = true
 	arr := strings.Split(val, ",")
@@ -392,7 +690,7 @@ func (p configParser) ParseTunnelAllowedPort(val string) {
 
 func (p configParser) ParseSocksParent(val string) {
 	var pp proxyParser
-	pp.ProxySocks5(val)
+	parentProxy.add(pp.ProxySocks5(val))
 	configNeedUpgrade = true
 }
 
@@ -412,7 +710,7 @@ func (p configParser) ParseSshServer(val string) {
 	config.SshServer = append(config.SshServer, val)
 }
 
-var http struct {
+var httpParentOpt struct {
 	parent    *httpParent
 	serverCnt int
 	passwdCnt int
@@ -423,9 +721,9 @@ func (p configParser) ParseHttpParent(val string) {
 		Fatal("parent http server", err)
 	}
 	config.saveReqLine = true
-	http.parent = newHttpParent(val)
-	parentProxy.add(http.parent)
-	http.serverCnt++
+	httpParentOpt.parent = newHttpParent(val)
+	parentProxy.add(httpParentOpt.parent)
+	httpParentOpt.serverCnt++
 	configNeedUpgrade = true
 }
 
@@ -433,17 +731,32 @@ func (p configParser) ParseHttpUserPasswd(val string) {
 	if !isUserPasswdValid(val) {
 		Fatal("httpUserPassword syntax wrong, should be in the form of user:passwd")
 	}
-	if http.passwdCnt >= http.serverCnt {
+	if httpParentOpt.passwdCnt >= httpParentOpt.serverCnt {
 		Fatal("must specify httpParent before corresponding httpUserPasswd")
 	}
-	http.parent.initAuth(val)
-	http.passwdCnt++
+	httpParentOpt.parent.initAuth(val)
+	httpParentOpt.passwdCnt++
 }
 
 func (p configParser) ParseAlwaysProxy(val string) {
 	config.AlwaysProxy = parseBool(val, "alwaysProxy")
 }
 
+func (p configParser) ParseHostMismatch(val string) {
+	switch val {
+	case "allow":
+		config.HostMismatch = hostMismatchAllow
+	case "log":
+		config.HostMismatch = hostMismatchLog
+	case "rewrite":
+		config.HostMismatch = hostMismatchRewrite
+	case "reject":
+		config.HostMismatch = hostMismatchReject
+	default:
+		Fatalf("invalid hostMismatch policy: %s, should be allow, log, rewrite or reject\n", val)
+	}
+}
+
 func (p configParser) ParseLoadBalance(val string) {
 	switch val {
 	case "backup":
@@ -461,6 +774,68 @@ func (p configParser) ParseStatFile(val string) {
 	config.StatFile = expandTilde(val)
 }
 
+func (p configParser) ParseStatSaveInterval(val string) {
+	config.StatSaveInterval = parseDuration(val, "statSaveInterval")
+	if config.StatSaveInterval < time.Minute {
+		Fatal("statSaveInterval should be at least 1m")
+	}
+}
+
+func (p configParser) ParsePidFile(val string) {
+	config.PidFile = expandTilde(val)
+}
+
+func (p configParser) ParseLocale(val string) {
+	config.Locale = val
+}
+
+func (p configParser) ParseLocaleDir(val string) {
+	config.LocaleDir = expandTilde(val)
+	if err := isDirExists(config.LocaleDir); err != nil {
+		Fatal("locale dir:", err)
+	}
+}
+
+func (p configParser) ParseCacheDir(val string) {
+	config.CacheDir = expandTilde(val)
+}
+
+func (p configParser) ParseCacheSize(val string) {
+	config.CacheSize = parseSize(val, "cacheSize")
+}
+
+func (p configParser) ParseCacheMaxObjectSize(val string) {
+	config.CacheMaxObjectSize = parseSize(val, "cacheMaxObjectSize")
+}
+
+func (p configParser) ParseMemCacheSize(val string) {
+	config.MemCacheSize = parseSize(val, "memCacheSize")
+}
+
+func (p configParser) ParseIcapReqmod(val string) {
+	var err error
+	if icap.reqmod, err = parseIcapURL(val); err != nil {
+		Fatal("icapReqmod:", err)
+	}
+	config.IcapReqmod = val
+}
+
+func (p configParser) ParseIcapRespmod(val string) {
+	var err error
+	if icap.respmod, err = parseIcapURL(val); err != nil {
+		Fatal("icapRespmod:", err)
+	}
+	config.IcapRespmod = val
+}
+
+func (p configParser) ParseIcapBypass(val string) {
+	config.IcapBypass = parseBool(val, "icapBypass")
+}
+
+func (p configParser) ParseIcapMaxBodySize(val string) {
+	config.IcapMaxBodySize = parseSize(val, "icapMaxBodySize")
+}
+
 func (p configParser) ParseBlockedFile(val string) {
 	config.BlockedFile = expandTilde(val)
 	if err := isFileExists(config.BlockedFile); err != nil {
@@ -579,14 +954,401 @@ func (p configParser) ParseReadTimeout(val string) {
 	config.ReadTimeout = parseDuration(val, "readTimeout")
 }
 
+func (p configParser) ParseMaintenancePage(val string) {
+	config.MaintenancePage = expandTilde(val)
+}
+
+func (p configParser) ParseMaintenanceRetryAfter(val string) {
+	config.MaintenanceRetryAfter = parseDuration(val, "maintenanceRetryAfter")
+	if config.MaintenanceRetryAfter < time.Second {
+		Fatal("maintenanceRetryAfter should be at least 1s")
+	}
+}
+
 func (p configParser) ParseDialTimeout(val string) {
 	config.DialTimeout = parseDuration(val, "dialTimeout")
 }
 
+func (p configParser) ParseClientIdleTimeout(val string) {
+	config.ClientIdleTimeout = parseDuration(val, "clientIdleTimeout")
+	if config.ClientIdleTimeout < time.Second {
+		Fatal("clientIdleTimeout should be at least 1s")
+	}
+}
+
+func (p configParser) ParseServerIdleTimeout(val string) {
+	config.ServerIdleTimeout = parseDuration(val, "serverIdleTimeout")
+}
+
+func (p configParser) ParseTunnelIdleTimeout(val string) {
+	config.TunnelIdleTimeout = parseDuration(val, "tunnelIdleTimeout")
+}
+
+func (p configParser) ParseMaxRequestBody(val string) {
+	config.MaxRequestBody = parseSize(val, "maxRequestBody")
+}
+
+func (p configParser) ParseHarFile(val string) {
+	config.HarFile = val
+}
+
+func (p configParser) ParseHarHost(val string) {
+	for _, h := range strings.Split(val, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			config.HarHost = append(config.HarHost, h)
+		}
+	}
+}
+
+func (p configParser) ParseHarBodySize(val string) {
+	config.HarBodySize = parseSize(val, "harBodySize")
+}
+
+func (p configParser) ParseSegmentDownload(val string) {
+	config.SegmentDownload = parseInt(val, "segmentDownload")
+}
+
+func (p configParser) ParseSegmentMinSize(val string) {
+	config.SegmentMinSize = parseSize(val, "segmentMinSize")
+	if config.SegmentMinSize < segmentPieceSize {
+		Fatalf("segmentMinSize should be at least %d\n", segmentPieceSize)
+	}
+}
+
+func (p configParser) ParseStallTimeout(val string) {
+	config.StallTimeout = parseDuration(val, "stallTimeout")
+}
+
+func (p configParser) ParseReplayQueue(val string) {
+	config.ReplayQueue = parseInt(val, "replayQueue")
+}
+
+func (p configParser) ParseConnectUDP(val string) {
+	config.ConnectUDP = parseBool(val, "connectUDP")
+}
+
+func (p configParser) ParseUploadLimit(val string) {
+	config.UploadLimit = parseRate(val, "uploadLimit")
+}
+
+func (p configParser) ParseDownloadLimit(val string) {
+	config.DownloadLimit = parseRate(val, "downloadLimit")
+}
+
+func (p configParser) ParseClientUploadLimit(val string) {
+	config.ClientUploadLimit = parseRate(val, "clientUploadLimit")
+}
+
+func (p configParser) ParseClientDownloadLimit(val string) {
+	config.ClientDownloadLimit = parseRate(val, "clientDownloadLimit")
+}
+
+func (p configParser) ParseUserUploadLimit(val string) {
+	config.UserUploadLimit = parseRate(val, "userUploadLimit")
+}
+
+func (p configParser) ParseUserDownloadLimit(val string) {
+	config.UserDownloadLimit = parseRate(val, "userDownloadLimit")
+}
+
+func (p configParser) ParseParentUploadLimit(val string) {
+	config.ParentUploadLimit = parseRate(val, "parentUploadLimit")
+}
+
+func (p configParser) ParseParentDownloadLimit(val string) {
+	config.ParentDownloadLimit = parseRate(val, "parentDownloadLimit")
+}
+
+func (p configParser) ParseBandwidthSchedule(val string) {
+	bs, err := parseBandwidthSchedule(val)
+	if err != nil {
+		Fatalf("bandwidthSchedule %s: %v\n", val, err)
+	}
+	config.BandwidthSchedule = append(config.BandwidthSchedule, bs)
+}
+
+func (p configParser) ParsePacDirectMax(val string) {
+	config.PacDirectMax = parseInt(val, "pacDirectMax")
+	if config.PacDirectMax < 0 {
+		Fatal("pacDirectMax should not be negative")
+	}
+}
+
+func (p configParser) ParsePacDirectMinVisit(val string) {
+	config.PacDirectMinVisit = parseInt(val, "pacDirectMinVisit")
+	if config.PacDirectMinVisit < 0 || config.PacDirectMinVisit > maxCnt {
+		Fatalf("pacDirectMinVisit should be between 0 and %d\n", maxCnt)
+	}
+}
+
+func (p configParser) ParseDnsPrefetch(val string) {
+	config.DnsPrefetch = parseInt(val, "dnsPrefetch")
+	if config.DnsPrefetch < 0 {
+		Fatal("dnsPrefetch should not be negative")
+	}
+}
+
+func (p configParser) ParseDnsCheckResolver(val string) {
+	for _, s := range strings.Split(val, ",") {
+		s = strings.TrimSpace(s)
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		config.DnsCheckResolver = append(config.DnsCheckResolver, s)
+	}
+}
+
+func (p configParser) ParseDnsPoisonIP(val string) {
+	for _, s := range strings.Split(val, ",") {
+		ipnet, err := parseIPNet(strings.TrimSpace(s))
+		if err != nil {
+			Fatal("dnsPoisonIP", err)
+		}
+		config.DnsPoisonIP = append(config.DnsPoisonIP, ipnet)
+	}
+}
+
+func (p configParser) ParseDesync(val string) {
+	if err := parseDesync(val); err != nil {
+		Fatal("desync", val+":", err)
+	}
+}
+
+func (p configParser) ParseTun(val string) {
+	config.Tun = strings.Fields(val)
+	if len(config.Tun) == 0 {
+		Fatal("tun should be command and arguments")
+	}
+}
+
+func (p configParser) ParseFakeDNS(val string) {
+	fd, err := parseFakeDNS(val)
+	if err != nil {
+		Fatal("fakeDNS", val+":", err)
+	}
+	fakeDNS = fd
+}
+
+func (p configParser) ParseDnsCacheTTL(val string) {
+	config.DnsCacheTTL = parseDuration(val, "dnsCacheTTL")
+	if config.DnsCacheTTL < minDnsCacheTTL {
+		Fatalf("dnsCacheTTL should be at least %v\n", minDnsCacheTTL)
+	}
+}
+
 func (p configParser) ParseDetectSSLErr(val string) {
 	config.DetectSSLErr = parseBool(val, "detectSSLErr")
 }
 
+func (p configParser) ParseSystemProxy(val string) {
+	switch val {
+	case "pac", "http":
+		config.SystemProxy = val
+	default:
+		Fatalf("invalid systemProxy: %s, should be pac or http\n", val)
+	}
+}
+
+func (p configParser) ParseUpstreamProxy(val string) {
+	if val != "auto" && !strings.HasPrefix(val, "http://") && !strings.HasPrefix(val, "https://") {
+		Fatalf("invalid upstreamProxy: %s, should be auto or PAC url\n", val)
+	}
+	config.UpstreamProxy = val
+}
+
+func (p configParser) ParseConnHook(val string) {
+	if strings.TrimSpace(val) == "" {
+		Fatal("connHook should be URL or program")
+	}
+	config.ConnHook = append(config.ConnHook, val)
+}
+
+func (p configParser) ParseHelperProgram(val string) {
+	config.HelperProgram = val
+}
+
+func (p configParser) ParseHelperTimeout(val string) {
+	config.HelperTimeout = parseDuration(val, "helperTimeout")
+}
+
+func (p configParser) ParseScriptFile(val string) {
+	config.ScriptFile = val
+	// Routing script may return http parent proxies.
+	config.saveReqLine = true
+}
+
+// ParseRuleProvider parses "route behavior source [interval]".
+func (p configParser) ParseRuleProvider(val string) {
+	f := strings.Fields(val)
+	if len(f) != 3 && len(f) != 4 {
+		Fatal("ruleProvider should be: direct|proxy|group domain|ipcidr|classical url|path [interval]")
+	}
+	rp := &ruleProvider{source: expandTilde(f[2]), interval: defaultRuleProviderInterval}
+	switch f[0] {
+	case "direct":
+		rp.route = routeDirect
+	case "proxy":
+		rp.route = routeProxy
+	default:
+		if strings.Contains(f[0], "://") {
+			Fatalf("ruleProvider route should be direct, proxy or proxy group, got %s\n", f[0])
+		}
+		rp.route = routeProxy
+		rp.group = f[0]
+	}
+	switch f[1] {
+	case "domain", "ipcidr", "classical":
+		rp.behavior = f[1]
+	default:
+		Fatalf("ruleProvider behavior should be domain, ipcidr or classical, got %s\n", f[1])
+	}
+	if len(f) == 4 {
+		rp.interval = parseDuration(f[3], "ruleProvider interval")
+	}
+	ruleProviders = append(ruleProviders, rp)
+}
+
+func (p configParser) ParseProxyGroup(val string) {
+	g, err := parseProxyGroup(val)
+	if err != nil {
+		Fatal("proxyGroup", val+":", err)
+	}
+	if _, ok := proxyGroups[g.name]; ok {
+		Fatal("proxyGroup", g.name, "already exists")
+	}
+	proxyGroups[g.name] = g
+}
+
+func (p configParser) ParseRequestRule(val string) {
+	rr, err := parseRequestRule(val)
+	if err != nil {
+		Fatal("requestRule", val+":", err)
+	}
+	if strings.HasPrefix(rr.entry, "PROXY ") {
+		config.saveReqLine = true
+	}
+	requestRules = append(requestRules, rr)
+}
+
+func (p configParser) ParseAccessRule(val string) {
+	ar, err := parseAccessRule(val)
+	if err != nil {
+		Fatal("accessRule", val+":", err)
+	}
+	accessRules = append(accessRules, ar)
+}
+
+func (p configParser) ParseAsnFile(val string) {
+	fpath := expandTilde(val)
+	if err := isFileExists(fpath); err != nil {
+		Fatal("asn file:", err)
+	}
+	config.ASNFile = append(config.ASNFile, fpath)
+}
+
+func (p configParser) ParseSniRouting(val string) {
+	config.SniRouting = parseBool(val, "sniRouting")
+}
+
+func (p configParser) ParseBlockQUIC(val string) {
+	config.BlockQUIC = parseBool(val, "blockQUIC")
+}
+
+func (p configParser) ParseClusterListen(val string) {
+	if err := checkServerAddr(val); err != nil {
+		Fatal("clusterListen", err)
+	}
+	config.ClusterListen = val
+}
+
+func (p configParser) ParseClusterPeer(val string) {
+	if err := checkServerAddr(val); err != nil {
+		Fatal("clusterPeer", err)
+	}
+	config.ClusterPeer = append(config.ClusterPeer, val)
+}
+
+func (p configParser) ParseClusterSecret(val string) {
+	config.ClusterSecret = val
+}
+
+func (p configParser) ParseStandbyOf(val string) {
+	if err := checkServerAddr(val); err != nil {
+		Fatal("standbyOf", err)
+	}
+	config.StandbyOf = val
+}
+
+func (p configParser) ParseConfigSource(val string) {
+	if _, err := newKVStore(val); err != nil {
+		Fatal("configSource", val+":", err)
+	}
+	config.ConfigSource = val
+}
+
+func (p configParser) ParseDebugRouteHeader(val string) {
+	config.DebugRouteHeader = parseBool(val, "debugRouteHeader")
+}
+
+func (p configParser) ParseServerTiming(val string) {
+	config.ServerTiming = parseBool(val, "serverTiming")
+}
+
+func (p configParser) ParseBindAddr(val string) {
+	if err := checkBindAddr(val); err != nil {
+		Fatal("bindAddr:", err)
+	}
+	config.BindAddr = val
+}
+
+func (p configParser) ParseBindInterface(val string) {
+	if err := checkBindInterface(val); err != nil {
+		Fatalf("bindInterface %s: %v\n", val, err)
+	}
+	config.BindInterface = val
+}
+
+func (p configParser) ParseDirectMark(val string) {
+	mark, err := parseMark(val)
+	if err != nil {
+		Fatal("directMark:", err)
+	}
+	config.DirectMark = mark
+}
+
+func (p configParser) ParseParentMark(val string) {
+	mark, err := parseMark(val)
+	if err != nil {
+		Fatal("parentMark:", err)
+	}
+	config.ParentMark = mark
+}
+
+func (p configParser) ParseParentPAC(val string) {
+	if parentPAC != nil {
+		Fatal("parentPAC can only be specified once")
+	}
+	parentPAC = &parentPACRoute{source: expandTilde(val)}
+	// PAC result may contain http parent proxies.
+	config.saveReqLine = true
+}
+
+func (p configParser) ParseAdminSocket(val string) {
+	config.AdminSocket = expandTilde(val)
+}
+
+func (p configParser) ParseMetricsFile(val string) {
+	config.MetricsFile = expandTilde(val)
+}
+
+func (p configParser) ParseTlsSessionFile(val string) {
+	config.TlsSessionFile = expandTilde(val)
+}
+
+func (p configParser) ParseRunAsUser(val string) {
+	config.RunAsUser = val
+}
+
 func (p configParser) ParseEstimateTarget(val string) {
 	config.EstimateTarget = val
 }
@@ -601,12 +1363,35 @@ func parseConfig(rc string, override *Config) {
 	}
 
 	IgnoreUTF8BOM(f)
+	rcData, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		Fatal("Error reading config file:", err)
+	}
+	// Config synced from primary is parsed first, so options in standby's
+	// rc take precedence.
+	if hasConfigOption(rcData, "standbyOf") {
+		parseSyncedRc(standbyPrefix)
+	}
+	if source, ok := configOptionValue(rcData, "configSource"); ok {
+		loadConfigSource(source)
+	}
+	lines := parseConfigLines(bytes.NewReader(rcData))
 
-	scanner := bufio.NewScanner(f)
+	overrideConfig(&config, override)
+	checkConfig()
+
+	if configNeedUpgrade && !override.CheckConfig {
+		upgradeConfig(rc, lines)
+	}
+}
+
+// parseConfigLines parses options in rc file format, returns all lines read.
+func parseConfigLines(r io.Reader) (lines []string) {
+	scanner := bufio.NewScanner(r)
 
 	parser := reflect.ValueOf(configParser{})
 	zeroMethod := reflect.Value{}
-	var lines []string // store lines for upgrade
 
 	var n int
 	for scanner.Scan() {
@@ -639,14 +1424,7 @@ func parseConfig(rc string, override *Config) {
 	if scanner.Err() != nil {
 		Fatalf("Error reading rc file: %v\n", scanner.Err())
 	}
-	f.Close()
-
-	overrideConfig(&config, override)
-	checkConfig()
-
-	if configNeedUpgrade {
-		upgradeConfig(rc, lines)
-	}
+	return
 }
 
 func upgradeConfig(rc string, lines []string) {
@@ -746,4 +1524,21 @@ func checkConfig() {
 	if listenProxy == nil {
 		listenProxy = []Proxy{newHttpProxy(defaultListenAddr, "")}
 	}
+	fullKeepAliveHeader = fmt.Sprintf("Keep-Alive: timeout=%d\r\n",
+		int(config.ClientIdleTimeout/time.Second))
+	if config.BindAddr != "" || config.BindInterface != "" || config.DirectMark != 0 {
+		directBind = &bindOpt{
+			addr:  config.BindAddr,
+			iface: config.BindInterface,
+			mark:  config.DirectMark,
+		}
+	}
+	if len(config.DnsCheckResolver) == 1 {
+		Fatal("dnsCheckResolver needs at least two resolvers to cross-check")
+	}
+	if config.SslKeyLogFile != "" {
+		// Anyone reading the file can decrypt the traffic.
+		info.Println("sslKeyLogFile is set, TLS keys of transport adapters are logged to",
+			config.SslKeyLogFile)
+	}
 }
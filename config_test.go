@@ -1,4 +1,4 @@
-package main
+package cow
 
 import (
 	"testing"
@@ -81,7 +81,7 @@ func TestParseProxy(t *testing.T) {
 	if hp.server != "127.0.0.2:9090" {
 		t.Error("2nd http proxy server address wrong, got:", hp.server)
 	}
-	if hp.authHeader == nil {
+	if hp.auth == nil {
 		t.Error("2nd http proxy server user password not parsed")
 	}
 
@@ -1,16 +1,21 @@
+//go:build darwin || freebsd || linux || netbsd || openbsd
 // +build darwin freebsd linux netbsd openbsd
 
-package main
+package cow
 
 import (
 	"path"
 )
 
 const (
-	rcFname      = "rc"
-	blockedFname = "blocked"
-	directFname  = "direct"
-	statFname    = "stat"
+	rcFname         = "rc"
+	blockedFname    = "blocked"
+	directFname     = "direct"
+	statFname       = "stat"
+	pidFname        = "pid"
+	metricsFname    = "metrics"
+	tlsSessionFname = "tls-session"
+	localeDirName   = "locale"
 
 	newLine = "\n"
 )
@@ -1,4 +1,4 @@
-package main
+package cow
 
 import (
 	"os"
@@ -6,10 +6,14 @@ import (
 )
 
 const (
-	rcFname      = "rc.txt"
-	blockedFname = "blocked.txt"
-	directFname  = "direct.txt"
-	statFname    = "stat.txt"
+	rcFname         = "rc.txt"
+	blockedFname    = "blocked.txt"
+	directFname     = "direct.txt"
+	statFname       = "stat.txt"
+	pidFname        = "pid.txt"
+	metricsFname    = "metrics.txt"
+	tlsSessionFname = "tls-session"
+	localeDirName   = "locale"
 
 	newLine = "\r\n"
 )
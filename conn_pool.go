@@ -1,6 +1,6 @@
 // Share server connections between different clients.
 
-package main
+package cow
 
 import (
 	"sync"
@@ -90,6 +90,7 @@ func (cp *ConnPool) Get(hostPort string, asDirect bool) (sv *serverConn) {
 }
 
 func (cp *ConnPool) Put(sv *serverConn) {
+	sv.hookClose()
 	// Multiplexing connections.
 	switch sv.Conn.(type) {
 	case httpConn, cowConn:
@@ -0,0 +1,280 @@
+package cow
+
+// CONNECT-UDP (RFC 9298) over HTTP/1.1.
+//
+// If connectUDP is enabled, clients can proxy UDP (e.g. QUIC, WebRTC) by
+// upgrading a request to the default URI template:
+//
+//   GET /.well-known/masque/udp/{target_host}/{target_port}/ HTTP/1.1
+//   Host: <cow address>
+//   Connection: Upgrade
+//   Upgrade: connect-udp
+//   Capsule-Protocol: ?1
+//
+// After "101 Switching Protocols", UDP payloads are carried in DATAGRAM
+// capsules (RFC 9297) on the connection. COW has no HTTP/2 or HTTP/3
+// listener, so extended CONNECT and QUIC datagrams are not supported.
+//
+// Sites routed to parent proxy use http parents with "udp" option, which
+// must support CONNECT-UDP with the default URI template. The upgraded
+// connection to parent is relayed as is. Other sites and sites without such
+// parent use direct UDP sockets.
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	masqueUDPPath = "/.well-known/masque/udp/"
+
+	capsuleDatagram = 0x00
+
+	// Max UDP payload.
+	maxUDPPayload = 65527
+	// Idle direct UDP sessions are closed if nothing is received from the
+	// target.
+	udpIdleTimeout = 5 * time.Minute
+)
+
+var errCapsuleTooLarge = errors.New("capsule too large")
+
+// connectUDPTarget returns target host:port of CONNECT-UDP request, empty if
+// the request is not one.
+func connectUDPTarget(r *Request) string {
+	if !config.ConnectUDP || r.Method != "GET" || r.URL.HostPort != "" ||
+		r.Upgrade != "connect-udp" || !strings.HasPrefix(r.URL.Path, masqueUDPPath) {
+		return ""
+	}
+	f := strings.Split(strings.TrimSuffix(r.URL.Path[len(masqueUDPPath):], "/"), "/")
+	if len(f) != 2 {
+		return ""
+	}
+	// IPv6 address colons are percent encoded.
+	host, err := url.QueryUnescape(f[0])
+	if err != nil || host == "" {
+		return ""
+	}
+	if port, err := strconv.Atoi(f[1]); err != nil || port <= 0 || port > 65535 {
+		return ""
+	}
+	return net.JoinHostPort(host, f[1])
+}
+
+// masqueUDPURI returns the request URI for target host:port.
+func masqueUDPURI(host, port string) string {
+	return masqueUDPPath + url.QueryEscape(host) + "/" + port + "/"
+}
+
+func readVarint(r io.ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := 1 << (b >> 6)
+	v := uint64(b & 0x3f)
+	for i := 1; i < n; i++ {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	}
+	return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+type capsuleReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readUDPDatagram returns UDP payload in the next DATAGRAM capsule with
+// context ID 0. Other capsules and contexts are skipped.
+func readUDPDatagram(r capsuleReader, buf []byte) ([]byte, error) {
+	for {
+		typ, err := readVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		length, err := readVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if typ != capsuleDatagram || length == 0 {
+			if _, err = io.CopyN(SinkWriter{}, r, int64(length)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if length > uint64(len(buf)) {
+			return nil, errCapsuleTooLarge
+		}
+		value := buf[:length]
+		if _, err = io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		ctx := varintReader(value)
+		id, err := readVarint(&ctx)
+		if err != nil || id != 0 {
+			continue
+		}
+		return []byte(ctx), nil
+	}
+}
+
+// varintReader reads varint from byte slice, the remaining bytes are left in
+// the slice.
+type varintReader []byte
+
+func (vr *varintReader) ReadByte() (byte, error) {
+	if len(*vr) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := (*vr)[0]
+	*vr = (*vr)[1:]
+	return b, nil
+}
+
+// udpDatagramCapsule encodes payload in DATAGRAM capsule with context ID 0.
+func udpDatagramCapsule(b, payload []byte) []byte {
+	b = appendVarint(b[:0], capsuleDatagram)
+	b = appendVarint(b, uint64(len(payload)+1))
+	b = append(b, 0) // context ID
+	return append(b, payload...)
+}
+
+const connectUDPResponse = "HTTP/1.1 101 Switching Protocols\r\n" +
+	"Connection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n"
+
+// serveConnectUDP handles CONNECT-UDP request, client connection is closed
+// afterwards.
+func (c *clientConn) serveConnectUDP(r *Request, target string) {
+	u := new(URL)
+	u.ParseHostPort(target)
+	if !config.TunnelAllowedPort[u.Port] {
+		sendErrorPage(c, statusForbidden, "Forbidden UDP port",
+			genErrMsg(r, nil, "Please contact proxy admin."))
+		return
+	}
+	siteInfo := siteStat.GetVisitCnt(u)
+	if config.AlwaysProxy || siteInfo.AsBlocked() {
+		for _, p := range allParents() {
+			if hp, ok := p.(*httpParent); ok && hp.connectUDP {
+				if err := c.connectUDPParent(r, hp, u); err == nil {
+					return
+				}
+			}
+		}
+	}
+	c.connectUDPDirect(r, u)
+}
+
+func (c *clientConn) connectUDPDirect(r *Request, u *URL) {
+	uc, err := net.DialTimeout("udp", u.HostPort, dialTimeout)
+	if err != nil {
+		debug.Printf("cli(%s) CONNECT-UDP %s: %v\n", c.RemoteAddr(), u.HostPort, err)
+		sendErrorPage(c, "502 Bad Gateway", err.Error(),
+			genErrMsg(r, nil, "Can't create UDP socket for the target."))
+		return
+	}
+	defer uc.Close()
+	if _, err = io.WriteString(c, connectUDPResponse); err != nil {
+		return
+	}
+	debug.Printf("cli(%s) CONNECT-UDP %s direct\n", c.RemoteAddr(), u.HostPort)
+
+	go func() {
+		buf := make([]byte, maxUDPPayload)
+		var capsule []byte
+		for {
+			uc.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+			n, err := uc.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && !ne.Timeout() && ne.Temporary() {
+					continue
+				}
+				// Unblock reading capsules from client. Buffer is released
+				// by serve.
+				c.Conn.Close()
+				return
+			}
+			capsule = udpDatagramCapsule(capsule, buf[:n])
+			if _, err = c.Write(capsule); err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, maxUDPPayload+8)
+	for {
+		payload, err := readUDPDatagram(c.bufRd, buf)
+		if err != nil {
+			debug.Printf("cli(%s) CONNECT-UDP %s closed: %v\n", c.RemoteAddr(), u.HostPort, err)
+			return
+		}
+		// Errors like ICMP port unreachable are reported on write, UDP
+		// doesn't guarantee delivery anyway.
+		uc.Write(payload)
+	}
+}
+
+// connectUDPParent relays the request to parent. Returns error if no
+// response has been sent to the client.
+func (c *clientConn) connectUDPParent(r *Request, hp *httpParent, u *URL) error {
+	pc, err := hp.connect(u)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	uri := masqueUDPURI(u.Host, u.Port)
+	req := "GET " + uri + " HTTP/1.1\r\nHost: " + hp.server + "\r\n" +
+		"Connection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n"
+	if hp.auth != nil && !hp.auth.ntlm {
+		req += string(hp.auth.header("GET", uri))
+	}
+	if _, err = io.WriteString(pc, req+CRLF); err != nil {
+		return err
+	}
+	setConnReadTimeout(pc, readTimeout, "CONNECT-UDP")
+	rd := bufio.NewReader(pc)
+	resp, err := http.ReadResponse(rd, nil)
+	if err != nil {
+		errl.Printf("CONNECT-UDP parent %s for %s: %v\n", hp.server, u.HostPort, err)
+		return err
+	}
+	if resp.StatusCode != 101 {
+		resp.Body.Close()
+		errl.Printf("CONNECT-UDP parent %s for %s: %s\n", hp.server, u.HostPort, resp.Status)
+		return errors.New(resp.Status)
+	}
+	unsetConnReadTimeout(pc, "CONNECT-UDP")
+	if _, err = io.WriteString(c, connectUDPResponse); err != nil {
+		return nil
+	}
+	debug.Printf("cli(%s) CONNECT-UDP %s through http parent %s\n", c.RemoteAddr(), u.HostPort, hp.server)
+
+	go func() {
+		io.Copy(c, rd)
+		c.Conn.Close()
+	}()
+	io.Copy(pc, c.bufRd)
+	return nil
+}
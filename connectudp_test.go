@@ -0,0 +1,82 @@
+package cow
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 37, 63, 64, 15293, 16383, 16384, 494878333, 1<<30 - 1, 1 << 30, 151288809941952652} {
+		b := appendVarint(nil, v)
+		r := bytes.NewReader(b)
+		got, err := readVarint(r)
+		if err != nil || got != v || r.Len() != 0 {
+			t.Errorf("varint %d encoded %x decoded %d %v", v, b, got, err)
+		}
+	}
+	// Examples from RFC 9000 appendix A.1.
+	if b := appendVarint(nil, 15293); !bytes.Equal(b, []byte{0x7b, 0xbd}) {
+		t.Errorf("15293 encoded %x", b)
+	}
+	if b := appendVarint(nil, 494878333); !bytes.Equal(b, []byte{0x9d, 0x7f, 0x3e, 0x7d}) {
+		t.Errorf("494878333 encoded %x", b)
+	}
+}
+
+func TestReadUDPDatagram(t *testing.T) {
+	var stream []byte
+	// Unknown capsule type is skipped.
+	stream = append(stream, 0x40, 0x80, 3, 'a', 'b', 'c')
+	// Datagram with context ID other than 0 is skipped.
+	stream = append(stream, 0, 3, 2, 'x', 'y')
+	stream = append(stream, udpDatagramCapsule(nil, []byte("hello"))...)
+	stream = append(stream, udpDatagramCapsule(nil, nil)...)
+
+	r := bytes.NewReader(stream)
+	buf := make([]byte, 16)
+	p, err := readUDPDatagram(r, buf)
+	if err != nil || string(p) != "hello" {
+		t.Fatalf("read datagram %q %v", p, err)
+	}
+	if p, err = readUDPDatagram(r, buf); err != nil || len(p) != 0 {
+		t.Errorf("read empty datagram %q %v", p, err)
+	}
+	if _, err = readUDPDatagram(r, buf); err == nil {
+		t.Error("should return error at end of stream")
+	}
+
+	r = bytes.NewReader(udpDatagramCapsule(nil, make([]byte, 16)))
+	if _, err = readUDPDatagram(r, buf); err != errCapsuleTooLarge {
+		t.Error("large capsule should return error, got", err)
+	}
+}
+
+func TestConnectUDPTarget(t *testing.T) {
+	saved := config.ConnectUDP
+	config.ConnectUDP = true
+	defer func() { config.ConnectUDP = saved }()
+
+	testData := []struct {
+		path    string
+		upgrade string
+		target  string
+	}{
+		{"/.well-known/masque/udp/192.0.2.6/443/", "connect-udp", "192.0.2.6:443"},
+		{"/.well-known/masque/udp/example.com/443/", "connect-udp", "example.com:443"},
+		{"/.well-known/masque/udp/2001%3Adb8%3A%3A42/53/", "connect-udp", "[2001:db8::42]:53"},
+		{"/.well-known/masque/udp/example.com/443/", "", ""},
+		{"/.well-known/masque/udp/example.com/0/", "connect-udp", ""},
+		{"/.well-known/masque/udp/example.com/", "connect-udp", ""},
+		{"/pac", "connect-udp", ""},
+	}
+	for _, td := range testData {
+		r := &Request{Method: "GET", URL: &URL{Path: td.path}}
+		r.Upgrade = td.upgrade
+		if target := connectUDPTarget(r); target != td.target {
+			t.Errorf("%s upgrade %q target should be %q, got %q", td.path, td.upgrade, td.target, target)
+		}
+	}
+	if uri := masqueUDPURI("2001:db8::42", "53"); uri != "/.well-known/masque/udp/2001%3Adb8%3A%3A42/53/" {
+		t.Error("wrong URI", uri)
+	}
+}
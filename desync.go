@@ -0,0 +1,242 @@
+package cow
+
+// Evasions against DPI for direct connections.
+//
+//   desync = split,tlsrec,ttl=1 example.com,example.net
+//
+// The first data sent on direct connections to the listed domains and their
+// sub domains is altered so that DPI boxes matching server names fail, while
+// servers still get the same byte stream. The split point is in the middle
+// of the server name in TLS ClientHello, or the Host header value of plain
+// HTTP requests. Methods:
+//
+//   split   send data before and after the split point in separate TCP
+//           segments
+//   tlsrec  split the TLS record carrying ClientHello into two records at the
+//           split point, servers must reassemble handshake messages
+//   ttl=N   send the first segment with IP TTL (hop limit for IPv6) N, which
+//           should be too small to reach the server, so it's dropped on the
+//           way and retransmitted by the kernel later with normal TTL. DPI
+//           sees the second segment first. Implies split, N defaults to 1
+//
+// Sites working with desync don't need parent proxies, put them in the
+// direct file so they are not tried with parent proxies after a failure.
+// Connections through upstreamProxy are not altered.
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const defaultDesyncTTL = 1
+
+type desyncOpt struct {
+	split     bool // send in two TCP segments
+	tlsRecord bool // split ClientHello into two TLS records
+	ttl       int  // TTL of the first segment, 0 to keep
+}
+
+// desyncDomain maps domain in desync option to its methods.
+var desyncDomain map[string]*desyncOpt
+
+func parseDesyncMethods(s string) (*desyncOpt, error) {
+	opt := &desyncOpt{}
+	for _, m := range strings.Split(s, ",") {
+		m = strings.TrimSpace(m)
+		switch {
+		case m == "split":
+			opt.split = true
+		case m == "tlsrec":
+			opt.tlsRecord = true
+		case m == "ttl":
+			opt.ttl = defaultDesyncTTL
+		case strings.HasPrefix(m, "ttl="):
+			n, err := strconv.Atoi(m[len("ttl="):])
+			if err != nil || n < 1 || n > 255 {
+				return nil, errors.New("ttl should be between 1 and 255")
+			}
+			opt.ttl = n
+		default:
+			return nil, errors.New("unknown method " + m)
+		}
+	}
+	if opt.ttl != 0 {
+		opt.split = true
+	}
+	return opt, nil
+}
+
+// parseDesync parses "methods domains" and adds the domains to desyncDomain.
+func parseDesync(val string) error {
+	f := strings.Fields(val)
+	if len(f) != 2 {
+		return errors.New("should be methods and domains, both separated by comma")
+	}
+	opt, err := parseDesyncMethods(f[0])
+	if err != nil {
+		return err
+	}
+	domains := strings.Split(f[1], ",")
+	for i, d := range domains {
+		if domains[i] = strings.ToLower(strings.Trim(strings.TrimSpace(d), ".")); domains[i] == "" {
+			return errors.New("empty domain")
+		}
+	}
+	if desyncDomain == nil {
+		desyncDomain = make(map[string]*desyncOpt)
+	}
+	for _, d := range domains {
+		desyncDomain[d] = opt
+	}
+	return nil
+}
+
+// findDesync returns desync methods of host, nil if not configured.
+func findDesync(host string) *desyncOpt {
+	if len(desyncDomain) == 0 {
+		return nil
+	}
+	host = strings.ToLower(host)
+	for {
+		if opt, ok := desyncDomain[host]; ok {
+			return opt
+		}
+		dot := strings.IndexByte(host, '.')
+		if dot < 0 {
+			return nil
+		}
+		host = host[dot+1:]
+	}
+}
+
+var headerHostPrefix = []byte("\r\nhost:")
+
+// desyncSplitPos returns the split point of the first data sent to server,
+// 0 if no server name is found.
+func desyncSplitPos(b []byte) int {
+	var start, end int
+	if len(b) > 0 && b[0] == 0x16 {
+		host, err := parseSNI(b)
+		if err != nil {
+			return 0
+		}
+		if start = bytes.Index(b, []byte(host)); start < 0 {
+			return 0
+		}
+		end = start + len(host)
+	} else {
+		// Header names are case insensitive.
+		n := len(b)
+		if n > 4096 {
+			n = 4096
+		}
+		i := bytes.Index(bytes.ToLower(b[:n]), headerHostPrefix)
+		if i < 0 {
+			return 0
+		}
+		start = i + len(headerHostPrefix)
+		for start < len(b) && b[start] == ' ' {
+			start++
+		}
+		end = start
+		for end < len(b) && b[end] != '\r' {
+			end++
+		}
+	}
+	if end-start < 2 {
+		return start + 1
+	}
+	return start + (end-start)/2
+}
+
+// splitTLSRecord splits the TLS record at the beginning of b into two at
+// pos. The record may be longer than b, the rest is sent in later writes.
+func splitTLSRecord(b []byte, pos int) []byte {
+	if len(b) < 5 || pos <= 5 || pos >= len(b) {
+		return b
+	}
+	total := int(b[3])<<8 | int(b[4])
+	first := pos - 5
+	if first >= total {
+		return b
+	}
+	rest := total - first
+	out := make([]byte, 0, len(b)+5)
+	out = append(out, b[:3]...)
+	out = append(out, byte(first>>8), byte(first))
+	out = append(out, b[5:pos]...)
+	out = append(out, b[:3]...)
+	out = append(out, byte(rest>>8), byte(rest))
+	return append(out, b[pos:]...)
+}
+
+// desyncConn alters the first write on the connection.
+type desyncConn struct {
+	net.Conn
+	opt  *desyncOpt
+	done bool
+}
+
+// desync wraps direct connection c to host if desync is configured for it.
+func desync(c net.Conn, host string) net.Conn {
+	if opt := findDesync(host); opt != nil {
+		return &desyncConn{Conn: c, opt: opt}
+	}
+	return c
+}
+
+func (dc *desyncConn) Write(b []byte) (int, error) {
+	if dc.done {
+		return dc.Conn.Write(b)
+	}
+	dc.done = true
+	pos := desyncSplitPos(b)
+	if pos <= 0 || pos >= len(b) {
+		return dc.Conn.Write(b)
+	}
+	out := b
+	if dc.opt.tlsRecord && b[0] == 0x16 {
+		// The first record ends at pos, the second record header follows.
+		out = splitTLSRecord(b, pos)
+	}
+	if !dc.opt.split {
+		if _, err := dc.Conn.Write(out); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if err := dc.writeFirst(out[:pos]); err != nil {
+		return 0, err
+	}
+	if _, err := dc.Conn.Write(out[pos:]); err != nil {
+		return pos, err
+	}
+	return len(b), nil
+}
+
+// writeFirst writes the first segment, with low TTL if configured.
+func (dc *desyncConn) writeFirst(b []byte) error {
+	tc, ok := dc.Conn.(*net.TCPConn)
+	if dc.opt.ttl == 0 || !ok {
+		_, err := dc.Conn.Write(b)
+		return err
+	}
+	ipv6 := false
+	if addr, ok := tc.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+	orig, err := setConnTTL(tc, ipv6, dc.opt.ttl)
+	if err != nil {
+		debug.Println("desync set ttl:", err)
+		_, err = tc.Write(b)
+		return err
+	}
+	_, err = tc.Write(b)
+	if _, err2 := setConnTTL(tc, ipv6, orig); err2 != nil {
+		errl.Println("desync restore ttl:", err2)
+	}
+	return err
+}
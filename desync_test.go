@@ -0,0 +1,125 @@
+package cow
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseDesync(t *testing.T) {
+	saved := desyncDomain
+	defer func() { desyncDomain = saved }()
+	desyncDomain = nil
+
+	if err := parseDesync("split,tlsrec example.com,.Example.NET"); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseDesync("ttl=3 foo.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"split", "bogus example.com", "ttl=0 example.com", "split example.com,,a.com"} {
+		if err := parseDesync(s); err == nil {
+			t.Errorf("%q should fail", s)
+		}
+	}
+
+	testData := []struct {
+		host string
+		opt  *desyncOpt
+	}{
+		{"example.com", &desyncOpt{split: true, tlsRecord: true}},
+		{"www.example.net", &desyncOpt{split: true, tlsRecord: true}},
+		{"foo.example.com", &desyncOpt{split: true, ttl: 3}},
+		{"a.foo.example.com", &desyncOpt{split: true, ttl: 3}},
+		{"example.org", nil},
+		{"com", nil},
+	}
+	for _, td := range testData {
+		opt := findDesync(td.host)
+		if (opt == nil) != (td.opt == nil) || opt != nil && *opt != *td.opt {
+			t.Errorf("%s desync should be %v, got %v", td.host, td.opt, opt)
+		}
+	}
+}
+
+func TestDesyncSplitPos(t *testing.T) {
+	req := []byte("GET / HTTP/1.1\r\nHOST:  www.example.com\r\n\r\n")
+	pos := desyncSplitPos(req)
+	if string(req[:pos]) != "GET / HTTP/1.1\r\nHOST:  www.exa" {
+		t.Errorf("wrong split of HTTP request: %q", req[:pos])
+	}
+	hello := clientHello("www.example.com")
+	pos = desyncSplitPos(hello)
+	if !bytes.HasSuffix(hello[:pos], []byte("www.exa")) {
+		t.Errorf("ClientHello should be split in server name, got %q", hello[pos-7:pos])
+	}
+	if desyncSplitPos(clientHello("1.2.3.4")) != 0 {
+		t.Error("ClientHello without SNI should not be split")
+	}
+	if desyncSplitPos([]byte("SSH-2.0-OpenSSH\r\n")) != 0 {
+		t.Error("data without host should not be split")
+	}
+}
+
+func TestSplitTLSRecord(t *testing.T) {
+	hello := clientHello("www.example.com")
+	pos := desyncSplitPos(hello)
+	out := splitTLSRecord(hello, pos)
+	if len(out) != len(hello)+5 {
+		t.Fatalf("split record should be 5 bytes longer, got %d -> %d", len(hello), len(out))
+	}
+	n1 := int(out[3])<<8 | int(out[4])
+	if n1 != pos-5 {
+		t.Errorf("first record length should be %d, got %d", pos-5, n1)
+	}
+	r2 := out[pos:]
+	n2 := int(r2[3])<<8 | int(r2[4])
+	if r2[0] != 0x16 || n1+n2 != len(hello)-5 {
+		t.Errorf("wrong second record header %v", r2[:5])
+	}
+	if !bytes.Equal(append(append([]byte{}, out[5:pos]...), r2[5:]...), hello[5:]) {
+		t.Error("record content changed")
+	}
+}
+
+func TestDesyncConn(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+
+	// Loopback doesn't decrement TTL, so the low TTL segment is delivered.
+	for _, opt := range []*desyncOpt{
+		{split: true},
+		{tlsRecord: true},
+		{split: true, tlsRecord: true, ttl: 1},
+	} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dc := &desyncConn{Conn: c, opt: opt}
+		tc := tls.Client(dc, &tls.Config{ServerName: "www.example.com", InsecureSkipVerify: true})
+		if _, err = tc.Write([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")); err != nil {
+			t.Errorf("%+v handshake: %v", *opt, err)
+			c.Close()
+			continue
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+		if err != nil {
+			t.Errorf("%+v read response: %v", *opt, err)
+		} else {
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != "ok" {
+				t.Errorf("%+v wrong body %q", *opt, body)
+			}
+		}
+		c.Close()
+	}
+}
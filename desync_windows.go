@@ -0,0 +1,27 @@
+package cow
+
+import (
+	"net"
+	"syscall"
+)
+
+// setConnTTL sets IP TTL or IPv6 hop limit of c, returns the previous value.
+func setConnTTL(c *net.TCPConn, ipv6 bool, ttl int) (orig int, err error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TTL
+	if ipv6 {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS
+	}
+	cerr := raw.Control(func(fd uintptr) {
+		if orig, err = syscall.GetsockoptInt(syscall.Handle(fd), level, opt); err == nil {
+			err = syscall.SetsockoptInt(syscall.Handle(fd), level, opt, ttl)
+		}
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	return orig, err
+}
@@ -0,0 +1,208 @@
+package cow
+
+// DNS cache for direct connections, with prefetching for frequently visited
+// hosts.
+//
+// Go's resolver doesn't expose record TTL, so cached addresses expire after
+// dnsCacheTTL. Before an entry expires, the top dnsPrefetch hosts by direct
+// visit count in site stat are resolved again in background, so requests to
+// these hosts never wait for DNS lookup.
+//
+// Direct connections try each resolved address in turn, addresses failed
+// to connect are moved to the end of the cached entry.
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDnsCacheTTL = 5 * time.Minute
+	minDnsCacheTTL     = 30 * time.Second
+)
+
+type dnsEntry struct {
+	addrs  []string
+	expire time.Time
+}
+
+var dnsCache = struct {
+	sync.RWMutex
+	entry map[string]dnsEntry
+}{entry: make(map[string]dnsEntry)}
+
+func dnsCacheEnabled() bool {
+	return config.DnsPrefetch > 0
+}
+
+func resolveAndCache(host string) ([]string, error) {
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	dnsCache.Lock()
+	dnsCache.entry[host] = dnsEntry{addrs, time.Now().Add(config.DnsCacheTTL)}
+	dnsCache.Unlock()
+	return addrs, nil
+}
+
+func lookupHostCached(host string) ([]string, error) {
+	dnsCache.RLock()
+	e, ok := dnsCache.entry[host]
+	dnsCache.RUnlock()
+	if ok && time.Now().Before(e.expire) {
+		return e.addrs, nil
+	}
+	return resolveAndCache(host)
+}
+
+// lookupHost resolves host, using DNS cache if enabled.
+func lookupHost(host string) ([]string, error) {
+	if dnsCacheEnabled() {
+		return lookupHostCached(host)
+	}
+	return net.LookupHost(host)
+}
+
+// dialDirect connects to hostPort, using cached DNS result if enabled.
+// If there's upstream proxy for host, connect through it instead. Timeout 0
+// means no timeout.
+func dialDirect(hostPort string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if up := getUpstreamProxy(); up != nil && err == nil && !bypassUpstream(host) {
+		if up = up.forHost(host, port); up != nil {
+			return up.dial(hostPort, timeout)
+		}
+	}
+	start := time.Now()
+	var c net.Conn
+	if err != nil || net.ParseIP(host) != nil {
+		if c, err = directBind.dial(hostPort, deadlineOf(timeout)); err != nil {
+			return nil, err
+		}
+		return timed(desync(c, host), 0, start), nil
+	}
+	// Resolve explicitly to try each address, this also measures DNS lookup
+	// for serverTiming.
+	addrs, err := lookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	dialStart := time.Now()
+	if c, err = dialAddrs(host, addrs, port, timeout); err != nil {
+		return nil, err
+	}
+	return timed(desync(c, host), dialStart.Sub(start), dialStart), nil
+}
+
+// minDialAttempt is the minimum timeout of connecting to one address, long
+// enough for a retransmitted SYN.
+const minDialAttempt = 2 * time.Second
+
+// dialAddrs connects to addresses of host in order until one succeeds. Each
+// attempt except the last gets an equal share of the remaining time, so a
+// dead address, like an unreachable CDN edge, doesn't use up the timeout
+// and make the site look blocked while other addresses work.
+func dialAddrs(host string, addrs []string, port string, timeout time.Duration) (c net.Conn, err error) {
+	deadline := deadlineOf(timeout)
+	var failed []string
+	for i, addr := range addrs {
+		d := deadline
+		if n := len(addrs) - i; n > 1 {
+			d = attemptDeadline(deadline, n)
+		}
+		if c, err = directBind.dial(net.JoinHostPort(addr, port), d); err == nil {
+			if len(failed) > 0 {
+				debug.Printf("connected to %s at %s after %d failed addresses\n", host, addr, len(failed))
+				demoteAddrs(host, failed)
+			}
+			return c, nil
+		}
+		debug.Printf("dial %s at %s: %v\n", host, addr, err)
+		failed = append(failed, addr)
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			break
+		}
+	}
+	return nil, err
+}
+
+// attemptDeadline returns deadline of the next one of n attempts to connect
+// before deadline. Attempts without deadline use dialTimeout.
+func attemptDeadline(deadline time.Time, n int) time.Time {
+	now := time.Now()
+	if deadline.IsZero() {
+		return now.Add(dialTimeout)
+	}
+	share := deadline.Sub(now) / time.Duration(n)
+	if share < minDialAttempt {
+		share = minDialAttempt
+	}
+	if d := now.Add(share); d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// demoteAddrs moves addresses failed to connect to the end of the cached
+// entry of host, so following connections try working addresses first.
+func demoteAddrs(host string, failed []string) {
+	if !dnsCacheEnabled() {
+		return
+	}
+	dnsCache.Lock()
+	defer dnsCache.Unlock()
+	e, ok := dnsCache.entry[host]
+	if !ok {
+		return
+	}
+	bad := make(map[string]bool, len(failed))
+	for _, addr := range failed {
+		bad[addr] = true
+	}
+	// Don't modify addrs in place, they may be in use.
+	addrs := make([]string, 0, len(e.addrs))
+	for _, addr := range e.addrs {
+		if !bad[addr] {
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, addr := range e.addrs {
+		if bad[addr] {
+			addrs = append(addrs, addr)
+		}
+	}
+	e.addrs = addrs
+	dnsCache.entry[host] = e
+}
+
+// runDnsPrefetch refreshes DNS cache of frequently visited hosts before the
+// entry expires, and removes expired entries.
+func runDnsPrefetch() {
+	interval := config.DnsCacheTTL / 4
+	for {
+		now := time.Now()
+		for _, host := range siteStat.GetTopDirectHosts(config.DnsPrefetch) {
+			dnsCache.RLock()
+			e, ok := dnsCache.entry[host]
+			dnsCache.RUnlock()
+			// Refresh if the entry will expire before next run.
+			if ok && e.expire.After(now.Add(interval)) {
+				continue
+			}
+			if _, err := resolveAndCache(host); err != nil {
+				debug.Println("dns prefetch:", err)
+			}
+		}
+
+		dnsCache.Lock()
+		for host, e := range dnsCache.entry {
+			if now.After(e.expire) {
+				delete(dnsCache.entry, host)
+			}
+		}
+		dnsCache.Unlock()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,74 @@
+package cow
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAttemptDeadline(t *testing.T) {
+	now := time.Now()
+	deadline := now.Add(10 * time.Second)
+	if d := attemptDeadline(deadline, 2).Sub(now); d < 4*time.Second || d > 6*time.Second {
+		t.Errorf("2 attempts in 10s should get 5s, got %v", d)
+	}
+	if d := attemptDeadline(deadline, 10).Sub(now); d < minDialAttempt || d > minDialAttempt+time.Second {
+		t.Errorf("attempt should get at least %v, got %v", minDialAttempt, d)
+	}
+	short := now.Add(time.Second)
+	if d := attemptDeadline(short, 3); !d.Equal(short) {
+		t.Errorf("attempt should not exceed deadline, got %v", d.Sub(now))
+	}
+	if d := attemptDeadline(zeroTime, 2); d.IsZero() {
+		t.Error("attempt without deadline should use dialTimeout")
+	}
+}
+
+func TestDialAddrs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	savedPrefetch := config.DnsPrefetch
+	config.DnsPrefetch = 1
+	defer func() { config.DnsPrefetch = savedPrefetch }()
+	const host = "multi-ip.cow.test"
+	dnsCache.Lock()
+	dnsCache.entry[host] = dnsEntry{[]string{"127.0.0.2", "127.0.0.1", "127.0.0.3"}, time.Now().Add(time.Minute)}
+	dnsCache.Unlock()
+	defer func() {
+		dnsCache.Lock()
+		delete(dnsCache.entry, host)
+		dnsCache.Unlock()
+	}()
+
+	addrs, _ := lookupHost(host)
+	c, err := dialAddrs(host, addrs, port, 5*time.Second)
+	if err != nil {
+		t.Fatal("should connect to the second address:", err)
+	}
+	if ra := c.RemoteAddr().(*net.TCPAddr); !ra.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Error("connected to wrong address", ra)
+	}
+	c.Close()
+	if addrs, _ = lookupHost(host); !reflect.DeepEqual(addrs, []string{"127.0.0.1", "127.0.0.3", "127.0.0.2"}) {
+		t.Error("failed address should be moved to the end, got", addrs)
+	}
+
+	if _, err = dialAddrs(host, []string{"127.0.0.2", "127.0.0.3"}, port, 5*time.Second); err == nil {
+		t.Error("should fail if no address works")
+	}
+}
@@ -0,0 +1,265 @@
+package cow
+
+// Cross-check DNS answers for suspicious domains.
+//
+// DNS poisoning returns bogus addresses, direct connection to them may
+// succeed or time out slowly. If dnsCheckResolver lists two (or more)
+// resolvers, cow queries all of them for hosts not yet known as direct, and
+// compares the answers against the dnsPoisonIP list. If any answer is in the
+// list, the host is taken as blocked immediately and parent proxy is used.
+// Answers from all resolvers are logged for diagnostics.
+//
+// Results are cached for dnsCacheTTL.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dnsCheckTimeout = 2 * time.Second
+
+type dnsCheckEntry struct {
+	poisoned bool
+	expire   time.Time
+}
+
+var dnsCheck = struct {
+	sync.Mutex
+	entry map[string]dnsCheckEntry
+}{entry: make(map[string]dnsCheckEntry)}
+
+func dnsCheckEnabled() bool {
+	return len(config.DnsCheckResolver) >= 2
+}
+
+// parseIPNet parses IP address or CIDR.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		return ipnet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func isPoisonIP(ip net.IP) bool {
+	for _, ipnet := range config.DnsPoisonIP {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsCheckNeeded returns true if the site is not specified by user and not
+// known as direct yet.
+func dnsCheckNeeded(vc *VisitCnt) bool {
+	return !vc.userSpecified() && vc.Direct < directDelta
+}
+
+// dnsPoisoned queries all check resolvers for host, returns true if any
+// answer is in the poison IP list.
+func dnsPoisoned(host string) bool {
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	dnsCheck.Lock()
+	e, ok := dnsCheck.entry[host]
+	dnsCheck.Unlock()
+	if ok && time.Now().Before(e.expire) {
+		return e.poisoned
+	}
+
+	answers := make([][]net.IP, len(config.DnsCheckResolver))
+	errs := make([]error, len(config.DnsCheckResolver))
+	var wg sync.WaitGroup
+	for i, server := range config.DnsCheckResolver {
+		wg.Add(1)
+		go func(i int, server string) {
+			answers[i], errs[i] = queryA(server, host, dnsCheckTimeout)
+			wg.Done()
+		}(i, server)
+	}
+	wg.Wait()
+
+	poisoned := false
+	for _, ips := range answers {
+		for _, ip := range ips {
+			if isPoisonIP(ip) {
+				poisoned = true
+			}
+		}
+	}
+	if poisoned || !sameIPSet(answers) {
+		var desc []string
+		for i, server := range config.DnsCheckResolver {
+			if errs[i] != nil {
+				desc = append(desc, fmt.Sprintf("%s: %v", server, errs[i]))
+			} else {
+				desc = append(desc, fmt.Sprintf("%s: %v", server, answers[i]))
+			}
+		}
+		if poisoned {
+			errl.Printf("dns check %s poisoned, %s\n", host, strings.Join(desc, ", "))
+		} else {
+			debug.Printf("dns check %s answers differ, %s\n", host, strings.Join(desc, ", "))
+		}
+	}
+
+	dnsCheck.Lock()
+	dnsCheck.entry[host] = dnsCheckEntry{poisoned, time.Now().Add(config.DnsCacheTTL)}
+	dnsCheck.Unlock()
+	return poisoned
+}
+
+// sameIPSet returns true if all answers share at least one address, CDN may
+// return different addresses to different resolvers. Failed queries are
+// ignored.
+func sameIPSet(answers [][]net.IP) bool {
+	var first []net.IP
+	for _, ips := range answers {
+		if len(ips) == 0 {
+			continue
+		}
+		if first == nil {
+			first = ips
+			continue
+		}
+		common := false
+		for _, a := range first {
+			for _, b := range ips {
+				if a.Equal(b) {
+					common = true
+				}
+			}
+		}
+		if !common {
+			return false
+		}
+	}
+	return true
+}
+
+// queryA sends DNS query for A records of host to server over UDP.
+func queryA(server, host string, timeout time.Duration) ([]net.IP, error) {
+	c, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+
+	id := uint16(rand.Intn(1 << 16))
+	query, err := buildDNSQuery(id, host)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore reply with wrong ID, though injected reply usually comes
+		// with the right one.
+		if n >= 2 && binary.BigEndian.Uint16(buf) != id {
+			continue
+		}
+		return parseDNSReply(buf[:n])
+	}
+}
+
+const (
+	dnsTypeA   = 1
+	dnsClassIN = 1
+)
+
+func buildDNSQuery(id uint16, host string) ([]byte, error) {
+	b := make([]byte, 12, 12+len(host)+6)
+	binary.BigEndian.PutUint16(b, id)
+	b[2] = 1                             // recursion desired
+	binary.BigEndian.PutUint16(b[4:], 1) // question count
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.New("invalid domain name " + host)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0, 0, dnsTypeA, 0, dnsClassIN)
+	return b, nil
+}
+
+var errDNSReply = errors.New("malformed DNS reply")
+
+// skipDNSName returns offset after the (possibly compressed) name at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSReply
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xC0 == 0xC0:
+			return off + 2, nil
+		}
+		off += 1 + n
+	}
+}
+
+func parseDNSReply(msg []byte) ([]net.IP, error) {
+	if len(msg) < 12 {
+		return nil, errDNSReply
+	}
+	if rcode := msg[3] & 0xF; rcode != 0 {
+		return nil, fmt.Errorf("DNS reply rcode %d", rcode)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	var err error
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4 // type, class
+	}
+	var ips []net.IP
+	for i := 0; i < ancount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		// type(2) class(2) ttl(4) rdlength(2)
+		if off+10 > len(msg) {
+			return nil, errDNSReply
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, errDNSReply
+		}
+		if typ == dnsTypeA && rdlen == net.IPv4len {
+			ips = append(ips, net.IP(append([]byte{}, msg[off:off+rdlen]...)))
+		}
+		off += rdlen
+	}
+	return ips, nil
+}
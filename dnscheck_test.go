@@ -0,0 +1,73 @@
+package cow
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeDNSServer replies all A queries with ip.
+func fakeDNSServer(t *testing.T, ip string) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			reply := append([]byte{}, buf[:n]...)
+			reply[2] |= 0x80                         // response
+			binary.BigEndian.PutUint16(reply[6:], 1) // answer count
+			// Name is pointer to question.
+			reply = append(reply, 0xC0, 12, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0, 60, 0, 4)
+			reply = append(reply, net.ParseIP(ip).To4()...)
+			c.WriteTo(reply, addr)
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+func TestQueryA(t *testing.T) {
+	server := fakeDNSServer(t, "1.2.3.4")
+	ips, err := queryA(server, "www.example.com", time.Second)
+	if err != nil {
+		t.Fatal("query error:", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("1.2.3.4")) {
+		t.Error("answer should be 1.2.3.4, got", ips)
+	}
+	if _, err := buildDNSQuery(1, "www..com"); err == nil {
+		t.Error("empty label should fail")
+	}
+	if _, err := parseDNSReply([]byte{0, 1, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0, 3}); err == nil {
+		t.Error("truncated reply should fail")
+	}
+}
+
+func TestDnsPoisoned(t *testing.T) {
+	savedResolver, savedPoison, savedTTL := config.DnsCheckResolver, config.DnsPoisonIP, config.DnsCacheTTL
+	defer func() {
+		config.DnsCheckResolver, config.DnsPoisonIP, config.DnsCacheTTL = savedResolver, savedPoison, savedTTL
+	}()
+	config.DnsCacheTTL = time.Minute
+	ipnet, _ := parseIPNet("8.7.198.0/24")
+	config.DnsPoisonIP = []*net.IPNet{ipnet}
+	config.DnsCheckResolver = []string{fakeDNSServer(t, "1.2.3.4"), fakeDNSServer(t, "1.2.3.4")}
+	if dnsPoisoned("good.example.com") {
+		t.Error("good.example.com should not be poisoned")
+	}
+	config.DnsCheckResolver[1] = fakeDNSServer(t, "8.7.198.46")
+	if !dnsPoisoned("bad.example.com") {
+		t.Error("bad.example.com should be poisoned")
+	}
+	// Result is cached.
+	config.DnsCheckResolver[1] = config.DnsCheckResolver[0]
+	if !dnsPoisoned("bad.example.com") {
+		t.Error("bad.example.com poisoned result should be cached")
+	}
+}
@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: GPL-2.0
+//
+// eBPF programs to redirect TCP connections of processes in a cgroup to COW's
+// ebpf listen address (listen = ebpf://127.0.0.1:7778 /sys/fs/bpf/cow/cow_orig_dst).
+//
+// cow_connect4 rewrites the destination and saves the original one keyed by
+// socket cookie. When the connection is established, the client port is
+// known, cow_sockops moves the original destination to cow_orig_dst keyed by
+// client port, which is looked up by COW.
+//
+// Build and load (cgroup v2, COW itself must not be in the cgroup):
+//
+//   clang -O2 -g -target bpf -c cow_redirect.c -o cow_redirect.o
+//   bpftool prog loadall cow_redirect.o /sys/fs/bpf/cow pinmaps /sys/fs/bpf/cow
+//   bpftool cgroup attach /sys/fs/cgroup/proxied connect4 pinned /sys/fs/bpf/cow/cow_connect4
+//   bpftool cgroup attach /sys/fs/cgroup/proxied sock_ops pinned /sys/fs/bpf/cow/cow_sockops
+//   bpftool cgroup attach /sys/fs/cgroup/proxied sendmsg4 pinned /sys/fs/bpf/cow/cow_sendmsg4
+//   echo $PID > /sys/fs/cgroup/proxied/cgroup.procs
+//
+// Change COW_PORT if COW listens on other port.
+//
+// COW can't relay UDP. With blockQUIC in COW's config, UDP to port 443 is
+// rejected so browsers fall back to HTTP over TCP instead of bypassing COW
+// with QUIC. COW sets the flag in cow_config, which must be pinned in the
+// same directory as cow_orig_dst.
+
+#include <linux/bpf.h>
+#include <linux/in.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_endian.h>
+
+#define COW_IP   0x7f000001 /* 127.0.0.1 */
+#define COW_PORT 7778
+
+struct orig_dst {
+	__u32 ip;   /* network byte order */
+	__u16 port; /* network byte order */
+	__u16 pad;
+};
+
+#define COW_BLOCK_QUIC 1
+
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, __u32); /* COW_* flags, set by COW */
+} cow_config SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);
+	__uint(max_entries, 65536);
+	__type(key, __u64); /* socket cookie */
+	__type(value, struct orig_dst);
+} cow_sock_dst SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);
+	__uint(max_entries, 65536);
+	__type(key, __u16); /* client port, host byte order */
+	__type(value, struct orig_dst);
+} cow_orig_dst SEC(".maps");
+
+/* Returns 0 if UDP to port 443 should be rejected. */
+static __always_inline int check_quic(struct bpf_sock_addr *ctx)
+{
+	__u32 key = 0;
+	__u32 *flags;
+
+	if (bpf_ntohl(ctx->user_port) >> 16 != 443)
+		return 1;
+	flags = bpf_map_lookup_elem(&cow_config, &key);
+	if (flags && (*flags & COW_BLOCK_QUIC))
+		return 0;
+	return 1;
+}
+
+SEC("cgroup/connect4")
+int cow_connect4(struct bpf_sock_addr *ctx)
+{
+	struct orig_dst dst = {};
+	__u64 cookie;
+
+	if (ctx->protocol == IPPROTO_UDP)
+		return check_quic(ctx);
+	if (ctx->protocol != IPPROTO_TCP)
+		return 1;
+	/* Leave loopback connections alone. */
+	if ((bpf_ntohl(ctx->user_ip4) >> 24) == 127)
+		return 1;
+
+	dst.ip = ctx->user_ip4;
+	dst.port = bpf_htons(bpf_ntohl(ctx->user_port) >> 16);
+	cookie = bpf_get_socket_cookie(ctx);
+	bpf_map_update_elem(&cow_sock_dst, &cookie, &dst, BPF_ANY);
+
+	ctx->user_ip4 = bpf_htonl(COW_IP);
+	ctx->user_port = bpf_htonl(COW_PORT << 16);
+	return 1;
+}
+
+/* For unconnected UDP sockets. */
+SEC("cgroup/sendmsg4")
+int cow_sendmsg4(struct bpf_sock_addr *ctx)
+{
+	return check_quic(ctx);
+}
+
+SEC("sockops")
+int cow_sockops(struct bpf_sock_ops *skops)
+{
+	struct orig_dst *dst;
+	__u64 cookie;
+	__u16 port;
+
+	if (skops->op != BPF_SOCK_OPS_TCP_CONNECT_CB &&
+	    skops->op != BPF_SOCK_OPS_ACTIVE_ESTABLISHED_CB)
+		return 1;
+	cookie = bpf_get_socket_cookie(skops);
+	dst = bpf_map_lookup_elem(&cow_sock_dst, &cookie);
+	if (!dst)
+		return 1;
+	port = skops->local_port; /* host byte order */
+	bpf_map_update_elem(&cow_orig_dst, &port, dst, BPF_ANY);
+	bpf_map_delete_elem(&cow_sock_dst, &cookie);
+	return 1;
+}
+
+char _license[] SEC("license") = "GPL";
@@ -0,0 +1,151 @@
+package cow
+
+// Dump the effective rule set.
+//
+// `cow -dump-rules` prints rules used to route requests with the source of
+// each entry, one rule per line as "pattern route source", in the order they
+// are checked:
+//
+//  1. rule providers, the first matching provider wins
+//  2. site lists, user lists override builtin ones
+//  3. sites learned in the stat file
+//
+// Pattern is a host, "+.domain" for a domain and its sub domains, ".domain"
+// for sub domains only, "keyword:word" or an IP CIDR. Route is direct or
+// proxy. For learned sites, direct means trying direct connection first.
+//
+// Helper program, request rules and parent PAC decide for each request and
+// are only listed in comments. Stat is read from the stat file, sites learned
+// by the running cow since the last save are not included.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+func routeTypeName(rt routeType) string {
+	switch rt {
+	case routeDirect:
+		return "direct"
+	case routeProxy:
+		return "proxy"
+	}
+	return "default"
+}
+
+// entries returns patterns of all rules in the rule set, sorted in each
+// type.
+func (rs *ruleSet) entries() []string {
+	var all []string
+	add := func(m map[string]bool, prefix string) {
+		var lst []string
+		for d := range m {
+			lst = append(lst, prefix+d)
+		}
+		sort.Strings(lst)
+		all = append(all, lst...)
+	}
+	add(rs.host, "")
+	add(rs.suffix, "+.")
+	add(rs.subdomain, ".")
+	for _, k := range rs.keyword {
+		all = append(all, "keyword:"+k)
+	}
+	for _, n := range rs.ipNet {
+		all = append(all, n.String())
+	}
+	return all
+}
+
+func dumpRuleProviders(w io.Writer) {
+	for i, rp := range ruleProviders {
+		var content []byte
+		var err error
+		if rp.isURL() {
+			// Don't download, use the saved copy like cow at start up.
+			content, err = ioutil.ReadFile(rp.cacheFile())
+		} else {
+			content, err = rp.fetch()
+		}
+		if err != nil {
+			fmt.Fprintf(w, "# rule provider %s not loaded: %v\n", rp.source, err)
+			continue
+		}
+		source := fmt.Sprintf("provider#%d(%s)", i+1, rp.source)
+		for _, e := range parseRuleSet(content, rp.behavior).entries() {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", e, routeTypeName(rp.route), source)
+		}
+	}
+}
+
+func listSet(fpath string) map[string]bool {
+	set := make(map[string]bool)
+	lst, _ := loadSiteList(fpath)
+	for _, s := range lst {
+		set[s] = true
+	}
+	return set
+}
+
+func dumpSiteStat(w io.Writer, ss *SiteStat) {
+	userDirect := listSet(config.DirectFile)
+	userBlocked := listSet(config.BlockedFile)
+
+	var listLines, statLines []string
+	for site, vc := range ss.Vcnt {
+		route := "direct"
+		if vc.AlwaysBlocked() || (!vc.AlwaysDirect() && vc.Blocked-vc.Direct >= blockedDelta) {
+			route = "proxy"
+		}
+		if !vc.userSpecified() {
+			statLines = append(statLines, fmt.Sprintf("%s\t%s\tstat(direct %d, blocked %d)",
+				site, route, vc.Direct, vc.Blocked))
+			continue
+		}
+		source := "builtin"
+		if vc.AlwaysDirect() && userDirect[site] {
+			source = config.DirectFile
+		} else if vc.AlwaysBlocked() && userBlocked[site] {
+			source = config.BlockedFile
+		}
+		pattern := site
+		if host2Domain(site) == site {
+			// Domain in site list also matches its sub domains.
+			pattern = "+." + site
+		}
+		listLines = append(listLines, fmt.Sprintf("%s\t%s\t%s", pattern, route, source))
+	}
+	sort.Strings(listLines)
+	sort.Strings(statLines)
+	for _, l := range listLines {
+		fmt.Fprintln(w, l)
+	}
+	for _, l := range statLines {
+		fmt.Fprintln(w, l)
+	}
+}
+
+func dumpRules(w io.Writer) {
+	if parentProxy.empty() {
+		fmt.Fprintln(w, "# no parent proxy, all sites are connected directly")
+	} else if config.AlwaysProxy {
+		fmt.Fprintln(w, "# alwaysProxy is true, all sites use parent proxy")
+	}
+	if config.HelperProgram != "" {
+		fmt.Fprintln(w, "# helper program decides before rules below:", config.HelperProgram)
+	}
+	for _, rr := range requestRules {
+		fmt.Fprintln(w, "# request rule decides before rules below:", rr.source)
+	}
+	if parentPAC != nil {
+		fmt.Fprintln(w, "# parent PAC decides before site lists and stat:", parentPAC.source)
+	}
+	dumpRuleProviders(w)
+
+	// Errors are logged by load.
+	ss := newSiteStat()
+	ss.load(config.StatFile)
+	dumpSiteStat(w, ss)
+}
@@ -0,0 +1,237 @@
+package cow
+
+// Transparent interception with eBPF (Linux only).
+//
+// A cgroup/connect4 eBPF program attached to the cgroup of selected processes
+// rewrites the destination of their TCP connections to cow's ebpf listen
+// address, and saves the original destination. As the client port is not
+// known at connect time, a sockops program moves the saved destination into
+// a map keyed by client port once the connection is established. Refer to
+// doc/ebpf/cow_redirect.c for the programs, which should be loaded and
+// attached with bpftool.
+//
+// cow opens the pinned map, looks up the original destination of each
+// accepted connection by its source port, and tunnels the connection like
+// CONNECT requests.
+//
+// Map key is client port (__u16, host byte order). Value is struct
+// orig_dst { __u32 ip; __u16 port; __u16 pad; } with ip and port in network
+// byte order.
+//
+// UDP is not relayed. Flags in the cow_config map pinned in the same
+// directory tell the eBPF programs to reject UDP to port 443 (blockQUIC), so
+// QUIC doesn't bypass cow.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// bpf syscall number is not defined in syscall package.
+var sysBpf = map[string]uintptr{
+	"386":     357,
+	"amd64":   321,
+	"arm":     386,
+	"arm64":   280,
+	"ppc64":   361,
+	"ppc64le": 361,
+}
+
+const (
+	bpfMapLookupElem = 1
+	bpfMapUpdateElem = 2
+	bpfMapDeleteElem = 3
+	bpfObjGet        = 7
+)
+
+// bpf runs bpf command. Objects whose addresses are in attr must be pinned
+// by caller, attr itself is kept in place by converting it in the syscall
+// arguments.
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	nr, ok := sysBpf[runtime.GOARCH]
+	if !ok {
+		return 0, errors.New("bpf syscall not supported on " + runtime.GOARCH)
+	}
+	r, _, errno := syscall.Syscall(nr, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+func bpfObjGetPinned(path string) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	pin.Pin(p)
+	attr := struct {
+		pathname  uint64
+		bpfFd     uint32
+		fileFlags uint32
+	}{pathname: uint64(uintptr(unsafe.Pointer(p)))}
+	fd, err := bpf(bpfObjGet, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return int(fd), err
+}
+
+type bpfMapElemAttr struct {
+	mapFd uint32
+	pad   uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+// bpfMapElem runs map command on key and value, value is nil for delete.
+// They are pinned while kernel accesses them by addresses in attr.
+func bpfMapElem(cmd, fd int, key, value unsafe.Pointer) error {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	attr := bpfMapElemAttr{mapFd: uint32(fd)}
+	pin.Pin(key)
+	attr.key = uint64(uintptr(key))
+	if value != nil {
+		pin.Pin(value)
+		attr.value = uint64(uintptr(value))
+	}
+	_, err := bpf(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+const (
+	ebpfConfigMapName = "cow_config"
+	ebpfBlockQUIC     = 1
+)
+
+// setEbpfConfig writes flags into the cow_config map in dir.
+func setEbpfConfig(dir string) error {
+	fpath := path.Join(dir, ebpfConfigMapName)
+	if _, err := os.Stat(fpath); os.IsNotExist(err) && !config.BlockQUIC {
+		return nil
+	}
+	fd, err := bpfObjGetPinned(fpath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var key, flags uint32
+	if config.BlockQUIC {
+		flags |= ebpfBlockQUIC
+	}
+	return bpfMapElem(bpfMapUpdateElem, fd, unsafe.Pointer(&key), unsafe.Pointer(&flags))
+}
+
+type origDst struct {
+	ip   [4]byte
+	port [2]byte
+	pad  uint16
+}
+
+type ebpfProxy struct {
+	addr    string
+	mapPath string
+	mapFd   int
+	ln      net.Listener
+	mapLock sync.Mutex // serialize lookup and delete of the same key
+}
+
+func newEbpfProxy(addr, mapPath string) Proxy {
+	return &ebpfProxy{addr: addr, mapPath: mapPath, mapFd: -1}
+}
+
+func (ep *ebpfProxy) genConfig() string {
+	return fmt.Sprintf("listen = ebpf://%s %s", ep.addr, ep.mapPath)
+}
+
+func (ep *ebpfProxy) Addr() string {
+	return ep.addr
+}
+
+func (ep *ebpfProxy) listen() (err error) {
+	if ep.mapFd, err = bpfObjGetPinned(ep.mapPath); err != nil {
+		fmt.Printf("open bpf map %s failed: %v\n", ep.mapPath, err)
+		return
+	}
+	if err = setEbpfConfig(path.Dir(ep.mapPath)); err != nil {
+		fmt.Printf("set bpf map %s failed: %v\n", ebpfConfigMapName, err)
+		return
+	}
+	if ep.ln, err = net.Listen("tcp", ep.addr); err != nil {
+		fmt.Println("listen ebpf failed:", err)
+	}
+	return
+}
+
+// origDst returns the original destination of a redirected connection and
+// removes it from the map.
+func (ep *ebpfProxy) origDst(conn net.Conn) (string, error) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return "", errors.New("not tcp connection")
+	}
+	key := uint16(addr.Port)
+	var val origDst
+	ep.mapLock.Lock()
+	err := bpfMapElem(bpfMapLookupElem, ep.mapFd, unsafe.Pointer(&key), unsafe.Pointer(&val))
+	if err == nil {
+		bpfMapElem(bpfMapDeleteElem, ep.mapFd, unsafe.Pointer(&key), nil)
+	}
+	ep.mapLock.Unlock()
+	if err != nil {
+		return "", fmt.Errorf("no original destination for port %d: %v", key, err)
+	}
+	ip := net.IP(val.ip[:])
+	port := int(val.port[0])<<8 | int(val.port[1])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
+
+func (ep *ebpfProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer func() {
+		wg.Done()
+	}()
+	ln := ep.ln
+	if ln == nil {
+		return
+	}
+	info.Printf("COW %s ebpf transparent proxy address %s\n", version, ep.addr)
+	var exit bool
+	go func() {
+		<-quit
+		exit = true
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil && !exit {
+			errl.Printf("ebpf proxy(%s) accept %v\n", ln.Addr(), err)
+			if isErrTooManyOpenFd(err) {
+				connPool.CloseAll()
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if exit {
+			debug.Println("exiting ebpf listener")
+			break
+		}
+		dst, err := ep.origDst(conn)
+		if err != nil {
+			errl.Printf("ebpf proxy cli(%s) %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		c := newClientConn(conn, ep)
+		go c.serveTransparent(dst)
+	}
+}
@@ -0,0 +1,8 @@
+// +build !linux
+
+package cow
+
+func newEbpfProxy(addr, mapPath string) Proxy {
+	Fatal("listen = ebpf:// is only supported on Linux")
+	return nil
+}
@@ -1,4 +1,4 @@
-package main
+package cow
 
 import (
 	"bytes"
@@ -13,7 +13,7 @@ var headRawTmpl = "HTTP/1.1 {{.CodeReason}}\r\n" +
 	"Connection: keep-alive\r\n" +
 	"Cache-Control: no-cache\r\n" +
 	"Pragma: no-cache\r\n" +
-	"Content-Type: text/html\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
 	"Content-Length: {{.Length}}\r\n"
 
 var errPageTmpl, headTmpl *template.Template
@@ -31,8 +31,8 @@ func init() {
 		<h1>{{.H1}}</h1>
 		{{.Msg}}
 		<hr />
-		Generated by <i>COW ` + version + `</i> <br />
-		Host <i>` + hostName + `</i> <br />
+		{{.GeneratedBy}} <i>COW ` + version + `</i> <br />
+		{{.Host}} <i>` + hostName + `</i> <br />
 		{{.T}}
 	</body>
 </html>
@@ -45,15 +45,19 @@ func init() {
 	}
 }
 
-func genErrorPage(h1, msg string) (string, error) {
+func genErrorPage(l *locale, h1, msg string) (string, error) {
 	var err error
 	data := struct {
-		H1  string
-		Msg string
-		T   string
+		H1          string
+		Msg         string
+		GeneratedBy string
+		Host        string
+		T           string
 	}{
 		h1,
 		msg,
+		l.tr("Generated by"),
+		l.tr("Host"),
 		time.Now().Format(time.ANSIC),
 	}
 
@@ -62,13 +66,29 @@ func genErrorPage(h1, msg string) (string, error) {
 	return buf.String(), err
 }
 
+// writerLocale returns the locale of the client if w is a client connection.
+func writerLocale(w io.Writer) *locale {
+	if c, ok := w.(*clientConn); ok && c.locale != nil {
+		return c.locale
+	}
+	return locales.def
+}
+
+// h1 and msg are translated if they are messages in the locale. Messages
+// generated by genErrMsg are already translated.
 func sendPageGeneric(w io.Writer, codeReason, h1, msg string) {
-	page, err := genErrorPage(h1, msg)
+	l := writerLocale(w)
+	page, err := genErrorPage(l, l.tr(h1), l.tr(msg))
 	if err != nil {
 		errl.Println("Error generating error page:", err)
 		return
 	}
+	sendPage(w, codeReason, "", page)
+}
 
+// sendPage sends html page with extra header lines, which should end with
+// "\r\n".
+func sendPage(w io.Writer, codeReason, header, page string) {
 	data := struct {
 		CodeReason string
 		Length     int
@@ -82,11 +102,13 @@ func sendPageGeneric(w io.Writer, codeReason, h1, msg string) {
 		return
 	}
 
+	buf.WriteString(header)
 	buf.WriteString("\r\n")
 	buf.WriteString(page)
 	w.Write(buf.Bytes())
 }
 
 func sendErrorPage(w io.Writer, codeReason, h1, msg string) {
-	sendPageGeneric(w, codeReason, "[Error] "+h1, msg)
+	l := writerLocale(w)
+	sendPageGeneric(w, codeReason, "["+l.tr("Error")+"] "+l.tr(h1), msg)
 }
@@ -0,0 +1,99 @@
+package cow
+
+// Export rules to other clients.
+//
+// Sites in blocked/direct lists and sites learned in site stat are exported
+// as rule lists in Clash or Surge format, one list for each route:
+//
+//   clash-proxy, clash-direct    Clash rule provider YAML, classical behavior
+//   surge-proxy, surge-direct    Surge rule list for RULE-SET
+//
+// The http listener serves rule lists generated from the running cow at
+// /rules/<name>, e.g. http://127.0.0.1:7777/rules/clash-proxy, which can be
+// used as rule provider URL on other devices. `cow -export-rules <name>`
+// prints rule list generated from the stat file.
+//
+// Like PAC, direct list contains sites tried directly first, proxy list
+// contains sites which use parent proxy. Rule providers and other rules
+// deciding on each request are not exported.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+const rulesPathPrefix = "/rules/"
+
+// routedSites returns sites using parent proxy and sites connected directly.
+func (ss *SiteStat) routedSites() (proxy, direct []string) {
+	ss.vcLock.RLock()
+	for site, vc := range ss.Vcnt {
+		if vc.AlwaysBlocked() || (!vc.AlwaysDirect() && vc.Blocked-vc.Direct >= blockedDelta) {
+			proxy = append(proxy, site)
+		} else if vc.AsDirect() && !ss.hasBlockedHost[host2Domain(site)] {
+			direct = append(direct, site)
+		}
+	}
+	ss.vcLock.RUnlock()
+	sort.Strings(proxy)
+	sort.Strings(direct)
+	return
+}
+
+// siteRule converts site to classical rule.
+func siteRule(site string) string {
+	if ip := net.ParseIP(site); ip != nil {
+		if ip.To4() != nil {
+			return "IP-CIDR," + site + "/32"
+		}
+		return "IP-CIDR6," + site + "/128"
+	}
+	if host2Domain(site) == site {
+		// Domain also matches its sub domains.
+		return "DOMAIN-SUFFIX," + site
+	}
+	return "DOMAIN," + site
+}
+
+// exportRules writes rule list name generated from ss.
+func exportRules(w io.Writer, ss *SiteStat, name string) error {
+	f := strings.Split(name, "-")
+	if len(f) != 2 || (f[0] != "clash" && f[0] != "surge") || (f[1] != "proxy" && f[1] != "direct") {
+		return errors.New("unknown rule list " + name +
+			", should be clash-proxy, clash-direct, surge-proxy or surge-direct")
+	}
+	proxy, direct := ss.routedSites()
+	sites := proxy
+	if f[1] == "direct" {
+		sites = direct
+	}
+	fmt.Fprintf(w, "# %s sites exported by COW, %d rules\n", f[1], len(sites))
+	prefix := ""
+	if f[0] == "clash" {
+		io.WriteString(w, "payload:\n")
+		prefix = "  - "
+	}
+	for _, s := range sites {
+		io.WriteString(w, prefix+siteRule(s)+"\n")
+	}
+	return nil
+}
+
+func sendRules(c *clientConn, r *Request) {
+	var body bytes.Buffer
+	if err := exportRules(&body, siteStat, r.URL.Path[len(rulesPathPrefix):]); err != nil {
+		sendErrorPage(c, "404 not found", "Rule list not found", err.Error())
+		return
+	}
+	header := fmt.Sprintf("HTTP/1.1 200 OK\r\nServer: cow-proxy\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n",
+		body.Len())
+	if _, err := c.Write(append([]byte(header), body.Bytes()...)); err != nil {
+		debug.Printf("cli(%s) error sending rules: %v\n", c.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,38 @@
+package cow
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExportRules(t *testing.T) {
+	ss := newSiteStat()
+	ss.Vcnt["google.com"] = newVisitCnt(0, userCnt)
+	ss.Vcnt["www.example.com"] = newVisitCnt(0, blockedDelta+1)
+	ss.Vcnt["baidu.com"] = newVisitCnt(userCnt, 0)
+	ss.Vcnt["1.2.3.4"] = newVisitCnt(3, 0)
+	ss.Vcnt["2001:db8::1"] = newVisitCnt(3, 0)
+	ss.Vcnt["undecided.com"] = newVisitCnt(1, 1)
+
+	testData := []struct {
+		name     string
+		expected string
+	}{
+		{"clash-proxy", "# proxy sites exported by COW, 2 rules\npayload:\n" +
+			"  - DOMAIN-SUFFIX,google.com\n  - DOMAIN,www.example.com\n"},
+		{"surge-direct", "# direct sites exported by COW, 3 rules\n" +
+			"IP-CIDR,1.2.3.4/32\nIP-CIDR6,2001:db8::1/128\nDOMAIN-SUFFIX,baidu.com\n"},
+	}
+	for _, td := range testData {
+		var b bytes.Buffer
+		if err := exportRules(&b, ss, td.name); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != td.expected {
+			t.Errorf("%s should be:\n%s\ngot:\n%s", td.name, td.expected, b.String())
+		}
+	}
+	if err := exportRules(&bytes.Buffer{}, ss, "clash"); err == nil {
+		t.Error("unknown rule list should return error")
+	}
+}
@@ -0,0 +1,294 @@
+package cow
+
+// Fake IP DNS server for transparent proxying.
+//
+//   fakeDNS = 192.168.1.1:53 114.114.114.114:53 198.18.0.0/15
+//
+// cow answers A queries on the listen address with addresses allocated from
+// the pool (198.18.0.0/15 by default), and remembers the host of each fake
+// address. Connections to fake addresses redirected to cow (listen =
+// redir:// or ebpf://) are tunneled to the original host name, so cow routes
+// them by domain and the parent proxy resolves the name, like CONNECT
+// requests from browsers.
+//
+// Hosts known to be accessible directly (the direct list in PAC) and simple
+// host names get real answers, other queries are forwarded to the upstream
+// resolver unchanged. AAAA queries of fake hosts get empty answers so
+// clients use IPv4.
+//
+// Fake addresses are allocated in order and reused from the oldest when the
+// pool is exhausted. Mappings are not saved, fake answers have a short TTL
+// so clients don't use stale addresses after restart.
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFakeIPPool = "198.18.0.0/15"
+	fakeDNSTTL        = 10 // seconds
+	dnsTypeAAAA       = 28
+)
+
+type fakeIPPool struct {
+	sync.Mutex
+	base uint32 // first address
+	size uint32
+	next uint32            // offset of next allocation
+	host map[uint32]string // offset -> host
+	off  map[string]uint32 // host -> offset
+}
+
+func newFakeIPPool(cidr string) (*fakeIPPool, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := n.Mask.Size()
+	if bits != 32 || ones > 30 || ones < 8 {
+		return nil, errors.New("fake IP pool should be IPv4 network with prefix length 8 to 30")
+	}
+	return &fakeIPPool{
+		// Skip network and broadcast address.
+		base: binary.BigEndian.Uint32(n.IP.To4()) + 1,
+		size: 1<<uint(32-ones) - 2,
+		host: make(map[uint32]string),
+		off:  make(map[string]uint32),
+	}, nil
+}
+
+func (p *fakeIPPool) ip(off uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, p.base+off)
+	return ip
+}
+
+// alloc returns fake address of host, allocating one if not exists.
+func (p *fakeIPPool) alloc(host string) net.IP {
+	p.Lock()
+	defer p.Unlock()
+	if off, ok := p.off[host]; ok {
+		return p.ip(off)
+	}
+	off := p.next
+	p.next = (p.next + 1) % p.size
+	if old, ok := p.host[off]; ok {
+		delete(p.off, old)
+	}
+	p.host[off] = host
+	p.off[host] = off
+	return p.ip(off)
+}
+
+// lookup returns host of fake address ip.
+func (p *fakeIPPool) lookup(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return "", false
+	}
+	off := binary.BigEndian.Uint32(ip4) - p.base
+	if off >= p.size {
+		return "", false
+	}
+	p.Lock()
+	host, ok := p.host[off]
+	p.Unlock()
+	return host, ok
+}
+
+type fakeIPDNS struct {
+	addr     string
+	upstream string
+	pool     *fakeIPPool
+	conn     net.PacketConn
+}
+
+var fakeDNS *fakeIPDNS
+
+func parseFakeDNS(val string) (*fakeIPDNS, error) {
+	f := strings.Fields(val)
+	if len(f) != 2 && len(f) != 3 {
+		return nil, errors.New("should be listen address, upstream resolver and optional pool")
+	}
+	for _, addr := range f[:2] {
+		if err := checkServerAddr(addr); err != nil {
+			return nil, err
+		}
+	}
+	cidr := defaultFakeIPPool
+	if len(f) == 3 {
+		cidr = f[2]
+	}
+	pool, err := newFakeIPPool(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeIPDNS{addr: f[0], upstream: f[1], pool: pool}, nil
+}
+
+// fakeHostPort converts destination hostPort with fake address to host name.
+func fakeHostPort(hostPort string) string {
+	if fakeDNS == nil {
+		return hostPort
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return hostPort
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if name, ok := fakeDNS.pool.lookup(ip); ok {
+			return net.JoinHostPort(name, port)
+		}
+	}
+	return hostPort
+}
+
+// knownDirect returns true if host is in the direct list of PAC.
+func (ss *SiteStat) knownDirect(host string) bool {
+	domain := host2Domain(host)
+	if domain == "" || parentProxy.empty() {
+		return true
+	}
+	ss.vcLock.RLock()
+	blocked := ss.hasBlockedHost[domain]
+	ss.vcLock.RUnlock()
+	if blocked {
+		return false
+	}
+	vc := ss.get(host)
+	if vc == nil {
+		if vc = ss.get(domain); vc == nil || !vc.userSpecified() {
+			return false
+		}
+	}
+	return vc.AsDirect()
+}
+
+// parseDNSQuestion returns lower case name and type of the first question,
+// and offset after the question.
+func parseDNSQuestion(msg []byte) (name string, qtype uint16, end int, err error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:]) == 0 {
+		return "", 0, 0, errDNSReply
+	}
+	var labels []string
+	off := 12
+	for {
+		if off >= len(msg) {
+			return "", 0, 0, errDNSReply
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n > 63 || off+n > len(msg) {
+			return "", 0, 0, errDNSReply
+		}
+		labels = append(labels, string(msg[off:off+n]))
+		off += n
+	}
+	if off+4 > len(msg) {
+		return "", 0, 0, errDNSReply
+	}
+	qtype = binary.BigEndian.Uint16(msg[off:])
+	return strings.ToLower(strings.Join(labels, ".")), qtype, off + 4, nil
+}
+
+// buildFakeReply returns reply to query with the question ending at end,
+// ip is nil for empty answer.
+func buildFakeReply(query []byte, end int, ip net.IP) []byte {
+	b := make([]byte, end, end+16)
+	copy(b, query[:end])
+	b[2] = 0x80 | query[2]&0x79 // QR, keep opcode and RD
+	b[3] = 0x80                 // RA, no error
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint16(b[8:], 0)
+	binary.BigEndian.PutUint16(b[10:], 0)
+	if ip == nil {
+		binary.BigEndian.PutUint16(b[6:], 0)
+		return b
+	}
+	binary.BigEndian.PutUint16(b[6:], 1)
+	// Name pointer to the question, type A, class IN, TTL, address.
+	b = append(b, 0xC0, 12, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0, fakeDNSTTL, 0, net.IPv4len)
+	return append(b, ip.To4()...)
+}
+
+// forward sends query to upstream resolver and returns the reply.
+func (fd *fakeIPDNS) forward(query []byte) ([]byte, error) {
+	c, err := net.DialTimeout("udp", fd.upstream, dnsCheckTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(dnsCheckTimeout))
+	if _, err = c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// handle returns reply to query.
+func (fd *fakeIPDNS) handle(query []byte) ([]byte, error) {
+	name, qtype, end, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil, err
+	}
+	if (qtype == dnsTypeA || qtype == dnsTypeAAAA) && !siteStat.knownDirect(name) {
+		if qtype == dnsTypeAAAA {
+			return buildFakeReply(query, end, nil), nil
+		}
+		ip := fd.pool.alloc(name)
+		debug.Printf("fake dns %s -> %s\n", name, ip)
+		return buildFakeReply(query, end, ip), nil
+	}
+	return fd.forward(query)
+}
+
+func (fd *fakeIPDNS) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := fd.conn.ReadFrom(buf)
+		if err != nil {
+			errl.Println("fake dns:", err)
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			reply, err := fd.handle(query)
+			if err != nil {
+				debug.Printf("fake dns query from %s: %v\n", addr, err)
+				return
+			}
+			fd.conn.WriteTo(reply, addr)
+		}()
+	}
+}
+
+// initFakeDNS listens on fakeDNS address, should be called before dropping
+// privilege.
+func initFakeDNS() {
+	if fakeDNS == nil {
+		return
+	}
+	var err error
+	if fakeDNS.conn, err = net.ListenPacket("udp", fakeDNS.addr); err != nil {
+		Fatal("listen fake dns:", err)
+	}
+	info.Printf("fake dns server %s, upstream %s\n", fakeDNS.addr, fakeDNS.upstream)
+	go fakeDNS.serve()
+}
@@ -0,0 +1,109 @@
+package cow
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	if _, err := newFakeIPPool("198.18.0.0/31"); err == nil {
+		t.Error("too small pool should fail")
+	}
+	p, err := newFakeIPPool("10.0.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.alloc("a.com")
+	if !a.Equal(net.ParseIP("10.0.0.1")) {
+		t.Error("first address should be 10.0.0.1, got", a)
+	}
+	if b := p.alloc("b.com"); !b.Equal(net.ParseIP("10.0.0.2")) {
+		t.Error("second address should be 10.0.0.2, got", b)
+	}
+	if ip := p.alloc("a.com"); !ip.Equal(a) {
+		t.Error("same host should get the same address, got", ip)
+	}
+	// Pool has 2 addresses, c.com reuses the oldest.
+	if c := p.alloc("c.com"); !c.Equal(a) {
+		t.Error("should reuse 10.0.0.1, got", c)
+	}
+	if host, ok := p.lookup(a); !ok || host != "c.com" {
+		t.Error("10.0.0.1 should map to c.com, got", host)
+	}
+	if _, ok := p.off["a.com"]; ok {
+		t.Error("a.com should be removed")
+	}
+	for _, s := range []string{"10.0.0.0", "10.0.0.3", "10.0.1.1", "::1"} {
+		if _, ok := p.lookup(net.ParseIP(s)); ok {
+			t.Error(s, "should not be found")
+		}
+	}
+
+	old := fakeDNS
+	defer func() { fakeDNS = old }()
+	fakeDNS = &fakeIPDNS{pool: p}
+	if hp := fakeHostPort("10.0.0.2:443"); hp != "b.com:443" {
+		t.Error("fake address should be converted, got", hp)
+	}
+	if hp := fakeHostPort("1.2.3.4:443"); hp != "1.2.3.4:443" {
+		t.Error("real address should not be changed, got", hp)
+	}
+}
+
+func TestFakeDNSReply(t *testing.T) {
+	query, err := buildDNSQuery(0x1234, "WWW.Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, qtype, end, err := parseDNSQuestion(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "www.example.com" || qtype != dnsTypeA || end != len(query) {
+		t.Errorf("wrong question %s %d %d", name, qtype, end)
+	}
+	reply := buildFakeReply(query, end, net.ParseIP("198.18.0.1"))
+	if reply[0] != 0x12 || reply[1] != 0x34 || reply[2]&0x80 == 0 {
+		t.Error("wrong reply header")
+	}
+	ips, err := parseDNSReply(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("198.18.0.1")) {
+		t.Error("wrong answer", ips)
+	}
+	if ips, err = parseDNSReply(buildFakeReply(query, end, nil)); err != nil || len(ips) != 0 {
+		t.Error("empty answer expected, got", ips, err)
+	}
+	savedPool := parentProxy
+	defer func() { parentProxy = savedPool }()
+	pool := &backupParentPool{}
+	pool.add(newHttpParent("127.0.0.1:1"))
+	parentProxy = pool
+	fd, _ := parseFakeDNS("127.0.0.1:0 " + fakeDNSServer(t, "1.2.3.4") + " 10.0.0.0/24")
+	// Unknown site gets fake address.
+	if reply, err = fd.handle(query); err != nil {
+		t.Fatal(err)
+	}
+	if ips, err = parseDNSReply(reply); err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Error("fake answer should be 10.0.0.1, got", ips, err)
+	}
+	// Simple host name is forwarded.
+	query, _ = buildDNSQuery(1, "intranet")
+	if reply, err = fd.handle(query); err != nil {
+		t.Fatal(err)
+	}
+	if ips, err = parseDNSReply(reply); err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("1.2.3.4")) {
+		t.Error("forwarded answer should be 1.2.3.4, got", ips, err)
+	}
+	if _, _, _, err = parseDNSQuestion(query[:len(query)-2]); err == nil {
+		t.Error("truncated query should fail")
+	}
+	if _, err = parseFakeDNS("127.0.0.1:53"); err == nil {
+		t.Error("fakeDNS without upstream should fail")
+	}
+	if fd, err := parseFakeDNS("127.0.0.1:53 8.8.8.8:53"); err != nil || fd.pool.size != 1<<17-2 {
+		t.Error("default pool should be 198.18.0.0/15", err)
+	}
+}
@@ -0,0 +1,203 @@
+package cow
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProxy serves proxy clients on a local port until the listener is
+// closed.
+func testProxy(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hp := newHttpProxy(ln.Addr().String(), "")
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go newClientConn(conn, hp).serve()
+		}
+	}()
+	return ln
+}
+
+// rawOrigin is a web server sending canned responses by request path, to
+// produce responses net/http server won't.
+type rawOrigin struct {
+	net.Listener
+	response map[string]string
+	close    map[string]bool // close connection after response
+
+	sync.Mutex
+	accepted int
+}
+
+func newRawOrigin(t *testing.T) *rawOrigin {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &rawOrigin{Listener: ln, response: make(map[string]string), close: make(map[string]bool)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			o.Lock()
+			o.accepted++
+			o.Unlock()
+			go o.serve(c)
+		}
+	}()
+	return o
+}
+
+func (o *rawOrigin) serve(c net.Conn) {
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	for {
+		req, err := http.ReadRequest(rd)
+		if err != nil {
+			return
+		}
+		ioutil.ReadAll(req.Body)
+		resp, ok := o.response[req.URL.Path]
+		if !ok {
+			resp = "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"
+		}
+		if _, err = c.Write([]byte(resp)); err != nil || o.close[req.URL.Path] {
+			return
+		}
+	}
+}
+
+func (o *rawOrigin) connections() int {
+	o.Lock()
+	defer o.Unlock()
+	return o.accepted
+}
+
+// TestForwardNoBody checks responses without body don't break keep-alive
+// connections to the client and the server: each response is followed by
+// another request on the same client connection.
+func TestForwardNoBody(t *testing.T) {
+	saved := config.ServerIdleTimeout
+	config.ServerIdleTimeout = time.Minute
+	defer func() { config.ServerIdleTimeout = saved }()
+
+	origin := newRawOrigin(t)
+	defer origin.Close()
+	origin.response["/ok"] = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	origin.response["/len"] = "HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n"
+	origin.response["/chunked"] = "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"
+	origin.response["/nolen"] = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n"
+	origin.response["/304"] = "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\n\r\n"
+	origin.response["/304-len"] = "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\nContent-Length: 1000\r\n\r\n"
+	origin.response["/204"] = "HTTP/1.1 204 No Content\r\n\r\n"
+	origin.response["/early"] = "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nearly"
+	origin.response["/http10"] = "HTTP/1.0 304 Not Modified\r\n\r\n"
+	origin.close["/http10"] = true
+
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	// The proxy reads ServerIdleTimeout, wait for it to finish serving the
+	// client before restoring config.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		newClientConn(conn, newHttpProxy(proxy.Addr().String(), "")).serve()
+	}()
+	c, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.Close()
+		<-done
+	}()
+	rd := bufio.NewReader(c)
+	base := "http://" + origin.Addr().String()
+
+	get := func(method, path, header string) (*http.Response, string) {
+		req := method + " " + base + path + " HTTP/1.1\r\nHost: " + origin.Addr().String() + "\r\n" +
+			header + "\r\n"
+		if _, err := c.Write([]byte(req)); err != nil {
+			t.Fatal(method, path, err)
+		}
+		resp, err := http.ReadResponse(rd, &http.Request{Method: method})
+		if err != nil {
+			t.Fatal(method, path, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(method, path, "body:", err)
+		}
+		return resp, string(body)
+	}
+
+	testData := []struct {
+		method string
+		path   string
+		header string
+		status int
+		body   string
+	}{
+		{"HEAD", "/len", "", 200, ""},
+		{"HEAD", "/chunked", "", 200, ""},
+		{"HEAD", "/nolen", "", 200, ""},
+		{"GET", "/304", "If-None-Match: \"v1\"\r\n", 304, ""},
+		{"GET", "/304-len", "If-None-Match: \"v1\"\r\n", 304, ""},
+		{"HEAD", "/304", "If-None-Match: \"v1\"\r\n", 304, ""},
+		{"GET", "/204", "", 204, ""},
+		{"GET", "/early", "", 200, "early"},
+	}
+	for _, td := range testData {
+		resp, body := get(td.method, td.path, td.header)
+		if resp.StatusCode != td.status || body != td.body {
+			t.Errorf("%s %s got %d %q, should be %d %q", td.method, td.path,
+				resp.StatusCode, body, td.status, td.body)
+		}
+		if td.path == "/nolen" || td.path == "/304" {
+			if cl := resp.Header.Get("Content-Length"); cl != "" {
+				t.Errorf("%s %s should not add Content-Length, got %s", td.method, td.path, cl)
+			}
+		}
+		if td.path == "/len" && resp.ContentLength != 1000 {
+			t.Errorf("HEAD should keep Content-Length of entity, got %d", resp.ContentLength)
+		}
+		if resp, body = get("GET", "/ok", ""); resp.StatusCode != 200 || body != "ok" {
+			t.Errorf("request after %s %s got %d %q", td.method, td.path, resp.StatusCode, body)
+		}
+	}
+	if n := origin.connections(); n != 1 {
+		t.Errorf("server connection should be reused, got %d connections", n)
+	}
+
+	// HTTP/1.0 server closes connection after response without body.
+	for i := 0; i < 2; i++ {
+		if resp, _ := get("GET", "/http10", ""); resp.StatusCode != 304 {
+			t.Error("HTTP/1.0 304 got", resp.StatusCode)
+		}
+	}
+	if resp, body := get("GET", "/ok", ""); resp.StatusCode != 200 || body != "ok" {
+		t.Errorf("request after HTTP/1.0 response got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,248 @@
+package cow
+
+// Built-in traffic graphs for users without a monitoring stack.
+//
+// With adminSocket set, bytes sent to and received from servers (direct and
+// parent proxies) and the number of client connections are sampled every
+// graphSampleInterval, and kept in memory in buckets of 1 minute (last hour),
+// 5 minutes (last day) and 1 hour (last week). Admin command
+//
+//   cow ctl graph [1m|5m|1h] [svg|json] > graph.svg
+//
+// renders the series as SVG with bandwidth and connection charts, or prints
+// the buckets as JSON. Connections are the maximum sampled in a bucket.
+// Series are not saved across restarts.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const graphSampleInterval = 10 * time.Second
+
+type graphPoint struct {
+	Time  int64 `json:"time"` // unix time of bucket start
+	Sent  int64 `json:"sent"` // bytes sent to servers
+	Recv  int64 `json:"recv"` // bytes received from servers
+	Conns int   `json:"conns"`
+}
+
+type graphSeries struct {
+	Name  string        `json:"name"`
+	Step  int64         `json:"step"` // seconds
+	Point []graphPoint  `json:"point"`
+	step  time.Duration // bucket duration
+	size  int           // max number of buckets
+}
+
+func (gs *graphSeries) add(now time.Time, sent, recv int64, conns int) {
+	t := now.Truncate(gs.step).Unix()
+	if n := len(gs.Point); n > 0 && gs.Point[n-1].Time == t {
+		p := &gs.Point[n-1]
+		p.Sent += sent
+		p.Recv += recv
+		if conns > p.Conns {
+			p.Conns = conns
+		}
+		return
+	}
+	gs.Point = append(gs.Point, graphPoint{t, sent, recv, conns})
+	if len(gs.Point) > gs.size {
+		gs.Point = gs.Point[len(gs.Point)-gs.size:]
+	}
+}
+
+var graph struct {
+	sync.Mutex
+	series  []*graphSeries
+	sent    int64 // total counters at last sample
+	recv    int64
+	sampled bool
+}
+
+func init() {
+	for _, s := range []struct {
+		name string
+		step time.Duration
+		size int
+	}{
+		{"1m", time.Minute, 60},
+		{"5m", 5 * time.Minute, 288},
+		{"1h", time.Hour, 168},
+	} {
+		graph.series = append(graph.series, &graphSeries{
+			Name: s.name, Step: int64(s.step / time.Second), step: s.step, size: s.size,
+		})
+	}
+}
+
+// trafficTotal returns bytes sent and received through all parent proxies
+// and direct connections.
+func trafficTotal() (sent, recv int64) {
+	metrics.Lock()
+	for _, tc := range metrics.data.Parent {
+		cnt := tc.load()
+		sent += cnt.Sent
+		recv += cnt.Recv
+	}
+	metrics.Unlock()
+	return
+}
+
+func sampleGraph(now time.Time) {
+	sent, recv := trafficTotal()
+	cliConns.Lock()
+	conns := len(cliConns.info)
+	cliConns.Unlock()
+
+	graph.Lock()
+	defer graph.Unlock()
+	dsent, drecv := sent-graph.sent, recv-graph.recv
+	if !graph.sampled {
+		dsent, drecv = 0, 0
+	} else if dsent < 0 || drecv < 0 {
+		// Counters are reset by "metrics reset".
+		dsent, drecv = sent, recv
+	}
+	graph.sent, graph.recv, graph.sampled = sent, recv, true
+	for _, gs := range graph.series {
+		gs.add(now, dsent, drecv, conns)
+	}
+}
+
+func runGraph(quit <-chan struct{}) {
+	for {
+		sampleGraph(time.Now())
+		select {
+		case <-quit:
+			return
+		case <-time.After(graphSampleInterval):
+		}
+	}
+}
+
+// findGraphSeries returns a copy of the series with name.
+func findGraphSeries(name string) (*graphSeries, bool) {
+	graph.Lock()
+	defer graph.Unlock()
+	for _, gs := range graph.series {
+		if gs.Name == name {
+			cp := *gs
+			cp.Point = append([]graphPoint(nil), gs.Point...)
+			return &cp, true
+		}
+	}
+	return nil, false
+}
+
+func formatRate(bps float64) string {
+	units := []string{"B/s", "KB/s", "MB/s", "GB/s"}
+	i := 0
+	for bps >= 1000 && i < len(units)-1 {
+		bps /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", bps, units[i])
+}
+
+const (
+	graphWidth  = 720
+	graphHeight = 160
+	graphMargin = 40
+)
+
+// svgPolyline returns a polyline of values scaled to the chart at y offset.
+func svgPolyline(val []float64, max float64, top int, color string) string {
+	var pts []string
+	for i, v := range val {
+		x := graphMargin
+		if len(val) > 1 {
+			x += i * graphWidth / (len(val) - 1)
+		}
+		y := float64(top+graphHeight) - v/max*graphHeight
+		pts = append(pts, fmt.Sprintf("%d,%.1f", x, y))
+	}
+	return fmt.Sprintf("<polyline fill=\"none\" stroke=\"%s\" stroke-width=\"1.5\" points=\"%s\"/>\n",
+		color, strings.Join(pts, " "))
+}
+
+// svgChart writes a chart of lines with legend at y offset top.
+func svgChart(w io.Writer, top int, title string, line [][]float64, legend, color []string, format func(float64) string) {
+	max := 0.0
+	for _, val := range line {
+		for _, v := range val {
+			if v > max {
+				max = v
+			}
+		}
+	}
+	if max == 0 {
+		max = 1
+	}
+	fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" font-weight=\"bold\">%s</text>\n", graphMargin, top-8, title)
+	fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"none\" stroke=\"#ccc\"/>\n",
+		graphMargin, top, graphWidth, graphHeight)
+	fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" text-anchor=\"end\">%s</text>\n",
+		graphMargin+graphWidth, top-8, format(max))
+	for i, val := range line {
+		fmt.Fprint(w, svgPolyline(val, max, top, color[i]))
+		fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" fill=\"%s\">%s</text>\n",
+			graphMargin+200+i*100, top-8, color[i], legend[i])
+	}
+}
+
+// writeGraphSVG renders bandwidth and connection charts of gs.
+func writeGraphSVG(w io.Writer, gs *graphSeries) {
+	n := len(gs.Point)
+	sent, recv, conns := make([]float64, n), make([]float64, n), make([]float64, n)
+	for i, p := range gs.Point {
+		sent[i] = float64(p.Sent) / float64(gs.Step)
+		recv[i] = float64(p.Recv) / float64(gs.Step)
+		conns[i] = float64(p.Conns)
+	}
+	height := 2*(graphHeight+graphMargin) + graphMargin
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" "+
+		"font-family=\"sans-serif\" font-size=\"12\">\n", graphWidth+2*graphMargin, height)
+	svgChart(w, graphMargin, "Bandwidth ("+gs.Name+")", [][]float64{recv, sent},
+		[]string{"recv", "sent"}, []string{"#1f77b4", "#ff7f0e"}, formatRate)
+	svgChart(w, 2*graphMargin+graphHeight, "Client connections", [][]float64{conns},
+		[]string{"max"}, []string{"#2ca02c"}, func(v float64) string { return fmt.Sprintf("%.0f", v) })
+	if n > 0 {
+		y := height - graphMargin/2
+		fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\">%s</text>\n", graphMargin, y,
+			time.Unix(gs.Point[0].Time, 0).Format("2006-01-02 15:04"))
+		fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" text-anchor=\"end\">%s</text>\n", graphMargin+graphWidth, y,
+			time.Unix(gs.Point[n-1].Time, 0).Format("2006-01-02 15:04"))
+	}
+	fmt.Fprintln(w, "</svg>")
+}
+
+func adminGraph(w io.Writer, args []string) error {
+	name, format := "1m", "svg"
+	for _, a := range args {
+		switch a {
+		case "svg", "json":
+			format = a
+		default:
+			name = a
+		}
+	}
+	gs, ok := findGraphSeries(name)
+	if !ok {
+		return fmt.Errorf("unknown graph %s, should be 1m, 5m or 1h", name)
+	}
+	if format == "json" {
+		b, err := json.MarshalIndent(gs, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+	writeGraphSVG(w, gs)
+	return nil
+}
@@ -0,0 +1,77 @@
+package cow
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGraphSeriesAdd(t *testing.T) {
+	gs := &graphSeries{Name: "1m", Step: 60, step: time.Minute, size: 3}
+	start := time.Unix(1500000000, 0).Truncate(time.Minute)
+	gs.add(start, 10, 20, 1)
+	gs.add(start.Add(30*time.Second), 5, 5, 3)
+	gs.add(start.Add(40*time.Second), 5, 5, 2)
+	if len(gs.Point) != 1 {
+		t.Fatalf("samples in one minute should be in one bucket, got %d", len(gs.Point))
+	}
+	if p := gs.Point[0]; p.Sent != 20 || p.Recv != 30 || p.Conns != 3 {
+		t.Errorf("wrong bucket %+v", p)
+	}
+	for i := 1; i <= 3; i++ {
+		gs.add(start.Add(time.Duration(i)*time.Minute), 1, 1, 1)
+	}
+	if len(gs.Point) != 3 || gs.Point[0].Time != start.Add(time.Minute).Unix() {
+		t.Errorf("should keep last 3 buckets, got %+v", gs.Point)
+	}
+}
+
+func TestSampleGraph(t *testing.T) {
+	saved := graph.series
+	defer func() {
+		graph.series = saved
+		graph.sampled = false
+		resetMetrics()
+	}()
+	gs := &graphSeries{Name: "1m", Step: 60, step: time.Minute, size: 60}
+	graph.series = []*graphSeries{gs}
+	graph.sampled = false
+	resetMetrics()
+
+	tc := trafficOf(metrics.data.Parent, "DIRECT")
+	now := time.Unix(1500000000, 0).Truncate(time.Minute)
+	tc.add(100, 1000)
+	sampleGraph(now)
+	tc.add(10, 20)
+	sampleGraph(now.Add(10 * time.Second))
+	if p := gs.Point[0]; p.Sent != 10 || p.Recv != 20 {
+		t.Errorf("bucket should have traffic since first sample, got %+v", p)
+	}
+	resetMetrics()
+	tc.add(1, 2)
+	sampleGraph(now.Add(time.Minute))
+	if p := gs.Point[1]; p.Sent != 1 || p.Recv != 2 {
+		t.Errorf("traffic after metrics reset, got %+v", p)
+	}
+
+	var b bytes.Buffer
+	if err := adminGraph(&b, []string{"1m", "json"}); err != nil {
+		t.Fatal(err)
+	}
+	var out graphSeries
+	if err := json.Unmarshal(b.Bytes(), &out); err != nil || len(out.Point) != 2 || out.Step != 60 {
+		t.Errorf("wrong json output %s %v", b.String(), err)
+	}
+	b.Reset()
+	if err := adminGraph(&b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.String(); !strings.HasPrefix(s, "<svg") || strings.Count(s, "<polyline") != 3 {
+		t.Errorf("wrong svg output\n%s", s)
+	}
+	if err := adminGraph(&b, []string{"2m"}); err == nil {
+		t.Error("unknown graph should fail")
+	}
+}
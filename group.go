@@ -0,0 +1,338 @@
+package cow
+
+// Parent proxy groups selectable by routing rules.
+//
+//   proxyGroup = hk fallback 1.2.3.4:8080 5.6.7.8:1080
+//   proxyGroup = auto url-test 1.2.3.4:8080 socks5://5.6.7.8:1080 interval=10m
+//
+// Each proxyGroup option has a name, a type, and members which are server
+// addresses (optionally with protocol) of configured parent proxies,
+// followed by options:
+//
+//   url=URL        http URL to probe through each member, defaults to
+//                  http://www.gstatic.com/generate_204
+//   interval=dur   how often to probe, defaults to 5m
+//
+// Group types are:
+//
+//   fallback  use members in order. With url option, members failing the
+//             probe are tried after working ones
+//   url-test  use the member with the lowest probe latency, others are
+//             tried in order of latency if it fails. The current member is
+//             kept unless another one is faster by groupTolerance
+//
+// A group is selected with its name as route in requestRule and
+// ruleProvider:
+//
+//   requestRule = ua=*Steam* hk
+//   ruleProvider = auto domain https://example.com/rules/proxy.yaml
+//
+// Members disabled with admin command are skipped.
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGroupURL      = "http://www.gstatic.com/generate_204"
+	defaultGroupInterval = 5 * time.Minute
+	groupTolerance       = 50 * time.Millisecond
+	groupProbeFailed     = time.Duration(1<<63 - 1)
+)
+
+type proxyGroup struct {
+	name     string
+	typ      string // fallback or url-test
+	member   []string
+	url      *URL // nil if not probed
+	interval time.Duration
+
+	sync.RWMutex
+	parent  []ParentProxy   // members in config order
+	latency []time.Duration // of each parent, groupProbeFailed if failed
+	order   []ParentProxy   // members in order to try
+}
+
+var proxyGroups = make(map[string]*proxyGroup)
+
+func parseProxyGroup(val string) (*proxyGroup, error) {
+	f := strings.Fields(val)
+	if len(f) < 3 {
+		return nil, errors.New("should be name, type and members")
+	}
+	g := &proxyGroup{name: f[0], typ: f[1], interval: defaultGroupInterval}
+	if g.name == "direct" || g.name == "proxy" || strings.Contains(g.name, "://") {
+		return nil, errors.New("invalid group name " + g.name)
+	}
+	if g.typ != "fallback" && g.typ != "url-test" {
+		return nil, errors.New("type should be fallback or url-test, got " + g.typ)
+	}
+	rawurl := ""
+	if g.typ == "url-test" {
+		rawurl = defaultGroupURL
+	}
+	for _, s := range f[2:] {
+		switch {
+		case strings.HasPrefix(s, "url="):
+			rawurl = s[len("url="):]
+		case strings.HasPrefix(s, "interval="):
+			d, err := time.ParseDuration(s[len("interval="):])
+			if err != nil || d < time.Minute {
+				return nil, errors.New("interval should be a duration of at least 1m")
+			}
+			g.interval = d
+		default:
+			g.member = append(g.member, s)
+		}
+	}
+	if len(g.member) == 0 {
+		return nil, errors.New("no member")
+	}
+	if rawurl != "" {
+		if !strings.HasPrefix(rawurl, "http://") {
+			return nil, errors.New("url should be http URL")
+		}
+		var err error
+		if g.url, err = ParseRequestURI(rawurl); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// findMemberParent returns configured parent proxy with server address in
+// member, which may have protocol.
+func findMemberParent(member string) ParentProxy {
+	server := member
+	if id := strings.Index(member, "://"); id != -1 {
+		server = member[id+3:]
+	}
+	for _, p := range allParents() {
+		if p.getServer() != server {
+			continue
+		}
+		if id := strings.Index(member, "://"); id == -1 || member[:id] == parentProtocol(p) {
+			return p
+		}
+	}
+	return nil
+}
+
+// parentProtocol returns protocol of parent proxy in proxy option.
+func parentProtocol(p ParentProxy) string {
+	switch pp := p.(type) {
+	case *httpParent:
+		return pp.scheme()
+	case *socksParent:
+		return "socks5"
+	case *shadowsocksParent:
+		return "ss"
+	case *cowParent:
+		return "cow"
+	case *adapterParent:
+		return pp.protocol
+	}
+	return ""
+}
+
+func sortedProxyGroups() (group []*proxyGroup) {
+	var names []string
+	for name := range proxyGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		group = append(group, proxyGroups[name])
+	}
+	return
+}
+
+func findProxyGroup(name string) (*proxyGroup, error) {
+	g, ok := proxyGroups[name]
+	if !ok {
+		return nil, errors.New("no proxy group " + name)
+	}
+	return g, nil
+}
+
+func initProxyGroup() {
+	for _, g := range proxyGroups {
+		g.parent = nil
+		for _, m := range g.member {
+			p := findMemberParent(m)
+			if p == nil {
+				Fatal("proxyGroup", g.name+": no parent proxy", m)
+			}
+			g.parent = append(g.parent, p)
+		}
+		g.order = g.parent
+		if g.url != nil {
+			go g.run()
+		}
+	}
+}
+
+// parents returns enabled members in order to try, nil if there is none.
+func (g *proxyGroup) parents() (parent []ParentProxy) {
+	g.RLock()
+	order := g.order
+	g.RUnlock()
+	for _, p := range order {
+		if !parentDisabled(p.getServer()) {
+			parent = append(parent, p)
+		}
+	}
+	return
+}
+
+// probe returns time to get response header of the group URL through p.
+func (g *proxyGroup) probe(p ParentProxy) (time.Duration, error) {
+	start := time.Now()
+	c, err := p.connect(g.url)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(readTimeout))
+	uri, authHeader := requestURI(c, "GET", g.url)
+	req := "GET " + uri + " HTTP/1.1\r\nHost: " + g.url.HostPort + "\r\n" +
+		string(authHeader) + "Connection: close\r\n\r\n"
+	if _, err = c.Write([]byte(req)); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return 0, errors.New(resp.Status)
+	}
+	return time.Now().Sub(start), nil
+}
+
+// update probes all members and reorders them.
+func (g *proxyGroup) update() {
+	latency := make([]time.Duration, len(g.parent))
+	var wg sync.WaitGroup
+	for i, p := range g.parent {
+		wg.Add(1)
+		go func(i int, p ParentProxy) {
+			defer wg.Done()
+			d, err := g.probe(p)
+			if err != nil {
+				debug.Printf("proxy group %s probe %s: %v\n", g.name, p.getServer(), err)
+				d = groupProbeFailed
+			}
+			latency[i] = d
+		}(i, p)
+	}
+	wg.Wait()
+	failed := 0
+	for _, d := range latency {
+		if d == groupProbeFailed {
+			failed++
+		}
+	}
+	if failed == len(latency) {
+		errl.Printf("proxy group %s: all members failed probe\n", g.name)
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	var cur ParentProxy
+	if len(g.order) > 0 && g.latency != nil {
+		cur = g.order[0]
+	}
+	g.latency = latency
+	g.order = groupOrder(g.typ, g.parent, latency, cur)
+	if g.order[0] != cur && failed < len(latency) {
+		info.Printf("proxy group %s uses %s\n", g.name, g.order[0].getServer())
+	}
+}
+
+// groupOrder sorts parents by latency for url-test, or moves failed ones to
+// the end for fallback. url-test keeps cur first unless the fastest parent
+// is faster by groupTolerance.
+func groupOrder(typ string, parent []ParentProxy, latency []time.Duration, cur ParentProxy) []ParentProxy {
+	order := make([]ParentProxy, 0, len(parent))
+	if typ == "fallback" {
+		var failed []ParentProxy
+		for i, p := range parent {
+			if latency[i] == groupProbeFailed {
+				failed = append(failed, p)
+			} else {
+				order = append(order, p)
+			}
+		}
+		return append(order, failed...)
+	}
+	// Insertion sort keeps config order for the same latency.
+	lat := make([]time.Duration, 0, len(parent))
+	for i, p := range parent {
+		j := len(order)
+		for j > 0 && lat[j-1] > latency[i] {
+			j--
+		}
+		order = append(order[:j], append([]ParentProxy{p}, order[j:]...)...)
+		lat = append(lat[:j], append([]time.Duration{latency[i]}, lat[j:]...)...)
+	}
+	for i := 1; i < len(order); i++ {
+		if order[i] != cur {
+			continue
+		}
+		if lat[i] != groupProbeFailed && lat[i]-lat[0] < groupTolerance {
+			copy(order[1:i+1], order[:i])
+			order[0] = cur
+		}
+		break
+	}
+	return order
+}
+
+func (g *proxyGroup) run() {
+	for {
+		g.update()
+		time.Sleep(g.interval)
+	}
+}
+
+// routeGroup routes the request through members of the group. Returns false
+// if the group has no enabled member.
+func (r *Request) routeGroup(g *proxyGroup) bool {
+	parent := g.parents()
+	if len(parent) == 0 {
+		return false
+	}
+	r.route = routeProxy
+	r.pacRoute = parent
+	return true
+}
+
+// String returns the group and its members for admin command.
+func (g *proxyGroup) String() string {
+	g.RLock()
+	defer g.RUnlock()
+	var s []string
+	for _, p := range g.order {
+		m := p.getServer()
+		for i, q := range g.parent {
+			if q != p || g.latency == nil {
+				continue
+			}
+			if g.latency[i] == groupProbeFailed {
+				m += " (failed)"
+			} else {
+				m += " (" + (g.latency[i] / time.Millisecond * time.Millisecond).String() + ")"
+			}
+		}
+		s = append(s, m)
+	}
+	return g.name + " " + g.typ + ": " + strings.Join(s, ", ")
+}
@@ -0,0 +1,89 @@
+package cow
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProxyGroup(t *testing.T) {
+	g, err := parseProxyGroup("auto url-test 1.2.3.4:8080 socks5://5.6.7.8:1080 interval=10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.member) != 2 || g.interval != 10*time.Minute || g.url == nil || g.url.Host != "www.gstatic.com" {
+		t.Errorf("wrong group %+v", g)
+	}
+	if g, err = parseProxyGroup("hk fallback 1.2.3.4:8080"); err != nil || g.url != nil {
+		t.Errorf("fallback should not probe without url: %v", err)
+	}
+	for _, val := range []string{
+		"hk fallback",
+		"hk random 1.2.3.4:8080",
+		"direct fallback 1.2.3.4:8080",
+		"hk fallback 1.2.3.4:8080 url=https://example.com/",
+		"hk url-test 1.2.3.4:8080 interval=10s",
+	} {
+		if _, err := parseProxyGroup(val); err == nil {
+			t.Error("should fail:", val)
+		}
+	}
+}
+
+func TestGroupOrder(t *testing.T) {
+	a, b, c := newHttpParent("a:1"), newHttpParent("b:1"), newHttpParent("c:1")
+	parent := []ParentProxy{a, b, c}
+	servers := func(order []ParentProxy) string {
+		var s []string
+		for _, p := range order {
+			s = append(s, p.getServer())
+		}
+		return strings.Join(s, " ")
+	}
+	ms := time.Millisecond
+	testData := []struct {
+		typ     string
+		latency []time.Duration
+		cur     ParentProxy
+		order   string
+	}{
+		{"fallback", []time.Duration{groupProbeFailed, 300 * ms, 100 * ms}, nil, "b:1 c:1 a:1"},
+		{"url-test", []time.Duration{groupProbeFailed, 300 * ms, 100 * ms}, nil, "c:1 b:1 a:1"},
+		{"url-test", []time.Duration{100 * ms, 100 * ms, 50 * ms}, nil, "c:1 a:1 b:1"},
+		// Keep current parent within tolerance.
+		{"url-test", []time.Duration{100 * ms, 120 * ms, 300 * ms}, b, "b:1 a:1 c:1"},
+		{"url-test", []time.Duration{100 * ms, 200 * ms, 300 * ms}, b, "a:1 b:1 c:1"},
+		{"url-test", []time.Duration{100 * ms, groupProbeFailed, 300 * ms}, b, "a:1 c:1 b:1"},
+	}
+	for _, td := range testData {
+		if order := servers(groupOrder(td.typ, parent, td.latency, td.cur)); order != td.order {
+			t.Errorf("%s %v: order %s, should be %s", td.typ, td.latency, order, td.order)
+		}
+	}
+}
+
+func TestProxyGroupProbe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Host, "probe.cow.test") {
+			w.WriteHeader(502)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+	good := newHttpParent(strings.TrimPrefix(ts.URL, "http://"))
+	bad := newHttpParent("127.0.0.1:1")
+
+	g, err := parseProxyGroup("test url-test x url=http://probe.cow.test/generate_204")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.parent = []ParentProxy{bad, good}
+	g.order = g.parent
+	g.update()
+	if p := g.parents(); len(p) != 2 || p[0] != good {
+		t.Errorf("working parent should be used first, got %v", g)
+	}
+}
@@ -0,0 +1,288 @@
+package cow
+
+// Hot standby for high availability.
+//
+//   standbyOf = 192.168.1.2:7790
+//   clusterSecret = a long random string
+//
+// A primary and a standby share a virtual IP managed by keepalived (or other
+// VRRP daemon). The primary sets clusterListen, the standby sets standbyOf to
+// that address. Every haSyncInterval, the standby exchanges site stat and
+// parent proxy failures with the primary like cluster peers, and fetches the
+// primary's config file, userPasswdFile, directFile and blockedFile. They
+// are saved in the standby's config directory as primary.rc, primary.passwd,
+// primary.direct and primary.blocked, and the standby reloads if any of them
+// changes. Like config from configSource, they are checked before saving and
+// invalid config is ignored. primary.rc is parsed before the standby's own rc, so the standby's
+// rc only needs node specific options.
+//
+// GET /health on http listeners replies 200 while cow is serving, for use in
+// keepalived check scripts:
+//
+//   vrrp_script chk_cow {
+//       script "/usr/bin/curl -sf http://127.0.0.1:7777/health"
+//       interval 2
+//   }
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	haSyncInterval = 30 * time.Second
+	healthPath     = "/health"
+	standbyPrefix  = "primary"
+)
+
+// Files synced from primary or configSource, the rc file must be the first.
+// They are saved in the config directory with name prefix.suffix.
+var syncedFiles = []struct {
+	option string
+	suffix string
+}{
+	{"rc", "rc"},
+	{"userPasswdFile", "passwd"},
+	{"directFile", "direct"},
+	{"blockedFile", "blocked"},
+}
+
+func syncedFilePath(prefix, suffix string) string {
+	return path.Join(config.dir, prefix+"."+suffix)
+}
+
+// hasConfigOption returns whether rc contains option key.
+func hasConfigOption(rc []byte, key string) bool {
+	_, ok := configOptionValue(rc, key)
+	return ok
+}
+
+// configOptionValue returns value of the last option key in rc.
+func configOptionValue(rc []byte, key string) (val string, ok bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(rc))
+	for scanner.Scan() {
+		v := strings.SplitN(scanner.Text(), "=", 2)
+		if len(v) == 2 && strings.TrimSpace(v[0]) == key {
+			val, ok = strings.TrimSpace(v[1]), true
+		}
+	}
+	return
+}
+
+// parseSyncedRc parses config synced from primary or configSource if
+// exists.
+func parseSyncedRc(prefix string) {
+	f, err := os.Open(syncedFilePath(prefix, syncedFiles[0].suffix))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Fatal("Error opening synced config:", err)
+		}
+		return
+	}
+	defer f.Close()
+	parseConfigLines(f)
+}
+
+// primaryFiles returns files to send to standby.
+func primaryFiles() map[string][]byte {
+	files := make(map[string][]byte)
+	fpath := map[string]string{
+		"rc":             config.RcFile,
+		"userPasswdFile": config.UserPasswdFile,
+		"directFile":     config.DirectFile,
+		"blockedFile":    config.BlockedFile,
+	}
+	for _, sf := range syncedFiles {
+		if fpath[sf.option] == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(fpath[sf.option])
+		if err != nil {
+			if !os.IsNotExist(err) {
+				errl.Println("read file for standby:", err)
+			}
+			continue
+		}
+		files[sf.option] = b
+	}
+	return files
+}
+
+// syncedRc changes options of synced files in synced rc to the saved files.
+func syncedRc(prefix string, rc []byte, files map[string][]byte) []byte {
+	var b bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(rc))
+	for scanner.Scan() {
+		line := scanner.Text()
+		v := strings.SplitN(line, "=", 2)
+		if len(v) == 2 {
+			key := strings.TrimSpace(v[0])
+			if key == "standbyOf" || key == "configSource" || files[key] != nil && key != "rc" {
+				continue
+			}
+		}
+		b.WriteString(line + "\n")
+	}
+	for _, sf := range syncedFiles[1:] {
+		if files[sf.option] != nil {
+			fmt.Fprintf(&b, "%s = %s\n", sf.option, syncedFilePath(prefix, sf.suffix))
+		}
+	}
+	return b.Bytes()
+}
+
+// syncedFileData returns content of files from primary or configSource to
+// save, keyed by path.
+func syncedFileData(prefix string, files map[string][]byte) map[string][]byte {
+	data := make(map[string][]byte)
+	for _, sf := range syncedFiles {
+		b, ok := files[sf.option]
+		if !ok {
+			continue
+		}
+		if sf.option == "rc" {
+			b = syncedRc(prefix, b, files)
+		}
+		data[syncedFilePath(prefix, sf.suffix)] = b
+	}
+	return data
+}
+
+// saveSyncedFiles saves files from primary or configSource, returns true if
+// any changed. Previous files are kept with .bak suffix.
+func saveSyncedFiles(prefix string, files map[string][]byte) (changed bool, err error) {
+	if files["rc"] == nil {
+		return false, errors.New("no config file")
+	}
+	for fpath, b := range syncedFileData(prefix, files) {
+		if old, err := ioutil.ReadFile(fpath); err == nil && bytes.Equal(old, b) {
+			continue
+		}
+		if err = writeFileAtomic(fpath, b, true); err != nil {
+			return
+		}
+		changed = true
+	}
+	return
+}
+
+// checkSyncedFiles checks files from primary or configSource together with
+// local rc by running "cow -check" on copies of them, as parsing config in
+// the running process can't be undone.
+func checkSyncedFiles(prefix string, files map[string][]byte) error {
+	if fatalPanics {
+		// Embedded in other programs, there's no cow command to run.
+		return nil
+	}
+	if files["rc"] == nil {
+		return errors.New("no config file")
+	}
+	local, err := ioutil.ReadFile(expandTilde(config.RcFile))
+	if err != nil {
+		return err
+	}
+	tmp := prefix + ".check"
+	data := syncedFileData(tmp, files)
+	rcPath := syncedFilePath(tmp, syncedFiles[0].suffix)
+	// Options in local rc are parsed after synced rc, without those starting
+	// synchronization.
+	b := bytes.NewBuffer(data[rcPath])
+	scanner := bufio.NewScanner(bytes.NewReader(local))
+	for scanner.Scan() {
+		line := scanner.Text()
+		v := strings.SplitN(line, "=", 2)
+		if len(v) == 2 {
+			if key := strings.TrimSpace(v[0]); key == "standbyOf" || key == "configSource" {
+				continue
+			}
+		}
+		b.WriteString(line + "\n")
+	}
+	data[rcPath] = b.Bytes()
+	defer func() {
+		for fpath := range data {
+			os.Remove(fpath)
+		}
+	}()
+	for fpath, d := range data {
+		if err = ioutil.WriteFile(fpath, d, 0600); err != nil {
+			return err
+		}
+	}
+	argv0, err := lookPath()
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command(argv0, "-rc", rcPath, "-check").CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// checkSyncedConfig is replaced in tests.
+var checkSyncedConfig = checkSyncedFiles
+
+// updateSyncedFiles saves files from primary or configSource if any changed
+// and they pass the check, returns true if saved. Invalid config is not
+// saved, so the last good copy is kept.
+func updateSyncedFiles(prefix string, files map[string][]byte) (bool, error) {
+	if files["rc"] == nil {
+		return false, errors.New("no config file")
+	}
+	changed := false
+	for fpath, b := range syncedFileData(prefix, files) {
+		if old, err := ioutil.ReadFile(fpath); err != nil || !bytes.Equal(old, b) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	if err := checkSyncedConfig(prefix, files); err != nil {
+		return false, err
+	}
+	return saveSyncedFiles(prefix, files)
+}
+
+// runStandby syncs with primary until quit.
+func runStandby(quit <-chan struct{}) {
+	for {
+		local := localClusterState()
+		local.Standby = true
+		st, err := exchangeClusterState(config.StandbyOf, local)
+		if err != nil {
+			errl.Printf("standby sync with %s: %v\n", config.StandbyOf, err)
+		} else if changed, err := updateSyncedFiles(standbyPrefix, st.Files); err != nil {
+			errl.Println("standby config of primary not saved:", err)
+		} else if changed {
+			info.Println("config of primary changed, reloading")
+			if err = signalProcess(os.Getpid(), "reload"); err != nil {
+				errl.Println("standby reload:", err)
+			}
+		}
+		select {
+		case <-quit:
+			return
+		case <-time.After(haSyncInterval):
+		}
+	}
+}
+
+func sendHealth(c *clientConn) {
+	body := "OK\n"
+	header := fmt.Sprintf("HTTP/1.1 200 OK\r\nServer: cow-proxy\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n",
+		len(body))
+	if _, err := c.Write([]byte(header + body)); err != nil {
+		debug.Printf("cli(%s) error sending health: %v\n", c.RemoteAddr(), err)
+	}
+}
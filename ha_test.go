@@ -0,0 +1,118 @@
+package cow
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestHasConfigOption(t *testing.T) {
+	rc := []byte("listen = http://0.0.0.0:7777\n# standbyOf = 1.2.3.4:7790\n")
+	if hasConfigOption(rc, "standbyOf") {
+		t.Error("commented option should not count")
+	}
+	if !hasConfigOption(append(rc, " standbyOf= 1.2.3.4:7790\n"...), "standbyOf") {
+		t.Error("should have standbyOf")
+	}
+}
+
+func TestSaveSyncedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow-standby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedDir := config.dir
+	config.dir = dir
+	defer func() { config.dir = savedDir }()
+
+	files := map[string][]byte{
+		"rc":             []byte("listen = http://0.0.0.0:7777\nuserPasswdFile = /etc/cow/passwd\nclusterListen = 0.0.0.0:7790\n"),
+		"userPasswdFile": []byte("foo:bar\n"),
+	}
+	if _, err := saveSyncedFiles(standbyPrefix, map[string][]byte{"userPasswdFile": nil}); err == nil {
+		t.Error("should fail without rc")
+	}
+	changed, err := saveSyncedFiles(standbyPrefix, files)
+	if err != nil || !changed {
+		t.Fatalf("first save should change files: %v", err)
+	}
+	rc, _ := ioutil.ReadFile(path.Join(dir, "primary.rc"))
+	want := "listen = http://0.0.0.0:7777\nclusterListen = 0.0.0.0:7790\nuserPasswdFile = " +
+		path.Join(dir, "primary.passwd") + "\n"
+	if string(rc) != want {
+		t.Errorf("wrong primary.rc:\n%s", rc)
+	}
+	if b, _ := ioutil.ReadFile(path.Join(dir, "primary.passwd")); string(b) != "foo:bar\n" {
+		t.Errorf("wrong primary.passwd: %q", b)
+	}
+	if changed, err = saveSyncedFiles(standbyPrefix, files); err != nil || changed {
+		t.Errorf("same files should not change: %v", err)
+	}
+	files["userPasswdFile"] = []byte("foo:baz\n")
+	if changed, err = saveSyncedFiles(standbyPrefix, files); err != nil || !changed {
+		t.Errorf("changed user file should be saved: %v", err)
+	}
+}
+
+func TestUpdateSyncedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow-synced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedDir, savedCheck := config.dir, checkSyncedConfig
+	defer func() { config.dir, checkSyncedConfig = savedDir, savedCheck }()
+	config.dir = dir
+	checked := 0
+	checkSyncedConfig = func(prefix string, files map[string][]byte) error {
+		checked++
+		if strings.Contains(string(files["rc"]), "bad") {
+			return errors.New("invalid config")
+		}
+		return nil
+	}
+
+	good := map[string][]byte{"rc": []byte("listen = http://0.0.0.0:7777\n")}
+	if changed, err := updateSyncedFiles(kvPrefix, good); err != nil || !changed {
+		t.Fatalf("good config should be saved: %v", err)
+	}
+	if changed, err := updateSyncedFiles(kvPrefix, good); err != nil || changed || checked != 1 {
+		t.Errorf("same config should not be checked or saved: %v, checked %d", err, checked)
+	}
+	bad := map[string][]byte{"rc": []byte("bad option\n")}
+	if changed, err := updateSyncedFiles(kvPrefix, bad); err == nil || changed {
+		t.Error("bad config should not be saved")
+	}
+	if rc, _ := ioutil.ReadFile(path.Join(dir, "kv.rc")); string(rc) != string(good["rc"]) {
+		t.Errorf("last good config should be kept, got %q", rc)
+	}
+}
+
+func TestPrimaryFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow-primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedRc, savedPasswd, savedDirect, savedBlocked := config.RcFile, config.UserPasswdFile,
+		config.DirectFile, config.BlockedFile
+	defer func() {
+		config.RcFile, config.UserPasswdFile = savedRc, savedPasswd
+		config.DirectFile, config.BlockedFile = savedDirect, savedBlocked
+	}()
+	config.RcFile = path.Join(dir, "rc")
+	config.UserPasswdFile = ""
+	config.DirectFile = path.Join(dir, "direct")
+	config.BlockedFile = path.Join(dir, "blocked")
+	ioutil.WriteFile(config.RcFile, []byte("listen = http://0.0.0.0:7777\n"), 0644)
+	ioutil.WriteFile(config.DirectFile, []byte("example.com\n"), 0644)
+
+	files := primaryFiles()
+	if len(files) != 2 || string(files["directFile"]) != "example.com\n" || files["rc"] == nil {
+		t.Errorf("wrong primary files %v", files)
+	}
+}
@@ -0,0 +1,384 @@
+package cow
+
+// HAR recorder.
+//
+// If harFile is set, plain HTTP requests to hosts in harHost (all hosts if
+// not set) are recorded into the file in HAR 1.2 format, which can be
+// opened by browser developer tools and other HAR viewers. Request and
+// response bodies are included up to harBodySize bytes, 0 records headers
+// only.
+//
+// Only the latest harMaxEntries requests are kept. The file is rewritten
+// shortly after new requests are recorded. CONNECT tunnels are encrypted
+// and not recorded.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	harMaxEntries = 1000
+	harSaveDelay  = time.Second
+)
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// Timings are in milliseconds.
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harBody records body written up to harBodySize.
+type harBody struct {
+	data    []byte
+	size    int64 // total bytes written
+	chunked bool
+}
+
+type harBodyWriter struct {
+	w io.Writer
+	b *harBody
+}
+
+func (hw harBodyWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.b.size += int64(n)
+	if room := int(config.HarBodySize) - len(hw.b.data); room > 0 {
+		if room > n {
+			room = n
+		}
+		hw.b.data = append(hw.b.data, p[:room]...)
+	}
+	return n, err
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+
+	start, sent, recv time.Time
+	reqBody, rpBody   harBody
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harLog struct {
+	Log struct {
+		Version string      `json:"version"`
+		Creator harCreator  `json:"creator"`
+		Entries []*harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+var har = struct {
+	sync.Mutex
+	entries []*harEntry
+	save    chan struct{}
+}{}
+
+func harEnabled() bool {
+	return har.save != nil
+}
+
+func initHAR() {
+	if config.HarFile == "" {
+		return
+	}
+	har.save = make(chan struct{}, 1)
+	go func() {
+		for range har.save {
+			time.Sleep(harSaveDelay)
+			if err := saveHAR(); err != nil {
+				errl.Println("save HAR file:", err)
+			}
+		}
+	}()
+}
+
+// harMatch returns true if requests to host should be recorded. Host in
+// harHost also matches its sub domains.
+func harMatch(host string) bool {
+	if len(config.HarHost) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, h := range config.HarHost {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// harHeaders splits header lines into name value pairs, hop-by-hop headers
+// generated by cow are skipped.
+func harHeaders(lines []byte) (hdr []harNameValue) {
+	hdr = []harNameValue{}
+	for _, line := range bytes.Split(lines, []byte("\n")) {
+		cid := bytes.IndexByte(line, ':')
+		if cid <= 0 {
+			continue
+		}
+		name := strings.TrimSpace(string(line[:cid]))
+		if hopByHopHeader[strings.ToLower(name)] {
+			continue
+		}
+		hdr = append(hdr, harNameValue{name, strings.TrimSpace(string(line[cid+1:]))})
+	}
+	return
+}
+
+func harHeaderValue(hdr []harNameValue, name string) string {
+	for _, h := range hdr {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func harQueryString(path string) (qs []harNameValue) {
+	qs = []harNameValue{}
+	id := strings.IndexByte(path, '?')
+	if id == -1 {
+		return
+	}
+	for _, kv := range strings.Split(path[id+1:], "&") {
+		if kv == "" {
+			continue
+		}
+		var name, value string
+		if eq := strings.IndexByte(kv, '='); eq == -1 {
+			name = kv
+		} else {
+			name, value = kv[:eq], kv[eq+1:]
+		}
+		if s, err := url.QueryUnescape(name); err == nil {
+			name = s
+		}
+		if s, err := url.QueryUnescape(value); err == nil {
+			value = s
+		}
+		qs = append(qs, harNameValue{name, value})
+	}
+	return
+}
+
+func newHAREntry(r *Request) *harEntry {
+	lines := r.raw.Bytes()[r.headStart:r.bodyStart]
+	e := &harEntry{start: time.Now()}
+	e.StartedDateTime = e.start.Format(time.RFC3339Nano)
+	e.Request = harRequest{
+		Method:      r.Method,
+		URL:         "http://" + r.URL.HostPort + r.URL.Path,
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(lines),
+		QueryString: harQueryString(r.URL.Path),
+		HeadersSize: -1,
+	}
+	e.reqBody.chunked = r.Chunking
+	return e
+}
+
+// requestSent is called after request body is sent.
+func (e *harEntry) requestSent(r *Request) {
+	e.sent = time.Now()
+	if r.isRetry() && e.reqBody.size == 0 && r.raw != nil {
+		// Body buffered in the first try is sent with header on retry.
+		harBodyWriter{ioutil.Discard, &e.reqBody}.Write(r.rawBody())
+	}
+}
+
+func (e *harEntry) setResponse(rp *Response, chunked bool) {
+	e.recv = time.Now()
+	var lines []byte
+	raw := rp.raw.Bytes()
+	if id := bytes.IndexByte(raw, '\n'); id != -1 {
+		lines = raw[id+1:]
+	}
+	e.Response = harResponse{
+		Status:      rp.Status,
+		StatusText:  string(bytes.TrimSpace(rp.Reason)),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(lines),
+		HeadersSize: -1,
+	}
+	e.Response.RedirectURL = harHeaderValue(e.Response.Headers, "Location")
+	e.Response.Content.MimeType = harHeaderValue(e.Response.Headers, "Content-Type")
+	e.rpBody.chunked = chunked
+}
+
+// dechunk decodes chunked body, which may be truncated. Returns false if
+// the body is not complete.
+func dechunk(b []byte) ([]byte, bool) {
+	var body []byte
+	for {
+		id := bytes.IndexByte(b, '\n')
+		if id == -1 {
+			return body, false
+		}
+		line := b[:id]
+		if semi := bytes.IndexByte(line, ';'); semi != -1 {
+			line = line[:semi]
+		}
+		size, err := ParseIntFromBytes(TrimSpace(line), 16)
+		if err != nil {
+			return body, false
+		}
+		if size == 0 {
+			return body, true
+		}
+		b = b[id+1:]
+		if int64(len(b)) < size {
+			return append(body, b...), false
+		}
+		body = append(body, b[:size]...)
+		b = bytes.TrimLeft(b[size:], "\r\n")
+	}
+}
+
+// text returns body content and encoding for HAR.
+func (b *harBody) text() (text, encoding, comment string, size int64) {
+	data := b.data
+	complete := b.size == int64(len(b.data))
+	size = b.size
+	if b.chunked {
+		data, complete = dechunk(data)
+		if complete {
+			size = int64(len(data))
+		}
+	}
+	if !complete {
+		comment = fmt.Sprintf("body truncated to %d bytes", len(data))
+	}
+	if utf8.Valid(data) {
+		return string(data), "", comment, size
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64", comment, size
+}
+
+func (e *harEntry) finish(route string) {
+	now := time.Now()
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	e.Time = ms(now.Sub(e.start))
+	e.Timings = harTimings{
+		Send:    ms(e.sent.Sub(e.start)),
+		Wait:    ms(e.recv.Sub(e.sent)),
+		Receive: ms(now.Sub(e.recv)),
+	}
+	e.Comment = "route " + route
+
+	e.Request.BodySize = e.reqBody.size
+	if e.reqBody.size > 0 {
+		pd := &harPostData{MimeType: harHeaderValue(e.Request.Headers, "Content-Type")}
+		if config.HarBodySize > 0 {
+			// HAR has no encoding for post data, binary body is base64 encoded
+			// and noted in comment.
+			var encoding string
+			pd.Text, encoding, pd.Comment, _ = e.reqBody.text()
+			if encoding != "" {
+				pd.Comment = strings.TrimSpace(pd.Comment + " " + encoding + " encoded")
+			}
+		}
+		e.Request.PostData = pd
+	}
+	e.Response.BodySize = e.rpBody.size
+	c := &e.Response.Content
+	c.Size = e.rpBody.size
+	if config.HarBodySize > 0 && e.rpBody.size > 0 {
+		c.Text, c.Encoding, c.Comment, c.Size = e.rpBody.text()
+	}
+	harRecord(e)
+}
+
+func harRecord(e *harEntry) {
+	har.Lock()
+	har.entries = append(har.entries, e)
+	if len(har.entries) > harMaxEntries {
+		har.entries = har.entries[len(har.entries)-harMaxEntries:]
+	}
+	har.Unlock()
+	select {
+	case har.save <- struct{}{}:
+	default:
+	}
+}
+
+func saveHAR() error {
+	var hl harLog
+	hl.Log.Version = "1.2"
+	hl.Log.Creator = harCreator{"COW", version}
+	har.Lock()
+	hl.Log.Entries = har.entries
+	data, err := json.MarshalIndent(&hl, "", "  ")
+	har.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(expandTilde(config.HarFile), data, false)
+}
@@ -0,0 +1,65 @@
+package cow
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDechunk(t *testing.T) {
+	testData := []struct {
+		chunked  string
+		body     string
+		complete bool
+	}{
+		{"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", "hello world", true},
+		{"5;ext=1\r\nhello\r\n0\r\n\r\n", "hello", true},
+		{"5\r\nhello\r\n6\r\n wo", "hello wo", false},
+		{"5\r\nhel", "hel", false},
+	}
+	for _, td := range testData {
+		body, complete := dechunk([]byte(td.chunked))
+		if string(body) != td.body || complete != td.complete {
+			t.Errorf("%q dechunked to %q %v", td.chunked, body, complete)
+		}
+	}
+}
+
+func TestHarQueryString(t *testing.T) {
+	qs := harQueryString("/search?q=a%20b&empty=&flag")
+	expected := []harNameValue{{"q", "a b"}, {"empty", ""}, {"flag", ""}}
+	if len(qs) != len(expected) {
+		t.Fatal("wrong query string:", qs)
+	}
+	for i, nv := range expected {
+		if qs[i] != nv {
+			t.Errorf("query %d should be %v, got %v", i, nv, qs[i])
+		}
+	}
+	if qs = harQueryString("/"); qs == nil || len(qs) != 0 {
+		t.Error("no query should return empty list")
+	}
+}
+
+func TestHarBody(t *testing.T) {
+	old := config.HarBodySize
+	defer func() { config.HarBodySize = old }()
+	config.HarBodySize = 8
+
+	var b harBody
+	var out bytes.Buffer
+	w := harBodyWriter{&out, &b}
+	w.Write([]byte("hello "))
+	w.Write([]byte("world"))
+	if out.String() != "hello world" || b.size != 11 || string(b.data) != "hello wo" {
+		t.Errorf("wrong body recorded: %q %d %q", out.String(), b.size, b.data)
+	}
+	text, encoding, comment, size := b.text()
+	if text != "hello wo" || encoding != "" || comment == "" || size != 11 {
+		t.Error("truncated body text wrong:", text, encoding, comment, size)
+	}
+
+	b = harBody{data: []byte{0xff, 0xfe}, size: 2}
+	if text, encoding, comment, _ = b.text(); text != "//4=" || encoding != "base64" || comment != "" {
+		t.Error("binary body should be base64 encoded, got", text, encoding, comment)
+	}
+}
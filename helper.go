@@ -0,0 +1,231 @@
+package cow
+
+// External helper program for routing and rewriting decisions, like squid's
+// url_rewrite_program.
+//
+// The helper is a long-lived process. For each request, cow writes one line
+// to the helper's stdin:
+//
+//   client host method url user
+//
+// user is "-" if the client is not authenticated by user name. For CONNECT
+// request, url is host:port. The helper replies one line on stdout:
+//
+//   OK               no change
+//   DIRECT           connect directly
+//   PROXY            connect through parent proxy
+//   REWRITE url      send request to url instead
+//   REDIRECT url     redirect client to url
+//   DENY             reject the request
+//
+// Requests are sent to the helper one at a time. If the helper fails or
+// doesn't reply in time, it's restarted and the request is processed as if
+// the helper replied OK.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyfdecyf/bufio"
+)
+
+const (
+	defaultHelperTimeout = 5 * time.Second
+	helperRestartDelay   = 5 * time.Second
+)
+
+type routeType byte
+
+const (
+	routeDefault routeType = iota
+	routeDirect
+	routeProxy
+)
+
+// Visit count used for requests routed by helper. User specified visit count
+// are not updated.
+var (
+	routeDirectCnt = newVisitCnt(userCnt, 0)
+	routeProxyCnt  = newVisitCnt(0, userCnt)
+)
+
+var errHelperUnavailable = errors.New("helper not running")
+
+type helperProc struct {
+	sync.Mutex
+	args     []string
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	reply    chan string
+	failedAt time.Time
+}
+
+var helper *helperProc
+
+func initHelper() {
+	if config.HelperProgram == "" {
+		return
+	}
+	helper = &helperProc{args: strings.Fields(config.HelperProgram)}
+	helper.Lock()
+	err := helper.start()
+	helper.Unlock()
+	if err != nil {
+		Fatal("start helper program:", err)
+	}
+}
+
+// start should be called with lock held.
+func (h *helperProc) start() error {
+	cmd := exec.Command(h.args[0], h.args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	// Only one request is outstanding, so at most one late reply after
+	// timeout. Buffer it so the reading goroutine can exit.
+	reply := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			reply <- scanner.Text()
+		}
+		close(reply)
+		cmd.Wait()
+	}()
+	h.cmd, h.stdin, h.reply = cmd, stdin, reply
+	debug.Println("helper started:", config.HelperProgram)
+	return nil
+}
+
+// stop should be called with lock held.
+func (h *helperProc) stop() {
+	if h.cmd == nil {
+		return
+	}
+	h.stdin.Close()
+	h.cmd.Process.Kill()
+	h.cmd = nil
+	h.failedAt = time.Now()
+}
+
+func (h *helperProc) query(line string) (string, error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.cmd == nil {
+		if time.Now().Sub(h.failedAt) < helperRestartDelay {
+			return "", errHelperUnavailable
+		}
+		if err := h.start(); err != nil {
+			h.failedAt = time.Now()
+			return "", err
+		}
+	}
+	if _, err := io.WriteString(h.stdin, line+"\n"); err != nil {
+		h.stop()
+		return "", err
+	}
+	select {
+	case s, ok := <-h.reply:
+		if !ok {
+			h.stop()
+			return "", errors.New("helper exited")
+		}
+		return s, nil
+	case <-time.After(config.HelperTimeout):
+		h.stop()
+		return "", errors.New("helper reply timeout")
+	}
+}
+
+func helperRequestLine(c *clientConn, r *Request) string {
+	clientIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	url := r.URL.HostPort
+	if !r.isConnect {
+		url = "http://" + r.URL.HostPort + r.URL.Path
+	}
+	user := c.user
+	if user == "" {
+		user = "-"
+	}
+	return strings.Join([]string{clientIP, r.URL.Host, r.Method, url, user}, " ")
+}
+
+// applyHelper asks helper for decision on the request. Returns errPageSent if
+// response is sent to the client.
+func (c *clientConn) applyHelper(r *Request) error {
+	reply, err := helper.query(helperRequestLine(c, r))
+	if err != nil {
+		errl.Printf("cli(%s) helper for %v: %v\n", c.RemoteAddr(), r, err)
+		return nil
+	}
+	return c.applyAction(r, reply, "helper")
+}
+
+// applyAction handles one helper style reply from source, which is also
+// used as route rule.
+func (c *clientConn) applyAction(r *Request, reply, source string) (err error) {
+	f := strings.Fields(reply)
+	if len(f) == 0 {
+		return nil
+	}
+	action := strings.ToUpper(f[0])
+	if (action == "REWRITE" || action == "REDIRECT") && len(f) < 2 {
+		errl.Printf("%s reply %q: no url\n", source, reply)
+		return nil
+	}
+	debug.Printf("cli(%s) %s %s for %v\n", c.RemoteAddr(), source, reply, r)
+	switch action {
+	case "OK":
+	case "DIRECT":
+		r.route = routeDirect
+		r.routeRule = source
+	case "PROXY":
+		r.route = routeProxy
+		r.routeRule = source
+	case "REWRITE":
+		if err = r.rewriteURL(f[1]); err != nil {
+			errl.Printf("%s rewrite %v to %s: %v\n", source, r, f[1], err)
+		}
+	case "REDIRECT":
+		if r.isConnect {
+			return c.helperDeny(r)
+		}
+		conn := "keep-alive"
+		if !r.ConnectionKeepAlive {
+			conn = "close"
+		}
+		_, err = fmt.Fprintf(c, "HTTP/1.1 302 Found\r\nLocation: %s\r\n"+
+			"Content-Length: 0\r\nConnection: %s\r\n\r\n", f[1], conn)
+		if err != nil {
+			return err
+		}
+		return errPageSent
+	case "DENY":
+		return c.helperDeny(r)
+	default:
+		errl.Printf("%s reply %q: unknown action\n", source, reply)
+	}
+	return nil
+}
+
+func (c *clientConn) helperDeny(r *Request) error {
+	sendErrorPage(c, statusForbidden, "Forbidden",
+		genErrMsg(r, nil, "Please contact proxy admin."))
+	return errPageSent
+}
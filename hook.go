@@ -0,0 +1,239 @@
+package cow
+
+// Connection event hooks for integrations.
+//
+//   connHook = http://127.0.0.1:8000/cow-events
+//   connHook = /usr/local/bin/usage-display --verbose
+//
+// An "open" event is fired when a client starts using a server connection,
+// new or taken from the connection pool, and a "close" event when the client
+// is done with it: after each plain HTTP request, or when a CONNECT tunnel
+// closes. Events are JSON objects like
+//
+//   {"event":"close","time":1500000000,"client":"192.168.1.5:52011",
+//    "user":"alice","dest":"www.example.com:443","route":"DIRECT",
+//    "sent":1024,"recv":65536,"duration":1200}
+//
+// sent and recv are bytes sent to and received from the server during the
+// use, duration is in milliseconds, they are 0 in open events. user is
+// empty if the client is not authenticated by user name.
+//
+// A connHook which is an http:// or https:// URL gets each event in a POST
+// request. Otherwise it's a program started by cow, which reads one event
+// per line on stdin, and is restarted if it exits. Events are delivered in
+// background and dropped if the queue is full, so a slow hook never slows
+// down requests. connHook can be given multiple times.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	connHookQueue        = 1024
+	connHookTimeout      = 5 * time.Second
+	connHookRestartDelay = 5 * time.Second
+)
+
+type connEvent struct {
+	Event    string `json:"event"`
+	Time     int64  `json:"time"`
+	Client   string `json:"client"`
+	User     string `json:"user"`
+	Dest     string `json:"dest"`
+	Route    string `json:"route"`
+	Sent     int64  `json:"sent"`
+	Recv     int64  `json:"recv"`
+	Duration int64  `json:"duration"` // milliseconds
+}
+
+// connUse is a client's use of a server connection.
+type connUse struct {
+	ev     connEvent
+	start  time.Time
+	sent   int64 // updated atomically
+	recv   int64
+	closed int32 // tunnel may be closed in two goroutines
+}
+
+type connHook struct {
+	target  string
+	queue   chan []byte
+	dropped int64 // updated atomically
+	failing bool  // only log the first error of consecutive failures
+}
+
+var connHooks []*connHook
+
+func initConnHook() {
+	connHooks = nil
+	for _, target := range config.ConnHook {
+		connHooks = append(connHooks, &connHook{target: target, queue: make(chan []byte, connHookQueue)})
+	}
+}
+
+func isHookURL(target string) bool {
+	return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
+
+func fireConnEvent(ev *connEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		errl.Println("connHook marshal event:", err)
+		return
+	}
+	b = append(b, '\n')
+	for _, h := range connHooks {
+		select {
+		case h.queue <- b:
+		default:
+			if n := atomic.AddInt64(&h.dropped, 1); n == 1 || n%1000 == 0 {
+				errl.Printf("connHook %s queue full, %d events dropped\n", h.target, n)
+			}
+		}
+	}
+}
+
+// hookOpen starts a use of the server connection by client c for request r.
+func (sv *serverConn) hookOpen(c *clientConn, r *Request) {
+	if len(connHooks) == 0 {
+		return
+	}
+	sv.hookClose()
+	now := time.Now()
+	u := &connUse{start: now}
+	u.ev = connEvent{
+		Event:  "open",
+		Time:   now.Unix(),
+		Client: c.RemoteAddr().String(),
+		User:   c.user,
+		Dest:   r.URL.HostPort,
+		Route:  routeName(sv.Conn),
+	}
+	sv.use = u
+	fireConnEvent(&u.ev)
+}
+
+// hookClose ends the current use of the server connection.
+func (sv *serverConn) hookClose() {
+	u := sv.use
+	if u == nil || !atomic.CompareAndSwapInt32(&u.closed, 0, 1) {
+		return
+	}
+	now := time.Now()
+	ev := u.ev
+	ev.Event = "close"
+	ev.Time = now.Unix()
+	ev.Sent = atomic.LoadInt64(&u.sent)
+	ev.Recv = atomic.LoadInt64(&u.recv)
+	ev.Duration = int64(now.Sub(u.start) / time.Millisecond)
+	fireConnEvent(&ev)
+}
+
+func (u *connUse) add(sent, recv int) {
+	if u == nil {
+		return
+	}
+	if sent > 0 {
+		atomic.AddInt64(&u.sent, int64(sent))
+	}
+	if recv > 0 {
+		atomic.AddInt64(&u.recv, int64(recv))
+	}
+}
+
+func (h *connHook) post(b []byte) error {
+	client := &http.Client{Timeout: connHookTimeout}
+	resp, err := client.Post(h.target, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// hookProc is a hook program reading events on stdin.
+type hookProc struct {
+	args     []string
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	failedAt time.Time
+}
+
+func (hp *hookProc) write(b []byte) error {
+	if hp.cmd == nil {
+		if time.Now().Sub(hp.failedAt) < connHookRestartDelay {
+			return errors.New("program not running")
+		}
+		cmd := exec.Command(hp.args[0], hp.args[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			hp.failedAt = time.Now()
+			return err
+		}
+		go cmd.Wait()
+		hp.cmd, hp.stdin = cmd, stdin
+	}
+	if _, err := hp.stdin.Write(b); err != nil {
+		hp.stop()
+		return err
+	}
+	return nil
+}
+
+func (hp *hookProc) stop() {
+	if hp.cmd == nil {
+		return
+	}
+	hp.stdin.Close()
+	hp.cmd.Process.Kill()
+	hp.cmd = nil
+	hp.failedAt = time.Now()
+}
+
+func (h *connHook) run(quit <-chan struct{}) {
+	var proc *hookProc
+	if !isHookURL(h.target) {
+		proc = &hookProc{args: strings.Fields(h.target)}
+		defer proc.stop()
+	}
+	for {
+		select {
+		case <-quit:
+			return
+		case b := <-h.queue:
+			var err error
+			if proc != nil {
+				err = proc.write(b)
+			} else {
+				err = h.post(b)
+			}
+			if err != nil && !h.failing {
+				errl.Printf("connHook %s: %v\n", h.target, err)
+			}
+			h.failing = err != nil
+		}
+	}
+}
+
+func runConnHook(quit <-chan struct{}) {
+	for _, h := range connHooks {
+		go h.run(quit)
+	}
+}
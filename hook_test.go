@@ -0,0 +1,69 @@
+package cow
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnHook(t *testing.T) {
+	events := make(chan connEvent, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev connEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error("decode event:", err)
+		}
+		events <- ev
+	}))
+	defer ts.Close()
+
+	saved := config.ConnHook
+	config.ConnHook = []string{ts.URL}
+	initConnHook()
+	defer func() {
+		config.ConnHook = saved
+		initConnHook()
+	}()
+	quit := make(chan struct{})
+	defer close(quit)
+	runConnHook(quit)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		b := make([]byte, 10)
+		c1.Read(b)
+		c1.Write([]byte("reply"))
+	}()
+	c := &clientConn{Conn: c1, user: "alice"}
+	url, _ := ParseRequestURI("http://www.example.com/")
+	sv := newServerConn(c2, url.HostPort, nil)
+	sv.hookOpen(c, &Request{URL: url})
+	sv.Write([]byte("req"))
+	sv.Read(make([]byte, 10))
+	sv.Close()
+	sv.Close()
+
+	for _, want := range []connEvent{
+		{Event: "open", User: "alice", Dest: "www.example.com:80", Route: "DIRECT"},
+		{Event: "close", User: "alice", Dest: "www.example.com:80", Route: "DIRECT", Sent: 3, Recv: 5},
+	} {
+		select {
+		case ev := <-events:
+			ev.Time, ev.Duration, ev.Client = 0, 0, ""
+			if ev != want {
+				t.Errorf("got event %+v, want %+v", ev, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no event for", want.Event)
+		}
+	}
+	select {
+	case ev := <-events:
+		t.Error("close should fire only once, got", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
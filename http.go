@@ -1,4 +1,4 @@
-package main
+package cow
 
 import (
 	"bytes"
@@ -14,7 +14,8 @@ import (
 const CRLF = "\r\n"
 
 const (
-	statusCodeContinue = 100
+	statusCodeContinue       = 100
+	statusCodeSwitchProtocol = 101
 )
 
 const (
@@ -22,6 +23,8 @@ const (
 	statusForbidden      = "403 Forbidden"
 	statusExpectFailed   = "417 Expectation Failed"
 	statusRequestTimeout = "408 Request Timeout"
+	statusBodyTooLarge   = "413 Request Entity Too Large"
+	statusUnavailable    = "503 Service Unavailable"
 )
 
 var CustomHttpErr = errors.New("CustomHttpErr")
@@ -30,11 +33,15 @@ type Header struct {
 	ContLen             int64
 	KeepAlive           time.Duration
 	ProxyAuthorization  string
+	ProxyAuthenticate   string // only used for parent proxy response
+	AcceptLanguage      string // used to localize pages generated by COW
 	Chunking            bool
 	Trailer             bool
 	ConnectionKeepAlive bool
 	ExpectContinue      bool
 	Host                string
+	Upgrade             string // lower case, only used for CONNECT-UDP
+	hostHeader          string // Host header of request with absolute URI
 }
 
 type rqState byte
@@ -59,10 +66,23 @@ type Request struct {
 	bodyStart  int // start of body in raw
 
 	Header
+	cache     *cacheRequest // nil if response can't be cached
+	route     routeType     // set by helper program or rule provider
+	routeRule string        // why the request is routed, for X-Cow-Route
+	pacRoute  []ParentProxy // proxies returned by parent PAC, nil is direct
+	sniURL    *URL          // server name in TLS ClientHello of tunnel
 	isConnect bool
 	partial   bool // whether contains only partial request data
 	state     rqState
 	tryCnt    byte
+
+	// sniffed from TLS ClientHello of tunnel for access log
+	helloSNI     string
+	helloALPN    string
+	helloSniffed bool
+
+	har       *harEntry // nil if not recorded
+	segmented bool      // body fetched in segments or resumed, server conn not reusable
 }
 
 // Assume keep-alive request by default.
@@ -150,6 +170,108 @@ func (r *Request) rawBody() []byte {
 	return r.raw.Bytes()[r.bodyStart:]
 }
 
+// insertHeader adds header lines before the empty line ending request header.
+// Request body must not be stored in raw.
+func (r *Request) insertHeader(h []byte) {
+	r.raw.Truncate(r.bodyStart - len(CRLF))
+	r.raw.Write(h)
+	r.raw.WriteString(CRLF)
+	r.bodyStart = r.raw.Len()
+}
+
+// replaceHeader replaces end-to-end headers with h. Headers generated by COW
+// are kept. Request body must not be stored in raw.
+func (r *Request) replaceHeader(h []byte) {
+	r.raw.Truncate(r.headStart)
+	r.raw.Write(h)
+	if r.Chunking {
+		r.raw.WriteString(fullHeaderTransferEncoding)
+	}
+	if r.ConnectionKeepAlive {
+		r.raw.WriteString(fullHeaderConnectionKeepAlive)
+	} else {
+		r.raw.WriteString(fullHeaderConnectionClose)
+	}
+	r.raw.WriteString(CRLF)
+	r.bodyStart = r.raw.Len()
+}
+
+// siteURL returns URL used for site stat and routing.
+func (r *Request) siteURL() *URL {
+	if r.sniURL != nil {
+		return r.sniURL
+	}
+	return r.URL
+}
+
+// initTunnel creates a CONNECT request to hostPort, used for connections
+// intercepted transparently.
+func (r *Request) initTunnel(hostPort string) {
+	r.reset()
+	r.Method = "CONNECT"
+	r.URL = &URL{}
+	r.URL.ParseHostPort(hostPort)
+	r.Header.Host = r.URL.HostPort
+	r.isConnect = true
+	if config.saveReqLine {
+		r.raw.WriteString("CONNECT " + hostPort + " HTTP/1.1\r\n")
+		r.reqLnStart = r.raw.Len()
+	}
+	r.headStart = r.raw.Len()
+	r.raw.WriteString("Host: " + hostPort + CRLF + CRLF)
+	r.bodyStart = r.raw.Len()
+}
+
+// rewriteURL changes the request to rawurl, request line and Host header are
+// regenerated. Request body must not be stored in raw.
+func (r *Request) rewriteURL(rawurl string) error {
+	if r.isConnect {
+		rawurl = strings.TrimPrefix(rawurl, "https://")
+	} else if !strings.HasPrefix(rawurl, "http://") {
+		return errors.New("only http url is supported")
+	}
+	url, err := ParseRequestURI(rawurl)
+	if err != nil {
+		return err
+	}
+	if url.Host == "" {
+		return errors.New("no host in url")
+	}
+	host := url.HostPort
+	if url.Port == "80" {
+		host = url.Host
+	}
+
+	raw := r.raw.Bytes()
+	header := make([]byte, r.bodyStart-r.headStart)
+	copy(header, raw[r.headStart:r.bodyStart])
+
+	r.URL = url
+	r.Header.Host = host
+	r.raw.Reset()
+	r.reqLnStart = 0
+	if config.saveReqLine || (r.isConnect && bool(dbgRq) && verbose) {
+		fmt.Fprintf(r.raw, "%s %s HTTP/1.1\r\n", r.Method, rawurl)
+		if config.saveReqLine {
+			r.reqLnStart = r.raw.Len()
+		}
+	}
+	if !r.isConnect {
+		r.genRequestLine()
+	}
+	r.headStart = r.raw.Len()
+	r.raw.WriteString("Host: " + host + CRLF)
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		if len(line) > len(headerHost) && line[len(headerHost)] == ':' &&
+			strings.EqualFold(string(line[:len(headerHost)]), headerHost) {
+			continue
+		}
+		r.raw.Write(line)
+	}
+	r.bodyStart = r.raw.Len()
+	return nil
+}
+
 func (r *Request) proxyRequestLine() []byte {
 	return r.raw.Bytes()[0:r.reqLnStart]
 }
@@ -200,6 +322,14 @@ func (rp *Response) releaseBuf() {
 	}
 }
 
+// insertHeader adds header lines before the empty line ending response
+// header.
+func (rp *Response) insertHeader(h string) {
+	rp.raw.Truncate(rp.raw.Len() - len(CRLF))
+	rp.raw.WriteString(h)
+	rp.raw.WriteString(CRLF)
+}
+
 func (rp *Response) rawResponse() []byte {
 	return rp.raw.Bytes()
 }
@@ -235,6 +365,30 @@ func (url *URL) String() string {
 	return url.HostPort + url.Path
 }
 
+// hostMatch returns whether Host header value refers to the same host and
+// port as url. Port may be omitted for the default port.
+func (url *URL) hostMatch(hostHeader string) bool {
+	host, port, err := net.SplitHostPort(hostHeader)
+	if err != nil {
+		host = hostHeader
+		if url.Port != "80" && url.Port != "443" {
+			return false
+		}
+	} else if port != url.Port {
+		return false
+	}
+	trim := func(h string) string {
+		return strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(h, "["), "]"), ".")
+	}
+	return strings.EqualFold(trim(host), trim(url.Host))
+}
+
+// hostMismatch returns whether the request has absolute URI with host
+// different from Host header.
+func (r *Request) hostMismatch() bool {
+	return !r.isConnect && r.hostHeader != "" && !r.URL.hostMatch(r.hostHeader)
+}
+
 // Set all fields according to hostPort except Path.
 func (url *URL) ParseHostPort(hostPort string) {
 	if hostPort == "" {
@@ -318,6 +472,7 @@ func ParseRequestURIBytes(rawurl []byte) (*URL, error) {
 // Firefox and Safari send this header along with "Connection" header.
 // See more at http://homepage.ntlworld.com/jonathan.deboynepollard/FGA/web-proxy-connection-header.html
 const (
+	headerAcceptLanguage     = "accept-language"
 	headerConnection         = "connection"
 	headerContentLength      = "content-length"
 	headerExpect             = "expect"
@@ -339,15 +494,18 @@ const (
 
 // Using Go's method expression
 var headerParser = map[string]HeaderParserFunc{
+	headerAcceptLanguage:     (*Header).parseAcceptLanguage,
 	headerConnection:         (*Header).parseConnection,
 	headerContentLength:      (*Header).parseContentLength,
 	headerExpect:             (*Header).parseExpect,
 	headerHost:               (*Header).parseHost,
 	headerKeepAlive:          (*Header).parseKeepAlive,
+	headerProxyAuthenticate:  (*Header).parseProxyAuthenticate,
 	headerProxyAuthorization: (*Header).parseProxyAuthorization,
 	headerProxyConnection:    (*Header).parseConnection,
 	headerTransferEncoding:   (*Header).parseTransferEncoding,
 	headerTrailer:            (*Header).parseTrailer,
+	headerUpgrade:            (*Header).parseUpgrade,
 }
 
 var hopByHopHeader = map[string]bool{
@@ -391,6 +549,12 @@ func (h *Header) parseContentLength(s []byte) (err error) {
 func (h *Header) parseHost(s []byte) (err error) {
 	if h.Host == "" {
 		h.Host = string(s)
+	} else if h.hostHeader == "" {
+		// Host is from absolute URI, keep the header for hostMismatch.
+		h.hostHeader = string(s)
+	} else {
+		// Multiple Host headers never match the URI.
+		h.hostHeader += ", " + string(s)
 	}
 	return
 }
@@ -417,6 +581,24 @@ func (h *Header) parseProxyAuthorization(s []byte) error {
 	return nil
 }
 
+// parseProxyAuthenticate prefers Digest if there are several challenges.
+func (h *Header) parseProxyAuthenticate(s []byte) error {
+	if h.ProxyAuthenticate == "" || bytes.HasPrefix(bytes.ToLower(s), []byte("digest")) {
+		h.ProxyAuthenticate = string(s)
+	}
+	return nil
+}
+
+func (h *Header) parseUpgrade(s []byte) error {
+	h.Upgrade = strings.ToLower(string(s))
+	return nil
+}
+
+func (h *Header) parseAcceptLanguage(s []byte) error {
+	h.AcceptLanguage = string(s)
+	return nil
+}
+
 func (h *Header) parseTransferEncoding(s []byte) error {
 	ASCIIToLowerInplace(s)
 	// For transfer-encoding: identify, it's the same as specifying neither
@@ -695,9 +877,10 @@ func parseResponse(sv *serverConn, r *Request, rp *Response) (err error) {
 	if !bytes.Equal(proto[0:7], []byte("HTTP/1.")) {
 		return fmt.Errorf("invalid response status line: %s request %v", string(f[0]), r)
 	}
+	http10 := proto[7] == '0'
 	if proto[7] == '1' {
 		rp.raw.Write(s)
-	} else if proto[7] == '0' {
+	} else if http10 {
 		// Should return HTTP version as 1.1 to client since closed connection
 		// will be converted to chunked encoding
 		rp.genStatusLine()
@@ -721,21 +904,29 @@ func parseResponse(sv *serverConn, r *Request, rp *Response) (err error) {
 		errl.Println("Ignore server 100 response for", r)
 		return parseResponse(sv, r, rp)
 	}
+	if rp.Status > statusCodeContinue && rp.Status < 200 && rp.Status != statusCodeSwitchProtocol {
+		// Interim response like 103 Early Hints. Sending it to client would
+		// make the final response taken as response to the next request.
+		debug.Printf("ignore server %d response for %v\n", rp.Status, r)
+		return parseResponse(sv, r, rp)
+	}
 
 	if rp.Chunking {
 		rp.raw.WriteString(fullHeaderTransferEncoding)
 	} else if rp.ContLen == -1 {
-		// No chunk, no content length, assume close to signal end.
-		rp.ConnectionKeepAlive = false
 		if rp.hasBody(r.Method) {
-			// Connection close, no content length specification.
+			// No chunk, no content length, close signals end of body.
 			// Use chunked encoding to pass content back to client.
+			rp.ConnectionKeepAlive = false
 			debug.Println("add chunked encoding to close connection response", r, rp)
 			rp.raw.WriteString(fullHeaderTransferEncoding)
-		} else {
-			debug.Println("add content-length 0 to close connection response", r, rp)
-			rp.raw.WriteString("Content-Length: 0\r\n")
+		} else if http10 {
+			// HTTP/1.0 server may close connection after response without
+			// body, don't reuse it.
+			rp.ConnectionKeepAlive = false
 		}
+		// Response to HEAD, 204 and 304 ends after header, content length
+		// should not be added as it describes the entity for HEAD and 304.
 	}
 	// Whether COW should respond with keep-alive depends on client request,
 	// not server response.
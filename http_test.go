@@ -1,4 +1,4 @@
-package main
+package cow
 
 import (
 	"bytes"
@@ -109,3 +109,57 @@ func TestParseHeader(t *testing.T) {
 		}
 	}
 }
+
+func TestRewriteURL(t *testing.T) {
+	var r Request
+	r.reset()
+	r.Method = "GET"
+	r.URL, _ = ParseRequestURI("http://www.example.com/old")
+	r.genRequestLine()
+	r.headStart = r.raw.Len()
+	r.raw.WriteString("Host: www.example.com\r\nAccept: */*\r\n" + fullHeaderConnectionKeepAlive + CRLF)
+	r.bodyStart = r.raw.Len()
+
+	if err := r.rewriteURL("http://mirror.example.org:8080/new?a=1"); err != nil {
+		t.Fatal("rewrite url:", err)
+	}
+	if r.URL.HostPort != "mirror.example.org:8080" || r.Header.Host != "mirror.example.org:8080" {
+		t.Error("host not rewritten, got", r.URL.HostPort, r.Header.Host)
+	}
+	expected := "GET /new?a=1 HTTP/1.1\r\nHost: mirror.example.org:8080\r\nAccept: */*\r\n" +
+		fullHeaderConnectionKeepAlive + CRLF
+	if string(r.rawRequest()) != expected {
+		t.Errorf("rewritten request should be\n%q\ngot\n%q\n", expected, r.rawRequest())
+	}
+	if err := r.rewriteURL("ftp://www.example.com/"); err == nil {
+		t.Error("ftp url should be rejected")
+	}
+}
+
+func TestHostMatch(t *testing.T) {
+	testData := []struct {
+		url   string
+		host  string
+		match bool
+	}{
+		{"http://www.example.com/", "www.example.com", true},
+		{"http://www.example.com/", "WWW.Example.com.", true},
+		{"http://www.example.com/", "www.example.com:80", true},
+		{"http://www.example.com:8080/", "www.example.com", false},
+		{"http://www.example.com:8080/", "www.example.com:8080", true},
+		{"https://www.example.com/", "www.example.com", true},
+		{"http://www.example.com/", "evil.example.com", false},
+		{"http://www.example.com/", "www.example.com:81", false},
+		{"http://www.example.com/", "www.example.com, evil.example.com", false},
+		{"http://[::1]/", "[::1]", true},
+	}
+	for _, td := range testData {
+		url, err := ParseRequestURI(td.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if url.hostMatch(td.host) != td.match {
+			t.Errorf("%s with Host %s should match %v", td.url, td.host, td.match)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package cow
+
+// Localization for pages generated by COW (error pages, 407 authentication
+// page and the landing page).
+//
+// English messages in the code are used as message id. A locale is a map
+// from the English message to its translation, missing translation falls
+// back to English. Besides the builtin locales, user can put translation
+// files under localeDir, the file name is the language tag (e.g. zh-TW) and
+// each line has the form:
+//
+//   English message = translation
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cyfdecyf/bufio"
+)
+
+const defaultLocaleTag = "en"
+
+type locale struct {
+	tag string
+	msg map[string]string
+}
+
+func (l *locale) tr(s string) string {
+	if l == nil {
+		return s
+	}
+	if t, ok := l.msg[s]; ok {
+		return t
+	}
+	return s
+}
+
+var builtinLocale = map[string]map[string]string{
+	"en": {},
+	"zh-CN": {
+		"Error":        "错误",
+		"Generated by": "生成自",
+		"Host":         "主机",
+		"HTTP Request": "HTTP 请求",
+		"Using":        "使用",
+
+		"Proxy authentication required": "需要代理认证",
+		"COW proxy is running.":         "COW 代理正在运行。",
+		"PAC url":                       "PAC 地址",
+
+		"Page not found":                                       "页面不存在",
+		"Serving request to COW proxy.":                        "请求的是 COW 代理本身。",
+		"Bad request":                                          "错误的请求",
+		"Bad authorization request":                            "错误的认证请求",
+		"Forbidden":                                            "禁止访问",
+		"Forbidden tunnel port":                                "禁止建立隧道的端口",
+		"Please contact proxy admin.":                          "请联系代理管理员。",
+		"Expect header not supported":                          "不支持 Expect 头",
+		"Request body too large":                               "请求内容过大",
+		"Request body exceeds the size limit of the proxy.":    "请求内容超过代理的大小限制。",
+		"Host header mismatch":                                 "Host 头不一致",
+		"Host header differs from the host in request URI.":    "Host 头与请求 URL 中的主机不一致。",
+		"Can't finish HTTP request":                            "无法完成 HTTP 请求",
+		"Has tried several times.":                             "已尝试多次。",
+		"parse response":                                       "解析响应",
+		"read response body":                                   "读取响应内容",
+		"Your browser didn't send a complete request in time.": "浏览器未能及时发送完整请求。",
+		"Please contact COW's developer if you see this.":      "如果看到此页面，请联系 COW 开发者。",
+		"Request is too large to hold in buffer, can't retry. Refresh to retry may work.": "请求太大无法缓存，不能重试。刷新页面重试可能有效。",
+		"Parent proxy connection failed, always use parent proxy.":                        "连接二级代理失败，已设置总是使用二级代理。",
+		"Parent proxy connection failed, always blocked site.":                            "连接二级代理失败，该网站总是被墙。",
+		"Parent proxy connection failed, temporarily blocked site.":                       "连接二级代理失败，该网站暂时被认为被墙。",
+		"Parent proxy and direct connection failed, maybe blocked site.":                  "二级代理和直连均失败，网站可能被墙。",
+		"Direct connection failed, no parent proxy.":                                      "直连失败，没有二级代理。",
+		"Direct connection failed, always direct site.":                                   "直连失败，该网站总是直连。",
+		"Direct and parent proxy connection failed, maybe blocked site.":                  "直连和二级代理均失败，网站可能被墙。",
+		"Request is queued and will be sent again when parent proxy recovers.":            "请求已加入队列，二级代理恢复后将重新发送。",
+		"Proxy under maintenance":                                                         "代理正在维护",
+		"The proxy is under maintenance, please retry later.":                             "代理正在维护，请稍后重试。",
+		"Too many connections":                                                            "连接数过多",
+		"Too many concurrent connections for the user.":                                   "该用户的并发连接数超过限制。",
+		"The site is not allowed for the user.":                                           "该用户不允许访问此网站。",
+		"Traffic quota exceeded":                                                          "流量超额",
+		"Traffic quota of the user is used up.":                                           "该用户的流量配额已用完。",
+	},
+}
+
+var locales struct {
+	byTag map[string]*locale // key is lower case language tag
+	tags  []string           // sorted keys of byTag, for stable matching
+	def   *locale            // used when nothing matches
+}
+
+func addLocale(tag string, msg map[string]string) {
+	key := strings.ToLower(tag)
+	if l, ok := locales.byTag[key]; ok {
+		// User translation overrides builtin one.
+		for k, v := range msg {
+			l.msg[k] = v
+		}
+		return
+	}
+	l := &locale{tag: tag, msg: make(map[string]string, len(msg))}
+	for k, v := range msg {
+		l.msg[k] = v
+	}
+	locales.byTag[key] = l
+	locales.tags = append(locales.tags, key)
+	sort.Strings(locales.tags)
+}
+
+func loadLocaleFile(fpath string) (msg map[string]string, err error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	IgnoreUTF8BOM(f)
+
+	msg = make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		v := strings.SplitN(line, "=", 2)
+		if len(v) != 2 {
+			errl.Printf("locale file %s line %d: no = found\n", fpath, n)
+			continue
+		}
+		msg[strings.TrimSpace(v[0])] = strings.TrimSpace(v[1])
+	}
+	return msg, scanner.Err()
+}
+
+func loadLocaleDir(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := isDirExists(dir); err != nil {
+		if !os.IsNotExist(err) {
+			errl.Println("locale dir:", err)
+		}
+		return
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		errl.Println("read locale dir:", err)
+		return
+	}
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || fi.Name()[0] == '.' {
+			continue
+		}
+		tag := strings.TrimSuffix(fi.Name(), ".txt")
+		msg, err := loadLocaleFile(path.Join(dir, fi.Name()))
+		if err != nil {
+			errl.Printf("load locale %s: %v\n", fi.Name(), err)
+			continue
+		}
+		debug.Printf("loaded locale %s %d messages\n", tag, len(msg))
+		addLocale(tag, msg)
+	}
+}
+
+func initLocale() {
+	locales.byTag = make(map[string]*locale)
+	locales.tags = nil
+	for tag, msg := range builtinLocale {
+		addLocale(tag, msg)
+	}
+	loadLocaleDir(config.LocaleDir)
+
+	locales.def = locales.byTag[defaultLocaleTag]
+	if config.Locale != "" {
+		l, ok := locales.byTag[strings.ToLower(config.Locale)]
+		if !ok {
+			Fatalf("no such locale %s\n", config.Locale)
+		}
+		locales.def = l
+	}
+}
+
+type langQ struct {
+	tag string
+	q   float64
+}
+
+type byQ []langQ
+
+func (a byQ) Len() int           { return len(a) }
+func (a byQ) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byQ) Less(i, j int) bool { return a[i].q > a[j].q }
+
+// parseAcceptLanguage returns language tags in preference order.
+func parseAcceptLanguage(val string) []string {
+	var lq []langQ
+	for _, s := range strings.Split(val, ",") {
+		arr := strings.Split(strings.TrimSpace(s), ";")
+		tag := strings.ToLower(strings.TrimSpace(arr[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range arr[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			lq = append(lq, langQ{tag, q})
+		}
+	}
+	sort.Stable(byQ(lq))
+	tags := make([]string, len(lq))
+	for i, l := range lq {
+		tags[i] = l.tag
+	}
+	return tags
+}
+
+// findLocale selects locale for pages sent to client. Locale specified in
+// config takes precedence over the client's Accept-Language header.
+func findLocale(acceptLanguage string) *locale {
+	if config.Locale != "" || acceptLanguage == "" {
+		return locales.def
+	}
+	for _, tag := range parseAcceptLanguage(acceptLanguage) {
+		if l, ok := locales.byTag[tag]; ok {
+			return l
+		}
+		// Match on primary language, e.g. zh matches zh-CN. The first in
+		// sorted order is used if there are several, e.g. zh-CN and zh-TW.
+		primary := tag
+		if id := strings.Index(tag, "-"); id != -1 {
+			primary = tag[:id]
+		}
+		if l, ok := locales.byTag[primary]; ok {
+			return l
+		}
+		for _, key := range locales.tags {
+			if strings.HasPrefix(key, primary+"-") {
+				return locales.byTag[key]
+			}
+		}
+	}
+	return locales.def
+}
@@ -0,0 +1,51 @@
+package cow
+
+import (
+	"testing"
+)
+
+func TestFindLocale(t *testing.T) {
+	config.LocaleDir = ""
+	initLocale()
+
+	testData := []struct {
+		acceptLang string
+		tag        string
+	}{
+		{"", "en"},
+		{"zh-CN,zh;q=0.8,en;q=0.6", "zh-CN"},
+		{"zh", "zh-CN"},
+		{"zh-TW", "zh-CN"},
+		{"en-US,en;q=0.8,zh-CN;q=0.6", "en"},
+		{"en;q=0.5, zh-cn", "zh-CN"},
+		{"fr-FR,fr;q=0.8", "en"},
+		{"fr;q=0.9,zh;q=0", "en"},
+		{"*", "en"},
+	}
+	for _, td := range testData {
+		l := findLocale(td.acceptLang)
+		if l.tag != td.tag {
+			t.Errorf("%q should select %s, got %s\n", td.acceptLang, td.tag, l.tag)
+		}
+	}
+
+	l := findLocale("zh-CN")
+	if l.tr("Page not found") == "Page not found" {
+		t.Error("zh-CN should translate \"Page not found\"")
+	}
+	if l.tr("no such message") != "no such message" {
+		t.Error("untranslated message should be returned as is")
+	}
+
+	// Primary language fallback is stable with several matching locales.
+	addLocale("zh-TW", map[string]string{"Page not found": "找不到網頁"})
+	defer initLocale()
+	for i := 0; i < 20; i++ {
+		if l := findLocale("zh-HK"); l.tag != "zh-CN" {
+			t.Fatal("zh-HK should select zh-CN, got", l.tag)
+		}
+	}
+	if l := findLocale("zh-TW"); l.tag != "zh-TW" {
+		t.Error("zh-TW should select zh-TW, got", l.tag)
+	}
+}
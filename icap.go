@@ -0,0 +1,372 @@
+package cow
+
+// ICAP (RFC 3507) client for content scanning of plain HTTP traffic.
+//
+// REQMOD is sent with the request header only, request body is not scanned.
+// RESPMOD is sent for responses with Content-Length not exceeding
+// icapMaxBodySize, other responses are passed through without scanning.
+// A new connection is used for each ICAP transaction.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cyfdecyf/bufio"
+)
+
+const (
+	defaultIcapMaxBodySize = 1024 * 1024
+	icapTimeout            = 60 * time.Second
+)
+
+type icapService struct {
+	url      string // icap://host[:port]/path
+	hostPort string
+}
+
+var icap struct {
+	reqmod  *icapService
+	respmod *icapService
+}
+
+func parseIcapURL(val string) (*icapService, error) {
+	u, err := url.Parse(val)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "icap" || u.Host == "" {
+		return nil, errors.New("should be icap://host[:port]/service")
+	}
+	hostPort := u.Host
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		hostPort = net.JoinHostPort(hostPort, "1344")
+	}
+	return &icapService{url: val, hostPort: hostPort}, nil
+}
+
+type icapResponse struct {
+	status  int
+	reqHdr  []byte // modified request header
+	resHdr  []byte // modified or generated response header
+	body    []byte
+	hasBody bool
+}
+
+func (ir *icapResponse) modified() bool {
+	return ir.status == 200
+}
+
+// icapSection is an encapsulated message part. Body must be the last one.
+type icapSection struct {
+	name string
+	data []byte
+}
+
+func (s *icapService) roundTrip(method string, sections []icapSection) (*icapResponse, error) {
+	var enc []string
+	msg := new(bytes.Buffer)
+	for _, sec := range sections {
+		enc = append(enc, fmt.Sprintf("%s=%d", sec.name, msg.Len()))
+		if strings.HasSuffix(sec.name, "-body") && sec.name != "null-body" {
+			if len(sec.data) > 0 {
+				fmt.Fprintf(msg, "%x\r\n", len(sec.data))
+				msg.Write(sec.data)
+				msg.WriteString(CRLF)
+			}
+			msg.WriteString("0\r\n\r\n")
+		} else {
+			msg.Write(sec.data)
+		}
+	}
+
+	cn, err := net.DialTimeout("tcp", s.hostPort, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer cn.Close()
+	cn.SetDeadline(time.Now().Add(icapTimeout))
+
+	host, _, _ := net.SplitHostPort(s.hostPort)
+	req := new(bytes.Buffer)
+	fmt.Fprintf(req, "%s %s ICAP/1.0\r\n", method, s.url)
+	fmt.Fprintf(req, "Host: %s\r\n", host)
+	req.WriteString("Allow: 204\r\n")
+	req.WriteString("Connection: close\r\n")
+	fmt.Fprintf(req, "Encapsulated: %s\r\n\r\n", strings.Join(enc, ", "))
+	req.Write(msg.Bytes())
+	if _, err = cn.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+	return readIcapResponse(bufio.NewReader(cn))
+}
+
+func readIcapResponse(rd *bufio.Reader) (*icapResponse, error) {
+	line, err := rd.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	f := FieldsN(line, 3)
+	if len(f) < 2 || !bytes.HasPrefix(f[0], []byte("ICAP/")) {
+		return nil, fmt.Errorf("malformed ICAP status line %q", line)
+	}
+	status, err := ParseIntFromBytes(f[1], 10)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ICAP status line %q", line)
+	}
+	ir := &icapResponse{status: int(status)}
+
+	var encapsulated string
+	for {
+		if line, err = rd.ReadSlice('\n'); err != nil {
+			return nil, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			break
+		}
+		kv := bytes.SplitN(line, []byte(":"), 2)
+		if len(kv) == 2 && strings.EqualFold(string(kv[0]), "encapsulated") {
+			encapsulated = string(bytes.TrimSpace(kv[1]))
+		}
+	}
+	switch ir.status {
+	case 204:
+		return ir, nil
+	case 200:
+	default:
+		return nil, fmt.Errorf("ICAP server returns %d", ir.status)
+	}
+
+	type part struct {
+		name string
+		off  int
+	}
+	var parts []part
+	for _, s := range strings.Split(encapsulated, ",") {
+		kv := strings.SplitN(strings.TrimSpace(s), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed ICAP Encapsulated header %q", encapsulated)
+		}
+		off, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed ICAP Encapsulated header %q", encapsulated)
+		}
+		parts = append(parts, part{kv[0], off})
+	}
+	for i, p := range parts {
+		if strings.HasSuffix(p.name, "-body") {
+			if p.name != "null-body" {
+				ir.body, err = readIcapChunked(rd)
+				ir.hasBody = true
+			}
+			return ir, err
+		}
+		if i+1 == len(parts) || parts[i+1].off < p.off {
+			return nil, fmt.Errorf("malformed ICAP Encapsulated header %q", encapsulated)
+		}
+		buf := make([]byte, parts[i+1].off-p.off)
+		if _, err = io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		switch p.name {
+		case "req-hdr":
+			ir.reqHdr = buf
+		case "res-hdr":
+			ir.resHdr = buf
+		}
+	}
+	return ir, nil
+}
+
+func readIcapChunked(rd *bufio.Reader) ([]byte, error) {
+	body := new(bytes.Buffer)
+	for {
+		line, err := rd.ReadSlice('\n')
+		if err != nil {
+			return nil, err
+		}
+		// Remove chunk extension, e.g. "0; ieof".
+		if id := bytes.IndexByte(line, ';'); id != -1 {
+			line = line[:id]
+		}
+		size, err := ParseIntFromBytes(bytes.TrimSpace(line), 16)
+		if err != nil {
+			return nil, fmt.Errorf("ICAP chunk size: %v", err)
+		}
+		if size == 0 {
+			// skip trailer
+			for {
+				if line, err = rd.ReadSlice('\n'); err != nil {
+					return nil, err
+				}
+				if len(bytes.TrimSpace(line)) == 0 {
+					return body.Bytes(), nil
+				}
+			}
+		}
+		if _, err = io.CopyN(body, rd, size); err != nil {
+			return nil, err
+		}
+		if err = skipCRLF(rd); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// icapRequestHeader returns request header with absolute URI as sent by
+// client.
+func icapRequestHeader(r *Request) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(r.Method + " http://" + r.URL.HostPort)
+	if r.URL.Path == "" {
+		buf.WriteString("/")
+	} else {
+		buf.WriteString(r.URL.Path)
+	}
+	buf.WriteString(" HTTP/1.1\r\n")
+	buf.Write(r.raw.Bytes()[r.headStart:r.bodyStart])
+	return buf.Bytes()
+}
+
+// endToEndHeader splits header returned by ICAP server into status/request
+// line and header lines. Hop-by-hop headers and the terminating empty line are
+// removed, as well as Content-Length if skipContLen is true.
+func endToEndHeader(hdr []byte, skipContLen bool) (statusLine []byte, lines []byte) {
+	id := bytes.IndexByte(hdr, '\n')
+	if id == -1 {
+		return hdr, nil
+	}
+	buf := new(bytes.Buffer)
+	for _, line := range bytes.SplitAfter(hdr[id+1:], []byte("\n")) {
+		cid := bytes.IndexByte(line, ':')
+		if cid <= 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(string(line[:cid])))
+		if hopByHopHeader[name] || (skipContLen && name == headerContentLength) {
+			continue
+		}
+		buf.Write(line)
+	}
+	return hdr[:id+1], buf.Bytes()
+}
+
+func (c *clientConn) icapFailed(r *Request, err error) error {
+	errl.Printf("cli(%s) ICAP %v %v\n", c.RemoteAddr(), err, r)
+	if config.IcapBypass {
+		return nil
+	}
+	sendErrorPage(c, "502 ICAP error", "Content scanning failed",
+		genErrMsg(r, nil, "Please contact proxy admin."))
+	return errPageSent
+}
+
+// icapReqmod sends request header to ICAP server. If the ICAP server
+// generates a response (e.g. the request is blocked), it's sent to the client
+// and errPageSent is returned.
+func (c *clientConn) icapReqmod(r *Request) error {
+	ir, err := icap.reqmod.roundTrip("REQMOD", []icapSection{
+		{"req-hdr", icapRequestHeader(r)},
+		{"null-body", nil},
+	})
+	if err != nil {
+		return c.icapFailed(r, err)
+	}
+	if !ir.modified() {
+		return nil
+	}
+	if ir.resHdr != nil {
+		debug.Printf("cli(%s) ICAP REQMOD response %v\n", c.RemoteAddr(), r)
+		statusLine, lines := endToEndHeader(ir.resHdr, true)
+		buf := new(bytes.Buffer)
+		buf.Write(statusLine)
+		buf.Write(lines)
+		fmt.Fprintf(buf, "Content-Length: %d\r\n", len(ir.body))
+		if r.ConnectionKeepAlive {
+			buf.WriteString(fullHeaderConnectionKeepAlive)
+		} else {
+			buf.WriteString(fullHeaderConnectionClose)
+		}
+		buf.WriteString(CRLF)
+		buf.Write(ir.body)
+		if _, err = c.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		return errPageSent
+	}
+	if ir.reqHdr != nil {
+		// Only header modification is supported, request line is kept.
+		debug.Printf("cli(%s) ICAP REQMOD modified request %v\n", c.RemoteAddr(), r)
+		_, lines := endToEndHeader(ir.reqHdr, false)
+		r.replaceHeader(lines)
+	}
+	return nil
+}
+
+// icapRespmod sends response to ICAP server if it's small enough. It returns
+// the reader for response body to send to client, which is not the server
+// connection if body is read for scanning.
+func (c *clientConn) icapRespmod(sv *serverConn, r *Request, rp *Response) (*bufio.Reader, error) {
+	hasBody := rp.hasBody(r.Method)
+	if hasBody && (rp.Chunking || rp.ContLen < 0 || rp.ContLen > config.IcapMaxBodySize) {
+		return sv.bufRd, nil
+	}
+	var body []byte
+	if hasBody {
+		body = make([]byte, rp.ContLen)
+		if _, err := io.ReadFull(sv.bufRd, body); err != nil {
+			return nil, c.handleServerReadError(r, sv, err, "read response body")
+		}
+	}
+	origBody := bufio.NewReader(bytes.NewReader(body))
+
+	sections := []icapSection{
+		{"req-hdr", icapRequestHeader(r)},
+		{"res-hdr", rp.rawResponse()},
+	}
+	if hasBody {
+		sections = append(sections, icapSection{"res-body", body})
+	} else {
+		sections = append(sections, icapSection{"null-body", nil})
+	}
+	ir, err := icap.respmod.roundTrip("RESPMOD", sections)
+	if err != nil {
+		return origBody, c.icapFailed(r, err)
+	}
+	if !ir.modified() || ir.resHdr == nil {
+		return origBody, nil
+	}
+
+	debug.Printf("cli(%s) ICAP RESPMOD modified response %v\n", c.RemoteAddr(), r)
+	statusLine, lines := endToEndHeader(ir.resHdr, true)
+	f := FieldsN(statusLine, 3)
+	if len(f) < 2 {
+		return origBody, c.icapFailed(r, fmt.Errorf("malformed status line %q", statusLine))
+	}
+	status, err := ParseIntFromBytes(f[1], 10)
+	if err != nil {
+		return origBody, c.icapFailed(r, fmt.Errorf("malformed status line %q", statusLine))
+	}
+	rp.Status = int(status)
+	rp.ContLen = int64(len(ir.body))
+	rp.Chunking = false
+	rp.raw.Reset()
+	rp.raw.Write(statusLine)
+	rp.raw.Write(lines)
+	fmt.Fprintf(rp.raw, "Content-Length: %d\r\n", rp.ContLen)
+	if r.ConnectionKeepAlive {
+		rp.raw.WriteString(fullHeaderConnectionKeepAlive)
+		rp.raw.WriteString(fullKeepAliveHeader)
+	} else {
+		rp.raw.WriteString(fullHeaderConnectionClose)
+	}
+	rp.raw.WriteString(CRLF)
+	return bufio.NewReader(bytes.NewReader(ir.body)), nil
+}
@@ -0,0 +1,40 @@
+package cow
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cyfdecyf/bufio"
+)
+
+func TestReadIcapResponse(t *testing.T) {
+	resHdr := "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\n\r\n"
+	testData := []struct {
+		raw    string
+		status int
+		resHdr string
+		body   string
+	}{
+		{"ICAP/1.0 204 No Content\r\nISTag: x\r\n\r\n", 204, "", ""},
+		{"ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=52\r\n\r\n" +
+			resHdr + "5\r\nhello\r\n6; ieof\r\n world\r\n0\r\n\r\n",
+			200, resHdr, "hello world"},
+		{"ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, null-body=52\r\n\r\n" + resHdr,
+			200, resHdr, ""},
+	}
+	for _, td := range testData {
+		ir, err := readIcapResponse(bufio.NewReader(strings.NewReader(td.raw)))
+		if err != nil {
+			t.Errorf("%q: %v", td.raw, err)
+			continue
+		}
+		if ir.status != td.status || string(ir.resHdr) != td.resHdr || string(ir.body) != td.body {
+			t.Errorf("%q: got status %d res-hdr %q body %q", td.raw, ir.status, ir.resHdr, ir.body)
+		}
+	}
+
+	if _, err := readIcapResponse(bufio.NewReader(strings.NewReader(
+		"ICAP/1.0 500 Server Error\r\n\r\n"))); err == nil {
+		t.Error("ICAP error status should return error")
+	}
+}
@@ -0,0 +1,643 @@
+package cow
+
+// Import config of other proxy clients.
+//
+// `cow -import file` converts proxies and rules in Surge, Quantumult X or
+// Clash config to cow config. Converted options are appended to the config
+// file (created if not exist, the old one is kept as rc.bak), rules are
+// written to rule provider files in the config directory:
+//
+//   proxy = ss://aes-128-cfb:password@1.2.3.4:8388
+//   ruleProvider = proxy classical ~/.cow/import-surge-1.list
+//   ruleProvider = direct classical ~/.cow/import-surge-2.list
+//
+// Rule providers are checked in order, consecutive rules with the same route
+// are put in the same file to keep the order of rules. DIRECT policy is
+// converted to direct, other policies (proxy names and groups) to proxy, as
+// cow uses all parent proxies. Remote rule sets (RULE-SET and DOMAIN-SET with
+// URL, Clash rule-providers) are converted to rule providers using the URL.
+//
+// Proxies and rules cow doesn't support, e.g. vmess proxies, TLS, plugins,
+// REJECT, GEOIP and FINAL rules, are skipped and listed in the output.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+type importRule struct {
+	route routeType
+	rule  string // classical rule without policy
+}
+
+type importResult struct {
+	format   string
+	proxy    []string // proxy option values
+	rules    []importRule
+	provider []string // ruleProvider option values for remote rule sets
+	skipped  []string
+}
+
+func (ir *importResult) skip(format string, a ...interface{}) {
+	ir.skipped = append(ir.skipped, fmt.Sprintf(format, a...))
+}
+
+// importRoute returns false for policies cow can't handle.
+func importRoute(policy string) (routeType, bool) {
+	policy = strings.ToUpper(strings.TrimSpace(policy))
+	switch {
+	case policy == "DIRECT":
+		return routeDirect, true
+	case strings.HasPrefix(policy, "REJECT"):
+		return routeDefault, false
+	}
+	return routeProxy, true
+}
+
+var importRuleType = map[string]string{
+	"DOMAIN":         "DOMAIN",
+	"DOMAIN-SUFFIX":  "DOMAIN-SUFFIX",
+	"DOMAIN-KEYWORD": "DOMAIN-KEYWORD",
+	"IP-CIDR":        "IP-CIDR",
+	"IP-CIDR6":       "IP-CIDR6",
+	// Quantumult X
+	"HOST":         "DOMAIN",
+	"HOST-SUFFIX":  "DOMAIN-SUFFIX",
+	"HOST-KEYWORD": "DOMAIN-KEYWORD",
+	"IP6-CIDR":     "IP-CIDR6",
+}
+
+// addRule adds rule with type, value and policy, extra fields like
+// no-resolve are ignored.
+func (ir *importResult) addRule(line string, f []string) {
+	if len(f) < 3 {
+		ir.skip("rule %s", line)
+		return
+	}
+	typ, ok := importRuleType[strings.ToUpper(f[0])]
+	if !ok {
+		ir.skip("rule %s", line)
+		return
+	}
+	route, ok := importRoute(f[2])
+	if !ok {
+		ir.skip("rule %s", line)
+		return
+	}
+	ir.rules = append(ir.rules, importRule{route, typ + "," + f[1]})
+}
+
+func (ir *importResult) addProvider(line, policy, behavior, source string, interval time.Duration) {
+	route, ok := importRoute(policy)
+	if !ok || !(strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") ||
+		filepath.IsAbs(source)) {
+		ir.skip("rule %s", line)
+		return
+	}
+	val := []string{routeTypeName(route), behavior, source}
+	if interval > 0 {
+		val = append(val, interval.String())
+	}
+	ir.provider = append(ir.provider, strings.Join(val, " "))
+}
+
+// addProxy checks and adds proxy option value.
+func (ir *importResult) addProxy(name, protocol, host, port, method, user, passwd string) {
+	server := net.JoinHostPort(host, port)
+	if host == "" || port == "" {
+		ir.skip("proxy %s: no server address", name)
+		return
+	}
+	if strings.ContainsAny(method+user+passwd, " \t") {
+		ir.skip("proxy %s: white space in password is not supported", name)
+		return
+	}
+	switch protocol {
+	case "ss":
+		if _, err := ss.NewCipher(method, passwd); err != nil {
+			ir.skip("proxy %s: %v", name, err)
+			return
+		}
+		server = method + ":" + passwd + "@" + server
+	case "http":
+		if strings.Contains(user+passwd, "@") || strings.Contains(user, ":") {
+			ir.skip("proxy %s: user or password not supported", name)
+			return
+		}
+		if user != "" {
+			server = user + ":" + passwd + "@" + server
+		}
+	case "socks5":
+		if user != "" {
+			ir.skip("proxy %s: socks5 authentication is not supported", name)
+			return
+		}
+	}
+	ir.proxy = append(ir.proxy, protocol+"://"+server)
+}
+
+// splitFields splits s by sep and trims each field.
+func splitFields(s, sep string) []string {
+	f := strings.Split(s, sep)
+	for i := range f {
+		f[i] = strings.TrimSpace(f[i])
+	}
+	return f
+}
+
+// keyValues returns key=value pairs in fields, other fields are ignored.
+func keyValues(f []string) map[string]string {
+	kv := make(map[string]string)
+	for _, s := range f {
+		if id := strings.IndexByte(s, '='); id > 0 {
+			kv[strings.ToLower(strings.TrimSpace(s[:id]))] = strings.Trim(strings.TrimSpace(s[id+1:]), `"`)
+		}
+	}
+	return kv
+}
+
+// iniSections returns lines in each section, keyed by lower case section
+// name.
+func iniSections(content []byte) map[string][]string {
+	sections := make(map[string][]string)
+	var cur string
+	for _, l := range bytes.Split(content, []byte("\n")) {
+		line := strings.TrimSpace(string(l))
+		if line == "" || line[0] == '#' || line[0] == ';' || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			cur = strings.ToLower(line[1 : len(line)-1])
+			continue
+		}
+		sections[cur] = append(sections[cur], line)
+	}
+	return sections
+}
+
+func importSurge(sections map[string][]string, ir *importResult) {
+	ir.format = "Surge"
+	for _, line := range sections["proxy"] {
+		id := strings.IndexByte(line, '=')
+		if id == -1 {
+			ir.skip("proxy %s", line)
+			continue
+		}
+		name := strings.TrimSpace(line[:id])
+		f := splitFields(line[id+1:], ",")
+		typ := strings.ToLower(f[0])
+		if typ == "direct" || strings.HasPrefix(typ, "reject") {
+			continue
+		}
+		if len(f) < 3 {
+			ir.skip("proxy %s", name)
+			continue
+		}
+		kv := keyValues(f[3:])
+		if kv["tls"] == "true" || kv["obfs"] != "" {
+			ir.skip("proxy %s: TLS and obfs are not supported", name)
+			continue
+		}
+		var user, passwd string
+		switch typ {
+		case "ss":
+			ir.addProxy(name, "ss", f[1], f[2], kv["encrypt-method"], "", kv["password"])
+		case "custom":
+			// Old shadowsocks format: custom, host, port, method, password, module
+			if len(f) < 5 {
+				ir.skip("proxy %s", name)
+				continue
+			}
+			ir.addProxy(name, "ss", f[1], f[2], f[3], "", f[4])
+		case "http", "socks5":
+			if len(f) >= 5 && !strings.Contains(f[3], "=") {
+				user, passwd = f[3], f[4]
+			} else {
+				user, passwd = kv["username"], kv["password"]
+			}
+			ir.addProxy(name, typ, f[1], f[2], "", user, passwd)
+		default:
+			ir.skip("proxy %s: %s is not supported", name, typ)
+		}
+	}
+	for _, line := range sections["rule"] {
+		f := splitFields(line, ",")
+		switch strings.ToUpper(f[0]) {
+		case "RULE-SET", "DOMAIN-SET":
+			if len(f) < 3 {
+				ir.skip("rule %s", line)
+				continue
+			}
+			behavior := "classical"
+			if strings.ToUpper(f[0]) == "DOMAIN-SET" {
+				behavior = "domain"
+			}
+			ir.addProvider(line, f[2], behavior, f[1], 0)
+		default:
+			ir.addRule(line, f)
+		}
+	}
+}
+
+func importQuantumultX(sections map[string][]string, ir *importResult) {
+	ir.format = "Quantumult X"
+	for _, line := range sections["server_local"] {
+		f := splitFields(line, ",")
+		id := strings.IndexByte(f[0], '=')
+		if id == -1 {
+			ir.skip("proxy %s", line)
+			continue
+		}
+		typ := strings.ToLower(strings.TrimSpace(f[0][:id]))
+		kv := keyValues(f[1:])
+		name := kv["tag"]
+		if name == "" {
+			name = line
+		}
+		host, port, err := net.SplitHostPort(strings.TrimSpace(f[0][id+1:]))
+		if err != nil {
+			ir.skip("proxy %s: %v", name, err)
+			continue
+		}
+		if kv["over-tls"] == "true" || kv["obfs"] != "" {
+			ir.skip("proxy %s: TLS and obfs are not supported", name)
+			continue
+		}
+		switch typ {
+		case "shadowsocks":
+			ir.addProxy(name, "ss", host, port, kv["method"], "", kv["password"])
+		case "http", "socks5":
+			ir.addProxy(name, typ, host, port, "", kv["username"], kv["password"])
+		default:
+			ir.skip("proxy %s: %s is not supported", name, typ)
+		}
+	}
+	for _, line := range sections["filter_local"] {
+		ir.addRule(line, splitFields(line, ","))
+	}
+	for _, line := range sections["filter_remote"] {
+		ir.skip("remote filter %s", line)
+	}
+}
+
+// yamlLine is a non-empty line in YAML with its indent.
+type yamlLine struct {
+	indent int
+	text   string
+}
+
+// parseYAML parses the subset of YAML used in Clash config: block mappings
+// and sequences, flow mappings in sequences and scalars. Mappings are
+// map[string]interface{}, sequences []interface{} and others string.
+func parseYAML(content []byte) interface{} {
+	var lines []yamlLine
+	for _, l := range bytes.Split(content, []byte("\n")) {
+		s := strings.TrimRight(string(l), " \t\r")
+		text := strings.TrimLeft(s, " ")
+		if text == "" || text[0] == '#' || text == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{len(s) - len(text), text})
+	}
+	v, _ := parseYAMLBlock(lines, 0)
+	return v
+}
+
+func parseYAMLBlock(lines []yamlLine, i int) (interface{}, int) {
+	if i >= len(lines) {
+		return nil, i
+	}
+	indent := lines[i].indent
+	if lines[i].text == "-" || strings.HasPrefix(lines[i].text, "- ") {
+		var seq []interface{}
+		for i < len(lines) && lines[i].indent == indent &&
+			(lines[i].text == "-" || strings.HasPrefix(lines[i].text, "- ")) {
+			item := strings.TrimSpace(lines[i].text[1:])
+			if item == "" {
+				var v interface{}
+				v, i = parseYAMLBlock(lines, i+1)
+				seq = append(seq, v)
+				continue
+			}
+			if item[0] == '{' || yamlKeyEnd(item) == -1 {
+				seq = append(seq, yamlScalar(item))
+				i++
+				continue
+			}
+			// Mapping in sequence item, following keys are indented to the
+			// first key.
+			lines[i] = yamlLine{indent + len(lines[i].text) - len(item), item}
+			var v interface{}
+			v, i = parseYAMLBlock(lines, i)
+			seq = append(seq, v)
+		}
+		return seq, i
+	}
+	m := make(map[string]interface{})
+	for i < len(lines) && lines[i].indent == indent {
+		text := lines[i].text
+		id := yamlKeyEnd(text)
+		if id == -1 {
+			i++
+			continue
+		}
+		key := strings.Trim(text[:id], `'"`)
+		val := strings.TrimSpace(text[id+1:])
+		i++
+		if val != "" && val[0] != '#' {
+			m[key] = yamlScalar(val)
+			continue
+		}
+		// Sequence under key may have the same indent as key.
+		if i < len(lines) && (lines[i].indent > indent ||
+			lines[i].indent == indent && strings.HasPrefix(lines[i].text, "-")) {
+			m[key], i = parseYAMLBlock(lines, i)
+		}
+	}
+	// Skip lines with unexpected indent.
+	for i < len(lines) && lines[i].indent > indent {
+		i++
+	}
+	return m, i
+}
+
+// yamlKeyEnd returns index of ':' after mapping key, -1 if s is not a
+// mapping entry.
+func yamlKeyEnd(s string) int {
+	if s[0] == '"' || s[0] == '\'' {
+		end := strings.IndexByte(s[1:], s[0])
+		if end == -1 {
+			return -1
+		}
+		if id := end + 2; id < len(s) && s[id] == ':' {
+			return id
+		}
+		return -1
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] == ':' && (i+1 == len(s) || s[i+1] == ' ') {
+			return i
+		}
+	}
+	return -1
+}
+
+// yamlScalar parses flow mapping or scalar.
+func yamlScalar(s string) interface{} {
+	if s[0] == '{' && s[len(s)-1] == '}' {
+		m := make(map[string]interface{})
+		for _, kv := range splitFlow(s[1 : len(s)-1]) {
+			if id := strings.IndexByte(kv, ':'); id > 0 {
+				m[strings.Trim(strings.TrimSpace(kv[:id]), `'"`)] = yamlScalar(strings.TrimSpace(kv[id+1:]))
+			}
+		}
+		return m
+	}
+	if s == "" {
+		return s
+	}
+	switch s[0] {
+	case '"':
+		if v, err := strconv.Unquote(s); err == nil {
+			return v
+		}
+		return strings.Trim(s, `"`)
+	case '\'':
+		return strings.Replace(strings.Trim(s, "'"), "''", "'", -1)
+	}
+	if id := strings.Index(s, " #"); id != -1 {
+		s = strings.TrimSpace(s[:id])
+	}
+	return s
+}
+
+// splitFlow splits flow collection content by commas not in quotes or
+// nested collections.
+func splitFlow(s string) []string {
+	var f []string
+	var depth int
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			f = append(f, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		f = append(f, last)
+	}
+	return f
+}
+
+func yamlString(m map[string]interface{}, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func importClash(content []byte, dir string, ir *importResult) error {
+	ir.format = "Clash"
+	top, ok := parseYAML(content).(map[string]interface{})
+	if !ok {
+		return errors.New("not a Clash config")
+	}
+	proxies, _ := top["proxies"].([]interface{})
+	for _, p := range proxies {
+		m, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, typ := yamlString(m, "name"), yamlString(m, "type")
+		if yamlString(m, "tls") == "true" || m["plugin"] != nil {
+			ir.skip("proxy %s: TLS and plugins are not supported", name)
+			continue
+		}
+		switch typ {
+		case "ss":
+			ir.addProxy(name, "ss", yamlString(m, "server"), yamlString(m, "port"),
+				yamlString(m, "cipher"), "", yamlString(m, "password"))
+		case "http", "socks5":
+			ir.addProxy(name, typ, yamlString(m, "server"), yamlString(m, "port"),
+				"", yamlString(m, "username"), yamlString(m, "password"))
+		default:
+			ir.skip("proxy %s: %s is not supported", name, typ)
+		}
+	}
+	providers, _ := top["rule-providers"].(map[string]interface{})
+	rules, _ := top["rules"].([]interface{})
+	for _, r := range rules {
+		line, ok := r.(string)
+		if !ok {
+			continue
+		}
+		f := splitFields(line, ",")
+		if strings.ToUpper(f[0]) != "RULE-SET" {
+			ir.addRule(line, f)
+			continue
+		}
+		if len(f) < 3 {
+			ir.skip("rule %s", line)
+			continue
+		}
+		m, _ := providers[f[1]].(map[string]interface{})
+		if m == nil {
+			ir.skip("rule %s: no such rule provider", line)
+			continue
+		}
+		behavior := yamlString(m, "behavior")
+		source := yamlString(m, "url")
+		if yamlString(m, "type") == "file" {
+			source = yamlString(m, "path")
+			if source != "" && !filepath.IsAbs(source) {
+				source = filepath.Join(dir, source)
+			}
+		}
+		var interval time.Duration
+		if sec, err := strconv.Atoi(yamlString(m, "interval")); err == nil && sec > 0 {
+			interval = time.Duration(sec) * time.Second
+		}
+		if behavior != "domain" && behavior != "ipcidr" && behavior != "classical" {
+			ir.skip("rule %s: unsupported behavior %s", line, behavior)
+			continue
+		}
+		ir.addProvider(line, f[2], behavior, source, interval)
+	}
+	return nil
+}
+
+// convertConfig detects format of content and converts it. dir is used to
+// find files referenced in the config.
+func convertConfig(content []byte, dir string) (*importResult, error) {
+	ir := &importResult{}
+	sections := iniSections(content)
+	switch {
+	case sections["proxy"] != nil || sections["rule"] != nil:
+		importSurge(sections, ir)
+	case sections["server_local"] != nil || sections["filter_local"] != nil:
+		importQuantumultX(sections, ir)
+	default:
+		if err := importClash(content, dir, ir); err != nil {
+			return nil, err
+		}
+	}
+	if len(ir.proxy) == 0 && len(ir.rules) == 0 && len(ir.provider) == 0 {
+		return nil, errors.New("no proxy or rule found, supported formats are Surge, Quantumult X and Clash")
+	}
+	return ir, nil
+}
+
+// ruleFiles groups consecutive rules with the same route.
+func (ir *importResult) ruleFiles() (route []routeType, content [][]byte) {
+	for i, r := range ir.rules {
+		if i == 0 || r.route != ir.rules[i-1].route {
+			route = append(route, r.route)
+			content = append(content, nil)
+		}
+		n := len(content) - 1
+		content[n] = append(content[n], r.rule+"\n"...)
+	}
+	return
+}
+
+// importName returns name used in rule file names.
+func importName(src string) string {
+	name := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// importConfig converts src and adds result to config file rc, summary is
+// written to w.
+func importConfig(w io.Writer, src, rc string) error {
+	src, err := filepath.Abs(expandTilde(src))
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	ir, err := convertConfig(content, filepath.Dir(src))
+	if err != nil {
+		return err
+	}
+
+	old, err := ioutil.ReadFile(rc)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	mark := "# Imported from " + src
+	if bytes.Contains(old, []byte(mark+" (")) {
+		return errors.New(src + " is already imported to " + rc + ", remove the imported options first")
+	}
+	dir := path.Dir(rc)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	b.Write(old)
+	if len(old) > 0 {
+		if old[len(old)-1] != '\n' {
+			b.WriteByte('\n')
+		}
+		b.WriteByte('\n')
+	}
+	fmt.Fprintf(&b, "%s (%s)\n", mark, ir.format)
+	for _, p := range ir.proxy {
+		b.WriteString("proxy = " + p + "\n")
+	}
+	route, rules := ir.ruleFiles()
+	for i := range rules {
+		fname := path.Join(dir, fmt.Sprintf("import-%s-%d.list", importName(src), i+1))
+		header := "# Rules imported from " + src + "\n"
+		if err = ioutil.WriteFile(fname, append([]byte(header), rules[i]...), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "ruleProvider = %s classical %s\n", routeTypeName(route[i]), fname)
+	}
+	for _, p := range ir.provider {
+		b.WriteString("ruleProvider = " + p + "\n")
+	}
+	if err = writeFileAtomic(rc, b.Bytes(), len(old) > 0); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "imported %s config %s to %s: %d proxies, %d rules in %d files, %d remote rule sets\n",
+		ir.format, src, rc, len(ir.proxy), len(ir.rules), len(rules), len(ir.provider))
+	if len(ir.skipped) > 0 {
+		fmt.Fprintf(w, "skipped %d unsupported items:\n", len(ir.skipped))
+		for _, s := range ir.skipped {
+			fmt.Fprintln(w, "  "+s)
+		}
+	}
+	return nil
+}
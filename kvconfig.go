@@ -0,0 +1,328 @@
+package cow
+
+// Configuration from etcd or Consul KV store.
+//
+//   configSource = consul://127.0.0.1:8500/cow
+//   configSource = etcd://127.0.0.1:2379/cow
+//
+// Keys under the prefix (cow/ above) hold files shared by a fleet of
+// instances:
+//
+//   rc       config options
+//   direct   directFile
+//   blocked  blockedFile
+//   passwd   userPasswdFile
+//
+// Only rc is required. They are fetched on start up and saved in the config
+// directory as kv.rc, kv.direct, kv.blocked and kv.passwd. kv.rc is parsed
+// before the local rc, so the local rc only needs configSource and instance
+// specific options. If the store is not reachable on start up, copies saved
+// last time are used. Fetched files are checked with the local rc by running
+// "cow -check" before being saved, invalid config is ignored and the copies
+// of the last good config are kept. cow then watches the keys with Consul blocking queries
+// or etcd watch, and reloads as soon as any of them changes.
+//
+// Consul ACL token is given as user info, like consul://token@host:port/cow.
+// etcd is accessed with its v3 JSON gateway without authentication.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kvPrefix       = "kv"
+	kvWatchTimeout = 5 * time.Minute
+	kvFetchTimeout = 10 * time.Second
+	kvRetryDelay   = 10 * time.Second
+)
+
+// kvStore gets keys under the prefix from KV store.
+type kvStore interface {
+	// get returns values keyed by name without prefix, and the index of the
+	// store. If index is not 0, blocks until keys change after index or
+	// timeout.
+	get(index int64) (kv map[string][]byte, newIndex int64, err error)
+}
+
+func newKVStore(source string) (kvStore, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("no server address")
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	switch u.Scheme {
+	case "consul":
+		cs := &consulStore{addr: u.Host, prefix: prefix}
+		if u.User != nil {
+			cs.token = u.User.Username()
+		}
+		return cs, nil
+	case "etcd":
+		return &etcdStore{addr: u.Host, prefix: prefix}, nil
+	}
+	return nil, errors.New("should be consul:// or etcd:// URL")
+}
+
+var (
+	kvClient      = &http.Client{Timeout: kvFetchTimeout}
+	kvWatchClient = &http.Client{Timeout: kvWatchTimeout + time.Minute}
+)
+
+type consulStore struct {
+	addr   string
+	prefix string
+	token  string
+}
+
+func (cs *consulStore) get(index int64) (map[string][]byte, int64, error) {
+	uri := fmt.Sprintf("http://%s/v1/kv/%s?recurse=true", cs.addr, cs.prefix)
+	if index > 0 {
+		uri += fmt.Sprintf("&index=%d&wait=%ds", index, int(kvWatchTimeout/time.Second))
+	}
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if cs.token != "" {
+		req.Header.Set("X-Consul-Token", cs.token)
+	}
+	client := kvClient
+	if index > 0 {
+		client = kvWatchClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	newIndex, _ := strconv.ParseInt(resp.Header.Get("X-Consul-Index"), 10, 64)
+	// Consul requires resetting index if it goes backwards.
+	if newIndex < index {
+		newIndex = 0
+	}
+	kv := make(map[string][]byte)
+	if resp.StatusCode == 404 {
+		return kv, newIndex, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, 0, errors.New("consul: " + resp.Status)
+	}
+	var entries []struct {
+		Key   string
+		Value []byte
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	for _, e := range entries {
+		if e.Value != nil {
+			kv[strings.TrimPrefix(e.Key, cs.prefix)] = e.Value
+		}
+	}
+	return kv, newIndex, nil
+}
+
+type etcdStore struct {
+	addr   string
+	prefix string
+}
+
+// rangeEnd returns the end of keys with prefix, like etcd clientv3.
+func (es *etcdStore) rangeEnd() []byte {
+	end := []byte(es.prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// All keys.
+	return []byte{0}
+}
+
+func (es *etcdStore) post(client *http.Client, path string, body interface{}) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post("http://"+es.addr+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, errors.New("etcd: " + resp.Status)
+	}
+	return resp, nil
+}
+
+// watch blocks until keys change after revision or timeout.
+func (es *etcdStore) watch(rev int64) error {
+	resp, err := es.post(kvWatchClient, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(es.prefix),
+			"range_end":      es.rangeEnd(),
+			"start_revision": rev + 1,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	timedOut := make(chan struct{})
+	timer := time.AfterFunc(kvWatchTimeout, func() {
+		close(timedOut)
+		resp.Body.Close()
+	})
+	defer timer.Stop()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Canceled bool
+				Events   []json.RawMessage
+			}
+			Error *struct {
+				Message string
+			}
+		}
+		if err := dec.Decode(&msg); err != nil {
+			select {
+			case <-timedOut:
+				return nil
+			default:
+				return err
+			}
+		}
+		if msg.Error != nil {
+			return errors.New("etcd watch: " + msg.Error.Message)
+		}
+		if msg.Result.Canceled {
+			return errors.New("etcd watch canceled")
+		}
+		if len(msg.Result.Events) > 0 {
+			return nil
+		}
+	}
+}
+
+func (es *etcdStore) get(index int64) (map[string][]byte, int64, error) {
+	if index > 0 {
+		if err := es.watch(index); err != nil {
+			return nil, 0, err
+		}
+	}
+	resp, err := es.post(kvClient, "/v3/kv/range", map[string]interface{}{
+		"key":       []byte(es.prefix),
+		"range_end": es.rangeEnd(),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	var rr struct {
+		Header struct {
+			Revision int64 `json:"revision,string"`
+		}
+		Kvs []struct {
+			Key   []byte
+			Value []byte
+		}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&rr); err != nil {
+		return nil, 0, err
+	}
+	kv := make(map[string][]byte)
+	for _, e := range rr.Kvs {
+		kv[strings.TrimPrefix(string(e.Key), es.prefix)] = e.Value
+	}
+	return kv, rr.Header.Revision, nil
+}
+
+// kvFiles maps values in KV store to synced files by option.
+func kvFiles(kv map[string][]byte) map[string][]byte {
+	files := make(map[string][]byte)
+	for _, sf := range syncedFiles {
+		if v, ok := kv[sf.suffix]; ok {
+			files[sf.option] = v
+		}
+	}
+	return files
+}
+
+// loadConfigSource fetches config from KV store on start up. Saved copies
+// are used if it fails or the config is invalid.
+func loadConfigSource(source string) {
+	store, err := newKVStore(source)
+	if err != nil {
+		Fatal("configSource", source+":", err)
+	}
+	kv, _, err := store.get(0)
+	if err == nil {
+		_, err = updateSyncedFiles(kvPrefix, kvFiles(kv))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "configSource %s: %v, using saved config\n", source, err)
+	}
+	parseSyncedRc(kvPrefix)
+}
+
+// runConfigSource watches KV store and reloads on change until quit.
+func runConfigSource(quit <-chan struct{}) {
+	store, err := newKVStore(config.ConfigSource)
+	if err != nil {
+		errl.Println("configSource:", err)
+		return
+	}
+	var index int64
+	for {
+		kv, newIndex, err := store.get(index)
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		if err != nil {
+			errl.Printf("configSource %s: %v\n", config.ConfigSource, err)
+			index = 0
+			select {
+			case <-quit:
+				return
+			case <-time.After(kvRetryDelay):
+			}
+			continue
+		}
+		changed, err := updateSyncedFiles(kvPrefix, kvFiles(kv))
+		if err != nil {
+			errl.Println("configSource config not saved:", err)
+		} else if changed {
+			info.Println("config in", config.ConfigSource, "changed, reloading")
+			if err = signalProcess(os.Getpid(), "reload"); err != nil {
+				errl.Println("configSource reload:", err)
+			}
+		}
+		// Poll if the store doesn't give an index to watch.
+		if index = newIndex; index == 0 {
+			select {
+			case <-quit:
+				return
+			case <-time.After(kvRetryDelay):
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package cow
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewKVStore(t *testing.T) {
+	s, err := newKVStore("consul://secret@127.0.0.1:8500/cow/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, ok := s.(*consulStore)
+	if !ok || cs.addr != "127.0.0.1:8500" || cs.prefix != "cow/" || cs.token != "secret" {
+		t.Errorf("wrong consul store %+v", s)
+	}
+	s, err = newKVStore("etcd://127.0.0.1:2379/cow")
+	if es, ok := s.(*etcdStore); err != nil || !ok || es.prefix != "cow/" {
+		t.Errorf("wrong etcd store %+v %v", s, err)
+	}
+	for _, source := range []string{"http://127.0.0.1/cow", "consul:///cow"} {
+		if _, err := newKVStore(source); err == nil {
+			t.Error("should fail on", source)
+		}
+	}
+}
+
+func TestEtcdRangeEnd(t *testing.T) {
+	testData := []struct {
+		prefix string
+		end    string
+	}{
+		{"cow/", "cow0"},
+		{"a\xff", "b"},
+		{"", "\x00"},
+	}
+	for _, td := range testData {
+		es := &etcdStore{prefix: td.prefix}
+		if end := string(es.rangeEnd()); end != td.end {
+			t.Errorf("%q range end %q, should be %q", td.prefix, end, td.end)
+		}
+	}
+}
+
+func TestConsulStoreGet(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/cow/" || r.FormValue("recurse") == "" || r.Header.Get("X-Consul-Token") != "secret" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "42")
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"Key": "cow/", "Value": nil},
+			{"Key": "cow/rc", "Value": []byte("listen = http://0.0.0.0:7777\n")},
+			{"Key": "cow/direct", "Value": []byte("example.com\n")},
+		})
+	}))
+	defer ts.Close()
+
+	s, _ := newKVStore("consul://secret@" + strings.TrimPrefix(ts.URL, "http://") + "/cow")
+	kv, index, err := s.get(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 42 || len(kv) != 2 || string(kv["rc"]) != "listen = http://0.0.0.0:7777\n" {
+		t.Errorf("wrong kv %q index %d", kv, index)
+	}
+	files := kvFiles(kv)
+	if len(files) != 2 || string(files["directFile"]) != "example.com\n" || files["rc"] == nil {
+		t.Errorf("wrong kv files %q", files)
+	}
+}
+
+func TestEtcdStoreGet(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Key      []byte `json:"key"`
+			RangeEnd []byte `json:"range_end"`
+		}
+		if r.URL.Path != "/v3/kv/range" || json.NewDecoder(r.Body).Decode(&req) != nil ||
+			string(req.Key) != "cow/" || string(req.RangeEnd) != "cow0" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"header": map[string]interface{}{"revision": "7"},
+			"kvs": []map[string]interface{}{
+				{"key": []byte("cow/rc"), "value": []byte("listen = http://0.0.0.0:7777\n")},
+				{"key": []byte("cow/passwd"), "value": []byte("foo:bar\n")},
+			},
+		})
+	}))
+	defer ts.Close()
+
+	s, _ := newKVStore("etcd://" + strings.TrimPrefix(ts.URL, "http://") + "/cow")
+	kv, index, err := s.get(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 7 || len(kv) != 2 || string(kv["passwd"]) != "foo:bar\n" {
+		t.Errorf("wrong kv %q index %d", kv, index)
+	}
+	if files := kvFiles(kv); string(files["userPasswdFile"]) != "foo:bar\n" {
+		t.Errorf("wrong kv files %q", files)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package cow
 
 // This logging trick is learnt from a post by Rob Pike
 // https://groups.google.com/d/msg/golang-nuts/gU7oQGoCkmg/j3nNxuS2O_sJ
@@ -9,6 +9,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/cyfdecyf/color"
 )
@@ -20,9 +21,9 @@ type requestLogging bool
 type responseLogging bool
 
 var (
-	info   infoLogging
+	info   infoLogging = true
 	debug  debugLogging
-	errl   errorLogging
+	errl   errorLogging = true
 	dbgRq  requestLogging
 	dbgRep responseLogging
 
@@ -38,7 +39,9 @@ var (
 	colorize bool
 )
 
-func init() {
+// initLogFlags adds logging options to command line flags. Programs
+// embedding cow don't have these flags.
+func initLogFlags() {
 	flag.BoolVar((*bool)(&info), "info", true, "info log")
 	flag.BoolVar((*bool)(&debug), "debug", false, "debug log, with this option, log goes to stdout with color")
 	flag.BoolVar((*bool)(&errl), "err", true, "error log")
@@ -118,12 +121,28 @@ func (d responseLogging) Printf(format string, args ...interface{}) {
 	}
 }
 
+// fatalPanics is set when cow is embedded in other programs, Fatal panics
+// with fatalError instead of exiting the program.
+var fatalPanics bool
+
+type fatalError string
+
+func (e fatalError) Error() string {
+	return string(e)
+}
+
 func Fatal(args ...interface{}) {
+	if fatalPanics {
+		panic(fatalError(strings.TrimSpace(fmt.Sprintln(args...))))
+	}
 	fmt.Println(args...)
 	os.Exit(1)
 }
 
 func Fatalf(format string, args ...interface{}) {
+	if fatalPanics {
+		panic(fatalError(strings.TrimSpace(fmt.Sprintf(format, args...))))
+	}
 	fmt.Printf(format, args...)
 	os.Exit(1)
 }
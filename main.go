@@ -1,7 +1,9 @@
-package main
+package cow
 
 import (
 	// "flag"
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"runtime"
@@ -14,8 +16,13 @@ import (
 var (
 	quit     chan struct{}
 	relaunch bool
+	// Set after switching to runAsUser. The relaunched process would run as
+	// that user, which can't lock the pid file or listen on ports below 1024.
+	privilegeDropped bool
 )
 
+var errNoRelaunch = errors.New("can't reload after switching to runAsUser, restart cow instead")
+
 // This code is from goagain
 func lookPath() (argv0 string, err error) {
 	argv0, err = exec.LookPath(os.Args[0])
@@ -28,7 +35,9 @@ func lookPath() (argv0 string, err error) {
 	return
 }
 
-func main() {
+// Main runs cow with command line flags and config file, it's the main
+// function of the cow command.
+func Main() {
 	quit = make(chan struct{})
 	// Parse flags after load config to allow override options in config
 	cmdLineConfig := parseCmdLineConfig()
@@ -36,17 +45,116 @@ func main() {
 		printVersion()
 		os.Exit(0)
 	}
+	if cmdLineConfig.Update {
+		if err := selfUpdate(); err != nil {
+			Fatal("update failed:", err)
+		}
+		os.Exit(0)
+	}
+
+	if cmdLineConfig.Import != "" {
+		if err := importConfig(os.Stdout, cmdLineConfig.Import, cmdLineConfig.RcFile); err != nil {
+			Fatal("import failed:", err)
+		}
+		os.Exit(0)
+	}
 
 	parseConfig(cmdLineConfig.RcFile, cmdLineConfig)
+	if cmdLineConfig.CheckConfig {
+		fmt.Println("config ok")
+		os.Exit(0)
+	}
+
+	if cmdLineConfig.Ctl != nil {
+		if err := runCtl(cmdLineConfig.Ctl); err != nil {
+			Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if cmdLineConfig.Bench != nil {
+		if err := runBench(cmdLineConfig.Bench); err != nil {
+			Fatal("bench:", err)
+		}
+		os.Exit(0)
+	}
+	if cmdLineConfig.DumpRules {
+		dumpRules(os.Stdout)
+		os.Exit(0)
+	}
+	if cmdLineConfig.ExportRules != "" {
+		// Errors are logged by load.
+		ss := newSiteStat()
+		ss.load(config.StatFile)
+		if err := exportRules(os.Stdout, ss, cmdLineConfig.ExportRules); err != nil {
+			Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if cmdLineConfig.Stop || cmdLineConfig.Reload {
+		cmd := "stop"
+		if cmdLineConfig.Reload {
+			cmd = "reload"
+		}
+		if err := controlRunning(cmd); err != nil {
+			Fatal(err)
+		}
+		os.Exit(0)
+	}
+	lockPidFile()
+
+	go sigHandler()
+	wg := start()
+	setSystemProxy()
+
+	wg.Wait()
+	unsetSystemProxy()
+	removePidFile()
+
+	if relaunch {
+		info.Println("Relunching cow...")
+		// Need to fork me.
+		argv0, err := lookPath()
+		if nil != err {
+			errl.Println(err)
+			return
+		}
+
+		err = syscall.Exec(argv0, os.Args, os.Environ())
+		if err != nil {
+			errl.Println(err)
+		}
+	}
+	debug.Println("the main process is , exiting...")
+}
 
+// start initializes and runs all services after config is parsed. The
+// returned WaitGroup is done when all listeners exit after quit is closed.
+func start() *sync.WaitGroup {
 	initSelfListenAddr()
 	initLog()
+	initAccessLog()
+	initHAR()
+	initLocale()
 	initAuth()
+	initHelper()
+	initMaintenance()
+	initConnHook()
+	initScript()
 	initSiteStat()
+	initProxyGroup()
+	initRuleProvider()
+	initRequestRule()
+	initAccessRule()
+	initHttpCache()
+	initReplay()
 	initPAC() // initPAC uses siteStat, so must init after site stat
 
 	initStat()
+	initMetrics()
+	initTLSSession()
+	initShaper()
 
+	initParentPAC() // uses parent proxies before load balance pool is created
 	initParentPool()
 
 	/*
@@ -63,35 +171,49 @@ func main() {
 		runtime.GOMAXPROCS(config.Core)
 	}
 
-	go sigHandler()
 	go runSSH()
+	if dnsCacheEnabled() {
+		go runDnsPrefetch()
+	}
+	if config.UpstreamProxy != "" {
+		go runUpstreamDetect()
+	}
 	if config.EstimateTimeout {
 		go runEstimateTimeout()
 	} else {
 		info.Println("timeout estimation disabled")
 	}
 
+	for _, proxy := range listenProxy {
+		proxy.listen()
+	}
+	initFakeDNS()
+	initAdmin()
+	initCluster()
+	// All listening sockets are created, no need for root privilege any more.
+	dropPrivilege()
+
 	var wg sync.WaitGroup
 	wg.Add(len(listenProxy))
 	for _, proxy := range listenProxy {
 		go proxy.Serve(&wg, quit)
 	}
-
-	wg.Wait()
-
-	if relaunch {
-		info.Println("Relunching cow...")
-		// Need to fork me.
-		argv0, err := lookPath()
-		if nil != err {
-			errl.Println(err)
-			return
-		}
-
-		err = syscall.Exec(argv0, os.Args, os.Environ())
-		if err != nil {
-			errl.Println(err)
-		}
+	if adminListener != nil {
+		go runAdmin(quit)
+		go runGraph(quit)
 	}
-	debug.Println("the main process is , exiting...")
+	if clusterAEAD != nil {
+		go runCluster(quit)
+	}
+	if len(connHooks) > 0 {
+		go runConnHook(quit)
+	}
+	if config.ConfigSource != "" {
+		go runConfigSource(quit)
+	}
+	if len(config.Tun) > 0 {
+		wg.Add(1)
+		go runTun(&wg, quit)
+	}
+	return &wg
 }
@@ -1,6 +1,6 @@
 // +build darwin freebsd linux netbsd openbsd
 
-package main
+package cow
 
 import (
 	"os"
@@ -13,9 +13,15 @@ func sigHandler() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 
 	for sig := range sigChan {
+		if sig == syscall.SIGUSR1 && privilegeDropped {
+			errl.Println(errNoRelaunch)
+			continue
+		}
 		// May handle other signals in the future.
 		info.Printf("%v caught, exit\n", sig)
 		storeSiteStat(siteStatExit)
+		storeMetrics()
+		storeTLSSessions()
 		if sig == syscall.SIGUSR1 {
 			relaunch = true
 		}
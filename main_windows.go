@@ -1,4 +1,4 @@
-package main
+package cow
 
 import (
 	"os"
@@ -16,6 +16,8 @@ func sigHandler() {
 		// May handle other signals in the future.
 		info.Printf("%v caught, exit\n", sig)
 		storeSiteStat(siteStatExit)
+		storeMetrics()
+		storeTLSSessions()
 		// Windows has no SIGUSR1 signal, so relaunching is not supported now.
 		/*
 			if sig == syscall.SIGUSR1 {
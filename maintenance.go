@@ -0,0 +1,112 @@
+package cow
+
+// Maintenance mode.
+//
+// Enabled with admin command "maintenance on", e.g. when rotating parent
+// proxies or during upstream maintenance. New requests are answered with
+// 503 and Retry-After header instead of raw connection errors, while
+// requests in progress and established tunnels are left to finish.
+// Requests to cow itself (PAC, stats) are still served. New transparent
+// proxy connections are closed as there's no way to send a page.
+//
+//   maintenancePage = ~/.cow/maintenance.html
+//   maintenanceRetryAfter = 10m
+//
+// Without maintenancePage, a builtin page is sent. Maintenance mode is off
+// after restart or reload.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultMaintenanceRetryAfter = 5 * time.Minute
+
+var maintenance struct {
+	sync.RWMutex
+	on    bool
+	since time.Time
+	page  string // content of maintenancePage, empty uses builtin page
+}
+
+func initMaintenance() {
+	if config.MaintenancePage == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(config.MaintenancePage)
+	if err != nil {
+		Fatal("maintenancePage:", err)
+	}
+	maintenance.page = string(b)
+}
+
+func inMaintenance() bool {
+	maintenance.RLock()
+	on := maintenance.on
+	maintenance.RUnlock()
+	return on
+}
+
+func setMaintenance(on bool) {
+	maintenance.Lock()
+	if on != maintenance.on {
+		maintenance.on = on
+		maintenance.since = time.Now()
+		if on {
+			info.Println("maintenance mode on")
+		} else {
+			info.Println("maintenance mode off")
+		}
+	}
+	maintenance.Unlock()
+}
+
+func sendMaintenancePage(c *clientConn) {
+	header := "Retry-After: " + strconv.Itoa(int(config.MaintenanceRetryAfter/time.Second)) + "\r\n"
+	maintenance.RLock()
+	page := maintenance.page
+	maintenance.RUnlock()
+	if page == "" {
+		l := writerLocale(c)
+		var err error
+		page, err = genErrorPage(l, l.tr("Proxy under maintenance"),
+			l.tr("The proxy is under maintenance, please retry later."))
+		if err != nil {
+			errl.Println("Error generating maintenance page:", err)
+			return
+		}
+	}
+	sendPage(c, statusUnavailable, header, page)
+}
+
+func adminMaintenance(w io.Writer, args []string) error {
+	if len(args) > 1 {
+		return errors.New("too many arguments")
+	}
+	if len(args) == 1 {
+		switch args[0] {
+		case "on":
+			setMaintenance(true)
+		case "off":
+			setMaintenance(false)
+		default:
+			return errors.New("on or off required")
+		}
+	}
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	if !maintenance.on {
+		fmt.Fprintln(w, "maintenance: off")
+		return nil
+	}
+	fmt.Fprintln(w, "maintenance: on since", maintenance.since.Format(time.RFC3339))
+	cliConns.Lock()
+	fmt.Fprintln(w, "client connections:", len(cliConns.info))
+	cliConns.Unlock()
+	return nil
+}
@@ -0,0 +1,65 @@
+package cow
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenancePage(t *testing.T) {
+	saved := config.MaintenanceRetryAfter
+	config.MaintenanceRetryAfter = 10 * time.Minute
+	defer func() { config.MaintenanceRetryAfter = saved }()
+
+	get := func() *http.Response {
+		cli, srv := net.Pipe()
+		defer cli.Close()
+		go func() {
+			sendMaintenancePage(&clientConn{Conn: srv})
+			srv.Close()
+		}()
+		resp, err := http.ReadResponse(bufio.NewReader(cli), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp := get()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 503 || resp.Header.Get("Retry-After") != "600" {
+		t.Errorf("should get 503 with Retry-After 600, got %s %q", resp.Status, resp.Header.Get("Retry-After"))
+	}
+	if !strings.Contains(string(body), "Proxy under maintenance") {
+		t.Error("builtin page not sent:", string(body))
+	}
+
+	maintenance.page = "<html>back soon</html>"
+	defer func() { maintenance.page = "" }()
+	body, _ = ioutil.ReadAll(get().Body)
+	if string(body) != maintenance.page {
+		t.Error("custom page not sent:", string(body))
+	}
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	defer setMaintenance(false)
+	var out bytes.Buffer
+	if err := adminMaintenance(&out, []string{"on"}); err != nil || !inMaintenance() {
+		t.Fatal("maintenance should be on:", err)
+	}
+	if !strings.HasPrefix(out.String(), "maintenance: on since") {
+		t.Error("wrong output:", out.String())
+	}
+	out.Reset()
+	if err := adminMaintenance(&out, []string{"off"}); err != nil || inMaintenance() {
+		t.Error("maintenance should be off:", err)
+	}
+	if err := adminMaintenance(&out, []string{"maybe"}); err == nil {
+		t.Error("should fail on invalid argument")
+	}
+}
@@ -0,0 +1,220 @@
+package cow
+
+// Traffic counters for each parent proxy (and direct connections) and each
+// authenticated user.
+//
+// Counters are saved to metricsFile periodically and on exit, and restored at
+// start up, so accounting survives restarts. Uptime is accumulated the same
+// way. Use admin command "metrics reset" to start a new accounting period.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trafficCnt is updated atomically, Sent must be the first field for 64 bit
+// alignment on 32 bit platforms.
+type trafficCnt struct {
+	Sent int64 `json:"sent"` // bytes sent to server
+	Recv int64 `json:"recv"` // bytes received from server
+}
+
+func (tc *trafficCnt) add(sent, recv int) {
+	if tc == nil {
+		return
+	}
+	if sent > 0 {
+		atomic.AddInt64(&tc.Sent, int64(sent))
+	}
+	if recv > 0 {
+		atomic.AddInt64(&tc.Recv, int64(recv))
+	}
+}
+
+func (tc *trafficCnt) load() trafficCnt {
+	return trafficCnt{atomic.LoadInt64(&tc.Sent), atomic.LoadInt64(&tc.Recv)}
+}
+
+type metricsData struct {
+	Since  time.Time              `json:"since"`  // start of accounting period
+	Uptime int64                  `json:"uptime"` // seconds running since Since
+	Parent map[string]*trafficCnt `json:"parent"` // key is DIRECT or parent URL
+	User   map[string]*trafficCnt `json:"user"`
+	Usage  map[string]*userUsage  `json:"usage"` // for user quota, not reset
+}
+
+var metrics struct {
+	sync.Mutex
+	data  metricsData
+	start time.Time // when uptime in data is counted to
+}
+
+func init() {
+	metrics.data = metricsData{
+		Since:  time.Now(),
+		Parent: make(map[string]*trafficCnt),
+		User:   make(map[string]*trafficCnt),
+		Usage:  make(map[string]*userUsage),
+	}
+	metrics.start = time.Now()
+}
+
+// resetMetrics clears counters in place, as server connections keep pointer
+// to them.
+func resetMetrics() {
+	metrics.Lock()
+	for _, m := range []map[string]*trafficCnt{metrics.data.Parent, metrics.data.User} {
+		for _, tc := range m {
+			atomic.StoreInt64(&tc.Sent, 0)
+			atomic.StoreInt64(&tc.Recv, 0)
+		}
+	}
+	metrics.data.Since = time.Now()
+	metrics.data.Uptime = 0
+	metrics.start = time.Now()
+	metrics.Unlock()
+}
+
+func trafficOf(m map[string]*trafficCnt, key string) *trafficCnt {
+	metrics.Lock()
+	tc, ok := m[key]
+	if !ok {
+		tc = &trafficCnt{}
+		m[key] = tc
+	}
+	metrics.Unlock()
+	return tc
+}
+
+// setTraffic sets counters updated by read and write on the server
+// connection.
+func (sv *serverConn) setTraffic(user string) {
+	if sv.parentCnt == nil {
+		sv.parentCnt = trafficOf(metrics.data.Parent, routeName(sv.Conn))
+	}
+	sv.userCnt = nil
+	sv.usage = nil
+	if user != "" {
+		sv.userCnt = trafficOf(metrics.data.User, user)
+		sv.usage = usageOf(user)
+	}
+}
+
+// snapshotMetrics returns a copy of metrics with uptime updated.
+func snapshotMetrics() metricsData {
+	metrics.Lock()
+	defer metrics.Unlock()
+	now := time.Now()
+	metrics.data.Uptime += int64(now.Sub(metrics.start) / time.Second)
+	metrics.start = metrics.start.Add(now.Sub(metrics.start) / time.Second * time.Second)
+
+	d := metricsData{
+		Since:  metrics.data.Since,
+		Uptime: metrics.data.Uptime,
+		Parent: make(map[string]*trafficCnt),
+		User:   make(map[string]*trafficCnt),
+		Usage:  make(map[string]*userUsage),
+	}
+	for k, tc := range metrics.data.Parent {
+		cnt := tc.load()
+		d.Parent[k] = &cnt
+	}
+	for k, tc := range metrics.data.User {
+		cnt := tc.load()
+		d.User[k] = &cnt
+	}
+	for k, u := range metrics.data.Usage {
+		d.Usage[k] = u.snapshot()
+	}
+	return d
+}
+
+func storeMetrics() {
+	if config.MetricsFile == "" {
+		return
+	}
+	b, err := json.MarshalIndent(snapshotMetrics(), "", "\t")
+	if err != nil {
+		errl.Println("Error marshalling metrics:", err)
+		return
+	}
+	if err = writeFileAtomic(config.MetricsFile, b, false); err != nil {
+		errl.Println("Error writing metrics file:", err)
+	}
+}
+
+func loadMetrics(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var d metricsData
+	if err = json.Unmarshal(b, &d); err != nil {
+		return err
+	}
+	if d.Parent == nil {
+		d.Parent = make(map[string]*trafficCnt)
+	}
+	if d.User == nil {
+		d.User = make(map[string]*trafficCnt)
+	}
+	if d.Usage == nil {
+		d.Usage = make(map[string]*userUsage)
+	}
+	metrics.Lock()
+	metrics.data = d
+	metrics.start = time.Now()
+	metrics.Unlock()
+	return nil
+}
+
+func initMetrics() {
+	if config.MetricsFile == "" {
+		return
+	}
+	if err := loadMetrics(config.MetricsFile); err != nil && !os.IsNotExist(err) {
+		errl.Println("Error loading metrics:", err)
+	}
+	go func() {
+		for {
+			time.Sleep(config.StatSaveInterval)
+			storeMetrics()
+		}
+	}()
+}
+
+func printTraffic(w io.Writer, title string, m map[string]*trafficCnt) {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s %s\tsent %d\trecv %d\n", title, k, m[k].Sent, m[k].Recv)
+	}
+}
+
+func adminMetrics(w io.Writer, args []string) error {
+	if len(args) > 0 {
+		if args[0] != "reset" {
+			return fmt.Errorf("unknown metrics command %s", args[0])
+		}
+		resetMetrics()
+		storeMetrics()
+		fmt.Fprintln(w, "metrics reset")
+		return nil
+	}
+	d := snapshotMetrics()
+	fmt.Fprintln(w, "since:", d.Since.Format(time.RFC3339))
+	fmt.Fprintln(w, "uptime:", time.Duration(d.Uptime)*time.Second)
+	printTraffic(w, "parent", d.Parent)
+	printTraffic(w, "user", d.User)
+	return nil
+}
@@ -0,0 +1,47 @@
+package cow
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestMetricsStoreLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := config.MetricsFile
+	defer func() { config.MetricsFile = saved }()
+	config.MetricsFile = path.Join(dir, "metrics")
+
+	tc := trafficOf(metrics.data.Parent, "DIRECT")
+	tc.add(10, 20)
+	trafficOf(metrics.data.User, "alice").add(1, 2)
+	metrics.Lock()
+	metrics.data.Uptime = 100
+	metrics.start = time.Now().Add(-5 * time.Second)
+	metrics.Unlock()
+	storeMetrics()
+
+	resetMetrics()
+	if tc.Sent != 0 || tc.Recv != 0 {
+		t.Error("reset should clear counters in place")
+	}
+	if err = loadMetrics(config.MetricsFile); err != nil {
+		t.Fatal("load metrics:", err)
+	}
+	d := snapshotMetrics()
+	if d.Uptime < 105 {
+		t.Error("uptime should be accumulated, got", d.Uptime)
+	}
+	if p := d.Parent["DIRECT"]; p == nil || p.Sent < 10 || p.Recv < 20 {
+		t.Error("DIRECT traffic not restored:", p)
+	}
+	if u := d.User["alice"]; u == nil || u.Sent != 1 || u.Recv != 2 {
+		t.Error("user traffic not restored:", u)
+	}
+}
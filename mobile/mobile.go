@@ -0,0 +1,97 @@
+// Package mobile provides gomobile bindings of cow for Android and iOS apps,
+// e.g. VPN wrapper apps using cow as their local proxy:
+//
+//   gomobile bind -target=android github.com/cyfdecyf/cow/mobile
+//   gomobile bind -target=ios github.com/cyfdecyf/cow/mobile
+//
+// Only one cow can run in a process and it can't be started again after
+// stopped, so apps should run it in a dedicated process (like the process of
+// Android VpnService) and restart the process to apply new config.
+package mobile
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cyfdecyf/cow"
+)
+
+// TrafficCallback receives traffic statistics.
+type TrafficCallback interface {
+	// OnTraffic is called with bytes sent to and received from servers.
+	OnTraffic(sent, recv int64)
+}
+
+var (
+	lock      sync.Mutex
+	server    *cow.Server
+	stopStats chan struct{}
+)
+
+// Start starts cow in background. dir is a writable directory to store site
+// stat and other files, config is in rc file format.
+func Start(dir, config string) error {
+	lock.Lock()
+	defer lock.Unlock()
+	if server != nil {
+		return errors.New("cow is already started")
+	}
+	s := cow.NewServer(cow.Options{Dir: dir, Config: config})
+	if err := s.Start(); err != nil {
+		return err
+	}
+	server = s
+	return nil
+}
+
+// Stop stops cow and traffic callback.
+func Stop() {
+	lock.Lock()
+	defer lock.Unlock()
+	stopTrafficCallback()
+	if server != nil {
+		server.Stop()
+		server = nil
+	}
+}
+
+// SetTrafficCallback calls cb every intervalMs milliseconds while cow is
+// running, replacing previous callback. nil cb stops the callback.
+func SetTrafficCallback(cb TrafficCallback, intervalMs int) error {
+	lock.Lock()
+	defer lock.Unlock()
+	stopTrafficCallback()
+	if cb == nil {
+		return nil
+	}
+	if server == nil {
+		return errors.New("cow is not started")
+	}
+	if intervalMs <= 0 {
+		return errors.New("interval should be positive")
+	}
+	s := server
+	stop := make(chan struct{})
+	stopStats = stop
+	go func() {
+		ticker := time.NewTicker(time.Duration(intervalMs) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cb.OnTraffic(s.Traffic())
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func stopTrafficCallback() {
+	if stopStats != nil {
+		close(stopStats)
+		stopStats = nil
+	}
+}
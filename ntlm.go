@@ -0,0 +1,344 @@
+package cow
+
+// NTLM authentication to http parent proxy.
+//
+// Only NTLMv2 with explicit credentials in config is supported. Single sign
+// on with the logged in user's credentials (SSPI on Windows, GSSAPI/Kerberos
+// elsewhere) is not available.
+//
+// NTLM authenticates a connection instead of a request. Before sending the
+// first request on a connection to the parent, cow sends a negotiate message
+// (with HEAD or CONNECT request to the same URL) and reads the challenge from
+// the 407 response. The request itself is then sent with the authenticate
+// message on the same connection. Refer to [MS-NLMP] for message format.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+const (
+	ntlmNegotiateUnicode     = 0x00000001
+	ntlmNegotiateOEM         = 0x00000002
+	ntlmRequestTarget        = 0x00000004
+	ntlmNegotiateNTLM        = 0x00000200
+	ntlmNegotiateAlwaysSign  = 0x00008000
+	ntlmNegotiateExtendedSec = 0x00080000
+	ntlmNegotiateTargetInfo  = 0x00800000
+	ntlmNegotiate128         = 0x20000000
+	ntlmNegotiate56          = 0x80000000
+	ntlmNegotiateFlags       = ntlmNegotiateUnicode | ntlmNegotiateOEM |
+		ntlmRequestTarget | ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign |
+		ntlmNegotiateExtendedSec | ntlmNegotiate128 | ntlmNegotiate56
+	ntlmAvTimestamp            = 7
+	ntlmChallengeMinSize       = 32
+	ntlmAuthenticateHeaderSize = 64
+)
+
+var errNTLMChallenge = errors.New("malformed NTLM challenge")
+
+// md4 implements RFC 1320, which is not in the standard library. It's only
+// used for NTLM password hash.
+func md4(data []byte) []byte {
+	msg := append([]byte{}, data...)
+	bitLen := uint64(len(data)) << 3
+	msg = append(msg, 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	var lenBuf [8]byte
+	binary.LittleEndian.PutUint64(lenBuf[:], bitLen)
+	msg = append(msg, lenBuf[:]...)
+
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+	rotl := func(x uint32, s uint) uint32 { return x<<s | x>>(32-s) }
+	var x [16]uint32
+	for len(msg) > 0 {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(msg[i*4:])
+		}
+		aa, bb, cc, dd := a, b, c, d
+		// Round 1
+		for _, i := range []uint{0, 4, 8, 12} {
+			a = rotl(a+(b&c|^b&d)+x[i], 3)
+			d = rotl(d+(a&b|^a&c)+x[i+1], 7)
+			c = rotl(c+(d&a|^d&b)+x[i+2], 11)
+			b = rotl(b+(c&d|^c&a)+x[i+3], 19)
+		}
+		// Round 2
+		for _, i := range []uint{0, 1, 2, 3} {
+			a = rotl(a+(b&c|b&d|c&d)+x[i]+0x5a827999, 3)
+			d = rotl(d+(a&b|a&c|b&c)+x[i+4]+0x5a827999, 5)
+			c = rotl(c+(d&a|d&b|a&b)+x[i+8]+0x5a827999, 9)
+			b = rotl(b+(c&d|c&a|d&a)+x[i+12]+0x5a827999, 13)
+		}
+		// Round 3
+		for _, i := range []uint{0, 2, 1, 3} {
+			a = rotl(a+(b^c^d)+x[i]+0x6ed9eba1, 3)
+			d = rotl(d+(a^b^c)+x[i+8]+0x6ed9eba1, 9)
+			c = rotl(c+(d^a^b)+x[i+4]+0x6ed9eba1, 11)
+			b = rotl(b+(c^d^a)+x[i+12]+0x6ed9eba1, 15)
+		}
+		a, b, c, d = a+aa, b+bb, c+cc, d+dd
+		msg = msg[64:]
+	}
+	sum := make([]byte, 16)
+	for i, v := range []uint32{a, b, c, d} {
+		binary.LittleEndian.PutUint32(sum[i*4:], v)
+	}
+	return sum
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, v := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], v)
+	}
+	return b
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// ntowfv2 is the NTLMv2 response key.
+func ntowfv2(user, passwd, domain string) []byte {
+	return hmacMD5(md4(utf16le(passwd)), utf16le(strings.ToUpper(user)+domain))
+}
+
+// ntlmv2Response computes NT and LM challenge response.
+func ntlmv2Response(key, serverChallenge, clientChallenge, timestamp, targetInfo []byte) (nt, lm []byte) {
+	blob := new(bytes.Buffer)
+	blob.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	blob.Write(timestamp)
+	blob.Write(clientChallenge)
+	blob.Write([]byte{0, 0, 0, 0})
+	blob.Write(targetInfo)
+	blob.Write([]byte{0, 0, 0, 0})
+	ntProof := hmacMD5(key, serverChallenge, blob.Bytes())
+	nt = append(ntProof, blob.Bytes()...)
+	lm = append(hmacMD5(key, serverChallenge, clientChallenge), clientChallenge...)
+	return
+}
+
+func ntlmNegotiateMsg() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateFlags)
+	return msg
+}
+
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  []byte
+	targetName string
+	targetInfo []byte
+}
+
+// secBuf returns the payload referred by security buffer at offset.
+func secBuf(msg []byte, offset int) ([]byte, error) {
+	if len(msg) < offset+8 {
+		return nil, errNTLMChallenge
+	}
+	n := int(binary.LittleEndian.Uint16(msg[offset:]))
+	start := int(binary.LittleEndian.Uint32(msg[offset+4:]))
+	if start+n > len(msg) || start < 0 {
+		return nil, errNTLMChallenge
+	}
+	return msg[start : start+n], nil
+}
+
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < ntlmChallengeMinSize || !bytes.Equal(msg[:8], ntlmSignature) ||
+		binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errNTLMChallenge
+	}
+	ch := &ntlmChallenge{
+		flags:     binary.LittleEndian.Uint32(msg[20:]),
+		challenge: msg[24:32],
+	}
+	name, err := secBuf(msg, 12)
+	if err != nil {
+		return nil, err
+	}
+	if ch.flags&ntlmNegotiateUnicode != 0 {
+		u := make([]uint16, len(name)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(name[i*2:])
+		}
+		ch.targetName = string(utf16.Decode(u))
+	} else {
+		ch.targetName = string(name)
+	}
+	if ch.flags&ntlmNegotiateTargetInfo != 0 {
+		if ch.targetInfo, err = secBuf(msg, 40); err != nil {
+			return nil, err
+		}
+	}
+	return ch, nil
+}
+
+// avTimestamp returns MsvAvTimestamp in target info, nil if not found.
+func avTimestamp(info []byte) []byte {
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		n := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == 0 || len(info) < 4+n {
+			break
+		}
+		if id == ntlmAvTimestamp && n == 8 {
+			return info[4:12]
+		}
+		info = info[4+n:]
+	}
+	return nil
+}
+
+// fileTime returns t as Windows FILETIME, 100ns since 1601.
+func fileTime(t time.Time) []byte {
+	const epochDiff = 116444736000000000
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(t.UnixNano()/100+epochDiff))
+	return b
+}
+
+// ntlmAuthenticateMsg creates authenticate message for the challenge. user
+// may be in the form of DOMAIN\user.
+func ntlmAuthenticateMsg(userDomain, passwd string, ch *ntlmChallenge) []byte {
+	domain, user := ch.targetName, userDomain
+	if id := strings.IndexByte(userDomain, '\\'); id != -1 {
+		domain, user = userDomain[:id], userDomain[id+1:]
+	}
+	clientChallenge := make([]byte, 8)
+	rand.Read(clientChallenge)
+	timestamp := avTimestamp(ch.targetInfo)
+	hasTimestamp := timestamp != nil
+	if !hasTimestamp {
+		timestamp = fileTime(time.Now())
+	}
+	nt, lm := ntlmv2Response(ntowfv2(user, passwd, domain), ch.challenge,
+		clientChallenge, timestamp, ch.targetInfo)
+	if hasTimestamp {
+		// LM response should be zero if server provides timestamp.
+		lm = make([]byte, 24)
+	}
+	workstation, _ := osHostname()
+
+	fields := [][]byte{lm, nt, utf16le(domain), utf16le(user), utf16le(workstation), nil}
+	msg := make([]byte, ntlmAuthenticateHeaderSize)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	offset := ntlmAuthenticateHeaderSize
+	for i, f := range fields {
+		pos := 12 + i*8
+		binary.LittleEndian.PutUint16(msg[pos:], uint16(len(f)))
+		binary.LittleEndian.PutUint16(msg[pos+2:], uint16(len(f)))
+		binary.LittleEndian.PutUint32(msg[pos+4:], uint32(offset))
+		offset += len(f)
+	}
+	flags := ch.flags&^ntlmNegotiateOEM | ntlmNegotiateUnicode
+	binary.LittleEndian.PutUint32(msg[60:], flags)
+	for _, f := range fields {
+		msg = append(msg, f...)
+	}
+	return msg
+}
+
+// osHostname returns host name without domain, in upper case.
+func osHostname() (string, error) {
+	name, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	if id := strings.IndexByte(name, '.'); id != -1 {
+		name = name[:id]
+	}
+	return strings.ToUpper(name), nil
+}
+
+// ntlmChallengeFromHeader returns the NTLM challenge message in 407 response
+// header.
+func ntlmChallengeFromHeader(header []byte) ([]byte, error) {
+	for _, challenge := range proxyAuthenticateAll(header) {
+		f := strings.Fields(challenge)
+		if len(f) == 2 && strings.ToLower(f[0]) == "ntlm" {
+			return base64.StdEncoding.DecodeString(f[1])
+		}
+	}
+	return nil, errors.New("no NTLM challenge in parent response")
+}
+
+// contentLength returns Content-Length in raw response header, 0 if not
+// present.
+func contentLength(header []byte) int64 {
+	for _, line := range strings.Split(string(header), "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 && strings.ToLower(strings.TrimSpace(kv[0])) == headerContentLength {
+			n, _ := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// ntlmHandshake sends negotiate message on the connection and returns
+// Proxy-Authorization header line with authenticate message, which should be
+// sent with the request.
+func (hc httpConn) ntlmHandshake(r *Request) ([]byte, error) {
+	method, uri := "HEAD", "http://"+r.URL.HostPort+r.URL.Path
+	if r.isConnect {
+		method, uri = "CONNECT", r.URL.HostPort
+	}
+	req := method + " " + uri + " HTTP/1.1\r\nHost: " + r.URL.HostPort + CRLF +
+		"Proxy-Connection: keep-alive\r\n" + headerProxyAuthorization + ": NTLM " +
+		base64.StdEncoding.EncodeToString(ntlmNegotiateMsg()) + CRLF + CRLF
+	hc.SetDeadline(time.Now().Add(config.ReadTimeout))
+	defer hc.SetDeadline(zeroTime)
+	if _, err := io.WriteString(hc.Conn, req); err != nil {
+		return nil, err
+	}
+	status, header, err := readConnectResponseHeader(hc.Conn)
+	if err != nil {
+		return nil, err
+	}
+	if status != "407" {
+		return nil, errors.New("NTLM negotiate: parent response status " + status)
+	}
+	if n := contentLength(header); n > 0 {
+		if _, err = io.CopyN(ioutil.Discard, hc.Conn, n); err != nil {
+			return nil, err
+		}
+	}
+	msg, err := ntlmChallengeFromHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := parseNTLMChallenge(msg)
+	if err != nil {
+		return nil, err
+	}
+	auth := hc.parent.auth
+	b64 := base64.StdEncoding.EncodeToString(ntlmAuthenticateMsg(auth.user, auth.passwd, ch))
+	*hc.ntlmDone = true
+	return []byte(headerProxyAuthorization + ": NTLM " + b64 + CRLF), nil
+}
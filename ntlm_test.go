@@ -0,0 +1,76 @@
+package cow
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestMD4(t *testing.T) {
+	// Test suite in RFC 1320.
+	td := []struct {
+		in  string
+		sum string
+	}{
+		{"", "31d6cfe0d16ae931b73c59d7e0c089c0"},
+		{"abc", "a448017aaf21d8525fc10ae87aa6729d"},
+		{"message digest", "d9130a8164549fe818874806e1c7014b"},
+		{"12345678901234567890123456789012345678901234567890123456789012345678901234567890",
+			"e33b4ddc9c38f2199c3e7b164fcc0536"},
+	}
+	for _, d := range td {
+		if sum := hex.EncodeToString(md4([]byte(d.in))); sum != d.sum {
+			t.Errorf("md4(%q) got %s, should be %s", d.in, sum, d.sum)
+		}
+	}
+}
+
+func TestNTLMv2Response(t *testing.T) {
+	// Example in [MS-NLMP] section 4.2.4.
+	key := ntowfv2("User", "Password", "Domain")
+	if s := hex.EncodeToString(key); s != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Error("NTOWFv2 wrong:", s)
+	}
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge := bytes.Repeat([]byte{0xaa}, 8)
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e00" +
+		"01000c00530065007200760065007200" + "00000000")
+	nt, lm := ntlmv2Response(key, serverChallenge, clientChallenge, make([]byte, 8), targetInfo)
+	if s := hex.EncodeToString(nt[:16]); s != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Error("NTProofStr wrong:", s)
+	}
+	if s := hex.EncodeToString(lm); s != "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" {
+		t.Error("LMv2 response wrong:", s)
+	}
+}
+
+func TestParseNTLMChallenge(t *testing.T) {
+	// Challenge message in [MS-NLMP] section 4.2.4.3, without version.
+	msg, _ := hex.DecodeString("4e544c4d53535000020000000c000c0038000000" +
+		"33828ae20123456789abcdef00000000000000002400240044000000" +
+		"0000000000000000" +
+		"53006500720076006500720002000c0044006f006d00610069006e00" +
+		"01000c0053006500720076006500720000000000")
+	ch, err := parseNTLMChallenge(msg)
+	if err != nil {
+		t.Fatal("parse challenge:", err)
+	}
+	if ch.targetName != "Server" {
+		t.Error("target name wrong:", ch.targetName)
+	}
+	if hex.EncodeToString(ch.challenge) != "0123456789abcdef" {
+		t.Error("server challenge wrong")
+	}
+	if len(ch.targetInfo) != 36 || avTimestamp(ch.targetInfo) != nil {
+		t.Error("target info wrong:", hex.EncodeToString(ch.targetInfo))
+	}
+
+	auth := ntlmAuthenticateMsg(`Domain\User`, "Password", ch)
+	if !bytes.Equal(auth[:8], ntlmSignature) || auth[8] != 3 {
+		t.Error("authenticate message header wrong")
+	}
+	user, err := secBuf(auth, 36)
+	if err != nil || !bytes.Equal(user, utf16le("User")) {
+		t.Error("user in authenticate message wrong")
+	}
+}
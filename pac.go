@@ -1,4 +1,4 @@
-package main
+package cow
 
 import (
 	"bytes"
@@ -28,7 +28,13 @@ func getDirectList() string {
 }
 
 func updateDirectList() {
-	dl := strings.Join(siteStat.GetDirectList(), "\",\n\"")
+	var lst []string
+	if config.PacDirectMax > 0 || config.PacDirectMinVisit > 0 {
+		lst = siteStat.GetPACDirectList(config.PacDirectMax, vcntint(config.PacDirectMinVisit))
+	} else {
+		lst = siteStat.GetDirectList()
+	}
+	dl := strings.Join(lst, "\",\n\"")
 	pac.dLRWMutex.Lock()
 	pac.directList = dl
 	pac.dLRWMutex.Unlock()
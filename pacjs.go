@@ -0,0 +1,1515 @@
+package cow
+
+// Restricted JavaScript evaluator for PAC files.
+//
+// Only the part of JavaScript commonly used in PAC files is supported:
+// function and var declarations, if/else, for, while, return, break and
+// continue statements; string, number, boolean, array and plain object
+// values; usual operators; string methods like toLowerCase and indexOf.
+// Regular expressions, prototypes and exceptions are not supported, scripts
+// using them fail to load or evaluate.
+//
+// All PAC helper functions are provided except dateRange.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pacMaxSteps = 1000000
+
+type jsError string
+
+func (e jsError) Error() string { return string(e) }
+
+func jsPanic(format string, a ...interface{}) {
+	panic(jsError(fmt.Sprintf(format, a...)))
+}
+
+type jsUndefined struct{}
+
+var undefined = jsUndefined{}
+
+type jsArray struct {
+	elem []interface{}
+}
+
+// jsObject is a plain object, keys keep insertion order. modified is set
+// when a property is assigned, so Go code can tell whether a script changed
+// an object passed to it.
+type jsObject struct {
+	prop     map[string]interface{}
+	keys     []string
+	modified bool
+}
+
+func newJSObject() *jsObject {
+	return &jsObject{prop: make(map[string]interface{})}
+}
+
+func (o *jsObject) set(name string, v interface{}) {
+	if _, ok := o.prop[name]; !ok {
+		o.keys = append(o.keys, name)
+	}
+	o.prop[name] = v
+}
+
+type jsFunc struct {
+	name   string
+	params []string
+	body   []jsStmt
+}
+
+type jsBuiltin func(args []interface{}) interface{}
+
+// Lexer
+
+type jsTokKind byte
+
+const (
+	tokEOF jsTokKind = iota
+	tokIdent
+	tokNum
+	tokStr
+	tokPunct
+)
+
+type jsTok struct {
+	kind jsTokKind
+	s    string
+	num  float64
+	line int
+}
+
+var jsPuncts = []string{
+	"===", "!==", "==", "!=", "<=", ">=", "&&", "||", "++", "--", "+=", "-=",
+	"{", "}", "(", ")", "[", "]", ";", ",", ".", "?", ":",
+	"=", "<", ">", "+", "-", "*", "/", "%", "!",
+}
+
+func jsLex(src string) ([]jsTok, error) {
+	var toks []jsTok
+	line := 1
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == '\n':
+			line++
+			i++
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end == -1 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case ch == '"' || ch == '\'':
+			var sb []byte
+			j := i + 1
+			for ; j < len(src) && src[j] != ch; j++ {
+				if src[j] == '\n' {
+					return nil, fmt.Errorf("line %d: unterminated string", line)
+				}
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+					switch src[j] {
+					case 'n':
+						sb = append(sb, '\n')
+					case 't':
+						sb = append(sb, '\t')
+					default:
+						sb = append(sb, src[j])
+					}
+					continue
+				}
+				sb = append(sb, src[j])
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			toks = append(toks, jsTok{kind: tokStr, s: string(sb), line: line})
+			i = j + 1
+		case ch >= '0' && ch <= '9':
+			j := i
+			for j < len(src) && (isAlnum(src[j]) || src[j] == '.') {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				// Try hex.
+				v, err2 := strconv.ParseInt(src[i:j], 0, 64)
+				if err2 != nil {
+					return nil, fmt.Errorf("line %d: invalid number %s", line, src[i:j])
+				}
+				n = float64(v)
+			}
+			toks = append(toks, jsTok{kind: tokNum, num: n, line: line})
+			i = j
+		case isAlnum(ch) || ch == '$':
+			j := i
+			for j < len(src) && (isAlnum(src[j]) || src[j] == '$') {
+				j++
+			}
+			toks = append(toks, jsTok{kind: tokIdent, s: src[i:j], line: line})
+			i = j
+		default:
+			found := false
+			for _, p := range jsPuncts {
+				if strings.HasPrefix(src[i:], p) {
+					toks = append(toks, jsTok{kind: tokPunct, s: p, line: line})
+					i += len(p)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("line %d: unexpected character %q", line, ch)
+			}
+		}
+	}
+	return append(toks, jsTok{kind: tokEOF, line: line}), nil
+}
+
+func isAlnum(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// AST
+
+type jsStmt interface{}
+type jsExpr interface{}
+
+type (
+	jsVarStmt struct {
+		names []string
+		inits []jsExpr
+	}
+	jsIfStmt struct {
+		cond      jsExpr
+		then, els jsStmt
+	}
+	jsForStmt struct {
+		init       jsStmt
+		cond, post jsExpr
+		body       jsStmt
+	}
+	jsReturnStmt   struct{ x jsExpr }
+	jsBlockStmt    struct{ list []jsStmt }
+	jsExprStmt     struct{ x jsExpr }
+	jsFuncDecl     struct{ fn *jsFunc }
+	jsBreakStmt    struct{}
+	jsContinueStmt struct{}
+)
+
+type (
+	jsLit    struct{ v interface{} }
+	jsIdent  struct{ name string }
+	jsArrLit struct{ elem []jsExpr }
+	jsObjLit struct {
+		keys []string
+		vals []jsExpr
+	}
+	jsMember struct {
+		obj  jsExpr
+		name string
+	}
+	jsIndex struct{ obj, idx jsExpr }
+	jsCall  struct {
+		fn   jsExpr
+		args []jsExpr
+	}
+	jsUnary struct {
+		op string
+		x  jsExpr
+	}
+	jsBinary struct {
+		op   string
+		x, y jsExpr
+	}
+	jsAssign struct {
+		op     string
+		target jsExpr
+		x      jsExpr
+	}
+	jsUpdate struct {
+		op     string
+		target jsExpr
+		prefix bool
+	}
+	jsCond     struct{ cond, a, b jsExpr }
+	jsFuncExpr struct{ fn *jsFunc }
+)
+
+// Parser
+
+type jsParser struct {
+	toks []jsTok
+	pos  int
+}
+
+func (p *jsParser) peek() jsTok { return p.toks[p.pos] }
+
+func (p *jsParser) next() jsTok {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *jsParser) is(s string) bool {
+	t := p.peek()
+	return (t.kind == tokPunct || t.kind == tokIdent) && t.s == s
+}
+
+func (p *jsParser) accept(s string) bool {
+	if p.is(s) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *jsParser) expect(s string) {
+	if !p.accept(s) {
+		t := p.peek()
+		jsPanic("line %d: expect %s, got %q", t.line, s, t.s)
+	}
+}
+
+func (p *jsParser) ident() string {
+	t := p.next()
+	if t.kind != tokIdent {
+		jsPanic("line %d: expect identifier, got %q", t.line, t.s)
+	}
+	return t.s
+}
+
+func (p *jsParser) program() (list []jsStmt) {
+	for p.peek().kind != tokEOF {
+		list = append(list, p.stmt())
+	}
+	return
+}
+
+func (p *jsParser) stmt() jsStmt {
+	t := p.peek()
+	if t.kind == tokIdent {
+		switch t.s {
+		case "function":
+			p.next()
+			return &jsFuncDecl{p.function()}
+		case "var", "let", "const":
+			s := p.varStmt()
+			p.accept(";")
+			return s
+		case "if":
+			p.next()
+			p.expect("(")
+			s := &jsIfStmt{cond: p.expr()}
+			p.expect(")")
+			s.then = p.stmt()
+			if p.accept("else") {
+				s.els = p.stmt()
+			}
+			return s
+		case "for":
+			p.next()
+			p.expect("(")
+			s := &jsForStmt{}
+			if !p.is(";") {
+				if p.is("var") || p.is("let") {
+					s.init = p.varStmt()
+				} else {
+					s.init = &jsExprStmt{p.expr()}
+				}
+			}
+			p.expect(";")
+			if !p.is(";") {
+				s.cond = p.expr()
+			}
+			p.expect(";")
+			if !p.is(")") {
+				s.post = p.expr()
+			}
+			p.expect(")")
+			s.body = p.stmt()
+			return s
+		case "while":
+			p.next()
+			p.expect("(")
+			s := &jsForStmt{cond: p.expr()}
+			p.expect(")")
+			s.body = p.stmt()
+			return s
+		case "return":
+			p.next()
+			s := &jsReturnStmt{}
+			if !p.is(";") && !p.is("}") && p.peek().line == t.line {
+				s.x = p.expr()
+			}
+			p.accept(";")
+			return s
+		case "break":
+			p.next()
+			p.accept(";")
+			return &jsBreakStmt{}
+		case "continue":
+			p.next()
+			p.accept(";")
+			return &jsContinueStmt{}
+		}
+	}
+	if p.accept("{") {
+		b := &jsBlockStmt{}
+		for !p.accept("}") {
+			if p.peek().kind == tokEOF {
+				jsPanic("line %d: unexpected end of script", t.line)
+			}
+			b.list = append(b.list, p.stmt())
+		}
+		return b
+	}
+	if p.accept(";") {
+		return &jsBlockStmt{}
+	}
+	s := &jsExprStmt{p.expr()}
+	p.accept(";")
+	return s
+}
+
+func (p *jsParser) varStmt() *jsVarStmt {
+	p.next() // var, let or const
+	s := &jsVarStmt{}
+	for {
+		s.names = append(s.names, p.ident())
+		var init jsExpr
+		if p.accept("=") {
+			init = p.assign()
+		}
+		s.inits = append(s.inits, init)
+		if !p.accept(",") {
+			return s
+		}
+	}
+}
+
+func (p *jsParser) function() *jsFunc {
+	fn := &jsFunc{}
+	if p.peek().kind == tokIdent {
+		fn.name = p.ident()
+	}
+	p.expect("(")
+	for !p.accept(")") {
+		fn.params = append(fn.params, p.ident())
+		if !p.is(")") {
+			p.expect(",")
+		}
+	}
+	p.expect("{")
+	for !p.accept("}") {
+		if p.peek().kind == tokEOF {
+			jsPanic("unexpected end of script in function %s", fn.name)
+		}
+		fn.body = append(fn.body, p.stmt())
+	}
+	return fn
+}
+
+func (p *jsParser) expr() jsExpr {
+	x := p.assign()
+	for p.accept(",") {
+		x = &jsBinary{",", x, p.assign()}
+	}
+	return x
+}
+
+func (p *jsParser) assign() jsExpr {
+	x := p.ternary()
+	for _, op := range []string{"=", "+=", "-="} {
+		if p.accept(op) {
+			switch x.(type) {
+			case *jsIdent, *jsIndex, *jsMember:
+			default:
+				jsPanic("line %d: invalid assignment target", p.peek().line)
+			}
+			return &jsAssign{op, x, p.assign()}
+		}
+	}
+	return x
+}
+
+func (p *jsParser) ternary() jsExpr {
+	x := p.binary(0)
+	if p.accept("?") {
+		a := p.assign()
+		p.expect(":")
+		return &jsCond{x, a, p.assign()}
+	}
+	return x
+}
+
+var jsBinaryPrec = [][]string{
+	{"||"},
+	{"&&"},
+	{"===", "!==", "==", "!="},
+	{"<=", ">=", "<", ">"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *jsParser) binary(level int) jsExpr {
+	if level == len(jsBinaryPrec) {
+		return p.unary()
+	}
+	x := p.binary(level + 1)
+	for {
+		t := p.peek()
+		matched := false
+		if t.kind == tokPunct {
+			for _, op := range jsBinaryPrec[level] {
+				if t.s == op {
+					p.next()
+					x = &jsBinary{op, x, p.binary(level + 1)}
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			return x
+		}
+	}
+}
+
+func (p *jsParser) unary() jsExpr {
+	for _, op := range []string{"!", "-", "+", "typeof"} {
+		if p.accept(op) {
+			return &jsUnary{op, p.unary()}
+		}
+	}
+	for _, op := range []string{"++", "--"} {
+		if p.accept(op) {
+			return &jsUpdate{op, p.unary(), true}
+		}
+	}
+	x := p.postfix()
+	for _, op := range []string{"++", "--"} {
+		if p.accept(op) {
+			return &jsUpdate{op, x, false}
+		}
+	}
+	return x
+}
+
+func (p *jsParser) postfix() jsExpr {
+	x := p.primary()
+	for {
+		switch {
+		case p.accept("."):
+			x = &jsMember{x, p.ident()}
+		case p.accept("["):
+			x = &jsIndex{x, p.expr()}
+			p.expect("]")
+		case p.accept("("):
+			c := &jsCall{fn: x}
+			for !p.accept(")") {
+				c.args = append(c.args, p.assign())
+				if !p.is(")") {
+					p.expect(",")
+				}
+			}
+			x = c
+		default:
+			return x
+		}
+	}
+}
+
+func (p *jsParser) primary() jsExpr {
+	t := p.next()
+	switch t.kind {
+	case tokNum:
+		return &jsLit{t.num}
+	case tokStr:
+		return &jsLit{t.s}
+	case tokIdent:
+		switch t.s {
+		case "true":
+			return &jsLit{true}
+		case "false":
+			return &jsLit{false}
+		case "null":
+			return &jsLit{nil}
+		case "undefined":
+			return &jsLit{undefined}
+		case "function":
+			return &jsFuncExpr{p.function()}
+		}
+		return &jsIdent{t.s}
+	case tokPunct:
+		switch t.s {
+		case "(":
+			x := p.expr()
+			p.expect(")")
+			return x
+		case "[":
+			a := &jsArrLit{}
+			for !p.accept("]") {
+				a.elem = append(a.elem, p.assign())
+				if !p.is("]") {
+					p.expect(",")
+				}
+			}
+			return a
+		case "{":
+			o := &jsObjLit{}
+			for !p.accept("}") {
+				k := p.next()
+				if k.kind != tokIdent && k.kind != tokStr && k.kind != tokNum {
+					jsPanic("line %d: unexpected %q", k.line, k.s)
+				}
+				name := k.s
+				if k.kind == tokNum {
+					name = jsString(k.num)
+				}
+				p.expect(":")
+				o.keys = append(o.keys, name)
+				o.vals = append(o.vals, p.assign())
+				if !p.is("}") {
+					p.expect(",")
+				}
+			}
+			return o
+		case "/":
+			jsPanic("line %d: regular expression is not supported", t.line)
+		}
+	}
+	jsPanic("line %d: unexpected %q", t.line, t.s)
+	return nil
+}
+
+// Interpreter
+
+type jsScope struct {
+	vars   map[string]interface{}
+	parent *jsScope
+}
+
+func (s *jsScope) lookup(name string) (*jsScope, bool) {
+	for ; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+type jsCtrl byte
+
+const (
+	ctrlNone jsCtrl = iota
+	ctrlReturn
+	ctrlBreak
+	ctrlContinue
+)
+
+type jsInterp struct {
+	global *jsScope
+	steps  int
+}
+
+func (in *jsInterp) step() {
+	in.steps++
+	if in.steps > pacMaxSteps {
+		jsPanic("script runs too long")
+	}
+}
+
+func (in *jsInterp) execList(list []jsStmt, sc *jsScope) (jsCtrl, interface{}) {
+	// Hoist function declarations.
+	for _, s := range list {
+		if f, ok := s.(*jsFuncDecl); ok {
+			sc.vars[f.fn.name] = &jsClosure{f.fn, sc}
+		}
+	}
+	for _, s := range list {
+		if ctrl, v := in.exec(s, sc); ctrl != ctrlNone {
+			return ctrl, v
+		}
+	}
+	return ctrlNone, nil
+}
+
+type jsClosure struct {
+	fn    *jsFunc
+	scope *jsScope
+}
+
+func (in *jsInterp) exec(s jsStmt, sc *jsScope) (jsCtrl, interface{}) {
+	in.step()
+	switch s := s.(type) {
+	case *jsFuncDecl:
+	case *jsVarStmt:
+		for i, name := range s.names {
+			var v interface{} = undefined
+			if s.inits[i] != nil {
+				v = in.eval(s.inits[i], sc)
+			} else if _, ok := sc.vars[name]; ok {
+				continue
+			}
+			sc.vars[name] = v
+		}
+	case *jsExprStmt:
+		in.eval(s.x, sc)
+	case *jsReturnStmt:
+		var v interface{} = undefined
+		if s.x != nil {
+			v = in.eval(s.x, sc)
+		}
+		return ctrlReturn, v
+	case *jsIfStmt:
+		if jsTruthy(in.eval(s.cond, sc)) {
+			return in.exec(s.then, sc)
+		} else if s.els != nil {
+			return in.exec(s.els, sc)
+		}
+	case *jsBlockStmt:
+		for _, st := range s.list {
+			if ctrl, v := in.exec(st, sc); ctrl != ctrlNone {
+				return ctrl, v
+			}
+		}
+	case *jsForStmt:
+		if s.init != nil {
+			in.exec(s.init, sc)
+		}
+		for s.cond == nil || jsTruthy(in.eval(s.cond, sc)) {
+			in.step()
+			ctrl, v := in.exec(s.body, sc)
+			if ctrl == ctrlReturn {
+				return ctrl, v
+			}
+			if ctrl == ctrlBreak {
+				break
+			}
+			if s.post != nil {
+				in.eval(s.post, sc)
+			}
+		}
+	case *jsBreakStmt:
+		return ctrlBreak, nil
+	case *jsContinueStmt:
+		return ctrlContinue, nil
+	default:
+		jsPanic("unknown statement %T", s)
+	}
+	return ctrlNone, nil
+}
+
+func (in *jsInterp) call(f interface{}, args []interface{}) interface{} {
+	switch f := f.(type) {
+	case jsBuiltin:
+		return f(args)
+	case *jsClosure:
+		sc := &jsScope{vars: make(map[string]interface{}), parent: f.scope}
+		for i, name := range f.fn.params {
+			if i < len(args) {
+				sc.vars[name] = args[i]
+			} else {
+				sc.vars[name] = undefined
+			}
+		}
+		if ctrl, v := in.execList(f.fn.body, sc); ctrl == ctrlReturn {
+			return v
+		}
+		return undefined
+	}
+	jsPanic("%s is not a function", jsString(f))
+	return nil
+}
+
+func (in *jsInterp) eval(x jsExpr, sc *jsScope) interface{} {
+	in.step()
+	switch x := x.(type) {
+	case *jsLit:
+		return x.v
+	case *jsIdent:
+		if s, ok := sc.lookup(x.name); ok {
+			return s.vars[x.name]
+		}
+		jsPanic("%s is not defined", x.name)
+	case *jsArrLit:
+		a := &jsArray{}
+		for _, e := range x.elem {
+			a.elem = append(a.elem, in.eval(e, sc))
+		}
+		return a
+	case *jsObjLit:
+		o := newJSObject()
+		for i, k := range x.keys {
+			o.set(k, in.eval(x.vals[i], sc))
+		}
+		return o
+	case *jsFuncExpr:
+		return &jsClosure{x.fn, sc}
+	case *jsMember:
+		return jsProperty(in.eval(x.obj, sc), x.name)
+	case *jsIndex:
+		obj := in.eval(x.obj, sc)
+		idx := in.eval(x.idx, sc)
+		if a, ok := obj.(*jsArray); ok {
+			i := int(jsNumber(idx))
+			if i >= 0 && i < len(a.elem) {
+				return a.elem[i]
+			}
+			return undefined
+		}
+		if s, ok := obj.(string); ok {
+			if i := int(jsNumber(idx)); i >= 0 && i < len(s) {
+				return s[i : i+1]
+			}
+			return undefined
+		}
+		return jsProperty(obj, jsString(idx))
+	case *jsCall:
+		var args []interface{}
+		for _, a := range x.args {
+			args = append(args, in.eval(a, sc))
+		}
+		if m, ok := x.fn.(*jsMember); ok {
+			return jsMethod(in.eval(m.obj, sc), m.name, args)
+		}
+		return in.call(in.eval(x.fn, sc), args)
+	case *jsUnary:
+		v := in.eval(x.x, sc)
+		switch x.op {
+		case "!":
+			return !jsTruthy(v)
+		case "-":
+			return -jsNumber(v)
+		case "+":
+			return jsNumber(v)
+		case "typeof":
+			return jsTypeof(v)
+		}
+	case *jsBinary:
+		return in.binary(x, sc)
+	case *jsCond:
+		if jsTruthy(in.eval(x.cond, sc)) {
+			return in.eval(x.a, sc)
+		}
+		return in.eval(x.b, sc)
+	case *jsAssign:
+		v := in.eval(x.x, sc)
+		if x.op != "=" {
+			v = jsArith(x.op[:1], in.eval(x.target, sc), v)
+		}
+		in.store(x.target, v, sc)
+		return v
+	case *jsUpdate:
+		old := jsNumber(in.eval(x.target, sc))
+		v := old + 1
+		if x.op == "--" {
+			v = old - 1
+		}
+		in.store(x.target, v, sc)
+		if x.prefix {
+			return v
+		}
+		return old
+	}
+	jsPanic("unsupported expression %T", x)
+	return nil
+}
+
+func (in *jsInterp) store(target jsExpr, v interface{}, sc *jsScope) {
+	switch t := target.(type) {
+	case *jsIdent:
+		if s, ok := sc.lookup(t.name); ok {
+			s.vars[t.name] = v
+		} else {
+			in.global.vars[t.name] = v
+		}
+	case *jsMember:
+		in.storeProperty(in.eval(t.obj, sc), t.name, v)
+	case *jsIndex:
+		obj := in.eval(t.obj, sc)
+		if _, ok := obj.(*jsObject); ok {
+			in.storeProperty(obj, jsString(in.eval(t.idx, sc)), v)
+			return
+		}
+		a, ok := obj.(*jsArray)
+		if !ok {
+			jsPanic("index assignment only supported for array and object")
+		}
+		i := int(jsNumber(in.eval(t.idx, sc)))
+		if i < 0 || i > len(a.elem)+1024 {
+			jsPanic("invalid array index %d", i)
+		}
+		for len(a.elem) <= i {
+			a.elem = append(a.elem, undefined)
+		}
+		a.elem[i] = v
+	default:
+		jsPanic("invalid assignment target")
+	}
+}
+
+func (in *jsInterp) storeProperty(obj interface{}, name string, v interface{}) {
+	o, ok := obj.(*jsObject)
+	if !ok {
+		jsPanic("cannot set property %s of %s", name, jsString(obj))
+	}
+	o.set(name, v)
+	o.modified = true
+}
+
+func (in *jsInterp) binary(x *jsBinary, sc *jsScope) interface{} {
+	switch x.op {
+	case "&&":
+		v := in.eval(x.x, sc)
+		if !jsTruthy(v) {
+			return v
+		}
+		return in.eval(x.y, sc)
+	case "||":
+		v := in.eval(x.x, sc)
+		if jsTruthy(v) {
+			return v
+		}
+		return in.eval(x.y, sc)
+	case ",":
+		in.eval(x.x, sc)
+		return in.eval(x.y, sc)
+	}
+	a, b := in.eval(x.x, sc), in.eval(x.y, sc)
+	switch x.op {
+	case "===":
+		return jsStrictEqual(a, b)
+	case "!==":
+		return !jsStrictEqual(a, b)
+	case "==":
+		return jsLooseEqual(a, b)
+	case "!=":
+		return !jsLooseEqual(a, b)
+	case "<", ">", "<=", ">=":
+		sa, aok := a.(string)
+		sb, bok := b.(string)
+		var c int
+		if aok && bok {
+			switch {
+			case sa < sb:
+				c = -1
+			case sa > sb:
+				c = 1
+			}
+		} else {
+			na, nb := jsNumber(a), jsNumber(b)
+			if math.IsNaN(na) || math.IsNaN(nb) {
+				return false
+			}
+			switch {
+			case na < nb:
+				c = -1
+			case na > nb:
+				c = 1
+			}
+		}
+		switch x.op {
+		case "<":
+			return c < 0
+		case ">":
+			return c > 0
+		case "<=":
+			return c <= 0
+		}
+		return c >= 0
+	}
+	return jsArith(x.op, a, b)
+}
+
+func jsArith(op string, a, b interface{}) interface{} {
+	if op == "+" {
+		_, as := a.(string)
+		_, bs := b.(string)
+		if as || bs {
+			return jsString(a) + jsString(b)
+		}
+	}
+	na, nb := jsNumber(a), jsNumber(b)
+	switch op {
+	case "+":
+		return na + nb
+	case "-":
+		return na - nb
+	case "*":
+		return na * nb
+	case "/":
+		return na / nb
+	case "%":
+		return math.Mod(na, nb)
+	}
+	jsPanic("unknown operator %s", op)
+	return nil
+}
+
+func jsTruthy(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	case nil, jsUndefined:
+		return false
+	}
+	return true
+}
+
+func jsNumber(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			return 0
+		}
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return n
+		}
+	case nil:
+		return 0
+	}
+	return math.NaN()
+}
+
+func jsString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e21 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return "null"
+	case jsUndefined:
+		return "undefined"
+	case *jsArray:
+		s := make([]string, len(v.elem))
+		for i, e := range v.elem {
+			s[i] = jsString(e)
+		}
+		return strings.Join(s, ",")
+	case *jsObject:
+		return "[object Object]"
+	}
+	return "function"
+}
+
+func jsTypeof(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case jsUndefined:
+		return "undefined"
+	case jsBuiltin, *jsClosure:
+		return "function"
+	}
+	return "object"
+}
+
+func jsStrictEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case *jsArray:
+		bb, ok := b.(*jsArray)
+		return ok && a == bb
+	case *jsObject:
+		bb, ok := b.(*jsObject)
+		return ok && a == bb
+	case jsBuiltin, *jsClosure:
+		return false
+	}
+	switch b.(type) {
+	case *jsArray, *jsObject, jsBuiltin, *jsClosure:
+		return false
+	}
+	return a == b
+}
+
+func jsLooseEqual(a, b interface{}) bool {
+	aNull := a == nil || a == undefined
+	bNull := b == nil || b == undefined
+	if aNull || bNull {
+		return aNull && bNull
+	}
+	_, as := a.(string)
+	_, bs := b.(string)
+	if as && bs {
+		return a == b
+	}
+	_, aa := a.(*jsArray)
+	_, ba := b.(*jsArray)
+	_, ao := a.(*jsObject)
+	_, bo := b.(*jsObject)
+	if aa || ba || ao || bo {
+		return jsStrictEqual(a, b)
+	}
+	return jsNumber(a) == jsNumber(b)
+}
+
+func jsProperty(obj interface{}, name string) interface{} {
+	switch o := obj.(type) {
+	case string:
+		if name == "length" {
+			return float64(len(o))
+		}
+	case *jsArray:
+		if name == "length" {
+			return float64(len(o.elem))
+		}
+	case *jsObject:
+		if v, ok := o.prop[name]; ok {
+			return v
+		}
+	case nil, jsUndefined:
+		jsPanic("cannot read property %s of %s", name, jsString(obj))
+	}
+	return undefined
+}
+
+func jsArg(args []interface{}, i int) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+	return undefined
+}
+
+func jsMethod(obj interface{}, name string, args []interface{}) interface{} {
+	switch o := obj.(type) {
+	case string:
+		return jsStringMethod(o, name, args)
+	case *jsArray:
+		switch name {
+		case "indexOf":
+			for i, e := range o.elem {
+				if jsStrictEqual(e, jsArg(args, 0)) {
+					return float64(i)
+				}
+			}
+			return float64(-1)
+		case "join":
+			sep := ","
+			if len(args) > 0 {
+				sep = jsString(args[0])
+			}
+			s := make([]string, len(o.elem))
+			for i, e := range o.elem {
+				s[i] = jsString(e)
+			}
+			return strings.Join(s, sep)
+		case "push":
+			o.elem = append(o.elem, args...)
+			return float64(len(o.elem))
+		}
+	case nil, jsUndefined:
+		jsPanic("cannot call method %s of %s", name, jsString(obj))
+	}
+	jsPanic("method %s is not supported", name)
+	return nil
+}
+
+// clampIndex converts JavaScript index argument to valid index in s.
+func clampIndex(v interface{}, n int) int {
+	f := jsNumber(v)
+	if math.IsNaN(f) || f < 0 {
+		return 0
+	}
+	if f > float64(n) {
+		return n
+	}
+	return int(f)
+}
+
+func jsStringMethod(s, name string, args []interface{}) interface{} {
+	switch name {
+	case "toLowerCase":
+		return strings.ToLower(s)
+	case "toUpperCase":
+		return strings.ToUpper(s)
+	case "indexOf":
+		return float64(strings.Index(s, jsString(jsArg(args, 0))))
+	case "lastIndexOf":
+		return float64(strings.LastIndex(s, jsString(jsArg(args, 0))))
+	case "charAt":
+		f := jsNumber(jsArg(args, 0))
+		if math.IsNaN(f) {
+			f = 0
+		}
+		if f < 0 || f >= float64(len(s)) {
+			return ""
+		}
+		i := int(f)
+		return s[i : i+1]
+	case "substring":
+		start := clampIndex(jsArg(args, 0), len(s))
+		end := len(s)
+		if len(args) > 1 {
+			end = clampIndex(args[1], len(s))
+		}
+		if start > end {
+			start, end = end, start
+		}
+		return s[start:end]
+	case "substr":
+		// Clamp before converting to int, large numbers overflow.
+		f := math.Trunc(jsNumber(jsArg(args, 0)))
+		if f < 0 {
+			f += float64(len(s))
+		}
+		start := clampIndex(f, len(s))
+		end := len(s)
+		if len(args) > 1 {
+			end = clampIndex(float64(start)+jsNumber(args[1]), len(s))
+		}
+		if end < start {
+			end = start
+		}
+		return s[start:end]
+	case "startsWith":
+		return strings.HasPrefix(s, jsString(jsArg(args, 0)))
+	case "endsWith":
+		return strings.HasSuffix(s, jsString(jsArg(args, 0)))
+	case "split":
+		a := &jsArray{}
+		if len(args) == 0 || args[0] == undefined {
+			a.elem = append(a.elem, s)
+			return a
+		}
+		for _, e := range strings.Split(s, jsString(args[0])) {
+			a.elem = append(a.elem, e)
+		}
+		return a
+	case "replace":
+		return strings.Replace(s, jsString(jsArg(args, 0)), jsString(jsArg(args, 1)), 1)
+	case "trim":
+		return strings.TrimSpace(s)
+	case "toString":
+		return s
+	}
+	jsPanic("method %s is not supported", name)
+	return nil
+}
+
+// PAC helper functions.
+
+// shExpMatch matches shell expression with * and ?. Unlike path.Match, *
+// also matches /.
+func shExpMatch(s, pattern string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(s); i++ {
+			if shExpMatch(s[i:], pattern[1:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return s != "" && shExpMatch(s[1:], pattern[1:])
+	}
+	return s != "" && s[0] == pattern[0] && shExpMatch(s[1:], pattern[1:])
+}
+
+// pacLookupHost only caches result when DNS cache is enabled, so hosts
+// looked up by PAC don't pile up in the cache. Replaced in tests.
+var pacLookupHost = lookupHost
+
+func pacResolve(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return host
+	}
+	addrs, err := pacLookupHost(host)
+	if err != nil {
+		return ""
+	}
+	for _, a := range addrs {
+		if net.ParseIP(a).To4() != nil {
+			return a
+		}
+	}
+	return ""
+}
+
+func pacMyIPAddress() string {
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+				return ipNet.IP.String()
+			}
+		}
+	}
+	return "127.0.0.1"
+}
+
+var pacWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+func pacNow(args []interface{}) (time.Time, []interface{}) {
+	now := time.Now()
+	if n := len(args); n > 0 && jsString(args[n-1]) == "GMT" {
+		return now.UTC(), args[:n-1]
+	}
+	return now, args
+}
+
+func pacWeekdayRange(args []interface{}) interface{} {
+	now, args := pacNow(args)
+	day := func(v interface{}) int {
+		for i, d := range pacWeekdays {
+			if strings.ToUpper(jsString(v)) == d {
+				return i
+			}
+		}
+		return -1
+	}
+	if len(args) == 0 {
+		return false
+	}
+	wd1, wd2 := day(args[0]), day(args[0])
+	if len(args) > 1 {
+		wd2 = day(args[1])
+	}
+	if wd1 < 0 || wd2 < 0 {
+		return false
+	}
+	today := int(now.Weekday())
+	if wd1 <= wd2 {
+		return wd1 <= today && today <= wd2
+	}
+	return today >= wd1 || today <= wd2
+}
+
+func pacTimeRange(args []interface{}) interface{} {
+	now, args := pacNow(args)
+	n := make([]int, len(args))
+	for i, a := range args {
+		n[i] = int(jsNumber(a))
+	}
+	cur := now.Hour()*3600 + now.Minute()*60 + now.Second()
+	var start, end int
+	switch len(n) {
+	case 1:
+		start, end = n[0]*3600, n[0]*3600+3599
+	case 2:
+		start, end = n[0]*3600, n[1]*3600+3599
+	case 4:
+		start, end = n[0]*3600+n[1]*60, n[2]*3600+n[3]*60+59
+	case 6:
+		start, end = n[0]*3600+n[1]*60+n[2], n[3]*3600+n[4]*60+n[5]
+	default:
+		return false
+	}
+	if start <= end {
+		return start <= cur && cur <= end
+	}
+	return cur >= start || cur <= end
+}
+
+func pacBuiltins(ps *pacScript) map[string]interface{} {
+	str := func(args []interface{}, i int) string { return jsString(jsArg(args, i)) }
+	return map[string]interface{}{
+		"isPlainHostName": jsBuiltin(func(a []interface{}) interface{} {
+			return !strings.Contains(str(a, 0), ".")
+		}),
+		"dnsDomainIs": jsBuiltin(func(a []interface{}) interface{} {
+			return strings.HasSuffix(strings.ToLower(str(a, 0)), strings.ToLower(str(a, 1)))
+		}),
+		"localHostOrDomainIs": jsBuiltin(func(a []interface{}) interface{} {
+			host, hostdom := str(a, 0), str(a, 1)
+			if host == hostdom {
+				return true
+			}
+			return !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+".")
+		}),
+		"isResolvable": jsBuiltin(func(a []interface{}) interface{} {
+			return ps.resolve(str(a, 0)) != ""
+		}),
+		"isInNet": jsBuiltin(func(a []interface{}) interface{} {
+			ip := net.ParseIP(ps.resolve(str(a, 0))).To4()
+			pattern := net.ParseIP(str(a, 1)).To4()
+			mask := net.ParseIP(str(a, 2)).To4()
+			if ip == nil || pattern == nil || mask == nil {
+				return false
+			}
+			m := net.IPMask(mask)
+			return ip.Mask(m).Equal(pattern.Mask(m))
+		}),
+		"dnsResolve": jsBuiltin(func(a []interface{}) interface{} {
+			if ip := ps.resolve(str(a, 0)); ip != "" {
+				return ip
+			}
+			return nil
+		}),
+		"myIpAddress": jsBuiltin(func(a []interface{}) interface{} {
+			return pacMyIPAddress()
+		}),
+		"dnsDomainLevels": jsBuiltin(func(a []interface{}) interface{} {
+			return float64(strings.Count(str(a, 0), "."))
+		}),
+		"shExpMatch": jsBuiltin(func(a []interface{}) interface{} {
+			if len(a) < 2 {
+				return false
+			}
+			return shExpMatch(str(a, 0), str(a, 1))
+		}),
+		"weekdayRange": jsBuiltin(pacWeekdayRange),
+		"timeRange":    jsBuiltin(pacTimeRange),
+		"dateRange": jsBuiltin(func(a []interface{}) interface{} {
+			jsPanic("dateRange is not supported")
+			return nil
+		}),
+		"alert": jsBuiltin(func(a []interface{}) interface{} {
+			info.Println("PAC alert:", str(a, 0))
+			return undefined
+		}),
+	}
+}
+
+// pacScript is a loaded PAC file. Evaluation is serialized as scripts may
+// change global variables, except DNS lookup which is done without the lock
+// so one slow lookup doesn't block other calls.
+type pacScript struct {
+	sync.Mutex
+	interp *jsInterp
+	find   interface{}
+}
+
+// resolve is called by builtins with ps locked.
+func (ps *pacScript) resolve(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	steps := ps.interp.steps
+	ps.Unlock()
+	defer func() {
+		ps.Lock()
+		ps.interp.steps = steps
+	}()
+	return pacResolve(host)
+}
+
+func (ps *pacScript) run(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			je, ok := r.(jsError)
+			if !ok {
+				panic(r)
+			}
+			err = je
+		}
+	}()
+	f()
+	return
+}
+
+// loadJSScript parses and runs script src with PAC builtins and extra
+// global values, functions defined in it can then be called with callFunc.
+func loadJSScript(src string, extra map[string]interface{}) (*pacScript, error) {
+	toks, err := jsLex(src)
+	if err != nil {
+		return nil, err
+	}
+	ps := &pacScript{interp: &jsInterp{}}
+	var prog []jsStmt
+	if err = ps.run(func() {
+		prog = (&jsParser{toks: toks}).program()
+	}); err != nil {
+		return nil, err
+	}
+	global := pacBuiltins(ps)
+	for k, v := range extra {
+		global[k] = v
+	}
+	ps.interp.global = &jsScope{vars: global}
+	ps.Lock()
+	err = ps.run(func() {
+		ps.interp.execList(prog, ps.interp.global)
+	})
+	ps.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+func newPacScript(src string) (*pacScript, error) {
+	ps, err := loadJSScript(src, nil)
+	if err != nil {
+		return nil, err
+	}
+	find, ok := ps.interp.global.vars["FindProxyForURL"]
+	if !ok {
+		return nil, errors.New("no FindProxyForURL function")
+	}
+	ps.find = find
+	return ps, nil
+}
+
+// function returns global function name defined in the script, or nil.
+func (ps *pacScript) function(name string) interface{} {
+	switch f := ps.interp.global.vars[name].(type) {
+	case *jsClosure:
+		return f
+	}
+	return nil
+}
+
+// callFunc calls function fn in the script.
+func (ps *pacScript) callFunc(fn interface{}, args ...interface{}) (res interface{}, err error) {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.interp.steps = 0
+	err = ps.run(func() {
+		res = ps.interp.call(fn, args)
+	})
+	return
+}
+
+// FindProxyForURL calls the function in PAC script.
+func (ps *pacScript) FindProxyForURL(url, host string) (res string, err error) {
+	v, err := ps.callFunc(ps.find, url, host)
+	if err != nil {
+		return "", err
+	}
+	return jsString(v), nil
+}
@@ -0,0 +1,245 @@
+package cow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShExpMatch(t *testing.T) {
+	testData := []struct {
+		s, pattern string
+		match      bool
+	}{
+		{"http://home.netscape.com/people/ari/index.html", "*/ari/*", true},
+		{"http://home.netscape.com/people/montulli/index.html", "*/ari/*", false},
+		{"www.google.com", "*.google.com", true},
+		{"google.com", "*.google.com", false},
+		{"a.b", "?.b", true},
+		{"ab.b", "?.b", false},
+		{"", "*", true},
+	}
+	for _, td := range testData {
+		if shExpMatch(td.s, td.pattern) != td.match {
+			t.Errorf("shExpMatch(%q, %q) should be %v", td.s, td.pattern, td.match)
+		}
+	}
+}
+
+func TestPacScript(t *testing.T) {
+	src := `
+// Proxy list
+var proxy = "PROXY 127.0.0.1:8080; DIRECT";
+var direct = ["example.com", "example.org"];
+
+function inList(host, list) {
+	for (var i = 0; i < list.length; i++) {
+		if (dnsDomainIs(host, "." + list[i]) || host === list[i])
+			return true;
+	}
+	return false;
+}
+
+/* Main entry */
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (isPlainHostName(host) || isInNet(host, "10.0.0.0", "255.0.0.0"))
+		return "DIRECT";
+	if (inList(host, direct))
+		return "DIRECT";
+	if (shExpMatch(url, "https://*"))
+		return host.indexOf("socks") == 0 ? "SOCKS5 127.0.0.1:1080" : proxy;
+	var n = 0;
+	while (true) {
+		n += 1;
+		if (n >= 3) break;
+	}
+	return "PROXY " + host.substring(0, 3) + ":" + (n + 8000);
+}
+`
+	ps, err := newPacScript(src)
+	if err != nil {
+		t.Fatal("load PAC:", err)
+	}
+	testData := []struct {
+		url, host, res string
+	}{
+		{"http://intranet/", "intranet", "DIRECT"},
+		{"http://10.1.2.3/", "10.1.2.3", "DIRECT"},
+		{"http://www.Example.com/", "www.Example.com", "DIRECT"},
+		{"http://example.org/", "example.org", "DIRECT"},
+		{"https://www.google.com/", "www.google.com", "PROXY 127.0.0.1:8080; DIRECT"},
+		{"https://socks.google.com/", "socks.google.com", "SOCKS5 127.0.0.1:1080"},
+		{"http://www.google.com/", "www.google.com", "PROXY www:8003"},
+	}
+	for _, td := range testData {
+		res, err := ps.FindProxyForURL(td.url, td.host)
+		if err != nil {
+			t.Errorf("FindProxyForURL(%s) error: %v", td.url, err)
+			continue
+		}
+		if res != td.res {
+			t.Errorf("FindProxyForURL(%s) got %q, should be %q", td.url, res, td.res)
+		}
+	}
+
+	for _, src := range []string{
+		"function foo() {}",
+		"function FindProxyForURL(url, host) { return /re/.test(host); }",
+		"function FindProxyForURL(url, host) {",
+	} {
+		if _, err := newPacScript(src); err == nil {
+			t.Errorf("%q should fail to load", src)
+		}
+	}
+
+	ps, err = newPacScript("function FindProxyForURL(url, host) { while (true) {} }")
+	if err != nil {
+		t.Fatal("load PAC:", err)
+	}
+	if _, err := ps.FindProxyForURL("http://a/", "a"); err == nil {
+		t.Error("infinite loop should be stopped")
+	}
+}
+
+func TestJSStringMethod(t *testing.T) {
+	testData := []struct {
+		expr, res string
+	}{
+		{`"abc".substr(1e20)`, ""},
+		{`"abc".substr(-1e20)`, "abc"},
+		{`"abc".substr(-2)`, "bc"},
+		{`"abc".substr(1, 1)`, "b"},
+		{`"abc".substr(2, -1)`, ""},
+		{`"abc".substring(1e20)`, ""},
+		{`"abc".substring(2, 1e20)`, "c"},
+		{`"abc".charAt(1e20)`, ""},
+		{`"a.b".split().length + "," + "a.b".split()[0]`, "1,a.b"},
+		{`"a.b".split(".").join("|")`, "a|b"},
+		{`shExpMatch()`, "false"},
+		{`shExpMatch(host)`, "false"},
+	}
+	for _, td := range testData {
+		ps, err := newPacScript("function FindProxyForURL(url, host) { return " + td.expr + "; }")
+		if err != nil {
+			t.Errorf("%s: %v", td.expr, err)
+			continue
+		}
+		res, err := ps.FindProxyForURL("http://a/", "a")
+		if err != nil {
+			t.Errorf("%s: %v", td.expr, err)
+			continue
+		}
+		if res != td.res {
+			t.Errorf("%s got %q, should be %q", td.expr, res, td.res)
+		}
+	}
+}
+
+func TestPacResolveUnlocked(t *testing.T) {
+	started, block := make(chan struct{}), make(chan struct{})
+	pacLookupHost = func(host string) ([]string, error) {
+		if host == "slow.example.com" {
+			close(started)
+			<-block
+		}
+		return []string{"10.0.0.1"}, nil
+	}
+	defer func() { pacLookupHost = lookupHost }()
+
+	ps, err := newPacScript(`function FindProxyForURL(url, host) {
+	return isInNet(host, "10.0.0.0", "255.0.0.0") ? "DIRECT" : "PROXY a:80";
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := make(chan string)
+	go func() {
+		res, _ := ps.FindProxyForURL("http://slow.example.com/", "slow.example.com")
+		slow <- res
+	}()
+	<-started
+	done := make(chan string)
+	go func() {
+		res, _ := ps.FindProxyForURL("http://fast.example.com/", "fast.example.com")
+		done <- res
+	}()
+	select {
+	case res := <-done:
+		if res != "DIRECT" {
+			t.Error("fast host got", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("slow DNS lookup blocks other calls")
+	}
+	close(block)
+	if res := <-slow; res != "DIRECT" {
+		t.Error("slow host got", res)
+	}
+}
+
+func TestParentPACRoute(t *testing.T) {
+	pr := &pacParents{parent: make(map[string]ParentProxy)}
+	hp := newHttpParent("127.0.0.1:8080")
+	pr.addParent(hp)
+
+	if p, err := pr.getParent(" DIRECT"); p != nil || err != nil {
+		t.Error("DIRECT should return nil parent")
+	}
+	if p, _ := pr.getParent("PROXY 127.0.0.1:8080"); p != hp {
+		t.Error("should use configured parent")
+	}
+	p, _ := pr.getParent("SOCKS5 127.0.0.1:1080")
+	if sp, ok := p.(*socksParent); !ok || sp.server != "127.0.0.1:1080" {
+		t.Error("SOCKS5 should return socks parent")
+	}
+	if p2, _ := pr.getParent("SOCKS 127.0.0.1:1080"); p2 != p {
+		t.Error("parent should be reused")
+	}
+	for _, entry := range []string{"HTTPS 127.0.0.1:443", "PROXY 127.0.0.1", ""} {
+		if _, err := pr.getParent(entry); err != errPACSkip {
+			t.Errorf("%q should be skipped", entry)
+		}
+	}
+}
+
+func TestJSObject(t *testing.T) {
+	src := `
+var conf = {name: "a", "max-age": 3, 1: true};
+function get(o, k) { return o[k]; }
+function set(o) { o.count = (o.count || 0) + 1; o["x-y"] = "z"; return o.count; }
+`
+	ps, err := loadJSScript(src, nil)
+	if err != nil {
+		t.Fatal("load script:", err)
+	}
+	conf := ps.interp.global.vars["conf"].(*jsObject)
+	if conf.modified {
+		t.Error("object literal should not be modified")
+	}
+	get := ps.function("get")
+	testData := []struct {
+		key string
+		val interface{}
+	}{
+		{"name", "a"},
+		{"max-age", float64(3)},
+		{"1", true},
+		{"none", undefined},
+	}
+	for _, td := range testData {
+		if v, err := ps.callFunc(get, conf, td.key); err != nil || v != td.val {
+			t.Errorf("conf[%s] should be %v, got %v %v", td.key, td.val, v, err)
+		}
+	}
+
+	o := newJSObject()
+	if v, err := ps.callFunc(ps.function("set"), o); err != nil || v != float64(1) {
+		t.Error("set should return 1, got", v, err)
+	}
+	if !o.modified || o.prop["x-y"] != "z" || len(o.keys) != 2 || o.keys[0] != "count" {
+		t.Error("object not modified correctly:", o.prop, o.keys)
+	}
+	if ps.function("conf") != nil || ps.function("none") != nil {
+		t.Error("function should return nil for non function")
+	}
+}
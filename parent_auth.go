@@ -0,0 +1,184 @@
+package cow
+
+// Authentication to HTTP parent proxy.
+//
+// Credentials of http parent proxy are sent with Basic scheme preemptively.
+// If the parent replies 407 with a Digest challenge, cow switches to Digest
+// for that parent (Basic is never sent to it again) and retries the request,
+// for both normal requests and CONNECT. Digest nonce is reused with
+// increasing nonce count until the parent sends a new challenge.
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var errParentAuth = errors.New("parent proxy requires authentication")
+
+type parentAuth struct {
+	user   string
+	passwd string
+	basic  []byte // Basic Proxy-Authorization header line
+	ntlm   bool   // use NTLM instead of Basic/Digest
+
+	sync.Mutex
+	digest map[string]string // Digest challenge, nil if not received
+	nc     int               // nonce count for current nonce
+}
+
+func newParentAuth(userPasswd string) *parentAuth {
+	arr := strings.SplitN(userPasswd, ":", 2)
+	pa := &parentAuth{user: arr[0]}
+	if len(arr) == 2 {
+		pa.passwd = arr[1]
+	}
+	b64 := base64.StdEncoding.EncodeToString([]byte(userPasswd))
+	pa.basic = []byte(headerProxyAuthorization + ": Basic " + b64 + CRLF)
+	return pa
+}
+
+// parseChallenge parses authentication challenge like
+// `Digest realm="x", nonce="y", qop="auth,auth-int"`. Commas may appear in
+// quoted values.
+func parseChallenge(s string) (scheme string, param map[string]string) {
+	s = strings.TrimSpace(s)
+	id := strings.IndexByte(s, ' ')
+	if id == -1 {
+		return strings.ToLower(s), nil
+	}
+	scheme = strings.ToLower(s[:id])
+	param = make(map[string]string)
+	s = s[id+1:]
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " ")
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end == -1 {
+				val, s = s[1:], ""
+			} else {
+				val, s = s[1:end+1], s[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end == -1 {
+				end = len(s)
+			}
+			val, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		param[key] = val
+	}
+	return
+}
+
+// proxyAuthenticateAll returns all Proxy-Authenticate challenges in raw
+// response header.
+func proxyAuthenticateAll(header []byte) []string {
+	var challenge []string
+	for _, line := range strings.Split(string(header), "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 && strings.ToLower(strings.TrimSpace(kv[0])) == headerProxyAuthenticate {
+			challenge = append(challenge, strings.TrimSpace(kv[1]))
+		}
+	}
+	return challenge
+}
+
+// proxyAuthenticate returns the Proxy-Authenticate challenge in raw response
+// header, Digest is preferred if the parent offers several.
+func proxyAuthenticate(header []byte) string {
+	var challenge string
+	for _, v := range proxyAuthenticateAll(header) {
+		if challenge == "" || strings.HasPrefix(strings.ToLower(v), "digest") {
+			challenge = v
+		}
+	}
+	return challenge
+}
+
+// challenged handles the challenge in a 407 response. Returns true if the
+// request should be retried with new credentials, false if credentials are
+// rejected.
+func (pa *parentAuth) challenged(challenge string) bool {
+	scheme, param := parseChallenge(challenge)
+	pa.Lock()
+	defer pa.Unlock()
+	switch scheme {
+	case "digest":
+		if param["nonce"] == "" {
+			return false
+		}
+		// Same nonce means the credentials are wrong, unless it's stale.
+		retry := pa.digest == nil || pa.digest["nonce"] != param["nonce"] ||
+			strings.ToLower(param["stale"]) == "true"
+		pa.digest = param
+		pa.nc = 0
+		return retry
+	case "basic":
+		// Basic is always sent unless parent requires Digest.
+		if pa.digest != nil {
+			pa.digest = nil
+			return true
+		}
+	}
+	return false
+}
+
+// genCnonce is variable for testing.
+var genCnonce = func() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// header returns Proxy-Authorization header line for the request.
+func (pa *parentAuth) header(method, uri string) []byte {
+	pa.Lock()
+	if pa.digest == nil {
+		pa.Unlock()
+		return pa.basic
+	}
+	pa.nc++
+	d, nc := pa.digest, fmt.Sprintf("%08x", pa.nc)
+	pa.Unlock()
+
+	realm, nonce := d["realm"], d["nonce"]
+	cnonce := genCnonce()
+	ha1 := md5sum(pa.user + ":" + realm + ":" + pa.passwd)
+	if strings.ToLower(d["algorithm"]) == "md5-sess" {
+		ha1 = md5sum(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := md5sum(method + ":" + uri)
+
+	var qop string
+	for _, q := range strings.Split(d["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	h := fmt.Sprintf(`%s: Digest username="%s", realm="%s", nonce="%s", uri="%s"`,
+		headerProxyAuthorization, pa.user, realm, nonce, uri)
+	if qop != "" {
+		response := md5sum(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+		h += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s", response="%s"`, qop, nc, cnonce, response)
+	} else {
+		h += fmt.Sprintf(`, response="%s"`, md5sum(ha1+":"+nonce+":"+ha2))
+	}
+	if alg, ok := d["algorithm"]; ok {
+		h += ", algorithm=" + alg
+	}
+	if opaque, ok := d["opaque"]; ok {
+		h += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return []byte(h + CRLF)
+}
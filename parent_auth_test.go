@@ -0,0 +1,61 @@
+package cow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseChallenge(t *testing.T) {
+	scheme, param := parseChallenge(`Digest realm="a, b", qop="auth,auth-int", nonce="n1",algorithm=MD5`)
+	if scheme != "digest" {
+		t.Error("scheme wrong:", scheme)
+	}
+	if param["realm"] != "a, b" || param["qop"] != "auth,auth-int" ||
+		param["nonce"] != "n1" || param["algorithm"] != "MD5" {
+		t.Error("param wrong:", param)
+	}
+
+	header := []byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+		"Proxy-Authenticate: Basic realm=\"x\"\r\n" +
+		"proxy-authenticate: Digest realm=\"x\", nonce=\"y\"\r\n\r\n")
+	if c := proxyAuthenticate(header); c != `Digest realm="x", nonce="y"` {
+		t.Error("should prefer digest challenge, got:", c)
+	}
+}
+
+func TestParentAuthDigest(t *testing.T) {
+	saved := genCnonce
+	defer func() { genCnonce = saved }()
+	genCnonce = func() string { return "0a4f113b" }
+
+	// Example in RFC 2617 section 3.5.
+	pa := newParentAuth("Mufasa:Circle Of Life")
+	if h := string(pa.header("GET", "/dir/index.html")); !strings.HasPrefix(h, headerProxyAuthorization+": Basic ") {
+		t.Error("should send Basic before challenge, got:", h)
+	}
+	challenge := `Digest realm="testrealm@host.com", qop="auth,auth-int", ` +
+		`nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`
+	if !pa.challenged(challenge) {
+		t.Fatal("first digest challenge should retry")
+	}
+	h := string(pa.header("GET", "/dir/index.html"))
+	for _, s := range []string{
+		`username="Mufasa"`,
+		`nc=00000001`,
+		`response="6629fae49393a05397450978507c4ef1"`,
+		`opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+	} {
+		if !strings.Contains(h, s) {
+			t.Errorf("digest header should contain %s, got: %s", s, h)
+		}
+	}
+	if !strings.Contains(string(pa.header("GET", "/")), "nc=00000002") {
+		t.Error("nonce count not increased")
+	}
+	if pa.challenged(challenge) {
+		t.Error("same nonce means credentials rejected, should not retry")
+	}
+	if !pa.challenged(strings.Replace(challenge, "nonce=", "stale=true, nonce=", 1)) {
+		t.Error("stale nonce should retry")
+	}
+}
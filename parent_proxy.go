@@ -1,7 +1,7 @@
-package main
+package cow
 
 import (
-	"encoding/base64"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -71,7 +71,7 @@ func printParentProxy(parent []ParentWithFail) {
 		case *shadowsocksParent:
 			debug.Println("\tshadowsocks: ", pc.server)
 		case *httpParent:
-			debug.Println("\thttp parent: ", pc.server)
+			debug.Println("\t"+pc.scheme()+" parent: ", pc.server)
 		case *socksParent:
 			debug.Println("\tsocks parent: ", pc.server)
 		case *cowParent:
@@ -82,7 +82,8 @@ func printParentProxy(parent []ParentWithFail) {
 
 type ParentWithFail struct {
 	ParentProxy
-	fail int
+	fail  int
+	tried bool // connected by this instance, fail is not from cluster peers
 }
 
 // Backup load balance strategy:
@@ -96,7 +97,7 @@ func (pp *backupParentPool) empty() bool {
 }
 
 func (pp *backupParentPool) add(parent ParentProxy) {
-	pp.parent = append(pp.parent, ParentWithFail{parent, 0})
+	pp.parent = append(pp.parent, ParentWithFail{parent, 0, false})
 }
 
 func (pp *backupParentPool) connect(url *URL) (srvconn net.Conn, err error) {
@@ -115,9 +116,63 @@ func (pp *hashParentPool) connect(url *URL) (srvconn net.Conn, err error) {
 	return connectInOrder(url, pp.parent, start)
 }
 
+// Parent proxies disabled with admin command, keyed by server.
+var disabledParent = struct {
+	sync.RWMutex
+	server map[string]bool
+}{server: make(map[string]bool)}
+
+var errParentDisabled = errors.New("all parent proxies are disabled")
+
+func parentDisabled(server string) bool {
+	disabledParent.RLock()
+	disabled := disabledParent.server[server]
+	disabledParent.RUnlock()
+	return disabled
+}
+
+func setParentDisabled(server string, disabled bool) error {
+	for _, p := range allParents() {
+		if p.getServer() == server {
+			disabledParent.Lock()
+			if disabled {
+				disabledParent.server[server] = true
+			} else {
+				delete(disabledParent.server, server)
+			}
+			disabledParent.Unlock()
+			return nil
+		}
+	}
+	return errors.New("no parent proxy " + server)
+}
+
+// allParents returns parent proxies in the pool.
+func allParents() (parent []ParentProxy) {
+	switch pp := parentProxy.(type) {
+	case *backupParentPool:
+		for _, p := range pp.parent {
+			parent = append(parent, p.ParentProxy)
+		}
+	case *hashParentPool:
+		for _, p := range pp.parent {
+			parent = append(parent, p.ParentProxy)
+		}
+	case *latencyParentPool:
+		latencyMutex.RLock()
+		for _, p := range pp.parent {
+			parent = append(parent, p.ParentProxy)
+		}
+		latencyMutex.RUnlock()
+	}
+	return
+}
+
+const maxFailCnt = 30
+
 func (parent *ParentWithFail) connect(url *URL) (srvconn net.Conn, err error) {
-	const maxFailCnt = 30
 	srvconn, err = parent.ParentProxy.connect(url)
+	parent.tried = true
 	if err != nil {
 		if parent.fail < maxFailCnt && !networkBad() {
 			parent.fail++
@@ -140,6 +195,9 @@ func connectInOrder(url *URL, pp []ParentWithFail, start int) (srvconn net.Conn,
 	for i := 0; i < nproxy; i++ {
 		proxyId := (start + i) % nproxy
 		parent := &pp[proxyId]
+		if parentDisabled(parent.getServer()) {
+			continue
+		}
 		// skip failed server, but try it with some probability
 		if parent.fail > 0 && rand.Intn(parent.fail+baseFailCnt) != 0 {
 			skipped = append(skipped, proxyId)
@@ -155,6 +213,9 @@ func connectInOrder(url *URL, pp []ParentWithFail, start int) (srvconn net.Conn,
 			return
 		}
 	}
+	if err == nil {
+		err = errParentDisabled
+	}
 	return nil, err
 }
 
@@ -217,6 +278,9 @@ func (pp *latencyParentPool) connect(url *URL) (srvconn net.Conn, err error) {
 
 	for i := 0; i < nproxy; i++ {
 		parent := lp[i]
+		if parentDisabled(parent.getServer()) {
+			continue
+		}
 		if parent.latency >= latencyMax {
 			skipped = append(skipped, i)
 			continue
@@ -233,6 +297,9 @@ func (pp *latencyParentPool) connect(url *URL) (srvconn net.Conn, err error) {
 			return
 		}
 	}
+	if err == nil {
+		err = errParentDisabled
+	}
 	return nil, err
 }
 
@@ -312,17 +379,21 @@ func updateParentProxyLatency() {
 // http parent proxy
 type httpParent struct {
 	server     string
+	bind       *bindOpt
 	userPasswd string // for upgrade config
-	authHeader []byte
+	auth       *parentAuth
+	connectUDP bool        // supports CONNECT-UDP
+	tls        *tls.Config // https parent if not nil
 }
 
 type httpConn struct {
 	net.Conn
-	parent *httpParent
+	parent   *httpParent
+	ntlmDone *bool // whether NTLM handshake is done on the connection
 }
 
 func (s httpConn) String() string {
-	return "http parent proxy " + s.parent.server
+	return s.parent.scheme() + " parent proxy " + s.parent.server
 }
 
 func newHttpParent(server string) *httpParent {
@@ -333,11 +404,22 @@ func (hp *httpParent) getServer() string {
 	return hp.server
 }
 
+func (hp *httpParent) scheme() string {
+	if hp.tls != nil {
+		return "https"
+	}
+	return "http"
+}
+
 func (hp *httpParent) genConfig() string {
 	if hp.userPasswd != "" {
-		return fmt.Sprintf("proxy = http://%s@%s", hp.userPasswd, hp.server)
+		opt := hp.bind.genConfig()
+		if hp.auth.ntlm {
+			opt += " auth=ntlm"
+		}
+		return fmt.Sprintf("proxy = %s://%s@%s%s", hp.scheme(), hp.userPasswd, hp.server, opt)
 	} else {
-		return fmt.Sprintf("proxy = http://%s", hp.server)
+		return fmt.Sprintf("proxy = %s://%s%s", hp.scheme(), hp.server, hp.bind.genConfig())
 	}
 }
 
@@ -346,25 +428,32 @@ func (hp *httpParent) initAuth(userPasswd string) {
 		return
 	}
 	hp.userPasswd = userPasswd
-	b64 := base64.StdEncoding.EncodeToString([]byte(userPasswd))
-	hp.authHeader = []byte(headerProxyAuthorization + ": Basic " + b64 + CRLF)
+	hp.auth = newParentAuth(userPasswd)
 }
 
 func (hp *httpParent) connect(url *URL) (net.Conn, error) {
-	c, err := net.Dial("tcp", hp.server)
+	c, err := dialParent(hp.bind, hp.server)
 	if err != nil {
-		errl.Printf("can't connect to http parent %s for %s: %v\n",
-			hp.server, url.HostPort, err)
+		errl.Printf("can't connect to %s parent %s for %s: %v\n",
+			hp.scheme(), hp.server, url.HostPort, err)
 		return nil, err
 	}
-	debug.Printf("connected to: %s via http parent: %s\n",
-		url.HostPort, hp.server)
-	return httpConn{c, hp}, nil
+	if hp.tls != nil {
+		if c, err = hp.handshake(c); err != nil {
+			errl.Printf("tls handshake with https parent %s for %s: %v\n",
+				hp.server, url.HostPort, err)
+			return nil, err
+		}
+	}
+	debug.Printf("connected to: %s via %s parent: %s\n",
+		url.HostPort, hp.scheme(), hp.server)
+	return httpConn{c, hp, new(bool)}, nil
 }
 
 // shadowsocks parent proxy
 type shadowsocksParent struct {
 	server string
+	bind   *bindOpt
 	method string // method and passwd are for upgrade config
 	passwd string
 	cipher *ss.Cipher
@@ -396,7 +485,7 @@ func (sp *shadowsocksParent) genConfig() string {
 	if method == "" {
 		method = "table"
 	}
-	return fmt.Sprintf("proxy = ss://%s:%s@%s", method, sp.passwd, sp.server)
+	return fmt.Sprintf("proxy = ss://%s:%s@%s%s", method, sp.passwd, sp.server, sp.bind.genConfig())
 }
 
 func (sp *shadowsocksParent) initCipher(method, passwd string) {
@@ -410,7 +499,13 @@ func (sp *shadowsocksParent) initCipher(method, passwd string) {
 }
 
 func (sp *shadowsocksParent) connect(url *URL) (net.Conn, error) {
-	c, err := ss.Dial(url.HostPort, sp.server, sp.cipher.Copy())
+	var c net.Conn
+	var err error
+	if sp.bind == nil && config.ParentMark == 0 && !config.ServerTiming {
+		c, err = ss.Dial(url.HostPort, sp.server, sp.cipher.Copy())
+	} else {
+		c, err = sp.dialBind(url)
+	}
 	if err != nil {
 		errl.Printf("can't connect to shadowsocks parent %s for %s: %v\n",
 			sp.server, url.HostPort, err)
@@ -420,9 +515,28 @@ func (sp *shadowsocksParent) connect(url *URL) (net.Conn, error) {
 	return shadowsocksConn{c, sp}, nil
 }
 
+// dialBind is like ss.Dial, but connects to the server with binding.
+func (sp *shadowsocksParent) dialBind(url *URL) (net.Conn, error) {
+	rawaddr, err := ss.RawAddr(url.HostPort)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialParent(sp.bind, sp.server)
+	if err != nil {
+		return nil, err
+	}
+	ssc := ss.NewConn(c, sp.cipher.Copy())
+	if _, err = ssc.Write(rawaddr); err != nil {
+		ssc.Close()
+		return nil, err
+	}
+	return ssc, nil
+}
+
 // cow parent proxy
 type cowParent struct {
 	server string
+	bind   *bindOpt
 	method string
 	passwd string
 	cipher *ss.Cipher
@@ -442,7 +556,7 @@ func newCowParent(srv, method, passwd string) *cowParent {
 	if err != nil {
 		Fatal("create cow cipher:", err)
 	}
-	return &cowParent{srv, method, passwd, cipher}
+	return &cowParent{server: srv, method: method, passwd: passwd, cipher: cipher}
 }
 
 func (cp *cowParent) getServer() string {
@@ -454,11 +568,11 @@ func (cp *cowParent) genConfig() string {
 	if method == "" {
 		method = "table"
 	}
-	return fmt.Sprintf("proxy = cow://%s:%s@%s", method, cp.passwd, cp.server)
+	return fmt.Sprintf("proxy = cow://%s:%s@%s%s", method, cp.passwd, cp.server, cp.bind.genConfig())
 }
 
 func (cp *cowParent) connect(url *URL) (net.Conn, error) {
-	c, err := net.Dial("tcp", cp.server)
+	c, err := dialParent(cp.bind, cp.server)
 	if err != nil {
 		errl.Printf("can't connect to cow parent %s for %s: %v\n",
 			cp.server, url.HostPort, err)
@@ -495,6 +609,7 @@ var socksMsgVerMethodSelection = []byte{
 // socks5 parent proxy
 type socksParent struct {
 	server string
+	bind   *bindOpt
 }
 
 type socksConn struct {
@@ -507,7 +622,7 @@ func (s socksConn) String() string {
 }
 
 func newSocksParent(server string) *socksParent {
-	return &socksParent{server}
+	return &socksParent{server: server}
 }
 
 func (sp *socksParent) getServer() string {
@@ -515,11 +630,11 @@ func (sp *socksParent) getServer() string {
 }
 
 func (sp *socksParent) genConfig() string {
-	return fmt.Sprintf("proxy = socks5://%s", sp.server)
+	return fmt.Sprintf("proxy = socks5://%s%s", sp.server, sp.bind.genConfig())
 }
 
 func (sp *socksParent) connect(url *URL) (net.Conn, error) {
-	c, err := net.Dial("tcp", sp.server)
+	c, err := dialParent(sp.bind, sp.server)
 	if err != nil {
 		errl.Printf("can't connect to socks parent %s for %s: %v\n",
 			sp.server, url.HostPort, err)
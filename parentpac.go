@@ -0,0 +1,282 @@
+package cow
+
+// Select parent proxy with PAC file.
+//
+// If parentPAC is set, FindProxyForURL in the PAC file is called for each
+// request not routed by helper program or rule provider. The proxies
+// returned are tried in order: DIRECT connects directly, PROXY/HTTP and
+// SOCKS/SOCKS5 connect through the parent. Parent in PAC result matching a
+// configured parent proxy uses its settings (credentials etc.), others are
+// used without authentication. HTTPS proxies are not supported and skipped.
+//
+// PAC file from URL is saved in the config directory, and refreshed
+// periodically like rule providers.
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultParentPACInterval = 24 * time.Hour
+
+type parentPACRoute struct {
+	source string
+
+	sync.RWMutex
+	script *pacScript
+
+	pacParents
+}
+
+// pacParents maps entries in PAC style result to parent proxies.
+type pacParents struct {
+	parentLock sync.Mutex
+	parent     map[string]ParentProxy // "PROXY host:port" -> parent
+}
+
+var parentPAC *parentPACRoute
+
+func (pr *parentPACRoute) isURL() bool {
+	return strings.HasPrefix(pr.source, "http://") || strings.HasPrefix(pr.source, "https://")
+}
+
+func (pr *parentPACRoute) cacheFile() string {
+	return path.Join(config.dir, "parent-"+md5sum(pr.source)[:8]+".pac")
+}
+
+func (pr *parentPACRoute) fetch() (content []byte, err error) {
+	if !pr.isURL() {
+		return ioutil.ReadFile(pr.source)
+	}
+	if content, err = httpGet(pr.source); err != nil {
+		return
+	}
+	// Make sure the PAC file is valid before saving.
+	if _, err = newPacScript(string(content)); err != nil {
+		return
+	}
+	if err := writeFileAtomic(pr.cacheFile(), content, false); err != nil {
+		errl.Println("save parent PAC:", err)
+	}
+	return
+}
+
+func (pr *parentPACRoute) load(content []byte) error {
+	ps, err := newPacScript(string(content))
+	if err != nil {
+		return err
+	}
+	pr.Lock()
+	pr.script = ps
+	pr.Unlock()
+	info.Println("parent PAC loaded from", pr.source)
+	return nil
+}
+
+func (pr *parentPACRoute) refresh() {
+	for {
+		time.Sleep(defaultParentPACInterval)
+		content, err := pr.fetch()
+		if err == nil {
+			err = pr.load(content)
+		}
+		if err != nil {
+			errl.Printf("refresh parent PAC %s: %v\n", pr.source, err)
+		}
+	}
+}
+
+// initParents makes parent proxy in PAC result use settings of configured
+// parent with the same server.
+func (pp *pacParents) initParents() {
+	pp.parent = make(map[string]ParentProxy)
+	if bp, ok := parentProxy.(*backupParentPool); ok {
+		for _, p := range bp.parent {
+			pp.addParent(p.ParentProxy)
+		}
+	}
+}
+
+func (pp *pacParents) addParent(p ParentProxy) {
+	switch p.(type) {
+	case *httpParent:
+		pp.parent["PROXY "+p.getServer()] = p
+	case *socksParent:
+		pp.parent["SOCKS "+p.getServer()] = p
+	}
+}
+
+func initParentPAC() {
+	if parentPAC == nil {
+		return
+	}
+	pr := parentPAC
+	pr.initParents()
+	if pr.isURL() {
+		// Use saved copy first, download in background.
+		if content, err := ioutil.ReadFile(pr.cacheFile()); err == nil {
+			if err = pr.load(content); err != nil {
+				errl.Println("load saved parent PAC:", err)
+			}
+		}
+		go func() {
+			content, err := pr.fetch()
+			if err == nil {
+				err = pr.load(content)
+			}
+			if err != nil {
+				errl.Printf("download parent PAC %s: %v\n", pr.source, err)
+			}
+			pr.refresh()
+		}()
+		return
+	}
+	content, err := pr.fetch()
+	if err == nil {
+		err = pr.load(content)
+	}
+	if err != nil {
+		Fatal("load parent PAC:", err)
+	}
+	go pr.refresh()
+}
+
+// pacURL returns the URL passed to FindProxyForURL. Like browsers, only
+// scheme and host is used for CONNECT requests.
+func pacURL(r *Request) string {
+	url := r.siteURL()
+	if r.isConnect {
+		if url.Port == "443" {
+			return "https://" + url.Host + "/"
+		}
+		return "https://" + url.HostPort + "/"
+	}
+	host := url.HostPort
+	if url.Port == "80" {
+		host = url.Host
+	}
+	return "http://" + host + url.Path
+}
+
+// getParent returns parent proxy for one entry in PAC result. Returns nil
+// for DIRECT, errPACSkip for unsupported entry.
+func (pp *pacParents) getParent(entry string) (ParentProxy, error) {
+	f := strings.Fields(entry)
+	if len(f) == 0 {
+		return nil, errPACSkip
+	}
+	typ := strings.ToUpper(f[0])
+	if typ == "DIRECT" {
+		return nil, nil
+	}
+	if len(f) != 2 {
+		return nil, errPACSkip
+	}
+	server := f[1]
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return nil, errPACSkip
+	}
+	switch typ {
+	case "PROXY", "HTTP":
+		typ = "PROXY"
+	case "SOCKS", "SOCKS5":
+		typ = "SOCKS"
+	default:
+		return nil, errPACSkip
+	}
+	key := typ + " " + server
+	pp.parentLock.Lock()
+	defer pp.parentLock.Unlock()
+	if p, ok := pp.parent[key]; ok {
+		return p, nil
+	}
+	var p ParentProxy
+	if typ == "PROXY" {
+		p = newHttpParent(server)
+	} else {
+		p = newSocksParent(server)
+	}
+	pp.parent[key] = p
+	return p, nil
+}
+
+var errPACSkip = errors.New("unsupported PAC result")
+
+// findRoute evaluates the PAC file for the request. Returns the list of
+// parent proxies to try, nil element means direct connection.
+func (pr *parentPACRoute) findRoute(r *Request) ([]ParentProxy, error) {
+	pr.RLock()
+	ps := pr.script
+	pr.RUnlock()
+	if ps == nil {
+		return nil, errors.New("parent PAC not loaded")
+	}
+	res, err := ps.FindProxyForURL(pacURL(r), r.siteURL().Host)
+	if err != nil {
+		return nil, err
+	}
+	return pr.parseRoute(res, r)
+}
+
+// parseRoute parses PAC style result like "PROXY host:port; DIRECT".
+func (pp *pacParents) parseRoute(res string, r *Request) ([]ParentProxy, error) {
+	var route []ParentProxy
+	for _, entry := range strings.Split(res, ";") {
+		p, err := pp.getParent(entry)
+		if err == errPACSkip {
+			if strings.TrimSpace(entry) != "" {
+				debug.Printf("PAC result: skip %q for %v\n", entry, r)
+			}
+			continue
+		}
+		route = append(route, p)
+	}
+	if len(route) == 0 {
+		return nil, errors.New("no usable proxy in PAC result " + res)
+	}
+	return route, nil
+}
+
+// routeParentPAC sets route of the request according to parent PAC.
+func routeParentPAC(r *Request) {
+	route, err := parentPAC.findRoute(r)
+	if err != nil {
+		errl.Printf("parent PAC for %v: %v\n", r, err)
+		return
+	}
+	r.pacRoute = route
+	if route[0] == nil {
+		r.route = routeDirect
+	} else {
+		r.route = routeProxy
+	}
+	r.routeRule = "pac"
+}
+
+// connectPAC tries proxies returned by the PAC file, routing script or
+// specified by request rule in order.
+func (c *clientConn) connectPAC(r *Request, siteInfo *VisitCnt) (srvconn net.Conn, err error) {
+	source := "parent PAC"
+	if r.routeRule != "pac" {
+		source = r.routeRule
+	}
+	for _, p := range r.pacRoute {
+		if p == nil {
+			srvconn, err = connectDirect(r.URL, siteInfo)
+		} else {
+			srvconn, err = p.connect(r.URL)
+		}
+		if err == nil {
+			return
+		}
+		debug.Printf("cli(%s) %s route failed for %v: %v\n", c.RemoteAddr(), source, r, err)
+	}
+	errMsg := genErrMsg(r, nil, "All proxies returned by "+source+" failed.")
+	sendErrorPage(c, "504 Connection failed", err.Error(), errMsg)
+	return nil, errPageSent
+}
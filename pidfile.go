@@ -0,0 +1,72 @@
+package cow
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The pid file is kept open and locked while cow is running, which prevents
+// starting another cow with the same pid file. Other cow processes can then
+// use the pid in it to signal the running one.
+var pidFile *os.File
+
+func readPidFile(fpath string) (int, error) {
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("pid file %s content invalid: %v", fpath, err)
+	}
+	return pid, nil
+}
+
+func writePid(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+newLine), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func removePidFile() {
+	if pidFile == nil {
+		return
+	}
+	if isWindows {
+		// Can't remove file opened without delete sharing.
+		pidFile.Close()
+		os.Remove(config.PidFile)
+	} else {
+		// Remove before close, so the lock still prevents another cow from
+		// taking over the file in between.
+		os.Remove(config.PidFile)
+		pidFile.Close()
+	}
+	pidFile = nil
+}
+
+// controlRunning sends command to the cow process holding the pid file.
+func controlRunning(cmd string) error {
+	if config.PidFile == "" {
+		return fmt.Errorf("pidFile not specified")
+	}
+	if !pidFileLocked(config.PidFile) {
+		return fmt.Errorf("cow is not running (pid file %s not locked)", config.PidFile)
+	}
+	pid, err := readPidFile(config.PidFile)
+	if err != nil {
+		return err
+	}
+	if err = signalProcess(pid, cmd); err != nil {
+		return fmt.Errorf("%s cow pid %d: %v", cmd, pid, err)
+	}
+	fmt.Printf("sent %s to cow pid %d\n", cmd, pid)
+	return nil
+}
@@ -0,0 +1,66 @@
+// +build darwin freebsd linux netbsd openbsd
+
+package cow
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func openPidFile(fpath string) (*os.File, error) {
+	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// lockPidFile is called before creating any listener, so a second cow exits
+// before touching anything.
+func lockPidFile() {
+	if config.PidFile == "" {
+		return
+	}
+	f, err := openPidFile(config.PidFile)
+	if err == syscall.EWOULDBLOCK {
+		if pid, perr := readPidFile(config.PidFile); perr == nil {
+			Fatalf("cow already running with pid %d (pid file %s)\n", pid, config.PidFile)
+		}
+		Fatalf("cow already running (pid file %s)\n", config.PidFile)
+	} else if err != nil {
+		Fatal("open pid file:", err)
+	}
+	if err = writePid(f); err != nil {
+		Fatal("write pid file:", err)
+	}
+	pidFile = f
+}
+
+func pidFileLocked(fpath string) bool {
+	f, err := openPidFile(fpath)
+	if err != nil {
+		return err == syscall.EWOULDBLOCK
+	}
+	// Nobody holds the lock, remove the stale pid file.
+	os.Remove(fpath)
+	f.Close()
+	return false
+}
+
+func signalProcess(pid int, cmd string) error {
+	var sig syscall.Signal
+	switch cmd {
+	case "stop":
+		sig = syscall.SIGTERM
+	case "reload":
+		sig = syscall.SIGUSR1
+	default:
+		return fmt.Errorf("unknown command %s", cmd)
+	}
+	return syscall.Kill(pid, sig)
+}
@@ -0,0 +1,76 @@
+package cow
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Windows has no flock, open the pid file without write sharing instead, so
+// another process can only read it while cow is running.
+func openPidFile(fpath string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(fpath)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(name,
+		syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		syscall.FILE_SHARE_READ, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), fpath), nil
+}
+
+func isErrSharingViolation(err error) bool {
+	// ERROR_SHARING_VIOLATION
+	errno, ok := err.(syscall.Errno)
+	return ok && errno == 32
+}
+
+func lockPidFile() {
+	if config.PidFile == "" {
+		return
+	}
+	f, err := openPidFile(config.PidFile)
+	if isErrSharingViolation(err) {
+		if pid, perr := readPidFile(config.PidFile); perr == nil {
+			Fatalf("cow already running with pid %d (pid file %s)\n", pid, config.PidFile)
+		}
+		Fatalf("cow already running (pid file %s)\n", config.PidFile)
+	} else if err != nil {
+		Fatal("open pid file:", err)
+	}
+	if err = writePid(f); err != nil {
+		Fatal("write pid file:", err)
+	}
+	pidFile = f
+}
+
+func pidFileLocked(fpath string) bool {
+	f, err := openPidFile(fpath)
+	if err != nil {
+		return isErrSharingViolation(err)
+	}
+	f.Close()
+	os.Remove(fpath)
+	return false
+}
+
+func signalProcess(pid int, cmd string) error {
+	switch cmd {
+	case "stop":
+		p, err := os.FindProcess(pid)
+		if err != nil {
+			return err
+		}
+		// Windows can't send SIGTERM to another process, so stat is saved
+		// only up to the last periodic save.
+		return p.Kill()
+	case "reload":
+		return errors.New("reload is not supported on Windows")
+	}
+	return fmt.Errorf("unknown command %s", cmd)
+}
@@ -0,0 +1,17 @@
+// +build darwin freebsd netbsd openbsd
+
+package cow
+
+// Binding to interface uses local address instead of socket option on these
+// systems, no capability is needed.
+func needBindCaps() bool {
+	return false
+}
+
+func keepCaps() error {
+	return nil
+}
+
+func setBindCaps() error {
+	return nil
+}
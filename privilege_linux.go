@@ -0,0 +1,74 @@
+package cow
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	capNetAdmin    = 12 // SO_MARK
+	capNetRaw      = 13 // SO_BINDTODEVICE
+	prSetKeepCaps  = 8
+	prCapAmbient   = 47
+	prCapAmbRaise  = 2
+	linuxCapVer3   = 0x20080522
+	bindCapsNeeded = 1<<capNetAdmin | 1<<capNetRaw
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// needBindCaps returns true if outgoing connections are bound to interface
+// or set fwmark, see dialDevice.
+func needBindCaps() bool {
+	return sockOptBind || config.BindInterface != "" || config.DirectMark != 0 ||
+		config.ParentMark != 0
+}
+
+// keepCaps keeps permitted capabilities upon setuid from root. It's a
+// per-thread attribute, so it must be set on all threads, which is not
+// possible in binaries using cgo.
+func keepCaps() error {
+	_, _, e := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetKeepCaps, 1, 0)
+	if e == syscall.ENOTSUP {
+		return errors.New("not supported in cgo build, build with CGO_ENABLED=0")
+	}
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// setBindCaps limits capabilities of all threads to those needed by
+// bindInterface and fwmark, and makes them effective after setuid. They are
+// also raised as ambient capabilities, so programs started by cow (e.g. tun)
+// inherit them.
+func setBindCaps() error {
+	hdr := &capHeader{version: linuxCapVer3}
+	data := &[2]capData{{
+		effective:   bindCapsNeeded,
+		permitted:   bindCapsNeeded,
+		inheritable: bindCapsNeeded,
+	}}
+	_, _, e := syscall.AllThreadsSyscall(syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(hdr)), uintptr(unsafe.Pointer(data)), 0)
+	if e != 0 {
+		return e
+	}
+	for _, c := range []uintptr{capNetAdmin, capNetRaw} {
+		_, _, e = syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prCapAmbient, prCapAmbRaise, c)
+		if e != 0 {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// +build darwin freebsd linux netbsd openbsd
+
+package cow
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+func lookupUser(name string) (uid, gid int, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		// Allow numeric uid if there's no such user name.
+		if uid, nerr := strconv.Atoi(name); nerr == nil {
+			return uid, uid, nil
+		}
+		return
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return
+	}
+	gid, err = strconv.Atoi(u.Gid)
+	return
+}
+
+// dropPrivilege switches to config.RunAsUser. This allows cow started as root
+// to listen on privileged ports and then run as an unprivileged user. Linux
+// clears all capabilities upon setuid from root. They are not needed after
+// listening, except CAP_NET_RAW and CAP_NET_ADMIN for bindInterface and
+// fwmark on outgoing connections, which are kept if used. Relaunch is refused
+// afterwards, see privilegeDropped.
+func dropPrivilege() {
+	if config.RunAsUser == "" {
+		return
+	}
+	if os.Getuid() != 0 {
+		info.Println("not running as root, ignore runAsUser")
+		return
+	}
+	uid, gid, err := lookupUser(config.RunAsUser)
+	if err != nil {
+		Fatal("runAsUser:", err)
+	}
+
+	// The stat file and tls session file are updated while running, so they
+	// must be accessible by the new user.
+	for _, f := range []string{config.StatFile, config.StatFile + ".bak",
+		config.TlsSessionFile, config.TlsSessionFile + ".key"} {
+		if err := os.Chown(f, uid, gid); err != nil && !os.IsNotExist(err) {
+			errl.Println("runAsUser: chown", f+":", err)
+		}
+	}
+	if config.CacheDir != "" {
+		err = filepath.Walk(config.CacheDir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Chown(p, uid, gid)
+		})
+		if err != nil {
+			errl.Println("runAsUser: chown cache dir:", err)
+		}
+	}
+
+	keep := needBindCaps()
+	if keep {
+		if err = keepCaps(); err != nil {
+			Fatal("runAsUser: can't keep capabilities for bindInterface or fwmark:", err)
+		}
+	}
+	// Order matters: group must be changed while still root.
+	if err = syscall.Setgroups([]int{gid}); err != nil {
+		Fatal("runAsUser: setgroups:", err)
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		Fatal("runAsUser: setgid:", err)
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		Fatal("runAsUser: setuid:", err)
+	}
+	if keep {
+		if err = setBindCaps(); err != nil {
+			Fatal("runAsUser: set capabilities:", err)
+		}
+		info.Println("kept CAP_NET_RAW and CAP_NET_ADMIN for bindInterface and fwmark")
+	}
+	privilegeDropped = true
+	info.Printf("running as user %s uid %d gid %d\n", config.RunAsUser, uid, gid)
+}
@@ -0,0 +1,7 @@
+package cow
+
+func dropPrivilege() {
+	if config.RunAsUser != "" {
+		errl.Println("runAsUser is not supported on Windows")
+	}
+}
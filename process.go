@@ -0,0 +1,78 @@
+package cow
+
+// Process of local clients.
+//
+// For clients connecting from the host cow runs on, the owning process is
+// looked up when the connection is accepted (from /proc on Linux, with lsof
+// on macOS) and shown as name[pid] in debug log, access log and admin
+// command list-connections, to tell which application generates
+// surprising traffic.
+// Only processes of the same user are found if cow is not run as root.
+//
+// Lookup is only done if there's debug log, accessLog or adminSocket.
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var localIPs struct {
+	sync.Once
+	ip []net.IP
+}
+
+// isLocalIP returns true for loopback and addresses of local interfaces,
+// the latter for local traffic redirected to transparent proxies.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	localIPs.Do(func() {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			debug.Println("interface addresses:", err)
+			return
+		}
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok {
+				localIPs.ip = append(localIPs.ip, ipn.IP)
+			}
+		}
+	})
+	for _, lip := range localIPs.ip {
+		if lip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func processName(name string, pid int) string {
+	return name + "[" + strconv.Itoa(pid) + "]"
+}
+
+// lookupProcess finds the local process of client connection c, sets it
+// in c and connection info for admin command.
+func (c *clientConn) lookupProcess() {
+	if accessLog == nil && !bool(debug) && !cliConnTracked() {
+		return
+	}
+	client, ok1 := c.RemoteAddr().(*net.TCPAddr)
+	local, ok2 := c.LocalAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 || !isLocalIP(client.IP) {
+		return
+	}
+	name, pid, err := socketProcess(client, local)
+	if err != nil {
+		debug.Printf("cli(%s) lookup process: %v\n", c.RemoteAddr(), err)
+		return
+	}
+	if pid == 0 || pid == os.Getpid() {
+		return
+	}
+	c.process = processName(name, pid)
+	debug.Printf("cli(%s) process %s\n", c.RemoteAddr(), c.process)
+	setCliConnProcess(c, c.process)
+}
@@ -0,0 +1,50 @@
+package cow
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// socketProcess returns name and pid of the process owning the TCP socket
+// from client to server with lsof.
+func socketProcess(client, server *net.TCPAddr) (string, int, error) {
+	ip := client.IP.String()
+	if client.IP.To4() == nil {
+		ip = "[" + ip + "]"
+	}
+	out, err := exec.Command("lsof", "-nP", "-iTCP@"+ip+":"+strconv.Itoa(client.Port), "-Fpcn").Output()
+	if err != nil && len(out) == 0 {
+		return "", 0, err
+	}
+	// Output has a line for each field with field type as first character:
+	// p for process, c for command and n for socket name like
+	// 127.0.0.1:52431->127.0.0.1:7777.
+	var name string
+	var pid int
+	suffix := "->" + server.String()
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		switch line[0] {
+		case 'p':
+			pid, _ = strconv.Atoi(line[1:])
+			name = ""
+		case 'c':
+			name = line[1:]
+		case 'n':
+			if pid != os.Getpid() && strings.HasSuffix(line, suffix) {
+				return name, pid, nil
+			}
+		}
+	}
+	return "", 0, errors.New("process not found")
+}
@@ -0,0 +1,110 @@
+package cow
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// nativeEndian is byte order of the host. /proc/net/tcp prints addresses
+// as 32 bit words in host byte order.
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// parseProcNetAddr parses address like "0100007F:1F90" in /proc/net/tcp.
+func parseProcNetAddr(s string) (ip net.IP, port int, err error) {
+	id := strings.IndexByte(s, ':')
+	if id == -1 {
+		return nil, 0, errors.New("invalid address " + s)
+	}
+	b, err := hex.DecodeString(s[:id])
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return nil, 0, errors.New("invalid address " + s)
+	}
+	ip = make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		nativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(b[i:]))
+	}
+	p, err := strconv.ParseUint(s[id+1:], 16, 16)
+	if err != nil {
+		return nil, 0, errors.New("invalid port in " + s)
+	}
+	return ip, int(p), nil
+}
+
+// socketInode returns inode of the TCP socket from local to remote.
+func socketInode(local, remote *net.TCPAddr) (string, error) {
+	for _, fname := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(fname)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			// sl local_address rem_address st ... uid timeout inode
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			lip, lport, err := parseProcNetAddr(fields[1])
+			if err != nil || lport != local.Port || !lip.Equal(local.IP) {
+				continue
+			}
+			rip, rport, err := parseProcNetAddr(fields[2])
+			if err != nil || rport != remote.Port || !rip.Equal(remote.IP) {
+				continue
+			}
+			f.Close()
+			return fields[9], nil
+		}
+		f.Close()
+	}
+	return "", errors.New("socket not found")
+}
+
+// socketProcess returns name and pid of the process owning the TCP socket
+// from client to server.
+func socketProcess(client, server *net.TCPAddr) (string, int, error) {
+	inode, err := socketInode(client, server)
+	if err != nil {
+		return "", 0, err
+	}
+	link := "socket:[" + inode + "]"
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return "", 0, err
+	}
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := path.Join("/proc", p.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if l, err := os.Readlink(path.Join(fdDir, fd.Name())); err == nil && l == link {
+				comm, _ := ioutil.ReadFile(path.Join("/proc", p.Name(), "comm"))
+				return strings.TrimSpace(string(comm)), pid, nil
+			}
+		}
+	}
+	return "", 0, errors.New("process not found for " + link)
+}
@@ -0,0 +1,52 @@
+package cow
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestParseProcNetAddr(t *testing.T) {
+	// Samples are from little endian hosts.
+	if nativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("big endian host")
+	}
+	testData := []struct {
+		addr string
+		ip   string
+		port int
+	}{
+		{"0100007F:1F90", "127.0.0.1", 8080},
+		{"00000000000000000000000001000000:0050", "::1", 80},
+		{"0000000000000000FFFF00000100007F:1E61", "::ffff:127.0.0.1", 7777},
+	}
+	for _, td := range testData {
+		ip, port, err := parseProcNetAddr(td.addr)
+		if err != nil || !ip.Equal(net.ParseIP(td.ip)) || port != td.port {
+			t.Errorf("%s parsed as %v %d %v, should be %s %d", td.addr, ip, port, err, td.ip, td.port)
+		}
+	}
+	if _, _, err := parseProcNetAddr("7F00:1F90"); err == nil {
+		t.Error("should fail on short address")
+	}
+}
+
+func TestSocketProcess(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, pid, err := socketProcess(c.LocalAddr().(*net.TCPAddr), c.RemoteAddr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != os.Getpid() {
+		t.Errorf("pid %d, should be %d", pid, os.Getpid())
+	}
+}
@@ -0,0 +1,12 @@
+// +build !linux,!darwin
+
+package cow
+
+import (
+	"errors"
+	"net"
+)
+
+func socketProcess(client, server *net.TCPAddr) (string, int, error) {
+	return "", 0, errors.New("process lookup not supported")
+}
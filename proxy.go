@@ -1,4 +1,4 @@
-package main
+package cow
 
 import (
 	"bytes"
@@ -8,6 +8,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cyfdecyf/bufio"
@@ -33,15 +34,18 @@ const httpBufSize = 8192
 // holding post data.
 var httpBuf = leakybuf.NewLeakyBuf(512, httpBufSize)
 
-// If no keep-alive header in response, use this as the keep-alive value.
-const defaultServerConnTimeout = 15 * time.Second
+// Idle server connections are kept in pool for at most serverIdleTimeout,
+// or shorter if the server sends smaller keep-alive value.
+const defaultServerIdleTimeout = 15 * time.Second
 
 // Close client connection if no new requests received in some time.
 // (On OS X, the default soft limit of open file descriptor is 256, which is
 // very conservative and easy to cause problem if we are not careful to limit
 // open fds.)
-const clientConnTimeout = 15 * time.Second
-const fullKeepAliveHeader = "Keep-Alive: timeout=15\r\n"
+const defaultClientIdleTimeout = 15 * time.Second
+
+// Keep-Alive header sent to client, timeout is clientIdleTimeout.
+var fullKeepAliveHeader = "Keep-Alive: timeout=15\r\n"
 
 // If client closed connection for HTTP CONNECT method in less then 1 second,
 // consider it as an ssl error. This is only effective for Chrome which will
@@ -90,6 +94,17 @@ type serverConn struct {
 	willCloseOn time.Time
 	siteInfo    *VisitCnt
 	visited     bool
+	routeRule   string // why the connection is created, for X-Cow-Route
+	connTiming  string // Server-Timing metrics of creating the connection
+	reqSent     time.Time
+	parentCnt   *trafficCnt
+	userCnt     *trafficCnt
+	usage       *userUsage // for user quota
+	tunnelIdle  *idleTimer // nil if tunnel has no idle timeout
+	upShaper    shaper
+	downShaper  shaper
+	stallCheck  bool     // renew stallTimeout read deadline on each read
+	use         *connUse // for connHook, nil if no hook
 }
 
 type clientConn struct {
@@ -97,15 +112,31 @@ type clientConn struct {
 	bufRd    *bufio.Reader
 	buf      []byte // buffer for the buffered reader
 	proxy    Proxy
+	locale   *locale // for pages sent to client, nil means default
+	user     string  // authenticated user name
+
+	// Client doesn't expect response to CONNECT: intercepted transparently,
+	// or 200 response has been sent.
+	tunnelEstablished bool
+
+	synOS   string // OS guessed from SYN for accessRule
+	synRead bool
+	process string     // name[pid] of local client process, empty if unknown
+	usage   *userUsage // of the authenticated user, counts connection
 }
 
 var (
 	errPageSent      = errors.New("error page has sent")
 	errClientTimeout = errors.New("read client request timeout")
 	errAuthRequired  = errors.New("authentication requried")
+	errCacheMiss     = errors.New("cache entry not usable")
+	errParentConnect = errors.New("parent proxy CONNECT failed")
 )
 
 type Proxy interface {
+	// listen is called before Serve, and before dropping privilege, so
+	// listening on privileged ports is possible.
+	listen() error
 	Serve(*sync.WaitGroup, <-chan struct{})
 	Addr() string
 	genConfig() string // for upgrading config
@@ -117,10 +148,26 @@ func addListenProxy(p Proxy) {
 	listenProxy = append(listenProxy, p)
 }
 
+// localHttpProxyAddr returns address of the first http listener for use on
+// the local host, empty if there's no http listener.
+func localHttpProxyAddr() string {
+	for _, p := range listenProxy {
+		if hp, ok := p.(*httpProxy); ok {
+			host, port, _ := net.SplitHostPort(hp.addr)
+			if host == "" || host == "0.0.0.0" || host == "::" {
+				host = "127.0.0.1"
+			}
+			return net.JoinHostPort(host, port)
+		}
+	}
+	return ""
+}
+
 type httpProxy struct {
 	addr      string // listen address, contains port
 	port      string // for use when generating PAC
 	addrInPAC string // proxy server address to use in PAC
+	ln        net.Listener
 }
 
 func newHttpProxy(addr, addrInPAC string) *httpProxy {
@@ -128,7 +175,7 @@ func newHttpProxy(addr, addrInPAC string) *httpProxy {
 	if err != nil {
 		panic("proxy addr" + err.Error())
 	}
-	return &httpProxy{addr, port, addrInPAC}
+	return &httpProxy{addr: addr, port: port, addrInPAC: addrInPAC}
 }
 
 func (proxy *httpProxy) genConfig() string {
@@ -143,13 +190,25 @@ func (proxy *httpProxy) Addr() string {
 	return proxy.addr
 }
 
+func (hp *httpProxy) listen() (err error) {
+	if hp.ln, err = net.Listen("tcp", hp.addr); err != nil {
+		fmt.Println("listen http failed:", err)
+		return
+	}
+	if accessSaveSYN() {
+		if err := saveSYN(hp.ln); err != nil {
+			errl.Println("http listener save SYN:", err)
+		}
+	}
+	return
+}
+
 func (hp *httpProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
 	defer func() {
 		wg.Done()
 	}()
-	ln, err := net.Listen("tcp", hp.addr)
-	if err != nil {
-		fmt.Println("listen http failed:", err)
+	ln := hp.ln
+	if ln == nil {
 		return
 	}
 	var exit bool
@@ -194,6 +253,7 @@ type cowProxy struct {
 	method string
 	passwd string
 	cipher *ss.Cipher
+	ln     net.Listener
 }
 
 func newCowProxy(method, passwd, addr string) *cowProxy {
@@ -201,7 +261,7 @@ func newCowProxy(method, passwd, addr string) *cowProxy {
 	if err != nil {
 		Fatal("can't initialize cow proxy server", err)
 	}
-	return &cowProxy{addr, method, passwd, cipher}
+	return &cowProxy{addr: addr, method: method, passwd: passwd, cipher: cipher}
 }
 
 func (cp *cowProxy) genConfig() string {
@@ -216,14 +276,20 @@ func (cp *cowProxy) Addr() string {
 	return cp.addr
 }
 
+func (cp *cowProxy) listen() (err error) {
+	if cp.ln, err = net.Listen("tcp", cp.addr); err != nil {
+		fmt.Println("listen cow failed:", err)
+	}
+	return
+}
+
 func (cp *cowProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
 	defer func() {
 		wg.Done()
 	}()
 
-	ln, err := net.Listen("tcp", cp.addr)
-	if err != nil {
-		fmt.Println("listen cow failed:", err)
+	ln := cp.ln
+	if ln == nil {
 		return
 	}
 	info.Printf("COW %s cow proxy address %s\n", version, cp.addr)
@@ -261,6 +327,7 @@ func newClientConn(cli net.Conn, proxy Proxy) *clientConn {
 		bufRd: bufio.NewReaderFromBuf(cli, buf),
 		proxy: proxy,
 	}
+	trackCliConn(c)
 	if debug {
 		debug.Printf("cli(%s) connected, total %d clients\n",
 			cli.RemoteAddr(), incCliCnt())
@@ -279,6 +346,8 @@ func (c *clientConn) releaseBuf() {
 
 func (c *clientConn) Close() {
 	c.releaseBuf()
+	untrackCliConn(c)
+	c.releaseUsage()
 	if debug {
 		debug.Printf("cli(%s) closed, total %d clients\n",
 			c.RemoteAddr(), decCliCnt())
@@ -292,7 +361,7 @@ func (c *clientConn) setReadTimeout(msg string) {
 	// connection after a period of idle to reduce number of open connections.
 	if _, ok := c.Conn.(*ss.Conn); !ok {
 		// make actual timeout a little longer than keep-alive value sent to client
-		setConnReadTimeout(c.Conn, clientConnTimeout+2*time.Second, msg)
+		setConnReadTimeout(c.Conn, config.ClientIdleTimeout+2*time.Second, msg)
 	}
 }
 
@@ -367,6 +436,24 @@ func (c *clientConn) serveSelfURL(r *Request) (err error) {
 		// client connection.
 		return errPageSent
 	}
+	if strings.HasPrefix(r.URL.Path, rulesPathPrefix) {
+		sendRules(c, r)
+		return errPageSent
+	}
+	if r.URL.Path == healthPath {
+		sendHealth(c)
+		return errPageSent
+	}
+	if r.URL.Path == statsPath && auth.required {
+		c.sendStats(r)
+		return errPageSent
+	}
+	if r.URL.Path == "/" {
+		pacURL := "http://" + r.Header.Host + "/pac"
+		sendPageGeneric(c, "200 OK", "COW proxy is running.",
+			fmt.Sprintf("<p>%s: <a href=\"%s\">%s</a></p>", c.locale.tr("PAC url"), pacURL, pacURL))
+		return nil
+	}
 end:
 	sendErrorPage(c, "404 not found", "Page not found",
 		genErrMsg(r, nil, "Serving request to COW proxy."))
@@ -403,7 +490,7 @@ func (c *clientConn) shouldRetry(r *Request, sv *serverConn, re error) bool {
 		if sv.maybeFake() {
 			// Sometimes GFW reset will got EOF error leading to retry too many times.
 			// In that case, consider the url as temp blocked and try parent proxy.
-			siteStat.TempBlocked(r.URL)
+			siteStat.TempBlocked(r.siteURL())
 			r.tryCnt = 0
 			return true
 		}
@@ -441,6 +528,8 @@ func (c *clientConn) serve() {
 	var sv *serverConn
 	var err error
 
+	c.lookupProcess()
+
 	var authed bool
 	// For cow proxy server, authentication is done by matching password.
 	if _, ok := c.proxy.(*cowProxy); ok {
@@ -473,18 +562,43 @@ func (c *clientConn) serve() {
 			return
 		}
 		dbgPrintRq(c, &r)
+		setCliConnRequest(c, &r)
+		start := time.Now()
+		c.locale = findLocale(r.AcceptLanguage)
 
 		// PAC may leak frequently visited sites information. But if cow
 		// requires authentication for PAC, some clients may not be able
 		// handle it. (e.g. Proxy SwitchySharp extension on Chrome.)
-		if isSelfRequest(&r) {
+		udpTarget := connectUDPTarget(&r)
+		if udpTarget == "" && isSelfRequest(&r) {
 			if err = c.serveSelfURL(&r); err != nil {
 				return
 			}
 			continue
 		}
 
-		if auth.required && !authed {
+		if inMaintenance() {
+			debug.Printf("cli(%s) maintenance mode, reject %s\n", c.RemoteAddr(), &r)
+			sendMaintenancePage(c)
+			return
+		}
+
+		action := accessNone
+		if len(accessRules) > 0 {
+			action = c.matchAccessRule(&r)
+		}
+		if action == accessDeny {
+			sendErrorPage(c, statusForbidden, "Forbidden",
+				genErrMsg(&r, nil, "Please contact proxy admin."))
+			return
+		}
+		if action == accessAuth && c.user == "" {
+			if err = authUserPasswd(c, &r); err != nil {
+				errl.Printf("cli(%s) %v\n", c.RemoteAddr(), err)
+				return
+			}
+			authed = true
+		} else if auth.required && !authed {
 			if err = Authenticate(c, &r); err != nil {
 				errl.Printf("cli(%s) %v\n", c.RemoteAddr(), err)
 				// Request may have body. To make things simple, close
@@ -494,6 +608,22 @@ func (c *clientConn) serve() {
 			}
 			authed = true
 		}
+		if udpTarget != "" {
+			if c.user != "" {
+				host, _, _ := net.SplitHostPort(udpTarget)
+				if err = c.checkUserPolicy(&r, host); err != nil {
+					return
+				}
+			}
+			c.serveConnectUDP(&r, udpTarget)
+			return
+		}
+
+		if r.hostMismatch() && config.HostMismatch != hostMismatchAllow {
+			if err = c.handleHostMismatch(&r); err != nil {
+				return
+			}
+		}
 
 		if r.isConnect && !config.TunnelAllowedPort[r.URL.Port] {
 			sendErrorPage(c, statusForbidden, "Forbidden tunnel port",
@@ -501,6 +631,35 @@ func (c *clientConn) serve() {
 			return
 		}
 
+		if r.isConnect && fakeDNS != nil {
+			// CONNECT from TUN program with fake address.
+			if hostPort := fakeHostPort(r.URL.HostPort); hostPort != r.URL.HostPort {
+				r.initTunnel(hostPort)
+			}
+		}
+
+		if r.isConnect && config.SniRouting && net.ParseIP(r.URL.Host) != nil {
+			if err = c.peekSNI(&r); err != nil {
+				return
+			}
+		}
+
+		// Check after fake address and SNI are resolved, so policy applies to
+		// the host name.
+		if c.user != "" {
+			if err = c.checkUserPolicy(&r, r.siteURL().Host); err != nil {
+				return
+			}
+		}
+
+		if !r.isConnect && !r.Chunking && config.MaxRequestBody > 0 &&
+			r.ContLen > config.MaxRequestBody {
+			sendErrorPage(c, statusBodyTooLarge, "Request body too large",
+				genErrMsg(&r, nil, "Request body exceeds the size limit of the proxy."))
+			// Don't read request body, simply close connection.
+			return
+		}
+
 		if r.ExpectContinue {
 			sendErrorPage(c, statusExpectFailed, "Expect header not supported",
 				"Please contact COW's developer if you see this.")
@@ -511,6 +670,54 @@ func (c *clientConn) serve() {
 			return
 		}
 
+		if helper != nil {
+			if err = c.applyHelper(&r); err != nil {
+				if err != errPageSent || r.isConnect {
+					return
+				}
+				if r.hasBody() {
+					sendBody(SinkWriter{}, c.bufRd, int(r.ContLen), r.Chunking)
+				}
+				continue
+			}
+		}
+
+		if script != nil {
+			if err = c.applyScript(&r); err != nil {
+				if err != errPageSent || r.isConnect {
+					return
+				}
+				if r.hasBody() {
+					sendBody(SinkWriter{}, c.bufRd, int(r.ContLen), r.Chunking)
+				}
+				continue
+			}
+		}
+
+		if icap.reqmod != nil && !r.isConnect {
+			if err = c.icapReqmod(&r); err != nil {
+				if err != errPageSent {
+					return
+				}
+				if r.hasBody() {
+					sendBody(SinkWriter{}, c.bufRd, int(r.ContLen), r.Chunking)
+				}
+				continue
+			}
+		}
+
+		if cacheEnabled() {
+			if e := lookupCache(&r); e != nil {
+				debug.Printf("cli(%s) cache hit %v\n", c.RemoteAddr(), &r)
+				if err = c.sendCacheEntry(&r, e); err != errCacheMiss {
+					if err != nil || !r.ConnectionKeepAlive {
+						return
+					}
+					continue
+				}
+			}
+		}
+
 	retry:
 		r.tryOnce()
 		if bool(debug) && r.isRetry() {
@@ -541,6 +748,7 @@ func (c *clientConn) serve() {
 				goto retry
 			}
 			// debug.Printf("doConnect %s to %s done\n", c.RemoteAddr(), r.URL.HostPort)
+			logAccess(c, &r, sv, 200, start)
 			return
 		}
 
@@ -557,9 +765,10 @@ func (c *clientConn) serve() {
 			}
 			return
 		}
+		logAccess(c, &r, sv, rp.Status, start)
 		// Put server connection to pool, so other clients can use it.
 		_, isCowConn := sv.Conn.(cowConn)
-		if rp.ConnectionKeepAlive || isCowConn {
+		if (rp.ConnectionKeepAlive || isCowConn) && !r.segmented {
 			if debug {
 				debug.Printf("cli(%s) connPool put %s", c.RemoteAddr(), sv.hostPort)
 			}
@@ -584,15 +793,17 @@ func (c *clientConn) serve() {
 }
 
 func genErrMsg(r *Request, sv *serverConn, what string) string {
+	l := findLocale(r.AcceptLanguage)
 	if sv == nil {
-		return fmt.Sprintf("<p>HTTP Request <strong>%v</strong></p> <p>%s</p>", r, what)
+		return fmt.Sprintf("<p>%s <strong>%v</strong></p> <p>%s</p>",
+			l.tr("HTTP Request"), r, l.tr(what))
 	}
-	return fmt.Sprintf("<p>HTTP Request <strong>%v</strong></p> <p>%s</p> <p>Using %s.</p>",
-		r, what, sv.Conn)
+	return fmt.Sprintf("<p>%s <strong>%v</strong></p> <p>%s</p> <p>%s %s.</p>",
+		l.tr("HTTP Request"), r, l.tr(what), l.tr("Using"), sv.Conn)
 }
 
 func (c *clientConn) handleBlockedRequest(r *Request, err error) error {
-	siteStat.TempBlocked(r.URL)
+	siteStat.TempBlocked(r.siteURL())
 	return RetryError{err}
 }
 
@@ -615,11 +826,34 @@ func (c *clientConn) handleServerReadError(r *Request, sv *serverConn, err error
 	return err
 }
 
+// handleHostMismatch applies hostMismatch policy. Returns error if the
+// connection should be closed.
+func (c *clientConn) handleHostMismatch(r *Request) error {
+	switch config.HostMismatch {
+	case hostMismatchLog:
+		errl.Printf("cli(%s) Host header %q differs from %v\n", c.RemoteAddr(), r.hostHeader, r)
+	case hostMismatchRewrite:
+		debug.Printf("cli(%s) rewrite Host header %q for %v\n", c.RemoteAddr(), r.hostHeader, r)
+		if err := r.rewriteURL("http://" + r.URL.String()); err != nil {
+			errl.Printf("cli(%s) rewrite Host header for %v: %v\n", c.RemoteAddr(), r, err)
+			return err
+		}
+		r.hostHeader = ""
+	case hostMismatchReject:
+		errl.Printf("cli(%s) reject Host header %q differs from %v\n", c.RemoteAddr(), r.hostHeader, r)
+		sendErrorPage(c, statusBadReq, "Host header mismatch",
+			genErrMsg(r, nil, "Host header differs from the host in request URI."))
+		// Request may have body, simply close connection.
+		return errPageSent
+	}
+	return nil
+}
+
 func (c *clientConn) handleServerWriteError(r *Request, sv *serverConn, err error, msg string) error {
 	// This function is only called in doRequest, no response is sent to client.
 	// So if visiting blocked site, can always retry request.
 	if sv.maybeFake() && isErrConnReset(err) {
-		siteStat.TempBlocked(r.URL)
+		siteStat.TempBlocked(r.siteURL())
 	}
 	return RetryError{err}
 }
@@ -662,22 +896,87 @@ func (c *clientConn) readResponse(sv *serverConn, r *Request, rp *Response) (err
 	if err = parseResponse(sv, r, rp); err != nil {
 		return c.handleServerReadError(r, sv, err, "parse response")
 	}
+	ttfb := time.Now().Sub(sv.reqSent)
 	dbgPrintRep(c, r, rp)
+	if rp.Status == 407 {
+		hc, ok := sv.Conn.(httpConn)
+		if ok && hc.parent.auth != nil && hc.parent.auth.challenged(rp.ProxyAuthenticate) {
+			debug.Printf("cli(%s) parent %s requires authentication, retry %v\n",
+				c.RemoteAddr(), hc.parent.server, r)
+			return RetryError{errParentAuth}
+		}
+	}
+	if script != nil {
+		c.scriptResponse(r, rp)
+	}
+	if r.har != nil {
+		r.har.setResponse(rp, rp.Chunking || rp.ContLen < 0)
+	}
 	// After have received the first reponses from the server, we consider
 	// ther server as real instead of fake one caused by wrong DNS reply. So
 	// don't time out later.
 	sv.state = svSendRecvResponse
 	r.state = rsRecvBody
+
+	bodyRd := sv.bufRd
+	e := revalidated(r, rp)
+	if e == nil && icap.respmod != nil {
+		if bodyRd, err = c.icapRespmod(sv, r, rp); err != nil {
+			return err
+		}
+	}
+	var sd, rs *segmentDownload
+	if e == nil && icap.respmod == nil {
+		sd = newSegmentDownload(sv, r, rp)
+		if sd == nil && config.StallTimeout > 0 {
+			rs = newStallResume(sv, r, rp)
+		}
+	}
 	r.releaseBuf()
 
-	if _, err = c.Write(rp.rawResponse()); err != nil {
+	var w io.Writer = c
+	var cw *cacheWriter
+	if r.cache != nil && rp.hasBody(r.Method) {
+		if cw = newCacheWriter(c, r, rp); cw != nil {
+			w = cw
+		}
+	}
+	if r.har != nil {
+		w = harBodyWriter{w, &r.har.rpBody}
+	}
+	if e != nil {
+		err = c.sendCacheEntry(r, e)
+	} else {
+		if config.DebugRouteHeader {
+			rp.insertHeader(sv.routeHeader())
+		}
+		if config.ServerTiming {
+			rp.insertHeader(sv.timingHeader(ttfb))
+		}
+		_, err = c.Write(rp.rawResponse())
+	}
+	if err != nil {
+		if cw != nil {
+			cw.abort()
+		}
 		return err
 	}
 
 	rp.releaseBuf()
 
 	if rp.hasBody(r.Method) {
-		if err = sendBody(c, sv.bufRd, int(rp.ContLen), rp.Chunking); err != nil {
+		if sd != nil {
+			r.segmented = true
+			err = sd.send(w, bodyRd)
+		} else if config.StallTimeout > 0 && bodyRd == sv.bufRd {
+			err = c.sendBodyStall(w, sv, r, rp, rs)
+		} else {
+			err = sendBody(w, bodyRd, int(rp.ContLen), rp.Chunking)
+		}
+		if cw != nil {
+			cw.finish(err)
+		}
+		if err != nil {
 			if debug {
 				debug.Printf("cli(%s) send body %v\n", c.RemoteAddr(), err)
 			}
@@ -699,14 +998,18 @@ func (c *clientConn) readResponse(sv *serverConn, r *Request, rp *Response) (err
 		}
 	}
 	r.state = rsDone
+	if r.har != nil {
+		r.har.finish(routeName(sv.Conn))
+		r.har = nil
+	}
 	/*
 		if debug {
 			debug.Printf("[Finished] %v request %s %s\n", c.RemoteAddr(), r.Method, r.URL)
 		}
 	*/
 	if rp.ConnectionKeepAlive {
-		if rp.KeepAlive == time.Duration(0) {
-			sv.willCloseOn = time.Now().Add(defaultServerConnTimeout)
+		if rp.KeepAlive == time.Duration(0) || rp.KeepAlive > config.ServerIdleTimeout {
+			sv.willCloseOn = time.Now().Add(config.ServerIdleTimeout)
 		} else {
 			// debug.Printf("cli(%s) server %s keep-alive %v\n", c.RemoteAddr(), sv.hostPort, rp.KeepAlive)
 			sv.willCloseOn = time.Now().Add(rp.KeepAlive)
@@ -715,8 +1018,73 @@ func (c *clientConn) readResponse(sv *serverConn, r *Request, rp *Response) (err
 	return
 }
 
+// serveTransparent tunnels client connection to hostPort, the original
+// destination of a transparently intercepted connection.
+func (c *clientConn) serveTransparent(hostPort string) {
+	var r Request
+	var sv *serverConn
+	var err error
+
+	c.lookupProcess()
+	hostPort = fakeHostPort(hostPort)
+	c.tunnelEstablished = true
+	defer func() {
+		r.releaseBuf()
+		c.Close()
+	}()
+	if inMaintenance() {
+		debug.Printf("cli(%s) maintenance mode, close transparent connection to %s\n",
+			c.RemoteAddr(), hostPort)
+		return
+	}
+	r.initTunnel(hostPort)
+	setCliConnRequest(c, &r)
+	debug.Printf("cli(%s) transparent tunnel to %s\n", c.RemoteAddr(), hostPort)
+	if config.SniRouting {
+		if err = c.peekSNI(&r); err != nil {
+			return
+		}
+	}
+
+retry:
+	r.tryOnce()
+	if sv, err = c.getServerConn(&r); err != nil {
+		return
+	}
+	err = sv.doConnect(&r, c)
+	if c.shouldRetry(&r, sv, err) {
+		goto retry
+	}
+}
+
 func (c *clientConn) getServerConn(r *Request) (*serverConn, error) {
-	siteInfo := siteStat.GetVisitCnt(r.URL)
+	siteInfo := siteStat.GetVisitCnt(r.siteURL())
+	if r.route == routeDefault && embedRoute != nil {
+		routeEmbed(r)
+	}
+	if r.route == routeDefault && script != nil {
+		c.routeScript(r)
+	}
+	if r.route == routeDefault {
+		r.routeRule = ""
+		if len(requestRules) > 0 && c.routeRequestRule(r) {
+			debug.Printf("cli(%s) %s for %v\n", c.RemoteAddr(), r.routeRule, r)
+		} else if rp := matchRuleProvider(r.siteURL()); rp != nil {
+			r.route = rp.route
+			if rp.group != "" {
+				r.routeGroup(proxyGroups[rp.group])
+			}
+			r.routeRule = "provider " + rp.source
+		} else if parentPAC != nil {
+			routeParentPAC(r)
+		}
+	}
+	switch r.route {
+	case routeDirect:
+		siteInfo = routeDirectCnt
+	case routeProxy:
+		siteInfo = routeProxyCnt
+	}
 	// For CONNECT method, always create new connection.
 	if r.isConnect {
 		return c.createServerConn(r, siteInfo)
@@ -727,6 +1095,9 @@ func (c *clientConn) getServerConn(r *Request) (*serverConn, error) {
 		// content it loads may result reset. So we should reset server
 		// connection state to just connected.
 		sv.state = svConnected
+		sv.setTraffic(c.user)
+		sv.setShaper(c)
+		sv.hookOpen(c, r)
 		if debug {
 			debug.Printf("cli(%s) connPool get %s\n", c.RemoteAddr(), r.URL.HostPort)
 		}
@@ -742,7 +1113,7 @@ func connectDirect2(url *URL, siteInfo *VisitCnt, recursive bool) (net.Conn, err
 	var c net.Conn
 	var err error
 	if siteInfo.AlwaysDirect() {
-		c, err = net.Dial("tcp", url.HostPort)
+		c, err = dialDirect(url.HostPort, 0)
 	} else {
 		to := dialTimeout
 		if siteInfo.OnceBlocked() && to >= defaultDialTimeout {
@@ -753,7 +1124,7 @@ func connectDirect2(url *URL, siteInfo *VisitCnt, recursive bool) (net.Conn, err
 			// problems when network condition is bad.
 			to = maxTimeout
 		}
-		c, err = net.DialTimeout("tcp", url.HostPort, to)
+		c, err = dialDirect(url.HostPort, to)
 	}
 	if err != nil {
 		debug.Printf("error direct connect to: %s %v\n", url.HostPort, err)
@@ -798,15 +1169,37 @@ func maybeBlocked(err error) bool {
 // If direct connection fails, try parent proxies.
 func (c *clientConn) connect(r *Request, siteInfo *VisitCnt) (srvconn net.Conn, err error) {
 	var errMsg string
+	var rule string
+	// Whether parent proxy is tried, the request may be queued for replay
+	// if it fails.
+	var parentTried bool
+	defer func() {
+		if err == nil && r.routeRule == "" {
+			r.routeRule = rule
+		}
+	}()
+	if r.pacRoute != nil {
+		return c.connectPAC(r, siteInfo)
+	}
 	if config.AlwaysProxy {
+		rule = "alwaysProxy"
+		parentTried = true
 		if srvconn, err = parentProxy.connect(r.URL); err == nil {
 			return
 		}
 		errMsg = genErrMsg(r, nil, "Parent proxy connection failed, always use parent proxy.")
 		goto fail
 	}
+	rule = routeRule(siteInfo)
+	if dnsCheckEnabled() && !parentProxy.empty() && dnsCheckNeeded(siteInfo) &&
+		dnsPoisoned(r.URL.Host) {
+		siteStat.TempBlocked(r.URL)
+		siteInfo.BlockedVisit()
+		rule = "dns-poisoned"
+	}
 	if siteInfo.AsBlocked() && !parentProxy.empty() {
 		// In case of connection error to socks server, fallback to direct connection
+		parentTried = true
 		if srvconn, err = parentProxy.connect(r.URL); err == nil {
 			return
 		}
@@ -818,6 +1211,7 @@ func (c *clientConn) connect(r *Request, siteInfo *VisitCnt) (srvconn net.Conn,
 			errMsg = genErrMsg(r, nil, "Parent proxy connection failed, temporarily blocked site.")
 			goto fail
 		}
+		rule += ",parent-failed"
 		if srvconn, err = connectDirect(r.URL, siteInfo); err == nil {
 			return
 		}
@@ -845,6 +1239,8 @@ func (c *clientConn) connect(r *Request, siteInfo *VisitCnt) (srvconn net.Conn,
 		// To simplify things and avoid error in my observation, always try
 		// parent proxy in case of Dial error.
 		var socksErr error
+		rule = "direct-failed"
+		parentTried = true
 		if srvconn, socksErr = parentProxy.connect(r.URL); socksErr == nil {
 			c.handleBlockedRequest(r, err)
 			if debug {
@@ -858,16 +1254,101 @@ func (c *clientConn) connect(r *Request, siteInfo *VisitCnt) (srvconn net.Conn,
 	}
 
 fail:
+	if parentTried && queueReplay(r) {
+		errMsg += "<p>" + findLocale(r.AcceptLanguage).tr(
+			"Request is queued and will be sent again when parent proxy recovers.") + "</p>"
+	}
 	sendErrorPage(c, "504 Connection failed", err.Error(), errMsg)
 	return nil, errPageSent
 }
 
+// routeRule describes why a site is connected directly or through parent
+// proxy, used in X-Cow-Route header.
+func routeRule(siteInfo *VisitCnt) string {
+	switch {
+	case siteInfo == alwaysDirectVisitCnt:
+		if parentProxy.empty() {
+			return "no-parent"
+		}
+		return "local"
+	case siteInfo.AlwaysDirect():
+		return "direct-list"
+	case siteInfo.AlwaysBlocked():
+		return "blocked-list"
+	case siteInfo.AsTempBlocked():
+		return "temp-blocked"
+	}
+	return "stat"
+}
+
+const headerCowRoute = "X-Cow-Route"
+
+// routeName returns DIRECT or the parent proxy of the server connection.
+func routeName(c net.Conn) string {
+	switch pc := c.(type) {
+	case httpConn:
+		return pc.parent.scheme() + "://" + pc.parent.server
+	case socksConn:
+		return "socks5://" + pc.parent.server
+	case shadowsocksConn:
+		return "ss://" + pc.parent.server
+	case cowConn:
+		return "cow://" + pc.parent.server
+	case adapterConn:
+		return pc.parent.protocol + "://" + pc.parent.server
+	}
+	return "DIRECT"
+}
+
+// requestURI returns request URI and parent proxy authorization header for
+// request sent by cow itself on connection c.
+func requestURI(c net.Conn, method string, url *URL) (uri string, authHeader []byte) {
+	uri = url.Path
+	if uri == "" {
+		uri = "/"
+	}
+	switch pc := c.(type) {
+	case httpConn:
+		uri = "http://" + url.HostPort + uri
+		if pc.parent.auth != nil {
+			authHeader = pc.parent.auth.header(method, uri)
+		}
+	case cowConn:
+		uri = "http://" + url.HostPort + uri
+	}
+	return
+}
+
+// headerLines returns header lines of request r, skipping headers in skip.
+func headerLines(r *Request, skip map[string]bool) []byte {
+	var hdr bytes.Buffer
+	for _, line := range bytes.SplitAfter(r.raw.Bytes()[r.headStart:r.bodyStart], []byte("\n")) {
+		cid := bytes.IndexByte(line, ':')
+		if cid <= 0 || skip[strings.ToLower(strings.TrimSpace(string(line[:cid])))] {
+			continue
+		}
+		hdr.Write(line)
+	}
+	return hdr.Bytes()
+}
+
+func (sv *serverConn) routeHeader() string {
+	return headerCowRoute + ": " + routeName(sv.Conn) + "; rule=" + sv.routeRule + CRLF
+}
+
 func (c *clientConn) createServerConn(r *Request, siteInfo *VisitCnt) (*serverConn, error) {
 	srvconn, err := c.connect(r, siteInfo)
 	if err != nil {
 		return nil, err
 	}
 	sv := newServerConn(srvconn, r.URL.HostPort, siteInfo)
+	sv.routeRule = r.routeRule
+	if config.ServerTiming {
+		sv.connTiming = connTiming(srvconn)
+	}
+	sv.setTraffic(c.user)
+	sv.setShaper(c)
+	sv.hookOpen(c, r)
 	if debug {
 		debug.Printf("cli(%s) connected to %s %d concurrent connections\n",
 			c.RemoteAddr(), sv.hostPort, incSrvConnCnt(sv.hostPort))
@@ -887,6 +1368,31 @@ func newServerConn(c net.Conn, hostPort string, siteInfo *VisitCnt) *serverConn
 	return sv
 }
 
+// Read and Write on server connection update traffic counters and apply
+// bandwidth limits.
+func (sv *serverConn) Read(b []byte) (n int, err error) {
+	if sv.stallCheck {
+		setConnReadTimeout(sv.Conn, config.StallTimeout, "stall")
+	}
+	n, err = sv.Conn.Read(b)
+	sv.use.add(0, n)
+	sv.parentCnt.add(0, n)
+	sv.userCnt.add(0, n)
+	sv.usage.add(0, n)
+	sv.downShaper.wait(n)
+	return
+}
+
+func (sv *serverConn) Write(b []byte) (n int, err error) {
+	sv.upShaper.wait(len(b))
+	n, err = sv.Conn.Write(b)
+	sv.use.add(n, 0)
+	sv.parentCnt.add(n, 0)
+	sv.userCnt.add(n, 0)
+	sv.usage.add(n, 0)
+	return
+}
+
 func (sv *serverConn) isDirect() bool {
 	_, ok := sv.Conn.(directConn)
 	return ok
@@ -921,6 +1427,7 @@ func (sv *serverConn) releaseBuf() {
 }
 
 func (sv *serverConn) Close() error {
+	sv.hookClose()
 	sv.releaseBuf()
 	if debug {
 		debug.Printf("close connection to %s remains %d concurrent connections\n",
@@ -1010,9 +1517,11 @@ func copyServer2Client(sv *serverConn, c *clientConn, r *Request) (err error) {
 			readTimeoutSet = false
 		}
 		var n int
-		if n, err = sv.Read(buf); err != nil {
+		n, err = sv.Read(buf)
+		sv.tunnelIdle.touch(n)
+		if err != nil {
 			if sv.maybeFake() && maybeBlocked(err) {
-				siteStat.TempBlocked(r.URL)
+				siteStat.TempBlocked(r.siteURL())
 				debug.Printf("srv->cli blocked site %s detected, err: %v retry\n", r.URL.HostPort, err)
 				return RetryError{err}
 			}
@@ -1066,6 +1575,22 @@ func (sw *serverWriter) Write(p []byte) (int, error) {
 	return sw.sv.Write(p)
 }
 
+var errBodyTooLarge = errors.New("request body too large")
+
+// bodyLimitWriter fails when more than left bytes are written.
+type bodyLimitWriter struct {
+	w    io.Writer
+	left int64
+}
+
+func (bw *bodyLimitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > bw.left {
+		return 0, errBodyTooLarge
+	}
+	bw.left -= int64(len(p))
+	return bw.w.Write(p)
+}
+
 func copyClient2Server(c *clientConn, sv *serverConn, r *Request, srvStopped notification, done chan struct{}) (err error) {
 	// sv.maybeFake may change during execution in this function.
 	// So need a variable to record the whether timeout is set.
@@ -1097,6 +1622,7 @@ func copyClient2Server(c *clientConn, sv *serverConn, r *Request, srvStopped not
 		n = c.bufRd.Buffered()
 		if n > 0 {
 			buffered, _ := c.bufRd.Peek(n) // should not return error
+			r.sniffClientHello(buffered)
 			if _, err = w.Write(buffered); err != nil {
 				// debug.Printf("cli->srv write buffered err: %v\n", err)
 				return
@@ -1127,11 +1653,13 @@ func copyClient2Server(c *clientConn, sv *serverConn, r *Request, srvStopped not
 			unsetConnReadTimeout(c.Conn, "cli->srv before read")
 			deadlineIsSet = false
 		}
-		if n, err = c.Read(buf); err != nil {
+		n, err = c.Read(buf)
+		sv.tunnelIdle.touch(n)
+		if err != nil {
 			if config.DetectSSLErr && sv.maybeFake() && (isErrConnReset(err) || err == io.EOF) &&
 				sv.maybeSSLErr(start) {
 				debug.Println("client connection closed very soon, taken as SSL error:", r)
-				siteStat.TempBlocked(r.URL)
+				siteStat.TempBlocked(r.siteURL())
 			} else if isErrTimeout(err) && !srvStopped.hasNotified() {
 				// debug.Printf("cli(%s)->srv(%s) timeout\n", c.RemoteAddr(), r.URL.HostPort)
 				continue
@@ -1140,12 +1668,13 @@ func copyClient2Server(c *clientConn, sv *serverConn, r *Request, srvStopped not
 			return
 		}
 
+		r.sniffClientHello(buf[:n])
 		// copyServer2Client will detect write to closed server. Just store client content for retry.
 		if _, err = w.Write(buf[:n]); err != nil {
 			// XXX is it enough to only do block detection in copyServer2Client?
 			/*
 				if sv.maybeFake() && isErrConnReset(err) {
-					siteStat.TempBlocked(r.URL)
+					siteStat.TempBlocked(r.siteURL())
 					errl.Printf("copyClient2Server blocked site %d detected, retry\n", r.URL.HostPort)
 					return RetryError{err}
 				}
@@ -1174,9 +1703,17 @@ func (sv *serverConn) doConnect(r *Request, c *clientConn) (err error) {
 				c.RemoteAddr(), err)
 			return err
 		}
-	} else if !r.isRetry() {
+		// Consume response to CONNECT here if client doesn't expect it, or
+		// parent may require authentication.
+		hc, _ := sv.Conn.(httpConn)
+		if c.tunnelEstablished || (isHttpConn && hc.parent.auth != nil) {
+			if err = sv.readParentConnectResponse(r, c); err != nil {
+				return err
+			}
+		}
+	} else if !r.isRetry() && !c.tunnelEstablished {
 		// debug.Printf("send connection confirmation to %s->%s\n", c.RemoteAddr(), r.URL.HostPort)
-		if _, err = c.Write(connEstablished); err != nil {
+		if err = sv.sendConnEstablished(c); err != nil {
 			debug.Printf("cli(%s) error send 200 Connecion established: %v\n",
 				c.RemoteAddr(), err)
 			return err
@@ -1186,6 +1723,10 @@ func (sv *serverConn) doConnect(r *Request, c *clientConn) (err error) {
 	var cli2srvErr error
 	done := make(chan struct{})
 	srvStopped := newNotification()
+	if config.TunnelIdleTimeout > 0 {
+		sv.tunnelIdle = newIdleTimer()
+		go sv.closeIdleTunnel(c, done)
+	}
 	go func() {
 		// debug.Printf("doConnect: cli(%s)->srv(%s)\n", c.RemoteAddr(), r.URL.HostPort)
 		cli2srvErr = copyClient2Server(c, sv, r, srvStopped, done)
@@ -1210,14 +1751,139 @@ func (sv *serverConn) doConnect(r *Request, c *clientConn) (err error) {
 	return
 }
 
+// idleTimer records the last time data is transferred on a tunnel.
+type idleTimer struct {
+	last int64 // unix nano, must be first field for atomic access
+}
+
+func newIdleTimer() *idleTimer {
+	return &idleTimer{time.Now().UnixNano()}
+}
+
+func (t *idleTimer) touch(n int) {
+	if t != nil && n > 0 {
+		atomic.StoreInt64(&t.last, time.Now().UnixNano())
+	}
+}
+
+func (t *idleTimer) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&t.last))
+}
+
+// closeIdleTunnel closes the tunnel if no data is transferred in either
+// direction for tunnelIdleTimeout. Returns when done is closed.
+func (sv *serverConn) closeIdleTunnel(c *clientConn, done chan struct{}) {
+	timeout := config.TunnelIdleTimeout
+	check := timeout / 4
+	if check < time.Second {
+		check = time.Second
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(check):
+		}
+		if sv.tunnelIdle.idle() >= timeout {
+			debug.Printf("cli(%s) tunnel to %s idle for %v, close\n",
+				c.RemoteAddr(), sv.hostPort, timeout)
+			// Copy goroutines return on error and close sv.
+			sv.Conn.Close()
+			c.Conn.Close()
+			return
+		}
+	}
+}
+
+func (sv *serverConn) sendConnEstablished(c *clientConn) (err error) {
+	reply := connEstablished
+	var hdr string
+	if config.DebugRouteHeader {
+		hdr = sv.routeHeader()
+	}
+	if config.ServerTiming {
+		hdr += sv.timingHeader(-1)
+	}
+	if hdr != "" {
+		reply = []byte("HTTP/1.1 200 Tunnel established\r\n" + hdr + CRLF)
+	}
+	_, err = c.Write(reply)
+	return
+}
+
+// readParentConnectResponse reads parent proxy's response to CONNECT. If the
+// parent requires authentication, returns RetryError to resend CONNECT with
+// new credentials. Sends 200 to the client if not sent yet, or passes error
+// response to the client.
+func (sv *serverConn) readParentConnectResponse(r *Request, c *clientConn) error {
+	status, header, err := readConnectResponseHeader(sv.Conn)
+	if err != nil {
+		sv.Close()
+		return err
+	}
+	if status == "407" {
+		hc, ok := sv.Conn.(httpConn)
+		if ok && hc.parent.auth != nil && hc.parent.auth.challenged(proxyAuthenticate(header)) {
+			debug.Printf("cli(%s) parent %s requires authentication, retry CONNECT %s\n",
+				c.RemoteAddr(), hc.parent.server, r.URL.HostPort)
+			sv.Close()
+			return RetryError{errParentAuth}
+		}
+	}
+	if status != "200" {
+		errl.Printf("cli(%s) parent CONNECT %s status %s\n",
+			c.RemoteAddr(), r.URL.HostPort, status)
+		if c.tunnelEstablished {
+			sv.Close()
+			return errParentConnect
+		}
+		// Pass the response to client, body is copied with the tunnel.
+		if _, err = c.Write(header); err != nil {
+			sv.Close()
+			return err
+		}
+		r.state = rsRecvBody
+		sv.state = svSendRecvResponse
+		return nil
+	}
+	if !c.tunnelEstablished {
+		if err = sv.sendConnEstablished(c); err != nil {
+			sv.Close()
+			return err
+		}
+		c.tunnelEstablished = true
+	}
+	return nil
+}
+
 func (sv *serverConn) sendHTTPProxyRequestHeader(r *Request, c *clientConn) (err error) {
+	// Authorization header for parent http proxy
+	var authHeader []byte
+	if hc, ok := sv.Conn.(httpConn); ok && hc.parent.auth != nil {
+		if hc.parent.auth.ntlm {
+			if !*hc.ntlmDone {
+				if authHeader, err = hc.ntlmHandshake(r); err != nil {
+					return c.handleServerWriteError(r, sv, err,
+						"NTLM handshake with http parent")
+				}
+			}
+		} else {
+			uri := r.URL.HostPort
+			if !r.isConnect {
+				// Request-URI in the request line sent to parent.
+				if f := bytes.Fields(r.proxyRequestLine()); len(f) > 1 {
+					uri = string(f[1])
+				}
+			}
+			authHeader = hc.parent.auth.header(r.Method, uri)
+		}
+	}
 	if _, err = sv.Write(r.proxyRequestLine()); err != nil {
 		return c.handleServerWriteError(r, sv, err,
 			"send proxy request line to http parent")
 	}
-	if hc, ok := sv.Conn.(httpConn); ok && hc.parent.authHeader != nil {
-		// Add authorization header for parent http proxy
-		if _, err = sv.Write(hc.parent.authHeader); err != nil {
+	if authHeader != nil {
+		if _, err = sv.Write(authHeader); err != nil {
 			return c.handleServerWriteError(r, sv, err,
 				"send proxy authorization header to http parent")
 		}
@@ -1259,7 +1925,21 @@ func (sv *serverConn) sendRequestBody(r *Request, c *clientConn) (err error) {
 		return
 	}
 
-	err = sendBody(newServerWriter(r, sv), c.bufRd, int(r.ContLen), r.Chunking)
+	var w io.Writer = newServerWriter(r, sv)
+	if r.Chunking && config.MaxRequestBody > 0 {
+		// Chunk size lines are counted too, the overhead is small.
+		w = &bodyLimitWriter{w, config.MaxRequestBody}
+	}
+	if r.har != nil {
+		w = harBodyWriter{w, &r.har.reqBody}
+	}
+	err = sendBody(w, c.bufRd, int(r.ContLen), r.Chunking)
+	if err == errBodyTooLarge {
+		errl.Printf("cli(%s) request body exceeds maxRequestBody %s\n", c.RemoteAddr(), r)
+		sendErrorPage(c, statusBodyTooLarge, "Request body too large",
+			genErrMsg(r, nil, "Request body exceeds the size limit of the proxy."))
+		return errPageSent
+	}
 	if err != nil {
 		errl.Printf("cli(%s) send request body error %v %s\n", c.RemoteAddr(), err, r)
 		if isErrOpWrite(err) {
@@ -1276,12 +1956,20 @@ func (sv *serverConn) sendRequestBody(r *Request, c *clientConn) (err error) {
 // Do HTTP request other that CONNECT
 func (sv *serverConn) doRequest(c *clientConn, r *Request, rp *Response) (err error) {
 	r.state = rsCreated
+	if harEnabled() && r.har == nil && harMatch(r.URL.Host) {
+		// Entry is kept for retry as request body is not sent again.
+		r.har = newHAREntry(r)
+	}
 	if err = sv.sendRequestHeader(r, c); err != nil {
 		return
 	}
 	if err = sv.sendRequestBody(r, c); err != nil {
 		return
 	}
+	if r.har != nil {
+		r.har.requestSent(r)
+	}
+	sv.reqSent = time.Now()
 	r.state = rsSent
 	if err = c.readResponse(sv, r, rp); err == nil {
 		sv.updateVisit()
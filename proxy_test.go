@@ -1,4 +1,4 @@
-package main
+package cow
 
 import (
 	"bytes"
@@ -52,6 +52,19 @@ func TestSendBodyChunked(t *testing.T) {
 	}
 }
 
+func TestSendBodyChunkedLimit(t *testing.T) {
+	raw := "1a\r\nabcdefghijklmnopqrstuvwxyz\r\n10\r\n1234567890abcdef\r\n0\r\n\r\n"
+	r := bufio.NewReaderSize(strings.NewReader(raw), 64)
+	w := new(bytes.Buffer)
+	if err := sendBodyChunked(&bodyLimitWriter{w, int64(len(raw))}, r, 64); err != nil {
+		t.Error("body within limit should be sent, got error:", err)
+	}
+	r = bufio.NewReaderSize(strings.NewReader(raw), 64)
+	if err := sendBodyChunked(&bodyLimitWriter{w, 32}, r, 64); err != errBodyTooLarge {
+		t.Error("body exceeding limit should fail, got error:", err)
+	}
+}
+
 func TestInitSelfListenAddr(t *testing.T) {
 	listenProxy = []Proxy{newHttpProxy("0.0.0.0:7777", "")}
 	initSelfListenAddr()
@@ -0,0 +1,116 @@
+package cow
+
+// Transparent proxy for connections redirected with iptables (Linux only).
+//
+//   iptables -t nat -A PREROUTING -p tcp -d 198.18.0.0/15 -j REDIRECT --to-ports 7778
+//
+// The original destination is got with SO_ORIGINAL_DST, connections are
+// tunneled like CONNECT requests. Used with fakeDNS, destinations with fake
+// addresses are converted back to host names.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const soOriginalDst = 80
+
+type redirProxy struct {
+	addr string
+	ln   net.Listener
+}
+
+func newRedirProxy(addr string) Proxy {
+	return &redirProxy{addr: addr}
+}
+
+func (rp *redirProxy) genConfig() string {
+	return "listen = redir://" + rp.addr
+}
+
+func (rp *redirProxy) Addr() string {
+	return rp.addr
+}
+
+func (rp *redirProxy) listen() (err error) {
+	if rp.ln, err = net.Listen("tcp", rp.addr); err != nil {
+		fmt.Println("listen redir failed:", err)
+	}
+	return
+}
+
+// redirOrigDst returns the original destination of a connection redirected by
+// iptables.
+func redirOrigDst(conn net.Conn) (string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not tcp connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	// sockaddr_in fits in IPv6Mreq, which is the only 16 byte result
+	// supported by syscall package.
+	var mreq *syscall.IPv6Mreq
+	raw.Control(func(fd uintptr) {
+		mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+	})
+	if err != nil {
+		return "", fmt.Errorf("get original destination: %v", err)
+	}
+	sa := mreq.Multiaddr
+	ip := net.IPv4(sa[4], sa[5], sa[6], sa[7])
+	port := binary.BigEndian.Uint16(sa[2:4])
+	dst := net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	if dst == conn.LocalAddr().String() {
+		return "", errors.New("connection is not redirected")
+	}
+	return dst, nil
+}
+
+func (rp *redirProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer func() {
+		wg.Done()
+	}()
+	ln := rp.ln
+	if ln == nil {
+		return
+	}
+	info.Printf("COW %s redir transparent proxy address %s\n", version, rp.addr)
+	var exit bool
+	go func() {
+		<-quit
+		exit = true
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil && !exit {
+			errl.Printf("redir proxy(%s) accept %v\n", ln.Addr(), err)
+			if isErrTooManyOpenFd(err) {
+				connPool.CloseAll()
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if exit {
+			debug.Println("exiting redir listener")
+			break
+		}
+		dst, err := redirOrigDst(conn)
+		if err != nil {
+			errl.Printf("redir proxy cli(%s) %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		c := newClientConn(conn, rp)
+		go c.serveTransparent(dst)
+	}
+}
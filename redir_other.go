@@ -0,0 +1,8 @@
+// +build !linux
+
+package cow
+
+func newRedirProxy(addr string) Proxy {
+	Fatal("listen = redir:// is only supported on Linux")
+	return nil
+}
@@ -0,0 +1,197 @@
+package cow
+
+// Replay queue for requests failed because of parent proxy outage.
+//
+// If replayQueue is larger than 0, idempotent requests without body (GET,
+// HEAD, OPTIONS and DELETE) which fail because parent proxies can't be
+// connected are queued, and the client is told so in the error page. This
+// is meant for headless clients like webhook senders and RSS readers which
+// don't retry themselves.
+//
+// Every replayInterval, cow tries to send queued requests in order through
+// parent proxies, stopping at the first connection failure. Responses are
+// discarded, requests are removed from the queue once a response is
+// received. Requests older than replayMaxAge are dropped. The same request
+// is queued only once, new requests are dropped if the queue is full.
+//
+// The queue is saved in the replay file in the config directory, so queued
+// requests survive restart.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	replayFname    = "replay"
+	replayInterval = 30 * time.Second
+	replayMaxAge   = 24 * time.Hour
+)
+
+// Headers not saved in queued requests.
+var replaySkipHeader = map[string]bool{
+	"connection":          true,
+	"keep-alive":          true,
+	"proxy-authorization": true,
+	"proxy-connection":    true,
+}
+
+var replayMethod = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"DELETE":  true,
+}
+
+type replayEntry struct {
+	Method   string    `json:"method"`
+	HostPort string    `json:"host"`
+	Path     string    `json:"path"`
+	Header   string    `json:"header"`
+	Queued   time.Time `json:"queued"`
+}
+
+var replayQueue struct {
+	sync.Mutex
+	entry []*replayEntry
+}
+
+func replayFile() string {
+	return path.Join(config.dir, replayFname)
+}
+
+// queueReplay queues request r if it can be replayed, returns true if the
+// request is in the queue.
+func queueReplay(r *Request) bool {
+	if config.ReplayQueue <= 0 || r.isConnect || !replayMethod[r.Method] || r.hasBody() {
+		return false
+	}
+	e := &replayEntry{
+		Method:   r.Method,
+		HostPort: r.URL.HostPort,
+		Path:     r.URL.Path,
+		Header:   string(headerLines(r, replaySkipHeader)),
+		Queued:   time.Now(),
+	}
+	replayQueue.Lock()
+	defer replayQueue.Unlock()
+	for _, q := range replayQueue.entry {
+		if q.Method == e.Method && q.HostPort == e.HostPort && q.Path == e.Path {
+			return true
+		}
+	}
+	if len(replayQueue.entry) >= config.ReplayQueue {
+		errl.Printf("replay queue full, drop %s %s\n", r.Method, r.URL)
+		return false
+	}
+	replayQueue.entry = append(replayQueue.entry, e)
+	info.Printf("queued %s %s for replay, %d in queue\n", r.Method, r.URL, len(replayQueue.entry))
+	saveReplayQueue()
+	return true
+}
+
+// saveReplayQueue should be called with replayQueue locked.
+func saveReplayQueue() {
+	b, err := json.Marshal(replayQueue.entry)
+	if err != nil {
+		errl.Println("encode replay queue:", err)
+		return
+	}
+	if err = writeFileAtomic(replayFile(), b, false); err != nil {
+		errl.Println("save replay queue:", err)
+	}
+}
+
+// replay sends the request through parent proxies. Returns false if parent
+// proxies can't be connected.
+func (e *replayEntry) replay() bool {
+	url := &URL{Path: e.Path}
+	url.ParseHostPort(e.HostPort)
+	c, err := parentProxy.connect(url)
+	if err != nil {
+		debug.Printf("replay %s %s: %v\n", e.Method, url, err)
+		return false
+	}
+	defer c.Close()
+	uri, authHeader := requestURI(c, e.Method, url)
+	var b bytes.Buffer
+	b.WriteString(e.Method + " " + uri + " HTTP/1.1\r\n")
+	b.Write(authHeader)
+	b.WriteString(e.Header)
+	b.WriteString("Connection: close\r\n\r\n")
+	if _, err = c.Write(b.Bytes()); err != nil {
+		errl.Printf("replay %s %s: %v\n", e.Method, url, err)
+		return true
+	}
+	setConnReadTimeout(c, readTimeout, "replay")
+	resp, err := http.ReadResponse(bufio.NewReader(c), &http.Request{Method: e.Method})
+	if err != nil {
+		errl.Printf("replay %s %s: %v\n", e.Method, url, err)
+		return true
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	info.Printf("replayed %s %s queued at %s: %s\n", e.Method, url,
+		e.Queued.Format("2006-01-02 15:04:05"), resp.Status)
+	return true
+}
+
+// replayQueued replays requests in order until parent proxies can't be
+// connected.
+func replayQueued() {
+	for {
+		replayQueue.Lock()
+		var e *replayEntry
+		for len(replayQueue.entry) > 0 && e == nil {
+			e = replayQueue.entry[0]
+			if time.Now().Sub(e.Queued) > replayMaxAge {
+				errl.Printf("drop %s %s:%s from replay queue, queued at %s\n", e.Method, e.HostPort, e.Path,
+					e.Queued.Format("2006-01-02 15:04:05"))
+				replayQueue.entry = replayQueue.entry[1:]
+				saveReplayQueue()
+				e = nil
+			}
+		}
+		replayQueue.Unlock()
+		// Replay without lock, new requests may be queued meanwhile.
+		if e == nil || !e.replay() {
+			return
+		}
+		replayQueue.Lock()
+		if len(replayQueue.entry) > 0 && replayQueue.entry[0] == e {
+			replayQueue.entry = replayQueue.entry[1:]
+			saveReplayQueue()
+		}
+		replayQueue.Unlock()
+	}
+}
+
+func initReplay() {
+	if config.ReplayQueue <= 0 {
+		return
+	}
+	b, err := ioutil.ReadFile(replayFile())
+	if err == nil {
+		err = json.Unmarshal(b, &replayQueue.entry)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		errl.Println("load replay queue:", err)
+	}
+	if n := len(replayQueue.entry); n > 0 {
+		info.Printf("%d requests in replay queue\n", n)
+	}
+	go func() {
+		for {
+			time.Sleep(replayInterval)
+			replayQueued()
+		}
+	}()
+}
@@ -0,0 +1,67 @@
+package cow
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplayQueued(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Test"))
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "cow-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedDir, savedPool := config.dir, parentProxy
+	config.dir = dir
+	defer func() {
+		config.dir, parentProxy = savedDir, savedPool
+		replayQueue.entry = nil
+	}()
+
+	now := time.Now()
+	replayQueue.entry = []*replayEntry{
+		{"GET", "example.com:80", "/old", "", now.Add(-replayMaxAge - time.Minute)},
+		{"GET", "example.com:80", "/feed", "Host: example.com\r\nX-Test: 1\r\n", now},
+		{"DELETE", "example.com:80", "/hook", "Host: example.com\r\nX-Test: 2\r\n", now},
+	}
+
+	// Parent down, requests stay in queue.
+	pool := &backupParentPool{}
+	pool.add(newHttpParent("127.0.0.1:1"))
+	parentProxy = pool
+	replayQueued()
+	if len(replayQueue.entry) != 2 {
+		t.Fatalf("expired request should be dropped, %d in queue", len(replayQueue.entry))
+	}
+
+	pool = &backupParentPool{}
+	pool.add(newHttpParent(ts.Listener.Addr().String()))
+	parentProxy = pool
+	replayQueued()
+	if len(replayQueue.entry) != 0 {
+		t.Errorf("queue should be empty, %d in queue", len(replayQueue.entry))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 || got[0] != "GET /feed 1" || got[1] != "DELETE /hook 2" {
+		t.Errorf("wrong replayed requests %v", got)
+	}
+	b, err := ioutil.ReadFile(replayFile())
+	if err != nil || string(b) != "[]" {
+		t.Errorf("saved queue should be empty, got %q %v", b, err)
+	}
+}
@@ -0,0 +1,225 @@
+package cow
+
+// Routing rules on request attributes other than host.
+//
+// Each requestRule option has one or more conditions followed by the route:
+//
+//   requestRule = ua=*Dropbox* socks5://127.0.0.1:1080
+//   requestRule = port=7778 direct
+//   requestRule = asn=15169,36040 socks5://127.0.0.1:1081
+//
+// Conditions are:
+//
+//   ua=pattern             User-Agent header matches pattern
+//   header:name=pattern    request header matches pattern
+//   port=number            client connected to the listen port
+//   asn=number[,number]    destination address belongs to one of the ASNs
+//                          in asnFile
+//
+// Patterns are shell expressions like shExpMatch in PAC files, * matches
+// any string and ? any character. All conditions must match. Route is
+// direct, proxy (use parent proxies as usual), a parent proxy URL
+// http://host:port or socks5://host:port; configured parent with the same
+// address uses its settings like credentials, or name of a proxyGroup.
+//
+// Rules are checked in order before rule providers, the first matching rule
+// wins. asn conditions are checked after others as they may need DNS
+// lookup.
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type requestCond struct {
+	header  string // lower case header name, empty for port and asn
+	pattern string
+	asn     []uint32
+}
+
+type requestRule struct {
+	source string // option value
+	cond   []requestCond
+	route  routeType
+	entry  string // PAC style entry for parent proxy URL
+	parent ParentProxy
+	group  string // proxy group name
+}
+
+var requestRules []*requestRule
+
+// requestRuleParents maps parent proxy URL in rules to parent proxies.
+var requestRuleParents pacParents
+
+func parseRequestRule(val string) (*requestRule, error) {
+	f := strings.Fields(val)
+	if len(f) < 2 {
+		return nil, errors.New("should be conditions and route")
+	}
+	rr := &requestRule{source: val}
+	var err error
+	if rr.cond, err = parseRequestConds(f[:len(f)-1], true); err != nil {
+		return nil, err
+	}
+
+	route := f[len(f)-1]
+	switch {
+	case route == "direct":
+		rr.route = routeDirect
+	case route == "proxy":
+		rr.route = routeProxy
+	case strings.HasPrefix(route, "http://"):
+		rr.entry = "PROXY " + route[len("http://"):]
+	case strings.HasPrefix(route, "socks5://"):
+		rr.entry = "SOCKS " + route[len("socks5://"):]
+	case !strings.Contains(route, "://"):
+		rr.group = route
+		rr.route = routeProxy
+	default:
+		return nil, errors.New("route should be direct, proxy, parent proxy URL or proxy group, got " + route)
+	}
+	if rr.entry != "" {
+		if err := checkServerAddr(strings.Fields(rr.entry)[1]); err != nil {
+			return nil, err
+		}
+		rr.route = routeProxy
+	}
+	return rr, nil
+}
+
+// parseRequestConds parses conditions, asn conditions are put last.
+func parseRequestConds(f []string, asnAllowed bool) (cond []requestCond, err error) {
+	var asnCond []requestCond
+	for _, s := range f {
+		id := strings.IndexByte(s, '=')
+		if id <= 0 {
+			return nil, errors.New("invalid condition " + s)
+		}
+		name, pattern := strings.ToLower(s[:id]), s[id+1:]
+		switch {
+		case name == "ua":
+			cond = append(cond, requestCond{header: "user-agent", pattern: pattern})
+		case name == "port":
+			if _, err := strconv.Atoi(pattern); err != nil {
+				return nil, errors.New("invalid port " + pattern)
+			}
+			cond = append(cond, requestCond{pattern: pattern})
+		case name == "asn" && asnAllowed:
+			c := requestCond{pattern: pattern}
+			for _, s := range strings.Split(pattern, ",") {
+				asn, err := parseASN(s)
+				if err != nil {
+					return nil, err
+				}
+				c.asn = append(c.asn, asn)
+			}
+			asnCond = append(asnCond, c)
+		case strings.HasPrefix(name, "header:") && len(name) > len("header:"):
+			cond = append(cond, requestCond{header: name[len("header:"):], pattern: pattern})
+		default:
+			return nil, errors.New("unknown condition " + s)
+		}
+	}
+	return append(cond, asnCond...), nil
+}
+
+func initRequestRule() {
+	if len(requestRules) == 0 {
+		return
+	}
+	requestRuleParents.initParents()
+	asnUsed := make(map[uint32]bool)
+	for _, rr := range requestRules {
+		for _, c := range rr.cond {
+			for _, asn := range c.asn {
+				asnUsed[asn] = true
+			}
+		}
+		if rr.group != "" {
+			if _, err := findProxyGroup(rr.group); err != nil {
+				Fatal("requestRule", rr.source+":", err)
+			}
+		}
+		if rr.entry == "" {
+			continue
+		}
+		p, err := requestRuleParents.getParent(rr.entry)
+		if err != nil {
+			Fatal("requestRule", rr.source+":", err)
+		}
+		rr.parent = p
+	}
+	if len(asnUsed) > 0 {
+		initASN(asnUsed)
+	}
+}
+
+// headerValue returns value of the first header with name, case insensitive.
+func (r *Request) headerValue(name string) string {
+	for _, line := range bytes.Split(r.raw.Bytes()[r.headStart:r.bodyStart], []byte("\n")) {
+		cid := bytes.IndexByte(line, ':')
+		if cid <= 0 {
+			continue
+		}
+		if strings.EqualFold(strings.TrimSpace(string(line[:cid])), name) {
+			return strings.TrimSpace(string(line[cid+1:]))
+		}
+	}
+	return ""
+}
+
+func (rr *requestRule) match(r *Request, port string) bool {
+	return matchRequestConds(rr.cond, r, port)
+}
+
+func matchRequestConds(cond []requestCond, r *Request, port string) bool {
+	for _, c := range cond {
+		switch {
+		case c.asn != nil:
+			if !hostASNMatch(r.URL.Host, c.asn) {
+				return false
+			}
+		case c.header == "":
+			if port != c.pattern {
+				return false
+			}
+		default:
+			if !shExpMatch(r.headerValue(c.header), c.pattern) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchRequestRule returns the first rule matching the request from client
+// connected to the listen port.
+func matchRequestRule(r *Request, port string) *requestRule {
+	for _, rr := range requestRules {
+		if rr.match(r, port) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// routeRequestRule sets route of the request according to request rules.
+// Returns false if no rule matches.
+func (c *clientConn) routeRequestRule(r *Request) bool {
+	_, port, _ := net.SplitHostPort(c.LocalAddr().String())
+	rr := matchRequestRule(r, port)
+	if rr == nil {
+		return false
+	}
+	r.route = rr.route
+	if rr.parent != nil {
+		r.pacRoute = []ParentProxy{rr.parent}
+	} else if rr.group != "" {
+		r.routeGroup(proxyGroups[rr.group])
+	}
+	r.routeRule = "request " + rr.source
+	return true
+}
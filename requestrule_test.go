@@ -0,0 +1,71 @@
+package cow
+
+import (
+	"testing"
+)
+
+func TestParseRequestRule(t *testing.T) {
+	testData := []struct {
+		val   string
+		ncond int
+		route routeType
+		entry string
+	}{
+		{"ua=*Dropbox* socks5://127.0.0.1:1080", 1, routeProxy, "SOCKS 127.0.0.1:1080"},
+		{"port=7778 direct", 1, routeDirect, ""},
+		{"header:X-App=foo* port=7778 proxy", 2, routeProxy, ""},
+		{"asn=AS15169,36040 port=7778 direct", 2, routeDirect, ""},
+	}
+	for _, td := range testData {
+		rr, err := parseRequestRule(td.val)
+		if err != nil {
+			t.Errorf("%s: %v", td.val, err)
+			continue
+		}
+		if len(rr.cond) != td.ncond || rr.route != td.route || rr.entry != td.entry {
+			t.Errorf("%s parsed wrong: %+v", td.val, rr)
+		}
+	}
+	for _, val := range []string{"direct", "port=abc direct", "ua=* https://1.2.3.4:8080",
+		"host=a direct", "ua=* http://1.2.3.4", "asn=google direct"} {
+		if _, err := parseRequestRule(val); err == nil {
+			t.Errorf("%s should fail", val)
+		}
+	}
+}
+
+func TestMatchRequestRule(t *testing.T) {
+	old := requestRules
+	defer func() { requestRules = old }()
+	requestRules = nil
+	for _, val := range []string{"header:x-app=beta port=7778 proxy", "ua=*Dropbox* direct", "port=7778 direct"} {
+		rr, _ := parseRequestRule(val)
+		requestRules = append(requestRules, rr)
+	}
+
+	var r Request
+	r.reset()
+	r.Method = "GET"
+	r.URL, _ = ParseRequestURI("http://www.example.com/")
+	r.genRequestLine()
+	r.headStart = r.raw.Len()
+	r.raw.WriteString("Host: www.example.com\r\nUser-Agent: DropboxDesktopClient/1.0\r\nX-App: beta\r\n" +
+		fullHeaderConnectionKeepAlive + CRLF)
+	r.bodyStart = r.raw.Len()
+
+	if v := r.headerValue("user-agent"); v != "DropboxDesktopClient/1.0" {
+		t.Error("wrong User-Agent:", v)
+	}
+	testData := []struct {
+		port string
+		rule int
+	}{
+		{"7778", 0},
+		{"7777", 1},
+	}
+	for _, td := range testData {
+		if rr := matchRequestRule(&r, td.port); rr != requestRules[td.rule] {
+			t.Errorf("port %s should match rule %d, got %v", td.port, td.rule, rr)
+		}
+	}
+}
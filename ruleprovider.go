@@ -0,0 +1,282 @@
+package cow
+
+// Clash compatible rule providers.
+//
+// A rule provider is a rule set (Clash rule-providers payload in YAML, or
+// plain text with one rule per line) loaded from file or URL. Requests
+// matching a rule set are connected directly, through parent proxy or a
+// proxyGroup as specified in config, taking precedence over site stat.
+//
+// Supported rules for classical behavior: DOMAIN, DOMAIN-SUFFIX,
+// DOMAIN-KEYWORD, IP-CIDR and IP-CIDR6. IP rules only match requests using
+// IP address, host names are not resolved. GEOIP and other rules are
+// skipped as cow has no GeoIP database.
+//
+// Rule sets from URL are saved in the config directory, so they are
+// available at start up even if download fails.
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRuleProviderInterval = 24 * time.Hour
+
+type ruleSet struct {
+	host      map[string]bool // exact match
+	suffix    map[string]bool // domain and its sub domains
+	subdomain map[string]bool // sub domains only
+	keyword   []string
+	ipNet     []*net.IPNet
+	skipped   int // number of unsupported rules
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{
+		host:      make(map[string]bool),
+		suffix:    make(map[string]bool),
+		subdomain: make(map[string]bool),
+	}
+}
+
+func (rs *ruleSet) size() int {
+	return len(rs.host) + len(rs.suffix) + len(rs.subdomain) + len(rs.keyword) + len(rs.ipNet)
+}
+
+func (rs *ruleSet) addDomain(d string) {
+	switch {
+	case strings.HasPrefix(d, "+."):
+		rs.suffix[d[2:]] = true
+	case strings.HasPrefix(d, "*."):
+		// Clash matches only one level, treat as all sub domains.
+		rs.subdomain[d[2:]] = true
+	case strings.HasPrefix(d, "."):
+		rs.subdomain[d[1:]] = true
+	default:
+		rs.host[d] = true
+	}
+}
+
+func (rs *ruleSet) addCIDR(s string) {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		rs.skipped++
+		return
+	}
+	rs.ipNet = append(rs.ipNet, ipNet)
+}
+
+func (rs *ruleSet) addClassical(line string) {
+	f := strings.Split(line, ",")
+	if len(f) < 2 {
+		rs.skipped++
+		return
+	}
+	val := strings.ToLower(strings.TrimSpace(f[1]))
+	switch strings.ToUpper(strings.TrimSpace(f[0])) {
+	case "DOMAIN":
+		rs.host[val] = true
+	case "DOMAIN-SUFFIX":
+		rs.suffix[val] = true
+	case "DOMAIN-KEYWORD":
+		rs.keyword = append(rs.keyword, val)
+	case "IP-CIDR", "IP-CIDR6":
+		rs.addCIDR(val)
+	default:
+		rs.skipped++
+	}
+}
+
+// ruleLines returns rules in payload list of Clash rule provider YAML, or
+// each line if it's not YAML.
+func ruleLines(content []byte) []string {
+	var lines []string
+	var inPayload, isYAML bool
+	for _, l := range bytes.Split(content, []byte("\n")) {
+		line := strings.TrimSpace(string(l))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line == "payload:" {
+			inPayload, isYAML = true, true
+			continue
+		}
+		if isYAML {
+			if !inPayload || !strings.HasPrefix(line, "-") {
+				inPayload = false
+				continue
+			}
+			line = strings.TrimSpace(line[1:])
+			line = strings.Trim(line, `'"`)
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func parseRuleSet(content []byte, behavior string) *ruleSet {
+	rs := newRuleSet()
+	for _, line := range ruleLines(content) {
+		switch behavior {
+		case "domain":
+			rs.addDomain(strings.ToLower(line))
+		case "ipcidr":
+			rs.addCIDR(line)
+		default:
+			rs.addClassical(line)
+		}
+	}
+	return rs
+}
+
+func (rs *ruleSet) match(url *URL) bool {
+	if ip := net.ParseIP(url.Host); ip != nil {
+		for _, n := range rs.ipNet {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host := strings.ToLower(url.Host)
+	if rs.host[host] || rs.suffix[host] {
+		return true
+	}
+	for s := host; ; {
+		id := strings.IndexByte(s, '.')
+		if id == -1 {
+			break
+		}
+		s = s[id+1:]
+		if rs.suffix[s] || rs.subdomain[s] {
+			return true
+		}
+	}
+	for _, k := range rs.keyword {
+		if strings.Contains(host, k) {
+			return true
+		}
+	}
+	return false
+}
+
+type ruleProvider struct {
+	route    routeType
+	group    string // proxy group name
+	behavior string
+	source   string // URL or file path
+	interval time.Duration
+
+	sync.RWMutex
+	rules *ruleSet
+}
+
+var ruleProviders []*ruleProvider
+
+func (rp *ruleProvider) isURL() bool {
+	return strings.HasPrefix(rp.source, "http://") || strings.HasPrefix(rp.source, "https://")
+}
+
+// cacheFile is where rule set downloaded from URL is saved.
+func (rp *ruleProvider) cacheFile() string {
+	return path.Join(config.dir, "provider-"+md5sum(rp.source)[:8]+".yaml")
+}
+
+func (rp *ruleProvider) fetch() (content []byte, err error) {
+	if !rp.isURL() {
+		return ioutil.ReadFile(rp.source)
+	}
+	if content, err = httpGet(rp.source); err != nil {
+		return
+	}
+	if len(ruleLines(content)) == 0 {
+		return nil, errors.New("no rule found in " + rp.source)
+	}
+	if err := writeFileAtomic(rp.cacheFile(), content, false); err != nil {
+		errl.Println("save rule provider:", err)
+	}
+	return
+}
+
+func (rp *ruleProvider) load(content []byte) {
+	rs := parseRuleSet(content, rp.behavior)
+	rp.Lock()
+	rp.rules = rs
+	rp.Unlock()
+	if rs.skipped > 0 {
+		info.Printf("rule provider %s: %d rules loaded, %d unsupported rules skipped\n",
+			rp.source, rs.size(), rs.skipped)
+	} else {
+		info.Printf("rule provider %s: %d rules loaded\n", rp.source, rs.size())
+	}
+}
+
+func (rp *ruleProvider) match(url *URL) bool {
+	rp.RLock()
+	rs := rp.rules
+	rp.RUnlock()
+	return rs != nil && rs.match(url)
+}
+
+func (rp *ruleProvider) refresh() {
+	for {
+		time.Sleep(rp.interval)
+		content, err := rp.fetch()
+		if err != nil {
+			errl.Printf("refresh rule provider %s: %v\n", rp.source, err)
+			continue
+		}
+		rp.load(content)
+	}
+}
+
+func initRuleProvider() {
+	for _, rp := range ruleProviders {
+		if rp.group != "" {
+			if _, err := findProxyGroup(rp.group); err != nil {
+				Fatal("ruleProvider", rp.source+":", err)
+			}
+		}
+		var content []byte
+		var err error
+		if rp.isURL() {
+			// Use saved copy first, download in background.
+			if content, err = ioutil.ReadFile(rp.cacheFile()); err == nil {
+				rp.load(content)
+			}
+			go func(rp *ruleProvider) {
+				if content, err := rp.fetch(); err != nil {
+					errl.Printf("download rule provider %s: %v\n", rp.source, err)
+				} else {
+					rp.load(content)
+				}
+				rp.refresh()
+			}(rp)
+			continue
+		}
+		if content, err = rp.fetch(); err != nil {
+			Fatal("load rule provider:", err)
+		}
+		rp.load(content)
+		go rp.refresh()
+	}
+}
+
+// matchRuleProvider returns the first rule provider matching url, nil if
+// none matches.
+func matchRuleProvider(url *URL) *ruleProvider {
+	for _, rp := range ruleProviders {
+		if rp.match(url) {
+			return rp
+		}
+	}
+	return nil
+}
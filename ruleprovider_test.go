@@ -0,0 +1,73 @@
+package cow
+
+import (
+	"testing"
+)
+
+func TestRuleSetMatch(t *testing.T) {
+	classical := []byte(`payload:
+  - DOMAIN,exact.example.com
+  - 'DOMAIN-SUFFIX,google.com'
+  - "DOMAIN-KEYWORD,facebook"
+  - IP-CIDR,91.108.4.0/22,no-resolve
+  - GEOIP,CN
+other:
+  - DOMAIN,ignored.com
+`)
+	rs := parseRuleSet(classical, "classical")
+	if rs.skipped != 1 {
+		t.Error("GEOIP rule should be skipped, skipped", rs.skipped)
+	}
+	domain := parseRuleSet([]byte("# comment\n+.twitter.com\n.twimg.com\nt.co\n"), "domain")
+
+	testData := []struct {
+		rs    *ruleSet
+		url   string
+		match bool
+	}{
+		{rs, "exact.example.com", true},
+		{rs, "sub.exact.example.com", false},
+		{rs, "google.com", true},
+		{rs, "www.google.com", true},
+		{rs, "notgoogle.com", false},
+		{rs, "www.facebook.net", true},
+		{rs, "91.108.5.1", true},
+		{rs, "91.108.8.1", false},
+		{rs, "ignored.com", false},
+		{domain, "twitter.com", true},
+		{domain, "api.twitter.com", true},
+		{domain, "twimg.com", false},
+		{domain, "pbs.twimg.com", true},
+		{domain, "t.co", true},
+		{domain, "x.t.co", false},
+	}
+	for _, td := range testData {
+		url := &URL{}
+		url.ParseHostPort(td.url)
+		if rs := td.rs; rs.match(url) != td.match {
+			t.Errorf("%s should match %v\n", td.url, td.match)
+		}
+	}
+}
+
+func TestRuleSetEntries(t *testing.T) {
+	rs := parseRuleSet([]byte(`payload:
+  - DOMAIN,b.example.com
+  - DOMAIN,a.example.com
+  - DOMAIN-SUFFIX,google.com
+  - DOMAIN-KEYWORD,facebook
+  - IP-CIDR,91.108.4.0/22
+`), "classical")
+	rs.addDomain(".twimg.com")
+	want := []string{"a.example.com", "b.example.com", "+.google.com", ".twimg.com",
+		"keyword:facebook", "91.108.4.0/22"}
+	got := rs.entries()
+	if len(got) != len(want) {
+		t.Fatalf("entries got %v, should be %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d got %s, should be %s", i, got[i], want[i])
+		}
+	}
+}
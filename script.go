@@ -0,0 +1,229 @@
+package cow
+
+// Routing and rewriting hooks written in JavaScript.
+//
+// If scriptFile is set, the script is loaded at start up with the restricted
+// JavaScript evaluator used for PAC files, and may define these functions,
+// all optional:
+//
+//   onRequest(req)          after the request is received, returns an
+//                           action like the helper program: OK, DIRECT,
+//                           PROXY, REWRITE url, REDIRECT url or DENY.
+//                           Headers changed in req.headers are sent to the
+//                           web server.
+//   routeRequest(req)       when choosing route, returns DIRECT, PROXY (use
+//                           configured parent proxies) or PAC style result
+//                           like "PROXY host:port; SOCKS5 host:port; DIRECT".
+//                           Other values leave the decision to cow.
+//   onResponse(req, resp)   after response header is received, return value
+//                           is ignored.
+//
+// req has method, url, host, port, path, client, user and headers; resp has
+// status and headers. Header names are in lower case, hop-by-hop headers are
+// not included. PAC helper functions and log(msg) are available.
+//
+// Script errors are logged and the request is processed as if the hook is
+// not defined.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type scriptHooks struct {
+	ps           *pacScript
+	onRequest    interface{}
+	routeRequest interface{}
+	onResponse   interface{}
+
+	pacParents
+}
+
+var script *scriptHooks
+
+func loadScriptHooks(src string) (*scriptHooks, error) {
+	ps, err := loadJSScript(src, map[string]interface{}{
+		"log": jsBuiltin(func(a []interface{}) interface{} {
+			info.Println("script:", jsString(jsArg(a, 0)))
+			return undefined
+		}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sh := &scriptHooks{
+		ps:           ps,
+		onRequest:    ps.function("onRequest"),
+		routeRequest: ps.function("routeRequest"),
+		onResponse:   ps.function("onResponse"),
+	}
+	sh.initParents()
+	return sh, nil
+}
+
+func initScript() {
+	if config.ScriptFile == "" {
+		return
+	}
+	src, err := ioutil.ReadFile(expandTilde(config.ScriptFile))
+	if err != nil {
+		Fatal("read script file:", err)
+	}
+	if script, err = loadScriptHooks(string(src)); err != nil {
+		Fatal("load script file:", err)
+	}
+	info.Println("script loaded from", config.ScriptFile)
+}
+
+// headerObject converts header lines to object with lower case names.
+// Repeated headers are joined with ", ".
+func headerObject(lines []byte) *jsObject {
+	o := newJSObject()
+	for _, line := range bytes.Split(lines, []byte("\n")) {
+		cid := bytes.IndexByte(line, ':')
+		if cid <= 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(string(line[:cid])))
+		if hopByHopHeader[name] {
+			continue
+		}
+		val := strings.TrimSpace(string(line[cid+1:]))
+		if old, ok := o.prop[name]; ok {
+			val = jsString(old) + ", " + val
+		}
+		o.set(name, val)
+	}
+	return o
+}
+
+func newScriptRequest(r *Request, client, user string) *jsObject {
+	url := r.URL.HostPort
+	if !r.isConnect {
+		url = "http://" + r.URL.HostPort + r.URL.Path
+	}
+	o := newJSObject()
+	o.set("method", r.Method)
+	o.set("url", url)
+	o.set("host", r.URL.Host)
+	o.set("port", r.URL.Port)
+	o.set("path", r.URL.Path)
+	o.set("client", client)
+	o.set("user", user)
+	// Buffer is released if request body is too large.
+	var lines []byte
+	if r.raw != nil {
+		lines = r.raw.Bytes()[r.headStart:r.bodyStart]
+	}
+	o.set("headers", headerObject(lines))
+	return o
+}
+
+func (c *clientConn) scriptRequest(r *Request) *jsObject {
+	clientIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	return newScriptRequest(r, clientIP, c.user)
+}
+
+// applyHeaderObject replaces request header with headers in o. Content
+// length is kept as the body is not changed.
+func (r *Request) applyHeaderObject(o *jsObject) {
+	buf := new(bytes.Buffer)
+	for _, name := range o.keys {
+		v := o.prop[name]
+		if v == nil || v == undefined || hopByHopHeader[name] || name == headerContentLength {
+			continue
+		}
+		fmt.Fprintf(buf, "%s: %s\r\n", name, jsString(v))
+	}
+	if !r.Chunking && r.ContLen > 0 {
+		buf.WriteString("Content-Length: " + strconv.FormatInt(r.ContLen, 10) + CRLF)
+	}
+	r.replaceHeader(buf.Bytes())
+}
+
+func (sh *scriptHooks) call(fn interface{}, r *Request, args ...interface{}) (interface{}, bool) {
+	res, err := sh.ps.callFunc(fn, args...)
+	if err != nil {
+		errl.Printf("script for %v: %v\n", r, err)
+		return nil, false
+	}
+	return res, true
+}
+
+// applyScript calls onRequest in the script. Returns errPageSent if response
+// is sent to the client.
+func (c *clientConn) applyScript(r *Request) error {
+	if script.onRequest == nil {
+		return nil
+	}
+	req := c.scriptRequest(r)
+	orig := req.prop["headers"]
+	res, ok := script.call(script.onRequest, r, req)
+	if !ok {
+		return nil
+	}
+	// req.headers may be changed or replaced by another object.
+	if hdr, ok := req.prop["headers"].(*jsObject); ok && (hdr != orig || hdr.modified) && !r.isConnect {
+		debug.Printf("cli(%s) script modified header %v\n", c.RemoteAddr(), r)
+		r.applyHeaderObject(hdr)
+	}
+	if res == undefined || res == nil {
+		return nil
+	}
+	return c.applyAction(r, jsString(res), "script")
+}
+
+// routeScript sets route of the request according to routeRequest in the
+// script.
+func (c *clientConn) routeScript(r *Request) {
+	if script.routeRequest == nil {
+		return
+	}
+	res, ok := script.call(script.routeRequest, r, c.scriptRequest(r))
+	if !ok || res == undefined || res == nil {
+		return
+	}
+	s := strings.TrimSpace(jsString(res))
+	switch strings.ToUpper(s) {
+	case "":
+		return
+	case "DIRECT":
+		r.route = routeDirect
+	case "PROXY":
+		r.route = routeProxy
+	default:
+		route, err := script.parseRoute(s, r)
+		if err != nil {
+			errl.Printf("script route for %v: %v\n", r, err)
+			return
+		}
+		r.pacRoute = route
+		if route[0] == nil {
+			r.route = routeDirect
+		} else {
+			r.route = routeProxy
+		}
+	}
+	r.routeRule = "script"
+	debug.Printf("cli(%s) script route %s for %v\n", c.RemoteAddr(), s, r)
+}
+
+// scriptResponse calls onResponse in the script.
+func (c *clientConn) scriptResponse(r *Request, rp *Response) {
+	if script.onResponse == nil {
+		return
+	}
+	var lines []byte
+	raw := rp.raw.Bytes()
+	if id := bytes.IndexByte(raw, '\n'); id != -1 {
+		lines = raw[id+1:]
+	}
+	resp := newJSObject()
+	resp.set("status", float64(rp.Status))
+	resp.set("headers", headerObject(lines))
+	script.call(script.onResponse, r, c.scriptRequest(r), resp)
+}
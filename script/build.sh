@@ -5,6 +5,19 @@ cd "$( dirname "${BASH_SOURCE[0]}" )/.."
 version=`grep '^version=' ./install-cow.sh | sed -s 's/version=//'`
 echo "creating cow binary version $version"
 
+# Public key (base64 encoded DER) used by "cow update" to verify release
+# binaries. Signing is skipped if private key is not given.
+if [[ -n $COW_SIGN_KEY ]]; then
+    pubkey=`openssl ec -in $COW_SIGN_KEY -pubout -outform DER 2>/dev/null | base64 | tr -d '\n'`
+    ldflags="-ldflags \"-X github.com/cyfdecyf/cow.updatePubKey=$pubkey\""
+fi
+
+sign() {
+    if [[ -n $COW_SIGN_KEY ]]; then
+        openssl dgst -sha256 -sign $COW_SIGN_KEY -out $1.sig $1 || exit 1
+    fi
+}
+
 mkdir -p bin
 build() {
     local name
@@ -31,8 +44,8 @@ build() {
 
     name=cow-$arch-$version
     echo "building $name"
-    echo $cgo $goos $goarch $goarm go build
-    eval $cgo $goos $goarch $goarm go build || exit 1
+    echo $cgo $goos $goarch $goarm go build ./cmd/cow
+    eval $cgo $goos $goarch $goarm go build $ldflags ./cmd/cow || exit 1
     if [[ $1 == "windows" ]]; then
         mv cow.exe script
         pushd script
@@ -41,9 +54,11 @@ build() {
         rm -f cow.exe rc.txt
         mv $name.zip ../bin/
         popd
+        sign bin/$name.zip
     else
         mv cow bin/$name
         gzip -f bin/$name
+        sign bin/$name.gz
     fi
 }
 
@@ -54,5 +69,6 @@ build linux 386 linux32
 build linux arm linux-armv5tel
 build linux arm linux-armv6l
 build linux arm linux-armv7l
+build linux mipsle linux-mipsle
 build windows amd64 win64
 build windows 386 win32
@@ -2,7 +2,7 @@
 
 cd "$( dirname "${BASH_SOURCE[0]}" )/.."
 
-if ! go build; then
+if ! go build ./cmd/cow; then
     echo "build failed"
     exit 1
 fi
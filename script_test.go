@@ -0,0 +1,71 @@
+package cow
+
+import (
+	"testing"
+)
+
+func TestScriptHooks(t *testing.T) {
+	src := `
+function onRequest(req) {
+	if (req.host == "ads.example.com")
+		return "DENY";
+	if (req.headers["x-strip"]) {
+		req.headers["x-strip"] = null;
+		req.headers["x-user"] = req.user;
+	}
+}
+function routeRequest(req) {
+	if (dnsDomainIs(req.host, ".example.org"))
+		return "SOCKS5 127.0.0.1:1080; DIRECT";
+	return req.client == "10.0.0.1" ? "direct" : undefined;
+}
+`
+	sh, err := loadScriptHooks(src)
+	if err != nil {
+		t.Fatal("load script:", err)
+	}
+	if sh.onRequest == nil || sh.routeRequest == nil || sh.onResponse != nil {
+		t.Error("hooks not found correctly")
+	}
+
+	var r Request
+	r.reset()
+	r.Method = "POST"
+	r.URL, _ = ParseRequestURI("http://www.example.com/a")
+	r.ContLen = 3
+	r.ConnectionKeepAlive = true
+	r.genRequestLine()
+	r.headStart = r.raw.Len()
+	r.raw.WriteString("Host: www.example.com\r\nX-Strip: 1\r\nContent-Length: 3\r\n" +
+		fullHeaderConnectionKeepAlive + CRLF)
+	r.bodyStart = r.raw.Len()
+
+	req := newScriptRequest(&r, "127.0.0.1", "alice")
+	hdr := req.prop["headers"].(*jsObject)
+	if hdr.prop["x-strip"] != "1" || hdr.prop["connection"] != nil {
+		t.Error("wrong headers:", hdr.prop)
+	}
+	if res, err := sh.ps.callFunc(sh.onRequest, req); err != nil || res != undefined {
+		t.Error("onRequest should return undefined, got", res, err)
+	}
+	if !hdr.modified {
+		t.Fatal("headers should be modified")
+	}
+	r.applyHeaderObject(hdr)
+	expected := "POST /a HTTP/1.1\r\nhost: www.example.com\r\nx-user: alice\r\nContent-Length: 3\r\n" +
+		fullHeaderConnectionKeepAlive + CRLF
+	if string(r.rawRequest()) != expected {
+		t.Errorf("request should be\n%q\ngot\n%q\n", expected, r.rawRequest())
+	}
+
+	r.URL, _ = ParseRequestURI("http://www.example.org/")
+	res, _ := sh.ps.callFunc(sh.routeRequest, newScriptRequest(&r, "127.0.0.1", ""))
+	route, err := sh.parseRoute(jsString(res), &r)
+	if err != nil || len(route) != 2 || route[1] != nil {
+		t.Error("wrong route:", route, err)
+	}
+	r.URL, _ = ParseRequestURI("http://www.example.net/")
+	if res, _ := sh.ps.callFunc(sh.routeRequest, newScriptRequest(&r, "10.0.0.1", "")); res != "direct" {
+		t.Error("routeRequest should return direct, got", res)
+	}
+}
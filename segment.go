@@ -0,0 +1,373 @@
+package cow
+
+// Segmented downloads.
+//
+// If segmentDownload is larger than 1, plain HTTP GET responses with body
+// larger than segmentMinSize are fetched in ranges of segmentPieceSize by that
+// many connections in parallel, and written to the client in order. For
+// requests going through parent proxies, connections are spread over all
+// parent proxies, aggregating bandwidth of several slow links. Direct
+// requests use direct connections.
+//
+// The first piece is read from the original response, whose server
+// connection is closed afterwards. Only responses with "Accept-Ranges: bytes"
+// and a validator (strong ETag or Last-Modified) are segmented. Range
+// requests carry If-Range, so the download fails instead of mixing contents
+// if the file is changed. As response header has been sent to the client,
+// failure closes the client connection like other errors reading response
+// body.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSegmentMinSize = 16 * 1024 * 1024
+	segmentPieceSize      = 1024 * 1024
+	// Pieces fetched or buffered ahead of the client for each connection.
+	segmentWindow = 2
+	// Tries for each piece, on a new connection with the next route.
+	segmentMaxTry = 3
+)
+
+type segmentDownload struct {
+	url     *URL
+	header  []byte // end-to-end request headers
+	ifRange string
+	size    int64
+	direct  bool
+	parent  []ParentProxy
+}
+
+type segmentConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+type segmentResult struct {
+	data []byte
+	err  error
+}
+
+// segmentWorkers tracks connections of workers, so workers can be stopped
+// when the download ends.
+type segmentWorkers struct {
+	wg   sync.WaitGroup
+	done chan struct{}
+
+	lock sync.Mutex
+	conn map[*segmentConn]bool
+}
+
+func newSegmentWorkers() *segmentWorkers {
+	return &segmentWorkers{done: make(chan struct{}), conn: make(map[*segmentConn]bool)}
+}
+
+func (sw *segmentWorkers) stopped() bool {
+	select {
+	case <-sw.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// add tracks connection in use, returns false if workers are stopped.
+func (sw *segmentWorkers) add(sc *segmentConn) bool {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	if sw.stopped() {
+		return false
+	}
+	sw.conn[sc] = true
+	return true
+}
+
+func (sw *segmentWorkers) remove(sc *segmentConn) {
+	sw.lock.Lock()
+	delete(sw.conn, sc)
+	sw.lock.Unlock()
+}
+
+// stop closes connections in use to interrupt workers and waits for them to
+// exit.
+func (sw *segmentWorkers) stop() {
+	sw.lock.Lock()
+	close(sw.done)
+	for sc := range sw.conn {
+		sc.Close()
+	}
+	sw.lock.Unlock()
+	sw.wg.Wait()
+}
+
+// Headers not copied to range requests.
+var segmentSkipHeader = map[string]bool{
+	"connection":          true,
+	"keep-alive":          true,
+	"proxy-authorization": true,
+	"proxy-connection":    true,
+	"range":               true,
+	"if-range":            true,
+}
+
+// newSegmentDownload returns nil if the response should not be segmented.
+// Must be called before request and response buffers are released.
+func newSegmentDownload(sv *serverConn, r *Request, rp *Response) *segmentDownload {
+	if config.SegmentDownload < 2 || rp.ContLen < config.SegmentMinSize {
+		return nil
+	}
+	return newRangeDownload(sv, r, rp)
+}
+
+// newRangeDownload returns nil if the response body can't be fetched with
+// range requests. Must be called before request and response buffers are
+// released.
+func newRangeDownload(sv *serverConn, r *Request, rp *Response) *segmentDownload {
+	if r.Method != "GET" || r.hasBody() || rp.Status != 200 || rp.Chunking || rp.ContLen <= 0 {
+		return nil
+	}
+	raw := rp.rawResponse()
+	h := parseRawHeader(raw[bytes.IndexByte(raw, '\n')+1:])
+	if !strings.EqualFold(h["accept-ranges"], "bytes") {
+		return nil
+	}
+	// Pieces may still be fetched after the request is done.
+	url := *r.URL
+	sd := &segmentDownload{url: &url, size: rp.ContLen}
+	if etag := h["etag"]; etag != "" && !strings.HasPrefix(etag, "W/") {
+		sd.ifRange = etag
+	} else if lm := h["last-modified"]; lm != "" {
+		sd.ifRange = lm
+	} else {
+		return nil
+	}
+
+	if _, ok := parseRawHeader(r.raw.Bytes()[r.headStart:r.bodyStart])["range"]; ok {
+		return nil
+	}
+	sd.header = headerLines(r, segmentSkipHeader)
+
+	if sv.isDirect() {
+		sd.direct = true
+		return sd
+	}
+	if sd.parent = rangeParents(r); len(sd.parent) == 0 {
+		return nil
+	}
+	return sd
+}
+
+// rangeParents returns parent proxies usable for range requests of r.
+func rangeParents(r *Request) (parent []ParentProxy) {
+	route := r.pacRoute
+	if route == nil {
+		route = allParents()
+	}
+	for _, p := range route {
+		if p == nil {
+			continue
+		}
+		// NTLM needs handshake on each connection, not worth it here.
+		if hp, ok := p.(*httpParent); ok && hp.auth != nil && hp.auth.ntlm {
+			continue
+		}
+		parent = append(parent, p)
+	}
+	return
+}
+
+func (sd *segmentDownload) pieceRange(i int) (start, end int64) {
+	start = int64(i) * segmentPieceSize
+	end = start + segmentPieceSize
+	if end > sd.size {
+		end = sd.size
+	}
+	return
+}
+
+// connect uses the n-th route, routes are used in turn.
+func (sd *segmentDownload) connect(n int) (*segmentConn, error) {
+	var c net.Conn
+	var err error
+	if sd.direct {
+		if c, err = dialDirect(sd.url.HostPort, dialTimeout); err == nil {
+			c = directConn{c}
+		}
+	} else {
+		c, err = sd.parent[n%len(sd.parent)].connect(sd.url)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &segmentConn{c, bufio.NewReader(c)}, nil
+}
+
+func (sd *segmentDownload) request(c net.Conn, start, end int64) []byte {
+	uri, authHeader := requestURI(c, "GET", sd.url)
+	var b bytes.Buffer
+	b.WriteString("GET " + uri + " HTTP/1.1\r\n")
+	b.Write(authHeader)
+	b.Write(sd.header)
+	fmt.Fprintf(&b, "Range: bytes=%d-%d\r\n", start, end-1)
+	b.WriteString("If-Range: " + sd.ifRange + "\r\n")
+	b.WriteString(fullHeaderConnectionKeepAlive)
+	b.WriteString(CRLF)
+	return b.Bytes()
+}
+
+// rangeResponse sends range request for bytes [start, end) on connection
+// and reads the response header.
+func (sd *segmentDownload) rangeResponse(sc *segmentConn, start, end int64) (*http.Response, error) {
+	if _, err := sc.Write(sd.request(sc.Conn, start, end)); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(sc.rd, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 206 {
+		resp.Body.Close()
+		return nil, errors.New("unexpected response " + resp.Status)
+	}
+	cr := fmt.Sprintf("bytes %d-%d/%d", start, end-1, sd.size)
+	if resp.Header.Get("Content-Range") != cr || resp.ContentLength != end-start {
+		resp.Body.Close()
+		return nil, errors.New("unexpected content range " + resp.Header.Get("Content-Range"))
+	}
+	return resp, nil
+}
+
+// fetch gets bytes [start, end) on connection. Returns keep false if the
+// connection can't be used for next piece.
+func (sd *segmentDownload) fetch(sc *segmentConn, start, end int64) (data []byte, keep bool, err error) {
+	setConnReadTimeout(sc, readTimeout, "segment")
+	defer unsetConnReadTimeout(sc, "segment")
+	resp, err := sd.rangeResponse(sc, start, end)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	data = make([]byte, end-start)
+	if _, err = io.ReadFull(resp.Body, data); err != nil {
+		return nil, false, err
+	}
+	return data, !resp.Close, nil
+}
+
+func (sd *segmentDownload) worker(id int, piece <-chan int, result []chan segmentResult, sw *segmentWorkers) {
+	defer sw.wg.Done()
+	var sc *segmentConn
+	closeConn := func() {
+		sw.remove(sc)
+		sc.Close()
+		sc = nil
+	}
+	defer func() {
+		if sc != nil {
+			closeConn()
+		}
+	}()
+	for i := range piece {
+		start, end := sd.pieceRange(i)
+		var res segmentResult
+		for try := 0; try < segmentMaxTry; try++ {
+			if sw.stopped() {
+				return
+			}
+			if sc == nil {
+				if sc, res.err = sd.connect(id + try); res.err != nil {
+					continue
+				}
+				if !sw.add(sc) {
+					sc.Close()
+					sc = nil
+					return
+				}
+			}
+			var keep bool
+			res.data, keep, res.err = sd.fetch(sc, start, end)
+			if !keep {
+				closeConn()
+			}
+			if res.err == nil {
+				break
+			}
+			debug.Printf("segment %d-%d of %s: %v\n", start, end-1, sd.url, res.err)
+		}
+		if res.err != nil {
+			// Not returning net.OpError, which is taken as error reading
+			// the original response.
+			res.err = fmt.Errorf("segment %d-%d: %v", start, end-1, res.err)
+		}
+		result[i] <- res
+	}
+}
+
+// send writes the response body to w, the first piece is read from rd.
+// Workers are stopped before returning.
+func (sd *segmentDownload) send(w io.Writer, rd io.Reader) error {
+	npiece := int((sd.size + segmentPieceSize - 1) / segmentPieceSize)
+	nconn := config.SegmentDownload
+	if nconn > npiece-1 {
+		nconn = npiece - 1
+	}
+	start := time.Now()
+	debug.Printf("segmented download %s %d bytes with %d connections\n", sd.url, sd.size, nconn)
+
+	result := make([]chan segmentResult, npiece)
+	for i := 1; i < npiece; i++ {
+		result[i] = make(chan segmentResult, 1)
+	}
+	piece := make(chan int)
+	window := make(chan struct{}, nconn*segmentWindow)
+	sw := newSegmentWorkers()
+	defer sw.stop()
+	done := sw.done
+	go func() {
+		defer close(piece)
+		for i := 1; i < npiece; i++ {
+			select {
+			case window <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case piece <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	sw.wg.Add(nconn)
+	for i := 0; i < nconn; i++ {
+		go sd.worker(i, piece, result, sw)
+	}
+
+	_, end := sd.pieceRange(0)
+	if _, err := io.CopyN(w, rd, end); err != nil {
+		return err
+	}
+	for i := 1; i < npiece; i++ {
+		res := <-result[i]
+		<-window
+		if res.err != nil {
+			errl.Printf("segmented download %s: %v\n", sd.url, res.err)
+			return res.err
+		}
+		if _, err := w.Write(res.data); err != nil {
+			return err
+		}
+	}
+	debug.Printf("segmented download %s done in %v\n", sd.url, time.Since(start))
+	return nil
+}
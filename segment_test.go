@@ -0,0 +1,108 @@
+package cow
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSegmentDownload(t *testing.T) {
+	body := make([]byte, 3*segmentPieceSize+100)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+	modTime := time.Unix(1400000000, 0)
+	var ranged int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranged, 1)
+		}
+		http.ServeContent(w, r, "big.bin", modTime, bytes.NewReader(body))
+	}))
+	defer ts.Close()
+
+	url, err := ParseRequestURI(ts.URL + "/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd := &segmentDownload{
+		url:     url,
+		header:  []byte("Host: " + url.HostPort + "\r\n"),
+		ifRange: modTime.UTC().Format(http.TimeFormat),
+		size:    int64(len(body)),
+		direct:  true,
+	}
+	saved := config.SegmentDownload
+	config.SegmentDownload = 2
+	defer func() { config.SegmentDownload = saved }()
+
+	var out bytes.Buffer
+	if err := sd.send(&out, bytes.NewReader(body)); err != nil {
+		t.Fatal("segmented download:", err)
+	}
+	if !bytes.Equal(out.Bytes(), body) {
+		t.Error("segmented download body mismatch")
+	}
+	if ranged != 3 {
+		t.Error("should fetch 3 ranges, got", ranged)
+	}
+
+	// Changed file should fail the download.
+	sd.ifRange = modTime.Add(time.Hour).UTC().Format(http.TimeFormat)
+	out.Reset()
+	err = sd.send(&out, bytes.NewReader(body))
+	if err == nil || !strings.Contains(err.Error(), "unexpected response 200") {
+		t.Error("changed file should fail, got", err)
+	}
+}
+
+func TestSegmentDownloadStop(t *testing.T) {
+	body := make([]byte, 3*segmentPieceSize)
+	modTime := time.Unix(1400000000, 0)
+	var active int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Range"), "bytes=2") {
+			// The download fails on the first piece, this one should be
+			// canceled.
+			atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	url, err := ParseRequestURI(ts.URL + "/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd := &segmentDownload{
+		url:     url,
+		header:  []byte("Host: " + url.HostPort + "\r\n"),
+		ifRange: modTime.UTC().Format(http.TimeFormat),
+		size:    int64(len(body)),
+		direct:  true,
+	}
+	saved := config.SegmentDownload
+	config.SegmentDownload = 2
+	defer func() { config.SegmentDownload = saved }()
+
+	var out bytes.Buffer
+	if err := sd.send(&out, bytes.NewReader(body)); err == nil {
+		t.Fatal("download should fail")
+	}
+	for i := 0; atomic.LoadInt32(&active) != 0; i++ {
+		if i == 100 {
+			t.Fatal("worker still fetching after download failed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
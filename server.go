@@ -0,0 +1,155 @@
+package cow
+
+// Embedding cow in other Go programs.
+//
+// Server runs cow in the calling program, with options in rc file format:
+//
+//   s := cow.NewServer(cow.Options{
+//   	Dir:    dir,
+//   	Config: "listen = http://127.0.0.1:7777\nproxy = socks5://127.0.0.1:1080",
+//   })
+//   if err := s.Start(); err != nil {
+//   	...
+//   }
+//   ...
+//   s.Stop()
+//
+// Config, site stat and other state are global, so only one Server can run
+// in a process, and it can't be started again after stopped. Errors in
+// config are returned by Start instead of exiting the program. The embedding
+// program handles signals, pid file and system proxy setting are not used.
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// RouteFunc returns "direct" or "proxy" for requests to host, empty to leave
+// the decision to cow.
+type RouteFunc func(host string) string
+
+// PasswordFunc returns password of user for client authentication, ok is
+// false if there's no such user.
+type PasswordFunc func(user string) (passwd string, ok bool)
+
+type Options struct {
+	RcFile string // config file, optional
+	Config string // options in rc file format, parsed after RcFile
+	// Directory of stat, site lists and other files, defaults to the
+	// directory of RcFile.
+	Dir string
+
+	// Route is called for each request before routing rules in config.
+	Route RouteFunc
+	// Password is used in addition to users in config, enables client
+	// authentication if set.
+	Password PasswordFunc
+}
+
+type Server struct {
+	opts     Options
+	wg       *sync.WaitGroup
+	stopOnce sync.Once
+}
+
+var (
+	embedRoute    RouteFunc
+	embedPassword PasswordFunc
+
+	serverLock    sync.Mutex
+	serverStarted bool
+)
+
+func NewServer(opts Options) *Server {
+	return &Server{opts: opts}
+}
+
+// Start parses config and starts listening, requests are served in
+// background.
+func (s *Server) Start() (err error) {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	if serverStarted {
+		return errors.New("cow server can only be started once in a process")
+	}
+	rc := expandTilde(s.opts.RcFile)
+	dir := expandTilde(s.opts.Dir)
+	if dir == "" {
+		if rc == "" {
+			return errors.New("either RcFile or Dir should be given")
+		}
+		dir = path.Dir(rc)
+	}
+	serverStarted = true
+
+	fatalPanics = true
+	defer func() {
+		if r := recover(); r != nil {
+			fe, ok := r.(fatalError)
+			if !ok {
+				panic(r)
+			}
+			err = fe
+		}
+	}()
+	initConfig(path.Join(dir, rcFname))
+	config.EstimateTimeout = true
+	if rc != "" {
+		f, err := os.Open(rc)
+		if err != nil {
+			return err
+		}
+		IgnoreUTF8BOM(f)
+		parseConfigLines(f)
+		f.Close()
+	}
+	parseConfigLines(strings.NewReader(s.opts.Config))
+	checkConfig()
+
+	embedRoute = s.opts.Route
+	embedPassword = s.opts.Password
+	quit = make(chan struct{})
+	s.wg = start()
+	return nil
+}
+
+// Stop closes listeners and saves site stat. Established connections are
+// not closed.
+func (s *Server) Stop() {
+	if s.wg == nil {
+		return
+	}
+	s.stopOnce.Do(func() {
+		storeSiteStat(siteStatExit)
+		storeMetrics()
+		storeTLSSessions()
+		close(quit)
+		s.wg.Wait()
+	})
+}
+
+// routeEmbed sets route of the request by the embedding program.
+func routeEmbed(r *Request) {
+	switch embedRoute(r.siteURL().Host) {
+	case "direct":
+		r.route = routeDirect
+	case "proxy":
+		r.route = routeProxy
+	default:
+		return
+	}
+	r.routeRule = "embed"
+}
+
+// Traffic returns bytes sent to and received from servers in current
+// accounting period, see metricsFile option.
+func (s *Server) Traffic() (sent, recv int64) {
+	for _, tc := range snapshotMetrics().Parent {
+		sent += tc.Sent
+		recv += tc.Recv
+	}
+	return
+}
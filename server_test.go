@@ -0,0 +1,80 @@
+package cow
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestServerConfigError(t *testing.T) {
+	if err := NewServer(Options{}).Start(); err == nil {
+		t.Error("should require RcFile or Dir")
+	}
+
+	dir, err := ioutil.TempDir("", "cow-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := config
+	defer func() {
+		config = saved
+		fatalPanics = false
+		serverLock.Lock()
+		serverStarted = false
+		serverLock.Unlock()
+	}()
+	s := NewServer(Options{Dir: dir, Config: "noSuchOption = 1\n"})
+	if err = s.Start(); err == nil || !strings.Contains(err.Error(), "noSuchOption") {
+		t.Error("config error should be returned, got", err)
+	}
+	if err = s.Start(); err == nil {
+		t.Error("server should only start once")
+	}
+}
+
+func TestRouteEmbed(t *testing.T) {
+	embedRoute = func(host string) string {
+		switch host {
+		case "direct.example.com":
+			return "direct"
+		case "proxy.example.com":
+			return "proxy"
+		}
+		return ""
+	}
+	defer func() { embedRoute = nil }()
+
+	testData := []struct {
+		url   string
+		route routeType
+		rule  string
+	}{
+		{"http://direct.example.com/", routeDirect, "embed"},
+		{"http://proxy.example.com/", routeProxy, "embed"},
+		{"http://other.example.com/", routeDefault, ""},
+	}
+	for _, td := range testData {
+		url, err := ParseRequestURI(td.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &Request{URL: url}
+		routeEmbed(r)
+		if r.route != td.route || r.routeRule != td.rule {
+			t.Errorf("%s route %v rule %q", td.url, r.route, r.routeRule)
+		}
+	}
+}
+
+func TestServerTraffic(t *testing.T) {
+	s := &Server{}
+	sent, recv := s.Traffic()
+	trafficOf(metrics.data.Parent, "http://127.0.0.1:1").add(100, 2000)
+	trafficOf(metrics.data.Parent, "DIRECT").add(10, 200)
+	sent2, recv2 := s.Traffic()
+	if sent2-sent != 110 || recv2-recv != 2200 {
+		t.Errorf("traffic should increase 110 2200, got %d %d", sent2-sent, recv2-recv)
+	}
+}
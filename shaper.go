@@ -0,0 +1,392 @@
+package cow
+
+// Bandwidth shaping.
+//
+// Upload (client to server) and download (server to client) are limited
+// independently, globally, through parent proxies, per client IP and per
+// authenticated user. Limits are applied on server connections, so traffic
+// served from cache or by cow itself is not limited.
+//
+// Global and parent limits can be changed by time of day with
+// bandwidthSchedule, each entry has a cron expression and a profile which
+// takes effect when the expression matches.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket allowing 1 second of burst. Tokens can go
+// negative, the caller sleeps until the debt is paid.
+type rateLimiter struct {
+	sync.Mutex
+	rate  float64 // bytes per second, 0 means unlimited
+	avail float64
+	last  time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), avail: float64(rate), last: time.Now()}
+}
+
+func (l *rateLimiter) setRate(rate int64) {
+	l.Lock()
+	l.rate = float64(rate)
+	if l.avail > l.rate {
+		l.avail = l.rate
+	}
+	l.Unlock()
+}
+
+// reserve takes n bytes from the bucket, returns how long to wait before
+// transferring them.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	l.avail += now.Sub(l.last).Seconds() * l.rate
+	if l.avail > l.rate {
+		l.avail = l.rate
+	}
+	l.last = now
+	l.avail -= float64(n)
+	if l.avail >= 0 {
+		return 0
+	}
+	return time.Duration(-l.avail / l.rate * float64(time.Second))
+}
+
+// shaper holds limiters applied to one direction of a connection.
+type shaper []*rateLimiter
+
+func (s shaper) wait(n int) {
+	var d time.Duration
+	for _, l := range s {
+		if w := l.reserve(n); w > d {
+			d = w
+		}
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type limiterMap struct {
+	sync.Mutex
+	rate    int64
+	limiter map[string]*rateLimiter
+}
+
+func (lm *limiterMap) get(key string) *rateLimiter {
+	if lm.rate <= 0 || key == "" {
+		return nil
+	}
+	lm.Lock()
+	l, ok := lm.limiter[key]
+	if !ok {
+		l = newRateLimiter(lm.rate)
+		lm.limiter[key] = l
+	}
+	lm.Unlock()
+	return l
+}
+
+// removeIdle removes limiters that have been full for a while, they are
+// created again when needed.
+func (lm *limiterMap) removeIdle(idle time.Duration) {
+	lm.Lock()
+	for key, l := range lm.limiter {
+		l.Lock()
+		unused := time.Now().Sub(l.last) > idle
+		l.Unlock()
+		if unused {
+			delete(lm.limiter, key)
+		}
+	}
+	lm.Unlock()
+}
+
+var bandwidth struct {
+	upload, download             *rateLimiter
+	parentUpload, parentDownload *rateLimiter
+	clientUpload, clientDownload limiterMap
+	userUpload, userDownload     limiterMap
+}
+
+func shaperEnabled() bool {
+	return config.UploadLimit > 0 || config.DownloadLimit > 0 ||
+		config.ClientUploadLimit > 0 || config.ClientDownloadLimit > 0 ||
+		config.UserUploadLimit > 0 || config.UserDownloadLimit > 0 ||
+		config.ParentUploadLimit > 0 || config.ParentDownloadLimit > 0 ||
+		len(config.BandwidthSchedule) > 0
+}
+
+func initShaper() {
+	if !shaperEnabled() {
+		return
+	}
+	bandwidth.upload = newRateLimiter(config.UploadLimit)
+	bandwidth.download = newRateLimiter(config.DownloadLimit)
+	bandwidth.parentUpload = newRateLimiter(config.ParentUploadLimit)
+	bandwidth.parentDownload = newRateLimiter(config.ParentDownloadLimit)
+	for _, lm := range []struct {
+		m    *limiterMap
+		rate int64
+	}{
+		{&bandwidth.clientUpload, config.ClientUploadLimit},
+		{&bandwidth.clientDownload, config.ClientDownloadLimit},
+		{&bandwidth.userUpload, config.UserUploadLimit},
+		{&bandwidth.userDownload, config.UserDownloadLimit},
+	} {
+		lm.m.rate = lm.rate
+		lm.m.limiter = make(map[string]*rateLimiter)
+	}
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			for _, lm := range []*limiterMap{&bandwidth.clientUpload,
+				&bandwidth.clientDownload, &bandwidth.userUpload, &bandwidth.userDownload} {
+				lm.removeIdle(time.Minute)
+			}
+		}
+	}()
+	if len(config.BandwidthSchedule) > 0 {
+		// Apply the last entry matched before start up.
+		bs := lastBandwidthSchedule(time.Now())
+		if bs != nil {
+			bs.apply()
+		}
+		go runBandwidthSchedule(bs)
+	}
+}
+
+func appendLimiter(s shaper, l *rateLimiter) shaper {
+	if l != nil {
+		s = append(s, l)
+	}
+	return s
+}
+
+// setShaper sets limiters for the client currently using the server
+// connection.
+func (sv *serverConn) setShaper(c *clientConn) {
+	if bandwidth.upload == nil {
+		return
+	}
+	host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	sv.upShaper = shaper{bandwidth.upload}
+	if !sv.isDirect() {
+		sv.upShaper = append(sv.upShaper, bandwidth.parentUpload)
+	}
+	sv.upShaper = appendLimiter(sv.upShaper, bandwidth.clientUpload.get(host))
+	sv.upShaper = appendLimiter(sv.upShaper, bandwidth.userUpload.get(c.user))
+	sv.downShaper = shaper{bandwidth.download}
+	if !sv.isDirect() {
+		sv.downShaper = append(sv.downShaper, bandwidth.parentDownload)
+	}
+	sv.downShaper = appendLimiter(sv.downShaper, bandwidth.clientDownload.get(host))
+	sv.downShaper = appendLimiter(sv.downShaper, bandwidth.userDownload.get(c.user))
+}
+
+// parseRate parses rate in bytes per second like 512K or 2M, or in bits per
+// second like 10Mbps.
+func parseRate(val, msg string) int64 {
+	lower := strings.ToLower(val)
+	if !strings.HasSuffix(lower, "bps") {
+		return parseSize(val, msg)
+	}
+	num := lower[:len(lower)-3]
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(num, "k"):
+		unit = 1000
+	case strings.HasSuffix(num, "m"):
+		unit = 1000 * 1000
+	case strings.HasSuffix(num, "g"):
+		unit = 1000 * 1000 * 1000
+	}
+	if unit != 1 {
+		num = num[:len(num)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		Fatalf("%s should be a rate like 512K or 10Mbps\n", msg)
+	}
+	return n * unit / 8
+}
+
+// cronSpec is a cron expression with minute, hour, day of month, month and
+// day of week fields. Each field is a bit set of allowed values.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// Like cron, if both day of month and day of week are restricted, either
+	// one matching is enough.
+	domStar, dowStar bool
+}
+
+// parseCronField parses comma separated list of *, n, n-m, with optional
+// step like */15 or 1-5/2.
+func parseCronField(field string, min, max int) (bits uint64, err error) {
+	for _, item := range strings.Split(field, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i != -1 {
+			rng = item[:i]
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s", item)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bound := strings.SplitN(rng, "-", 2)
+			if lo, err = strconv.Atoi(bound[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %s", item)
+			}
+			hi = lo
+			if len(bound) == 2 {
+				if hi, err = strconv.Atoi(bound[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %s", item)
+				}
+			} else if step != 1 {
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%s out of range %d-%d", item, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	f := strings.Fields(expr)
+	if len(f) != 5 {
+		return nil, errors.New("cron expression should have 5 fields")
+	}
+	cs := &cronSpec{domStar: f[2] == "*", dowStar: f[4] == "*"}
+	var err error
+	if cs.minute, err = parseCronField(f[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if cs.hour, err = parseCronField(f[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if cs.dom, err = parseCronField(f[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if cs.month, err = parseCronField(f[3], 1, 12); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 are Sunday.
+	if cs.dow, err = parseCronField(f[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if cs.dow&(1<<7) != 0 {
+		cs.dow |= 1
+	}
+	return cs, nil
+}
+
+func (cs *cronSpec) match(t time.Time) bool {
+	has := func(bits uint64, v int) bool { return bits&(1<<uint(v)) != 0 }
+	if !has(cs.minute, t.Minute()) || !has(cs.hour, t.Hour()) || !has(cs.month, int(t.Month())) {
+		return false
+	}
+	domOK, dowOK := has(cs.dom, t.Day()), has(cs.dow, int(t.Weekday()))
+	if cs.domStar || cs.dowStar {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
+
+// bandwidthSchedule sets global and parent limits when spec matches. Limits
+// not given in the profile use value in config.
+type bandwidthSchedule struct {
+	spec    *cronSpec
+	profile string
+	limit   map[string]int64 // upload, download, parentUpload, parentDownload
+}
+
+func parseBandwidthSchedule(val string) (*bandwidthSchedule, error) {
+	f := strings.Fields(val)
+	if len(f) < 6 {
+		return nil, errors.New("should be cron expression followed by profile")
+	}
+	spec, err := parseCron(strings.Join(f[:5], " "))
+	if err != nil {
+		return nil, err
+	}
+	bs := &bandwidthSchedule{spec: spec, profile: strings.Join(f[5:], " "), limit: make(map[string]int64)}
+	for _, item := range strings.Split(bs.profile, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("profile item %q should be name=rate", item)
+		}
+		name := strings.TrimSpace(kv[0])
+		switch name {
+		case "upload", "download", "parentUpload", "parentDownload":
+		default:
+			return nil, fmt.Errorf("unknown limit %s in profile", name)
+		}
+		bs.limit[name] = parseRate(strings.TrimSpace(kv[1]), "bandwidthSchedule "+name)
+	}
+	return bs, nil
+}
+
+func (bs *bandwidthSchedule) apply() {
+	get := func(name string, dflt int64) int64 {
+		if v, ok := bs.limit[name]; ok {
+			return v
+		}
+		return dflt
+	}
+	bandwidth.upload.setRate(get("upload", config.UploadLimit))
+	bandwidth.download.setRate(get("download", config.DownloadLimit))
+	bandwidth.parentUpload.setRate(get("parentUpload", config.ParentUploadLimit))
+	bandwidth.parentDownload.setRate(get("parentDownload", config.ParentDownloadLimit))
+	info.Println("bandwidth profile:", bs.profile)
+}
+
+// matchBandwidthSchedule returns the last entry matching t.
+func matchBandwidthSchedule(t time.Time) *bandwidthSchedule {
+	for i := len(config.BandwidthSchedule) - 1; i >= 0; i-- {
+		if bs := config.BandwidthSchedule[i]; bs.spec.match(t) {
+			return bs
+		}
+	}
+	return nil
+}
+
+// lastBandwidthSchedule looks back at most one year for the entry in
+// effect at now.
+func lastBandwidthSchedule(now time.Time) *bandwidthSchedule {
+	t := now.Truncate(time.Minute)
+	for end := t.AddDate(-1, 0, 0); t.After(end); t = t.Add(-time.Minute) {
+		if bs := matchBandwidthSchedule(t); bs != nil {
+			return bs
+		}
+	}
+	return nil
+}
+
+func runBandwidthSchedule(cur *bandwidthSchedule) {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+		if bs := matchBandwidthSchedule(next); bs != nil && bs != cur {
+			bs.apply()
+			cur = bs
+		}
+	}
+}
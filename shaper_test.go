@@ -0,0 +1,108 @@
+package cow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	testData := []struct {
+		val  string
+		rate int64
+	}{
+		{"512", 512},
+		{"512K", 512 * 1024},
+		{"2M", 2 * 1024 * 1024},
+		{"10Mbps", 10 * 1000 * 1000 / 8},
+		{"512kbps", 512 * 1000 / 8},
+		{"800bps", 100},
+	}
+	for _, td := range testData {
+		if rate := parseRate(td.val, "test"); rate != td.rate {
+			t.Errorf("parseRate(%s) got %d, should be %d", td.val, rate, td.rate)
+		}
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	l := newRateLimiter(1000)
+	if d := l.reserve(1000); d != 0 {
+		t.Error("burst of 1 second should not wait, got", d)
+	}
+	d := l.reserve(500)
+	if d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Error("should wait about 500ms, got", d)
+	}
+	l.setRate(0)
+	if d := l.reserve(1 << 20); d != 0 {
+		t.Error("unlimited should not wait, got", d)
+	}
+}
+
+func TestCronSpec(t *testing.T) {
+	// 2015-06-01 is Monday.
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2015, 6, day, hour, min, 0, 0, time.Local)
+	}
+	testData := []struct {
+		expr  string
+		t     time.Time
+		match bool
+	}{
+		{"* * * * *", at(1, 0, 0), true},
+		{"0 9 * * 1-5", at(1, 9, 0), true},
+		{"0 9 * * 1-5", at(6, 9, 0), false},
+		{"0 9 * * 1-5", at(1, 9, 1), false},
+		{"*/15 * * * *", at(1, 3, 45), true},
+		{"*/15 * * * *", at(1, 3, 40), false},
+		{"30 22,23 * * *", at(1, 23, 30), true},
+		{"0 0 * * 7", at(7, 0, 0), true},
+		{"0 0 * * 0", at(7, 0, 0), true},
+		// Either day of month or day of week.
+		{"0 0 15 * 1", at(1, 0, 0), true},
+		{"0 0 15 * 1", at(2, 0, 0), false},
+		{"0 0 1 7 *", at(1, 0, 0), false},
+	}
+	for _, td := range testData {
+		cs, err := parseCron(td.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q) error: %v", td.expr, err)
+			continue
+		}
+		if cs.match(td.t) != td.match {
+			t.Errorf("%q match %v should be %v", td.expr, td.t, td.match)
+		}
+	}
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) should fail", expr)
+		}
+	}
+}
+
+func TestBandwidthSchedule(t *testing.T) {
+	if _, err := parseBandwidthSchedule("0 9 * * 1-5 bogus=1M"); err == nil {
+		t.Error("unknown limit should fail")
+	}
+	day, err := parseBandwidthSchedule("0 9 * * 1-5 download=10Mbps, parentDownload=1M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if day.limit["download"] != 10*1000*1000/8 || day.limit["parentDownload"] != 1024*1024 {
+		t.Error("wrong limits in profile:", day.limit)
+	}
+	night, _ := parseBandwidthSchedule("0 18 * * * download=0")
+	saved := config.BandwidthSchedule
+	defer func() { config.BandwidthSchedule = saved }()
+	config.BandwidthSchedule = []*bandwidthSchedule{day, night}
+
+	if bs := lastBandwidthSchedule(time.Date(2015, 6, 1, 12, 30, 0, 0, time.Local)); bs != day {
+		t.Error("Monday noon should use day profile")
+	}
+	if bs := lastBandwidthSchedule(time.Date(2015, 6, 2, 8, 0, 0, 0, time.Local)); bs != night {
+		t.Error("Tuesday morning should use night profile")
+	}
+	if bs := lastBandwidthSchedule(time.Date(2015, 6, 7, 12, 0, 0, 0, time.Local)); bs != night {
+		t.Error("Sunday noon should use night profile")
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package cow
 
 import (
 	"encoding/json"
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -285,28 +286,10 @@ func (ss *SiteStat) store(statPath string) (err error) {
 		panic("internal error: error marshalling site")
 	}
 
-	// Store stat into temp file first and then rename.
-	// Ensures atomic update to stat file to avoid file damage.
-
-	// Create tmp file inside config firectory to avoid cross FS rename.
-	f, err := ioutil.TempFile(config.dir, "stat")
-	if err != nil {
-		errl.Println("create tmp file to store stat", err)
-		return
-	}
-	if _, err = f.Write(b); err != nil {
+	// Atomic update to stat file to avoid file damage, and keep the previous
+	// version as backup.
+	if err = writeFileAtomic(statPath, b, true); err != nil {
 		errl.Println("Error writing stat file:", err)
-		f.Close()
-		return
-	}
-	f.Close()
-
-	// Windows don't allow rename to existing file.
-	os.Remove(statPath + ".bak")
-	os.Rename(statPath, statPath+".bak")
-	if err = os.Rename(f.Name(), statPath); err != nil {
-		errl.Println("rename new stat file", err)
-		return
 	}
 	return
 }
@@ -421,6 +404,111 @@ func (ss *SiteStat) GetDirectList() []string {
 	return lst
 }
 
+// pacSite is a direct site considered for PAC.
+type pacSite struct {
+	host   string
+	cnt    vcntint
+	recent Date
+}
+
+// byVisit sorts by visit count, then recent visit date, then host.
+type byVisit []pacSite
+
+func (a byVisit) Len() int      { return len(a) }
+func (a byVisit) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byVisit) Less(i, j int) bool {
+	if a[i].cnt != a[j].cnt {
+		return a[i].cnt > a[j].cnt
+	}
+	if !time.Time(a[i].recent).Equal(time.Time(a[j].recent)) {
+		return time.Time(a[i].recent).After(time.Time(a[j].recent))
+	}
+	return a[i].host < a[j].host
+}
+
+// GetPACDirectList returns direct sites for a minimized PAC: user specified
+// sites, and at most max (0 means no limit) sites with most direct visits,
+// which must be at least minVisit. Hosts whose domain is in the list are
+// omitted, as PAC also looks up the domain of host.
+func (ss *SiteStat) GetPACDirectList(max int, minVisit vcntint) []string {
+	var user, learned []pacSite
+	ss.vcLock.RLock()
+	for site, vc := range ss.Vcnt {
+		if ss.hasBlockedHost[host2Domain(site)] || !vc.AsDirect() {
+			continue
+		}
+		if vc.AlwaysDirect() {
+			user = append(user, pacSite{host: site})
+		} else if !vc.userSpecified() && vc.Direct > 0 && vc.Direct >= minVisit {
+			learned = append(learned, pacSite{site, vc.Direct, vc.Recent})
+		}
+	}
+	ss.vcLock.RUnlock()
+
+	sort.Sort(byVisit(learned))
+	inList := make(map[string]bool)
+	for _, s := range user {
+		inList[s.host] = true
+	}
+	n := 0
+	for _, s := range learned {
+		if max > 0 && n == max {
+			break
+		}
+		if !inList[host2Domain(s.host)] {
+			inList[s.host] = true
+			n++
+		}
+	}
+	// Domain may be added after its hosts.
+	lst := make([]string, 0, len(inList))
+	for _, s := range append(user, learned...) {
+		if !inList[s.host] {
+			continue
+		}
+		if domain := host2Domain(s.host); domain != s.host && inList[domain] {
+			continue
+		}
+		lst = append(lst, s.host)
+	}
+	return lst
+}
+
+type hostCnt struct {
+	host string
+	cnt  vcntint
+}
+
+type byCnt []hostCnt
+
+func (a byCnt) Len() int           { return len(a) }
+func (a byCnt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byCnt) Less(i, j int) bool { return a[i].cnt > a[j].cnt }
+
+// GetTopDirectHosts returns at most n hosts with most direct visits. User
+// specified sites are domains, so they are excluded.
+func (ss *SiteStat) GetTopDirectHosts(n int) []string {
+	var hc []hostCnt
+	ss.vcLock.RLock()
+	for site, vc := range ss.Vcnt {
+		if vc.userSpecified() || !vc.AsDirect() || vc.Direct == 0 {
+			continue
+		}
+		hc = append(hc, hostCnt{site, vc.Direct})
+	}
+	ss.vcLock.RUnlock()
+
+	sort.Sort(byCnt(hc))
+	if len(hc) > n {
+		hc = hc[:n]
+	}
+	lst := make([]string, len(hc))
+	for i, h := range hc {
+		lst[i] = h.host
+	}
+	return lst
+}
+
 var siteStat = newSiteStat()
 
 func initSiteStat() {
@@ -434,14 +522,16 @@ func initSiteStat() {
 		if err != nil {
 			siteStat = newSiteStat()
 			siteStat.load("") // load default site list
+		} else if isFileExists(config.StatFile) == nil {
+			info.Println("stat file damaged, loaded backup", config.StatFile+".bak")
 		}
 	}
 
 	// Dump site stat while running, so we don't always need to close cow to
-	// get updated stat.
+	// get updated stat, and won't lose much on power failure.
 	go func() {
 		for {
-			time.Sleep(5 * time.Minute)
+			time.Sleep(config.StatSaveInterval)
 			storeSiteStat(siteStatCont)
 		}
 	}()
@@ -501,3 +591,60 @@ func loadSiteList(fpath string) (lst []string, err error) {
 	}
 	return lst, scanner.Err()
 }
+
+// setUserSite makes site always blocked or always direct like sites in the
+// user specified lists, and saves it in the corresponding list file. Visit
+// counts of hosts covered by site are removed.
+func (ss *SiteStat) setUserSite(site string, blocked bool) error {
+	site = strings.ToLower(site)
+	addFile, removeFile := config.DirectFile, config.BlockedFile
+	vcnt := newVisitCntWithTime(userCnt, 0, zeroTime)
+	if blocked {
+		addFile, removeFile = removeFile, addFile
+		vcnt = newVisitCntWithTime(0, userCnt, zeroTime)
+	}
+	if err := updateSiteList(removeFile, site, false); err != nil {
+		return err
+	}
+	if err := updateSiteList(addFile, site, true); err != nil {
+		return err
+	}
+	ss.vcLock.Lock()
+	for s, vc := range ss.Vcnt {
+		if !vc.userSpecified() && host2Domain(s) == site {
+			delete(ss.Vcnt, s)
+		}
+	}
+	ss.Vcnt[site] = vcnt
+	ss.vcLock.Unlock()
+	return nil
+}
+
+// updateSiteList adds site to or removes it from the list file.
+func updateSiteList(fpath, site string, add bool) error {
+	if fpath == "" {
+		return nil
+	}
+	lst, err := loadSiteList(fpath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var buf []byte
+	found := false
+	for _, s := range lst {
+		if s == site {
+			found = true
+			if !add {
+				continue
+			}
+		}
+		buf = append(buf, s+"\n"...)
+	}
+	if found == add {
+		return nil
+	}
+	if add {
+		buf = append(buf, site+"\n"...)
+	}
+	return writeFileAtomic(fpath, buf, false)
+}
@@ -1,7 +1,10 @@
-package main
+package cow
 
 import (
+	"io/ioutil"
 	"os"
+	"path"
+	"strings"
 	"testing"
 	"time"
 )
@@ -261,3 +264,74 @@ func TestSiteStatGetVisitCnt(t *testing.T) {
 		t.Errorf("%s has one blocked visit, should has once blocked\n", g1.Host)
 	}
 }
+
+func TestSiteStatGetTopDirectHosts(t *testing.T) {
+	ss := newSiteStat()
+	ss.Vcnt["a.com"] = newVisitCnt(3, 0)
+	ss.Vcnt["b.com"] = newVisitCnt(10, 0)
+	ss.Vcnt["c.com"] = newVisitCnt(5, 0)
+	ss.Vcnt["blocked.com"] = newVisitCnt(20, 20)
+	ss.Vcnt["user.com"] = newVisitCnt(userCnt, 0)
+	ss.Vcnt["new.com"] = newVisitCnt(0, 0)
+
+	top := ss.GetTopDirectHosts(2)
+	if len(top) != 2 || top[0] != "b.com" || top[1] != "c.com" {
+		t.Error("top 2 direct hosts should be b.com c.com, got", top)
+	}
+	if top = ss.GetTopDirectHosts(10); len(top) != 3 {
+		t.Error("should return 3 hosts, got", top)
+	}
+}
+
+func TestSiteStatGetPACDirectList(t *testing.T) {
+	ss := newSiteStat()
+	ss.Vcnt["a.com"] = newVisitCnt(3, 0)
+	ss.Vcnt["b.com"] = newVisitCnt(10, 0)
+	ss.Vcnt["www.b.com"] = newVisitCnt(8, 0)
+	ss.Vcnt["c.com"] = newVisitCnt(5, 0)
+	ss.Vcnt["d.com"] = newVisitCnt(1, 0)
+	ss.Vcnt["blocked.com"] = newVisitCnt(20, 20)
+	ss.Vcnt["user.com"] = newVisitCnt(userCnt, 0)
+	ss.Vcnt["www.user.com"] = newVisitCnt(50, 0)
+
+	lst := ss.GetPACDirectList(2, 0)
+	if strings.Join(lst, " ") != "user.com b.com c.com" {
+		t.Error("should have user site and top direct hosts without sub domain, got", lst)
+	}
+	lst = ss.GetPACDirectList(0, 3)
+	if strings.Join(lst, " ") != "user.com b.com c.com a.com" {
+		t.Error("should have hosts visited at least 3 times, got", lst)
+	}
+}
+
+func TestSiteStatSetUserSite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow-sitestat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := config
+	defer func() { config = saved }()
+	config.DirectFile = path.Join(dir, "direct")
+	config.BlockedFile = path.Join(dir, "blocked")
+	ioutil.WriteFile(config.DirectFile, []byte("a.com\nexample.com\n"), 0644)
+
+	ss := newSiteStat()
+	ss.Vcnt["www.example.com"] = newVisitCnt(10, 0)
+	ss.Vcnt["www.other.com"] = newVisitCnt(10, 0)
+	if err = ss.setUserSite("Example.com", true); err != nil {
+		t.Fatal("setUserSite:", err)
+	}
+	if ss.get("www.example.com") != nil || ss.get("www.other.com") == nil {
+		t.Error("only sites covered by example.com should be removed")
+	}
+	if vc := ss.get("example.com"); vc == nil || !vc.AlwaysBlocked() {
+		t.Error("example.com should be always blocked")
+	}
+	if lst, _ := loadSiteList(config.DirectFile); len(lst) != 1 || lst[0] != "a.com" {
+		t.Error("example.com should be removed from direct file, got", lst)
+	}
+	if lst, _ := loadSiteList(config.BlockedFile); len(lst) != 1 || lst[0] != "example.com" {
+		t.Error("example.com should be added to blocked file, got", lst)
+	}
+}
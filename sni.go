@@ -0,0 +1,147 @@
+package cow
+
+// SNI based routing for tunnels to IP address.
+//
+// When a CONNECT request (or transparently intercepted connection) targets
+// an IP address, site stat can't tell whether the site is blocked. With
+// sniRouting enabled, cow replies 200 to the client first, peeks the TLS
+// ClientHello and uses the server name in it for site stat and rule
+// matching. The tunnel still goes to the original IP address and nothing is
+// decrypted.
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const sniPeekTimeout = 2 * time.Second
+
+var errNoSNI = errors.New("no SNI in ClientHello")
+
+// parseClientHello extracts server name and ALPN protocols from TLS
+// ClientHello. data may be incomplete, extensions not in data are ignored.
+func parseClientHello(data []byte) (serverName string, alpn []string, err error) {
+	// TLS record header: type(1) version(2) length(2)
+	if len(data) < 5 || data[0] != 0x16 {
+		return "", nil, errors.New("not TLS handshake")
+	}
+	p := data[5:]
+	// Handshake header: type(1) length(3), ClientHello type is 1.
+	if len(p) < 4 || p[0] != 1 {
+		return "", nil, errors.New("not ClientHello")
+	}
+	p = p[4:]
+	// version(2) random(32)
+	if len(p) < 34 {
+		return
+	}
+	p = p[34:]
+	// session id, cipher suites, compression methods
+	for _, lenSize := range []int{1, 2, 1} {
+		if len(p) < lenSize {
+			return
+		}
+		n := int(p[0])
+		if lenSize == 2 {
+			n = n<<8 | int(p[1])
+		}
+		if len(p) < lenSize+n {
+			return
+		}
+		p = p[lenSize+n:]
+	}
+	if len(p) < 2 {
+		return
+	}
+	p = p[2:] // extensions length, data may be truncated
+	for len(p) >= 4 {
+		extType := int(p[0])<<8 | int(p[1])
+		extLen := int(p[2])<<8 | int(p[3])
+		p = p[4:]
+		if len(p) < extLen {
+			return
+		}
+		ext := p[:extLen]
+		p = p[extLen:]
+		switch extType {
+		case 0:
+			// server_name_list length(2), name_type(1), name length(2)
+			if len(ext) < 5 || ext[2] != 0 {
+				continue
+			}
+			n := int(ext[3])<<8 | int(ext[4])
+			if len(ext) < 5+n {
+				continue
+			}
+			serverName = string(ext[5 : 5+n])
+		case 16:
+			// protocol_name_list length(2), each name has length(1)
+			if len(ext) < 2 {
+				continue
+			}
+			for ext = ext[2:]; len(ext) > 0 && len(ext) > int(ext[0]); ext = ext[1+int(ext[0]):] {
+				alpn = append(alpn, string(ext[1:1+int(ext[0])]))
+			}
+		}
+	}
+	return
+}
+
+// parseSNI extracts server name from TLS ClientHello. data may be
+// incomplete, as long as it contains the server name extension.
+func parseSNI(data []byte) (string, error) {
+	host, _, err := parseClientHello(data)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return "", errNoSNI
+	}
+	return host, nil
+}
+
+// peekSNI sends 200 response to CONNECT and peeks TLS ClientHello from the
+// client. Server name found is used for site stat and routing. Returns error
+// only if the client connection fails.
+func (c *clientConn) peekSNI(r *Request) error {
+	if !c.tunnelEstablished {
+		if _, err := c.Write(connEstablished); err != nil {
+			return err
+		}
+		c.tunnelEstablished = true
+	}
+
+	setConnReadTimeout(c.Conn, sniPeekTimeout, "peekSNI")
+	defer unsetConnReadTimeout(c.Conn, "peekSNI")
+	b, err := c.bufRd.Peek(5)
+	if err != nil {
+		if isErrTimeout(err) {
+			// Client may wait for server to send first.
+			return nil
+		}
+		return err
+	}
+	if b[0] != 0x16 {
+		return nil
+	}
+	n := 5 + (int(b[3])<<8 | int(b[4]))
+	if n > len(c.buf) {
+		n = len(c.buf)
+	}
+	if b, err = c.bufRd.Peek(n); err != nil && !isErrTimeout(err) {
+		return err
+	}
+	host, err := parseSNI(b)
+	if err != nil {
+		debug.Printf("cli(%s) %v %s\n", c.RemoteAddr(), err, r.URL.HostPort)
+		return nil
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	r.sniURL = &URL{}
+	r.sniURL.ParseHostPort(net.JoinHostPort(host, r.URL.Port))
+	debug.Printf("cli(%s) SNI %s for %s\n", c.RemoteAddr(), host, r.URL.HostPort)
+	return nil
+}
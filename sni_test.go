@@ -0,0 +1,49 @@
+package cow
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func clientHello(serverName string, alpn ...string) []byte {
+	cli, srv := net.Pipe()
+	go func() {
+		c := tls.Client(cli, &tls.Config{ServerName: serverName, NextProtos: alpn, InsecureSkipVerify: true})
+		c.Handshake()
+	}()
+	buf := make([]byte, 4096)
+	n, _ := srv.Read(buf)
+	srv.Close()
+	return buf[:n]
+}
+
+func TestParseSNI(t *testing.T) {
+	hello := clientHello("www.example.com")
+	if host, err := parseSNI(hello); err != nil || host != "www.example.com" {
+		t.Errorf("SNI should be www.example.com, got %q %v\n", host, err)
+	}
+	// No SNI for IP address.
+	if _, err := parseSNI(clientHello("1.2.3.4")); err == nil {
+		t.Error("should have no SNI for IP address")
+	}
+	if _, err := parseSNI(hello[:40]); err == nil {
+		t.Error("truncated ClientHello should fail")
+	}
+	if _, err := parseSNI([]byte("GET / HTTP/1.1\r\n")); err == nil {
+		t.Error("HTTP request is not ClientHello")
+	}
+}
+
+func TestParseClientHello(t *testing.T) {
+	host, alpn, err := parseClientHello(clientHello("www.example.com", "h2", "http/1.1"))
+	if err != nil || host != "www.example.com" {
+		t.Errorf("SNI should be www.example.com, got %q %v\n", host, err)
+	}
+	if len(alpn) != 2 || alpn[0] != "h2" || alpn[1] != "http/1.1" {
+		t.Errorf("ALPN should be h2,http/1.1, got %v", alpn)
+	}
+	if _, alpn, _ = parseClientHello(clientHello("www.example.com")); alpn != nil {
+		t.Errorf("should have no ALPN, got %v", alpn)
+	}
+}
@@ -0,0 +1,342 @@
+package cow
+
+// SOCKS5 proxy server (RFC 1928).
+//
+//   listen = socks5://127.0.0.1:1080
+//
+// Only the CONNECT command is supported. The destination is routed like a
+// CONNECT request received by the http listener, so blocked site detection,
+// rules and parent proxies all apply.
+//
+// If authentication is required, clients in allowedClient (or IPs already
+// authenticated through the http listener) can use no authentication,
+// others must use username/password authentication (RFC 1929) with users in
+// userPasswd and userPasswdFile. Users authenticated here are also cached
+// by IP like http clients.
+//
+// The success reply is sent once connection to the server or parent proxy is
+// created. Errors after that, e.g. parent proxy failing to connect to the
+// destination, just close the client connection.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	socksVer5       = 5
+	socksCmdConnect = 1
+
+	socksMethodNoAuth       = 0
+	socksMethodUserPass     = 2
+	socksMethodNoAcceptable = 0xff
+
+	// username/password sub negotiation
+	socksAuthVer     = 1
+	socksAuthSuccess = 0
+	socksAuthFailure = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksSucceeded        = 0
+	socksGeneralFailure   = 1
+	socksNotAllowed       = 2
+	socksHostUnreachable  = 4
+	socksCmdNotSupported  = 7
+	socksAtypNotSupported = 8
+
+	socksHandshakeTimeout = 10 * time.Second
+)
+
+var errSocksAuth = errors.New("socks5 authentication failed")
+
+type socksProxy struct {
+	addr string
+	ln   net.Listener
+}
+
+func newSocksProxy(addr string) *socksProxy {
+	return &socksProxy{addr: addr}
+}
+
+func (sp *socksProxy) genConfig() string {
+	return "listen = socks5://" + sp.addr
+}
+
+func (sp *socksProxy) Addr() string {
+	return sp.addr
+}
+
+func (sp *socksProxy) listen() (err error) {
+	if sp.ln, err = net.Listen("tcp", sp.addr); err != nil {
+		fmt.Println("listen socks5 failed:", err)
+	}
+	return
+}
+
+func (sp *socksProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer func() {
+		wg.Done()
+	}()
+	ln := sp.ln
+	if ln == nil {
+		return
+	}
+	info.Printf("COW %s socks5 proxy address %s\n", version, sp.addr)
+	var exit bool
+	go func() {
+		<-quit
+		exit = true
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil && !exit {
+			errl.Printf("socks5 proxy(%s) accept %v\n", ln.Addr(), err)
+			if isErrTooManyOpenFd(err) {
+				connPool.CloseAll()
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if exit {
+			debug.Println("exiting socks5 listener")
+			break
+		}
+		c := newClientConn(conn, sp)
+		go c.serveSocks()
+	}
+}
+
+// socksSelectMethod returns the authentication method to use among methods
+// offered by client.
+func (c *clientConn) socksSelectMethod(methods []byte) (byte, string) {
+	var noAuth, userPass bool
+	for _, m := range methods {
+		switch m {
+		case socksMethodNoAuth:
+			noAuth = true
+		case socksMethodUserPass:
+			userPass = true
+		}
+	}
+	var user string
+	needPass := false
+	if auth.required {
+		clientIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		var ok bool
+		if user, ok = auth.authed.get(clientIP); ok {
+			debug.Printf("%s has already authed as %s\n", clientIP, user)
+		} else if !authIP(clientIP) {
+			needPass = true
+		}
+	}
+	if noAuth && !needPass {
+		return socksMethodNoAuth, user
+	}
+	if userPass && auth.required {
+		return socksMethodUserPass, ""
+	}
+	return socksMethodNoAcceptable, ""
+}
+
+// socksAuthUserPass does username/password sub negotiation.
+func (c *clientConn) socksAuthUserPass() error {
+	// VER ULEN UNAME PLEN PASSWD
+	var b [256]byte
+	if _, err := io.ReadFull(c.bufRd, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != socksAuthVer {
+		return fmt.Errorf("socks5 auth version %d not supported", b[0])
+	}
+	n := int(b[1])
+	if _, err := io.ReadFull(c.bufRd, b[:n+1]); err != nil {
+		return err
+	}
+	user := string(b[:n])
+	n = int(b[n])
+	if _, err := io.ReadFull(c.bufRd, b[:n]); err != nil {
+		return err
+	}
+	passwd := string(b[:n])
+
+	au, ok := findAuthUser(user)
+	if !ok || !au.passwdMatch(passwd) || authPort(c, user, au) != nil {
+		c.Write([]byte{socksAuthVer, socksAuthFailure})
+		return errSocksAuth
+	}
+	if _, err := c.Write([]byte{socksAuthVer, socksAuthSuccess}); err != nil {
+		return err
+	}
+	c.user = user
+	clientIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	auth.authed.add(clientIP, user)
+	return nil
+}
+
+// socksReadRequest reads the request and returns the destination host:port
+// of CONNECT command. Error reply is sent if the request is not supported.
+func (c *clientConn) socksReadRequest() (string, error) {
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	var b [256]byte
+	if _, err := io.ReadFull(c.bufRd, b[:4]); err != nil {
+		return "", err
+	}
+	if b[0] != socksVer5 {
+		return "", fmt.Errorf("socks version %d not supported", b[0])
+	}
+	cmd := b[1]
+	var host string
+	switch b[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		n := net.IPv4len
+		if b[3] == socksAtypIPv6 {
+			n = net.IPv6len
+		}
+		if _, err := io.ReadFull(c.bufRd, b[:n]); err != nil {
+			return "", err
+		}
+		host = net.IP(b[:n]).String()
+	case socksAtypDomain:
+		if _, err := io.ReadFull(c.bufRd, b[:1]); err != nil {
+			return "", err
+		}
+		n := int(b[0])
+		if _, err := io.ReadFull(c.bufRd, b[:n]); err != nil {
+			return "", err
+		}
+		host = string(b[:n])
+	default:
+		c.socksReply(socksAtypNotSupported)
+		return "", fmt.Errorf("socks5 address type %d not supported", b[3])
+	}
+	if _, err := io.ReadFull(c.bufRd, b[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(b[:2])
+	if cmd != socksCmdConnect {
+		c.socksReply(socksCmdNotSupported)
+		return "", fmt.Errorf("socks5 command %d not supported", cmd)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// socksReply sends reply with zero bind address, which clients don't use for
+// CONNECT.
+func (c *clientConn) socksReply(rep byte) error {
+	_, err := c.Write([]byte{socksVer5, rep, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksHandshake negotiates authentication method and reads the request,
+// returns the destination.
+func (c *clientConn) socksHandshake() (string, error) {
+	setConnReadTimeout(c.Conn, socksHandshakeTimeout, "socks5 handshake")
+	defer unsetConnReadTimeout(c.Conn, "socks5 handshake")
+
+	// VER NMETHODS METHODS
+	var b [256]byte
+	if _, err := io.ReadFull(c.bufRd, b[:2]); err != nil {
+		return "", err
+	}
+	if b[0] != socksVer5 {
+		return "", fmt.Errorf("socks version %d not supported", b[0])
+	}
+	n := int(b[1])
+	if _, err := io.ReadFull(c.bufRd, b[:n]); err != nil {
+		return "", err
+	}
+	method, user := c.socksSelectMethod(b[:n])
+	if _, err := c.Write([]byte{socksVer5, method}); err != nil {
+		return "", err
+	}
+	switch method {
+	case socksMethodNoAcceptable:
+		return "", errSocksAuth
+	case socksMethodUserPass:
+		if err := c.socksAuthUserPass(); err != nil {
+			return "", err
+		}
+	default:
+		c.user = user
+	}
+	return c.socksReadRequest()
+}
+
+// serveSocks serves a socks5 client connection, the destination is tunneled
+// like CONNECT request.
+func (c *clientConn) serveSocks() {
+	var r Request
+	var sv *serverConn
+	var err error
+
+	c.lookupProcess()
+	defer func() {
+		r.releaseBuf()
+		c.Close()
+	}()
+
+	hostPort, err := c.socksHandshake()
+	if err != nil {
+		errl.Printf("cli(%s) %v\n", c.RemoteAddr(), err)
+		return
+	}
+	hostPort = fakeHostPort(hostPort)
+	r.initTunnel(hostPort)
+	setCliConnRequest(c, &r)
+	debug.Printf("cli(%s) socks5 user %q tunnel to %s\n", c.RemoteAddr(), c.user, hostPort)
+
+	if inMaintenance() {
+		debug.Printf("cli(%s) maintenance mode, reject socks5 %s\n", c.RemoteAddr(), hostPort)
+		c.socksReply(socksGeneralFailure)
+		return
+	}
+	if len(accessRules) > 0 && c.matchAccessRule(&r) == accessDeny {
+		c.socksReply(socksNotAllowed)
+		return
+	}
+	if !config.TunnelAllowedPort[r.URL.Port] {
+		debug.Printf("cli(%s) socks5 port %s not allowed\n", c.RemoteAddr(), r.URL.Port)
+		c.socksReply(socksNotAllowed)
+		return
+	}
+	if c.user != "" {
+		if reason, _ := c.userPolicyDenied(r.URL.Host); reason != "" {
+			c.socksReply(socksNotAllowed)
+			return
+		}
+	}
+
+	// Client data is only sent after the reply, so there's no response to
+	// tunnel and nothing to peek for SNI.
+	c.tunnelEstablished = true
+	replied := false
+retry:
+	r.tryOnce()
+	if sv, err = c.getServerConn(&r); err != nil {
+		if !replied {
+			c.socksReply(socksHostUnreachable)
+		}
+		return
+	}
+	if !replied {
+		if err = c.socksReply(socksSucceeded); err != nil {
+			sv.Close()
+			return
+		}
+		replied = true
+	}
+	err = sv.doConnect(&r, c)
+	if c.shouldRetry(&r, sv, err) {
+		goto retry
+	}
+}
@@ -0,0 +1,141 @@
+package cow
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testSocksProxy(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := newSocksProxy(ln.Addr().String())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go newClientConn(conn, sp).serveSocks()
+		}
+	}()
+	return ln
+}
+
+// socksRequest writes b and reads n bytes of reply.
+func socksRequest(t *testing.T, c net.Conn, b []byte, n int) []byte {
+	if _, err := c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, n)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatalf("read reply to %v: %v", b, err)
+	}
+	return reply
+}
+
+func socksConnectReq(cmd byte, host string, port int) []byte {
+	b := []byte{socksVer5, cmd, 0, socksAtypDomain, byte(len(host))}
+	b = append(b, host...)
+	return append(b, byte(port>>8), byte(port))
+}
+
+func TestSocks5(t *testing.T) {
+	savedRequired, savedUser, savedAuthed := auth.required, auth.user, auth.authed
+	savedUsage := metrics.data.Usage
+	defer func() {
+		auth.required, auth.user, auth.authed = savedRequired, savedUser, savedAuthed
+		metrics.data.Usage = savedUsage
+	}()
+	auth.required = true
+	auth.user = map[string]*authUser{"alice": {passwd: "secret"}}
+	auth.authed = NewTimeoutSet(time.Hour)
+	metrics.data.Usage = make(map[string]*userUsage)
+
+	origin := newRawOrigin(t)
+	defer origin.Close()
+	origin.response["/ok"] = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	_, portStr, _ := net.SplitHostPort(origin.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	savedPort := config.TunnelAllowedPort
+	config.TunnelAllowedPort = map[string]bool{portStr: true}
+	defer func() { config.TunnelAllowedPort = savedPort }()
+
+	proxy := testSocksProxy(t)
+	defer proxy.Close()
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	userPass := func(user, passwd string) []byte {
+		b := append([]byte{socksAuthVer, byte(len(user))}, user...)
+		b = append(b, byte(len(passwd)))
+		return append(b, passwd...)
+	}
+
+	c := dial()
+	if r := socksRequest(t, c, []byte{socksVer5, 1, socksMethodNoAuth}, 2); r[1] != socksMethodNoAcceptable {
+		t.Error("no authentication should not be accepted, got method", r[1])
+	}
+	c.Close()
+
+	c = dial()
+	socksRequest(t, c, []byte{socksVer5, 2, socksMethodNoAuth, socksMethodUserPass}, 2)
+	if r := socksRequest(t, c, userPass("alice", "wrong"), 2); r[1] != socksAuthFailure {
+		t.Error("wrong password should fail")
+	}
+	c.Close()
+
+	c = dial()
+	if r := socksRequest(t, c, []byte{socksVer5, 1, socksMethodUserPass}, 2); r[1] != socksMethodUserPass {
+		t.Fatal("should use username/password authentication, got method", r[1])
+	}
+	if r := socksRequest(t, c, userPass("alice", "secret"), 2); r[1] != socksAuthSuccess {
+		t.Fatal("authentication should succeed")
+	}
+	if r := socksRequest(t, c, socksConnectReq(socksCmdConnect, "127.0.0.1", port), 10); r[1] != socksSucceeded {
+		t.Fatal("CONNECT failed with reply", r[1])
+	}
+	if _, err := c.Write([]byte("GET /ok HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal("read response through socks5:", err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "ok" {
+		t.Errorf("wrong response body %q", body)
+	}
+	c.Close()
+	if !auth.authed.has("127.0.0.1") {
+		t.Error("authenticated IP should be cached")
+	}
+
+	// Authenticated IP needs no authentication.
+	c = dial()
+	if r := socksRequest(t, c, []byte{socksVer5, 1, socksMethodNoAuth}, 2); r[1] != socksMethodNoAuth {
+		t.Fatal("authenticated IP should use no authentication, got method", r[1])
+	}
+	if r := socksRequest(t, c, socksConnectReq(3, "127.0.0.1", port), 10); r[1] != socksCmdNotSupported {
+		t.Error("UDP ASSOCIATE should not be supported, got reply", r[1])
+	}
+	c.Close()
+
+	c = dial()
+	socksRequest(t, c, []byte{socksVer5, 1, socksMethodNoAuth}, 2)
+	if r := socksRequest(t, c, socksConnectReq(socksCmdConnect, "127.0.0.1", 25), 10); r[1] != socksNotAllowed {
+		t.Error("port not in tunnelAllowedPort should be rejected, got reply", r[1])
+	}
+	c.Close()
+}
@@ -0,0 +1,125 @@
+package cow
+
+// Stalled response bodies.
+//
+//   stallTimeout = 20s
+//
+// Throttled connections often stall in the middle of a response body
+// instead of failing. With stallTimeout set, reading response body fails if
+// no data is received from server for that long. A stall on a direct
+// connection is logged as "stalled" and the site is taken as temporarily
+// blocked, so following requests go through parent proxies.
+//
+// For plain HTTP GET responses with Content-Length, "Accept-Ranges: bytes"
+// and a validator (strong ETag or Last-Modified), the rest of a stalled body
+// is requested with Range and If-Range, through parent proxies if there are
+// any, and sent to the client as if nothing happened. Otherwise the client
+// connection is closed like other errors reading response body.
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+var errStalled = errors.New("response body stalled")
+
+// countWriter counts bytes written and records write error.
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(b []byte) (n int, err error) {
+	n, err = cw.w.Write(b)
+	cw.n += int64(n)
+	if err != nil {
+		cw.err = err
+	}
+	return
+}
+
+// stallReader renews read deadline of stallTimeout on each read.
+type stallReader struct {
+	conn net.Conn
+	rd   io.Reader
+}
+
+func (sr stallReader) Read(b []byte) (int, error) {
+	setConnReadTimeout(sr.conn, config.StallTimeout, "stall")
+	return sr.rd.Read(b)
+}
+
+// newStallResume returns nil if a stalled response body can't be resumed.
+// Must be called before request and response buffers are released.
+func newStallResume(sv *serverConn, r *Request, rp *Response) *segmentDownload {
+	sd := newRangeDownload(sv, r, rp)
+	if sd == nil || !sd.direct {
+		return sd
+	}
+	// Stalls on direct connections are usually caused by throttling.
+	if parent := rangeParents(r); len(parent) > 0 {
+		sd.direct = false
+		sd.parent = parent
+	}
+	return sd
+}
+
+// resume sends bytes from offset to the end of body to w, each try uses the
+// next route.
+func (sd *segmentDownload) resume(w io.Writer, offset int64) (err error) {
+	cw := &countWriter{w: w}
+	for try := 0; try < segmentMaxTry; try++ {
+		var sc *segmentConn
+		if sc, err = sd.connect(try); err != nil {
+			debug.Printf("resume %s connect: %v\n", sd.url, err)
+			continue
+		}
+		start := offset + cw.n
+		setConnReadTimeout(sc, readTimeout, "resume")
+		var resp *http.Response
+		if resp, err = sd.rangeResponse(sc, start, sd.size); err == nil {
+			_, err = io.Copy(cw, stallReader{sc, resp.Body})
+			resp.Body.Close()
+			if err == nil && offset+cw.n != sd.size {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		sc.Close()
+		if err == nil || cw.err != nil {
+			return err
+		}
+		debug.Printf("resume %s from %d: %v\n", sd.url, start, err)
+	}
+	return
+}
+
+// sendBodyStall sends response body with stall detection. Stalled body is
+// resumed with rs if not nil.
+func (c *clientConn) sendBodyStall(w io.Writer, sv *serverConn, r *Request, rp *Response, rs *segmentDownload) (err error) {
+	cw := &countWriter{w: w}
+	sv.stallCheck = true
+	err = sendBody(cw, sv.bufRd, int(rp.ContLen), rp.Chunking)
+	sv.stallCheck = false
+	unsetConnReadTimeout(sv.Conn, "stall")
+	if err == nil || cw.err != nil || !isErrTimeout(err) {
+		return
+	}
+	errl.Printf("cli(%s) stalled after %d bytes via %s %v\n", c.RemoteAddr(), cw.n, routeName(sv.Conn), r)
+	if sv.isDirect() && !sv.siteInfo.AlwaysDirect() && !parentProxy.empty() {
+		siteStat.TempBlocked(r.siteURL())
+	}
+	if rs == nil {
+		return errStalled
+	}
+	// Server connection is in the middle of response.
+	r.segmented = true
+	if err = rs.resume(w, cw.n); err != nil {
+		errl.Printf("cli(%s) resume stalled %v: %v\n", c.RemoteAddr(), r, err)
+		return errStalled
+	}
+	debug.Printf("cli(%s) resumed stalled %v from %d\n", c.RemoteAddr(), r, cw.n)
+	return nil
+}
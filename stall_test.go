@@ -0,0 +1,73 @@
+package cow
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStallResume(t *testing.T) {
+	body := make([]byte, 100000)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+	modTime := time.Unix(1400000000, 0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", modTime, bytes.NewReader(body))
+	}))
+	defer ts.Close()
+
+	url, err := ParseRequestURI(ts.URL + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd := &segmentDownload{
+		url:     url,
+		header:  []byte("Host: " + url.HostPort + "\r\n"),
+		ifRange: modTime.UTC().Format(http.TimeFormat),
+		size:    int64(len(body)),
+		direct:  true,
+	}
+	saved := config.StallTimeout
+	config.StallTimeout = time.Second
+	defer func() { config.StallTimeout = saved }()
+
+	var out bytes.Buffer
+	if err := sd.resume(&out, 12345); err != nil {
+		t.Fatal("resume:", err)
+	}
+	if !bytes.Equal(out.Bytes(), body[12345:]) {
+		t.Error("resumed body mismatch")
+	}
+
+	sd.ifRange = modTime.Add(time.Hour).UTC().Format(http.TimeFormat)
+	out.Reset()
+	if err := sd.resume(&out, 12345); err == nil || out.Len() != 0 {
+		t.Error("changed file should fail resume, got", err)
+	}
+}
+
+func TestStallReader(t *testing.T) {
+	saved := config.StallTimeout
+	config.StallTimeout = 50 * time.Millisecond
+	defer func() { config.StallTimeout = saved }()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		c2.Write([]byte("data"))
+		// Stall.
+	}()
+	sr := stallReader{c1, c1}
+	b := make([]byte, 10)
+	if n, err := sr.Read(b); err != nil || n != 4 {
+		t.Fatal("read before stall:", n, err)
+	}
+	if _, err := sr.Read(b); !isErrTimeout(err) {
+		t.Error("stalled read should time out, got", err)
+	}
+}
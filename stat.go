@@ -1,10 +1,11 @@
 // Proxy statistics.
 
-package main
+package cow
 
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var status struct {
@@ -45,3 +46,55 @@ func incSrvConnCnt(srv string) int {
 func decSrvConnCnt(srv string) int {
 	return addSrvConnCnt(srv, -1)
 }
+
+// Client connections tracked for admin list-connections command. Only
+// enabled when admin socket is configured.
+type cliConnInfo struct {
+	start   time.Time
+	request string // last request
+	process string // local client process, empty if unknown
+}
+
+var cliConns struct {
+	sync.Mutex
+	info map[*clientConn]*cliConnInfo
+}
+
+func trackCliConn(c *clientConn) {
+	cliConns.Lock()
+	if cliConns.info != nil {
+		cliConns.info[c] = &cliConnInfo{start: time.Now()}
+	}
+	cliConns.Unlock()
+}
+
+func untrackCliConn(c *clientConn) {
+	cliConns.Lock()
+	if cliConns.info != nil {
+		delete(cliConns.info, c)
+	}
+	cliConns.Unlock()
+}
+
+// cliConnTracked returns true if client connections are tracked.
+func cliConnTracked() bool {
+	cliConns.Lock()
+	defer cliConns.Unlock()
+	return cliConns.info != nil
+}
+
+func setCliConnProcess(c *clientConn, process string) {
+	cliConns.Lock()
+	if ci, ok := cliConns.info[c]; ok {
+		ci.process = process
+	}
+	cliConns.Unlock()
+}
+
+func setCliConnRequest(c *clientConn, r *Request) {
+	cliConns.Lock()
+	if ci, ok := cliConns.info[c]; ok {
+		ci.request = r.String()
+	}
+	cliConns.Unlock()
+}
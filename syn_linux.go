@@ -0,0 +1,62 @@
+// +build linux,!386
+
+package cow
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tcpSaveSYN  = 27
+	tcpSavedSYN = 28
+)
+
+const synSaveSupported = true
+
+// saveSYN makes the kernel keep SYN of connections accepted by ln.
+func saveSYN(ln net.Listener) error {
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		return errors.New("not tcp listener")
+	}
+	raw, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpSaveSYN, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// savedSYN returns IP and TCP header of the SYN of conn, nil if not saved.
+// Kernel frees the saved SYN after it's read.
+func savedSYN(conn net.Conn) []byte {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	buf := make([]byte, 512)
+	n := uint32(len(buf))
+	raw.Control(func(fd uintptr) {
+		_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, tcpSavedSYN,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)), 0)
+		if e != 0 {
+			err = e
+		}
+	})
+	if err != nil || n == 0 {
+		return nil
+	}
+	return buf[:n]
+}
@@ -0,0 +1,18 @@
+// +build !linux linux,386
+
+package cow
+
+import (
+	"errors"
+	"net"
+)
+
+const synSaveSupported = false
+
+func saveSYN(ln net.Listener) error {
+	return errors.New("saving SYN is not supported on this platform")
+}
+
+func savedSYN(conn net.Conn) []byte {
+	return nil
+}
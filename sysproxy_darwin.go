@@ -0,0 +1,188 @@
+package cow
+
+// Set OS X system proxy for the active network service while cow is running,
+// just like what GUI proxy clients do. We shell out to networksetup instead
+// of calling the SystemConfiguration framework to avoid cgo.
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/cyfdecyf/bufio"
+)
+
+const networksetup = "/usr/sbin/networksetup"
+
+// Network service whose proxy setting is changed by cow, empty if not set.
+var sysProxyService string
+
+func runNetworksetup(args ...string) error {
+	out, err := exec.Command(networksetup, args...).CombinedOutput()
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(out)) + " " + err.Error())
+	}
+	return nil
+}
+
+// defaultRouteInterface returns the device name used by the default route,
+// e.g. en0.
+func defaultRouteInterface() (string, error) {
+	out, err := exec.Command("/sbin/route", "-n", "get", "default").Output()
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "interface:") {
+			return strings.TrimSpace(line[len("interface:"):]), nil
+		}
+	}
+	return "", errors.New("no default route")
+}
+
+// activeNetworkService finds the network service name (e.g. Wi-Fi) for the
+// interface with default route. networksetup -listnetworkserviceorder output
+// looks like:
+//
+//	(1) Wi-Fi
+//	(Hardware Port: Wi-Fi, Device: en0)
+func activeNetworkService() (string, error) {
+	dev, err := defaultRouteInterface()
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command(networksetup, "-listnetworkserviceorder").Output()
+	if err != nil {
+		return "", err
+	}
+	var service string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "(Hardware Port:") {
+			if strings.HasSuffix(line, "Device: "+dev+")") && service != "" {
+				return service, nil
+			}
+			continue
+		}
+		// Service line starts with "(n) ", disabled service starts with "(*)".
+		if id := strings.Index(line, ") "); strings.HasPrefix(line, "(") && id != -1 {
+			service = line[id+2:]
+		}
+	}
+	return "", errors.New("no network service for device " + dev)
+}
+
+// systemProxyAddr returns the address of the first http listen address which
+// can be used by local applications.
+func systemProxyAddr() (host, port string, ok bool) {
+	for _, proxy := range listenProxy {
+		hp, isHttp := proxy.(*httpProxy)
+		if !isHttp {
+			continue
+		}
+		host, port, _ = net.SplitHostPort(hp.addr)
+		// Wildcard address (including IPv6 "::") can't be used as proxy.
+		if host == "" || net.ParseIP(host).IsUnspecified() {
+			host = "127.0.0.1"
+		}
+		return host, port, true
+	}
+	return "", "", false
+}
+
+func setSystemProxy() {
+	if config.SystemProxy == "" {
+		return
+	}
+	host, port, ok := systemProxyAddr()
+	if !ok {
+		errl.Println("systemProxy: no http listen address")
+		return
+	}
+	service, err := activeNetworkService()
+	if err != nil {
+		errl.Println("systemProxy: can't find active network service:", err)
+		return
+	}
+
+	switch config.SystemProxy {
+	case "pac":
+		pacURL := "http://" + net.JoinHostPort(host, port) + "/pac"
+		err = runNetworksetup("-setautoproxyurl", service, pacURL)
+	case "http":
+		if err = runNetworksetup("-setwebproxy", service, host, port); err == nil {
+			err = runNetworksetup("-setsecurewebproxy", service, host, port)
+		}
+	}
+	if err != nil {
+		errl.Printf("systemProxy: set %s proxy for %s: %v\n", config.SystemProxy, service, err)
+		return
+	}
+	sysProxyService = service
+	info.Printf("system %s proxy set for network service %s\n", config.SystemProxy, service)
+}
+
+// unsetSystemProxy turns off the proxy setting changed by setSystemProxy.
+func unsetSystemProxy() {
+	if sysProxyService == "" {
+		return
+	}
+	var err error
+	switch config.SystemProxy {
+	case "pac":
+		err = runNetworksetup("-setautoproxystate", sysProxyService, "off")
+	case "http":
+		if err = runNetworksetup("-setwebproxystate", sysProxyService, "off"); err == nil {
+			err = runNetworksetup("-setsecurewebproxystate", sysProxyService, "off")
+		}
+	}
+	if err != nil {
+		errl.Printf("systemProxy: unset proxy for %s: %v\n", sysProxyService, err)
+		return
+	}
+	info.Printf("system proxy unset for network service %s\n", sysProxyService)
+	sysProxyService = ""
+}
+
+// systemUpstreamProxy reads proxy setting of the primary network service.
+// scutil --proxy output looks like:
+//
+//	<dictionary> {
+//	  HTTPEnable : 1
+//	  HTTPPort : 8080
+//	  HTTPProxy : proxy.example.com
+//	  ProxyAutoConfigEnable : 1
+//	  ProxyAutoConfigURLString : http://wpad.example.com/proxy.pac
+//	}
+func systemUpstreamProxy() (server, pacURL string, err error) {
+	out, err := exec.Command("/usr/sbin/scutil", "--proxy").Output()
+	if err != nil {
+		return "", "", err
+	}
+	setting := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), " : ", 2)
+		if len(kv) == 2 {
+			setting[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	for _, proto := range []string{"HTTPS", "HTTP"} {
+		if setting[proto+"Enable"] == "1" && setting[proto+"Proxy"] != "" {
+			server = setting[proto+"Proxy"]
+			if port := setting[proto+"Port"]; port != "" {
+				server = net.JoinHostPort(server, port)
+			}
+			break
+		}
+	}
+	if setting["ProxyAutoConfigEnable"] == "1" {
+		pacURL = setting["ProxyAutoConfigURLString"]
+	}
+	return server, pacURL, scanner.Err()
+}
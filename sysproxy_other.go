@@ -0,0 +1,17 @@
+// +build !darwin,!windows
+
+package cow
+
+func setSystemProxy() {
+	if config.SystemProxy != "" {
+		errl.Println("systemProxy is only supported on OS X")
+	}
+}
+
+func unsetSystemProxy() {}
+
+// systemUpstreamProxy returns proxy configured in OS settings. Only
+// environment variables are used on this platform.
+func systemUpstreamProxy() (server, pacURL string, err error) {
+	return "", "", nil
+}
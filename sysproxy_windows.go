@@ -0,0 +1,66 @@
+package cow
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+
+	"github.com/cyfdecyf/bufio"
+)
+
+func setSystemProxy() {
+	if config.SystemProxy != "" {
+		errl.Println("systemProxy is only supported on OS X")
+	}
+}
+
+func unsetSystemProxy() {}
+
+const internetSettingsKey = `HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// systemUpstreamProxy reads proxy setting of Internet Options from registry.
+// reg query output looks like:
+//
+//	ProxyEnable    REG_DWORD    0x1
+//	ProxyServer    REG_SZ    http=proxy:8080;https=proxy:8080
+//	AutoConfigURL    REG_SZ    http://wpad.example.com/proxy.pac
+func systemUpstreamProxy() (server, pacURL string, err error) {
+	out, err := exec.Command("reg", "query", internetSettingsKey).Output()
+	if err != nil {
+		return "", "", err
+	}
+	var enabled bool
+	var proxyServer string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) != 3 {
+			continue
+		}
+		switch f[0] {
+		case "ProxyEnable":
+			enabled = f[2] == "0x1"
+		case "ProxyServer":
+			proxyServer = f[2]
+		case "AutoConfigURL":
+			pacURL = f[2]
+		}
+	}
+	if enabled {
+		server = proxyServer
+		// Per protocol setting, prefer https.
+		if strings.Contains(proxyServer, "=") {
+			server = ""
+			for _, s := range strings.Split(proxyServer, ";") {
+				if strings.HasPrefix(s, "https=") {
+					server = s[len("https="):]
+					break
+				}
+				if strings.HasPrefix(s, "http=") {
+					server = s[len("http="):]
+				}
+			}
+		}
+	}
+	return server, pacURL, scanner.Err()
+}
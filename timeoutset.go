@@ -1,46 +1,110 @@
-package main
+package cow
 
 import (
+	"sort"
 	"sync"
 	"time"
 )
 
+// TimeoutSet holds keys for timeout duration after they are added, each key
+// has an associated value.
 type TimeoutSet struct {
 	sync.RWMutex
-	time    map[string]time.Time
+	time    map[string]timeoutEntry
 	timeout time.Duration
 }
 
+type timeoutEntry struct {
+	Key   string
+	Value string
+	Added time.Time
+}
+
 func NewTimeoutSet(timeout time.Duration) *TimeoutSet {
-	ts := &TimeoutSet{time: make(map[string]time.Time),
+	ts := &TimeoutSet{time: make(map[string]timeoutEntry),
 		timeout: timeout,
 	}
 	return ts
 }
 
-func (ts *TimeoutSet) add(key string) {
+func (ts *TimeoutSet) add(key, value string) {
 	now := time.Now()
 	ts.Lock()
-	ts.time[key] = now
+	ts.purge(now)
+	ts.time[key] = timeoutEntry{key, value, now}
 	ts.Unlock()
 }
 
-func (ts *TimeoutSet) has(key string) bool {
+// purge removes expired keys, called with lock held.
+func (ts *TimeoutSet) purge(now time.Time) {
+	for k, e := range ts.time {
+		if now.Sub(e.Added) > ts.timeout {
+			delete(ts.time, k)
+		}
+	}
+}
+
+// get returns value of key if it has not expired.
+func (ts *TimeoutSet) get(key string) (string, bool) {
 	ts.RLock()
-	t, ok := ts.time[key]
+	e, ok := ts.time[key]
 	ts.RUnlock()
 	if !ok {
-		return false
+		return "", false
 	}
-	if time.Now().Sub(t) > ts.timeout {
+	if time.Now().Sub(e.Added) > ts.timeout {
 		ts.del(key)
-		return false
+		return "", false
 	}
-	return true
+	return e.Value, true
 }
 
-func (ts *TimeoutSet) del(key string) {
+func (ts *TimeoutSet) has(key string) bool {
+	_, ok := ts.get(key)
+	return ok
+}
+
+func (ts *TimeoutSet) del(key string) bool {
 	ts.Lock()
+	_, ok := ts.time[key]
 	delete(ts.time, key)
 	ts.Unlock()
+	return ok
+}
+
+// delValue removes all keys with value, returns the number removed.
+func (ts *TimeoutSet) delValue(value string) (n int) {
+	ts.Lock()
+	for k, e := range ts.time {
+		if e.Value == value {
+			delete(ts.time, k)
+			n++
+		}
+	}
+	ts.Unlock()
+	return
+}
+
+// expire returns when the entry expires.
+func (ts *TimeoutSet) expire(e timeoutEntry) time.Time {
+	return e.Added.Add(ts.timeout)
+}
+
+type byAdded []timeoutEntry
+
+func (a byAdded) Len() int           { return len(a) }
+func (a byAdded) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAdded) Less(i, j int) bool { return a[i].Added.Before(a[j].Added) }
+
+// list returns entries not expired, oldest first.
+func (ts *TimeoutSet) list() []timeoutEntry {
+	ts.Lock()
+	ts.purge(time.Now())
+	entry := make([]timeoutEntry, 0, len(ts.time))
+	for _, e := range ts.time {
+		entry = append(entry, e)
+	}
+	ts.Unlock()
+	sort.Sort(byAdded(entry))
+	return entry
 }
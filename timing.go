@@ -0,0 +1,112 @@
+package cow
+
+// Server-Timing header for latency diagnostics.
+//
+// If serverTiming is enabled, responses passed from servers contain a
+// Server-Timing header with durations in milliseconds:
+//
+//   dns               resolve server host name, direct connections only
+//   connect           TCP connection to server or parent proxy
+//   parent-handshake  parent proxy protocol handshake after TCP connection
+//   ttfb              from request sent to response header received
+//
+// dns, connect and parent-handshake are only reported on the first response
+// of a new server connection. CONNECT replies contain the connection
+// metrics. Browsers show the header in developer tools, so users can report
+// latency without access to cow's log.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+const headerServerTiming = "Server-Timing"
+
+// timedConn records how long it takes to create the connection.
+type timedConn struct {
+	net.Conn
+	dns       time.Duration
+	dial      time.Duration
+	connected time.Time
+}
+
+// timed wraps c to record timing if serverTiming is enabled. dialStart is
+// when TCP connection starts, after DNS lookup.
+func timed(c net.Conn, dns time.Duration, dialStart time.Time) net.Conn {
+	if !config.ServerTiming {
+		return c
+	}
+	now := time.Now()
+	return &timedConn{c, dns, now.Sub(dialStart), now}
+}
+
+// findTimedConn returns the timedConn under server connection c, nil if not
+// found.
+func findTimedConn(c net.Conn) *timedConn {
+	for {
+		switch pc := c.(type) {
+		case *timedConn:
+			return pc
+		case directConn:
+			c = pc.Conn
+		case httpConn:
+			c = pc.Conn
+		case *tls.Conn:
+			c = pc.NetConn()
+		case socksConn:
+			c = pc.Conn
+		case shadowsocksConn:
+			c = pc.Conn
+		case cowConn:
+			c = pc.Conn
+		case *ss.Conn:
+			c = pc.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+func timingMetric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.1f", name, float64(d)/float64(time.Millisecond))
+}
+
+// connTiming returns metrics of creating server connection c, should be
+// called right after c is created.
+func connTiming(c net.Conn) string {
+	tc := findTimedConn(c)
+	if tc == nil {
+		return ""
+	}
+	var m []string
+	if tc.dns > 0 {
+		m = append(m, timingMetric("dns", tc.dns))
+	}
+	m = append(m, timingMetric("connect", tc.dial))
+	if _, ok := c.(directConn); !ok {
+		m = append(m, timingMetric("parent-handshake", time.Now().Sub(tc.connected)))
+	}
+	return strings.Join(m, ", ")
+}
+
+// timingHeader returns Server-Timing header line, connection metrics are
+// only included once. ttfb is not included if negative.
+func (sv *serverConn) timingHeader(ttfb time.Duration) string {
+	m := sv.connTiming
+	sv.connTiming = ""
+	if ttfb >= 0 {
+		if m != "" {
+			m += ", "
+		}
+		m += timingMetric("ttfb", ttfb)
+	}
+	if m == "" {
+		return ""
+	}
+	return headerServerTiming + ": " + m + CRLF
+}
@@ -0,0 +1,45 @@
+package cow
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimingHeader(t *testing.T) {
+	sv := &serverConn{connTiming: "dns;dur=1.5, connect;dur=20.0"}
+	if h := sv.timingHeader(-1); h != "Server-Timing: dns;dur=1.5, connect;dur=20.0\r\n" {
+		t.Errorf("CONNECT reply got %q", h)
+	}
+	sv.connTiming = "connect;dur=3.0"
+	if h := sv.timingHeader(1234567 * time.Nanosecond); h != "Server-Timing: connect;dur=3.0, ttfb;dur=1.2\r\n" {
+		t.Errorf("first response got %q", h)
+	}
+	// Connection metrics are reported only once.
+	if h := sv.timingHeader(5 * time.Millisecond); h != "Server-Timing: ttfb;dur=5.0\r\n" {
+		t.Errorf("reused connection got %q", h)
+	}
+	if h := sv.timingHeader(-1); h != "" {
+		t.Errorf("no metrics got %q", h)
+	}
+}
+
+func TestConnTiming(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	tc := &timedConn{c1, 2 * time.Millisecond, 10 * time.Millisecond, time.Now()}
+	if m := connTiming(directConn{tc}); m != "dns;dur=2.0, connect;dur=10.0" {
+		t.Errorf("direct got %q", m)
+	}
+	tc.dns = 0
+	tc.connected = time.Now().Add(-30 * time.Millisecond)
+	m := connTiming(socksConn{tc, nil})
+	if len(m) < 40 || m[:39] != "connect;dur=10.0, parent-handshake;dur=" {
+		t.Errorf("parent got %q", m)
+	}
+	if m := connTiming(directConn{c1}); m != "" {
+		t.Errorf("untimed connection got %q", m)
+	}
+}
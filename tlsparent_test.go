@@ -0,0 +1,87 @@
+package cow
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTLSSessionResume(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "cow-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := config.TlsSessionFile
+	config.TlsSessionFile = path.Join(dir, "tls-session")
+	defer func() { config.TlsSessionFile = saved }()
+	defer func() {
+		tlsSessions.Lock()
+		tlsSessions.session = make(map[string]*tls.ClientSessionState)
+		tlsSessions.Unlock()
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	hp := newHttpParent(ts.Listener.Addr().String())
+	hp.tls = &tls.Config{ServerName: "example.com", RootCAs: roots, ClientSessionCache: tlsSessions}
+
+	// connect makes a request so that TLS 1.3 session tickets are received.
+	connect := func() bool {
+		c, err := net.Dial("tcp", hp.server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, err = hp.handshake(c); err != nil {
+			t.Fatal("handshake:", err)
+		}
+		defer c.Close()
+		c.Write([]byte("GET / HTTP/1.0\r\nHost: example.com\r\n\r\n"))
+		ioutil.ReadAll(c)
+		return c.(*tls.Conn).ConnectionState().DidResume
+	}
+	if connect() {
+		t.Error("first connection should not resume")
+	}
+	if !connect() {
+		t.Error("second connection should resume")
+	}
+
+	b, err := tlsSessions.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sealTLSSessions(b); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(config.TlsSessionFile + ".key"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key file should be only readable by owner: %v", err)
+	}
+	tlsSessions.Lock()
+	tlsSessions.session = make(map[string]*tls.ClientSessionState)
+	tlsSessions.Unlock()
+	if err = loadTLSSessions(); err != nil {
+		t.Fatal("load:", err)
+	}
+	if !connect() {
+		t.Error("connection should resume with loaded session")
+	}
+
+	// Tampered file should be rejected.
+	msg, _ := ioutil.ReadFile(config.TlsSessionFile)
+	msg[len(msg)-1] ^= 1
+	ioutil.WriteFile(config.TlsSessionFile, msg, 0600)
+	if err = loadTLSSessions(); err == nil {
+		t.Error("should fail on tampered session file")
+	}
+}
@@ -0,0 +1,140 @@
+package cow
+
+// Parent proxy transports.
+//
+// Each protocol in "proxy = protocol://address" is a transport registered
+// with registerTransport, which creates the parent proxy from the address.
+// New protocols can be added in a separate file calling registerTransport in
+// its init function, without changing routing code. Build tags can be used
+// to include the file optionally.
+//
+// Transports can also be implemented as external adapter programs, see
+// "transport" option. Adapter is started for each connection like ssh's
+// ProxyCommand, with the parent address and the target host:port appended to
+// its arguments:
+//
+//   command args... address host:port
+//
+// Adapter's stdin and stdout are connected to cow. After connecting to the
+// target, the adapter writes one line "OK" to stdout, then copies data
+// between stdin/stdout and the target until either side closes. Any other
+// line is taken as error message and the connection fails.
+//
+// The https transport writes NSS key log to sslKeyLogFile. Adapters
+// implementing TLS based protocols can write NSS key log to SSLKEYLOGFILE,
+// which is set to sslKeyLogFile option, so tools like Wireshark can decrypt
+// the traffic.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// parentTransport creates parent proxy from address in proxy option, errors
+// in address are fatal.
+type parentTransport func(pp proxyParser, addr string) ParentProxy
+
+var parentTransports = make(map[string]parentTransport)
+
+func registerTransport(protocol string, t parentTransport) {
+	if _, ok := parentTransports[protocol]; ok {
+		panic("transport " + protocol + " registered twice")
+	}
+	parentTransports[protocol] = t
+}
+
+func init() {
+	registerTransport("http", proxyParser.ProxyHttp)
+	registerTransport("socks5", proxyParser.ProxySocks5)
+	registerTransport("ss", proxyParser.ProxySs)
+	registerTransport("cow", proxyParser.ProxyCow)
+}
+
+// adapterTransport returns transport using the external adapter program.
+func adapterTransport(protocol string, args []string) parentTransport {
+	return func(pp proxyParser, addr string) ParentProxy {
+		if err := checkServerAddr(addr); err != nil {
+			Fatal("parent", protocol, "server", err)
+		}
+		if pp.bind != nil {
+			Fatal("parent", protocol, "server", addr+": bind options are not supported")
+		}
+		return &adapterParent{protocol: protocol, server: addr, args: args}
+	}
+}
+
+type adapterParent struct {
+	protocol string
+	server   string
+	args     []string // command and arguments
+}
+
+type adapterConn struct {
+	net.Conn
+	parent *adapterParent
+}
+
+func (s adapterConn) String() string {
+	return s.parent.protocol + " adapter " + s.parent.server
+}
+
+func (ap *adapterParent) getServer() string {
+	return ap.server
+}
+
+func (ap *adapterParent) genConfig() string {
+	return fmt.Sprintf("proxy = %s://%s", ap.protocol, ap.server)
+}
+
+func (ap *adapterParent) connect(url *URL) (net.Conn, error) {
+	c, err := startAdapter(ap.args, ap.server, url.HostPort)
+	if err != nil {
+		errl.Printf("can't start %s adapter for %s: %v\n", ap.protocol, url.HostPort, err)
+		return nil, err
+	}
+	if err = readAdapterStatus(c, config.DialTimeout); err != nil {
+		errl.Printf("%s adapter %s for %s: %v\n", ap.protocol, ap.server, url.HostPort, err)
+		c.Close()
+		return nil, err
+	}
+	debug.Printf("connected to: %s through %s adapter %s\n", url.HostPort, ap.protocol, ap.server)
+	return adapterConn{c, ap}, nil
+}
+
+const maxAdapterStatusLen = 1024
+
+// readAdapterStatus reads the status line written by adapter after it's
+// connected. Read byte by byte as data after the line belongs to the client.
+func readAdapterStatus(c net.Conn, timeout time.Duration) error {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxAdapterStatusLen {
+		if _, err := c.Read(b); err != nil {
+			return err
+		}
+		if b[0] == '\n' {
+			status := strings.TrimSpace(string(line))
+			if status == "OK" {
+				return nil
+			}
+			return errors.New(status)
+		}
+		line = append(line, b[0])
+	}
+	return errors.New("status line too long")
+}
+
+func isTransportName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '+' || c == '.') {
+			return false
+		}
+	}
+	return name != ""
+}
@@ -0,0 +1,67 @@
+package cow
+
+import (
+	"bufio"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestReadAdapterStatus(t *testing.T) {
+	testData := []struct {
+		data string
+		err  string
+	}{
+		{"OK\nrest", ""},
+		{"OK\r\n", ""},
+		{"connection refused\n", "connection refused"},
+	}
+	for _, td := range testData {
+		c1, c2 := net.Pipe()
+		go func(data string) {
+			c2.Write([]byte(data))
+			c2.Close()
+		}(td.data)
+		err := readAdapterStatus(c1, time.Second)
+		if td.err == "" && err != nil {
+			t.Errorf("%q should be ok, got %v", td.data, err)
+		} else if td.err != "" && (err == nil || err.Error() != td.err) {
+			t.Errorf("%q should fail with %s, got %v", td.data, td.err, err)
+		}
+		c1.Close()
+	}
+}
+
+func TestAdapterTransport(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("adapter is not supported on Windows")
+	}
+	// Echo arguments after status line, then copy stdin.
+	old := config.SslKeyLogFile
+	defer func() { config.SslKeyLogFile = old }()
+	config.SslKeyLogFile = "/tmp/keys.log"
+	tr := adapterTransport("echo", []string{"sh", "-c", `echo OK; echo "$1 $2 $SSLKEYLOGFILE"; cat`, "sh"})
+	ap := tr(proxyParser{}, "127.0.0.1:1234")
+	if ap.genConfig() != "proxy = echo://127.0.0.1:1234" {
+		t.Error("wrong config:", ap.genConfig())
+	}
+	url := &URL{}
+	url.ParseHostPort("www.example.com:443")
+	c, err := ap.connect(url)
+	if err != nil {
+		t.Fatal("connect:", err)
+	}
+	defer c.Close()
+	if routeName(c) != "echo://127.0.0.1:1234" {
+		t.Error("wrong route name:", routeName(c))
+	}
+	c.Write([]byte("hello\n"))
+	rd := bufio.NewReader(c)
+	for _, expected := range []string{"127.0.0.1:1234 www.example.com:443 /tmp/keys.log\n", "hello\n"} {
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if line, err := rd.ReadString('\n'); line != expected {
+			t.Errorf("should read %q, got %q %v", expected, line, err)
+		}
+	}
+}
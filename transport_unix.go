@@ -0,0 +1,40 @@
+// +build darwin freebsd linux netbsd openbsd
+
+package cow
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// startAdapter starts adapter program with one end of a socket pair as its
+// stdin and stdout, so the connection supports deadlines like TCP
+// connections.
+func startAdapter(args []string, server, target string) (net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	local := os.NewFile(uintptr(fds[0]), "adapter")
+	remote := os.NewFile(uintptr(fds[1]), "adapter")
+	defer local.Close()
+	defer remote.Close()
+
+	cmd := exec.Command(args[0], append(args[1:], server, target)...)
+	cmd.Stdin = remote
+	cmd.Stdout = remote
+	cmd.Stderr = os.Stderr
+	if config.SslKeyLogFile != "" {
+		cmd.Env = append(os.Environ(), "SSLKEYLOGFILE="+config.SslKeyLogFile)
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	// Reap the adapter when it exits, it should exit after stdin is closed.
+	go cmd.Wait()
+	return net.FileConn(local)
+}
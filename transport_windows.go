@@ -0,0 +1,10 @@
+package cow
+
+import (
+	"errors"
+	"net"
+)
+
+func startAdapter(args []string, server, target string) (net.Conn, error) {
+	return nil, errors.New("transport adapter is not supported on Windows")
+}
@@ -0,0 +1,85 @@
+package cow
+
+// TUN device mode with an external tun2socks program.
+//
+//   tun = tun2socks -device tun://cow0 -proxy {proxy}
+//
+// cow doesn't implement a TCP/IP stack. The tun option runs a program like
+// tun2socks (github.com/xjasonlyu/tun2socks, built on gVisor netstack),
+// which creates the TUN device, terminates TCP connections captured from it
+// and sends them to cow's http listener as CONNECT requests, so they are
+// routed like requests from browsers. "{proxy}" in arguments is replaced
+// with http://address of the first http listener. With fakeDNS, CONNECT to
+// fake addresses use the original host names.
+//
+// The program is started after cow listens, restarted if it exits, and
+// terminated when cow exits (scripts should exec the program so it gets the
+// signal). Routes to the TUN device are set up outside of cow, e.g. in the
+// program's post up script. UDP is not relayed as the http listener only
+// serves TCP.
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const tunRestartDelay = 5 * time.Second
+
+// tunArgs returns command line of the TUN program.
+func tunArgs(args []string, proxy string) []string {
+	res := make([]string, len(args))
+	for i, a := range args {
+		res[i] = strings.Replace(a, "{proxy}", "http://"+proxy, -1)
+	}
+	return res
+}
+
+// runTun runs the TUN program until quit is closed.
+func runTun(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	proxy := localHttpProxyAddr()
+	if proxy == "" {
+		Fatal("tun requires http listener")
+	}
+	args := tunArgs(config.Tun, proxy)
+	for {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		info.Println("starting tun program:", strings.Join(args, " "))
+		if err := cmd.Start(); err != nil {
+			errl.Println("start tun program:", err)
+		} else {
+			done := make(chan error, 1)
+			go func() {
+				done <- cmd.Wait()
+			}()
+			select {
+			case err := <-done:
+				errl.Println("tun program exited:", err)
+			case <-quit:
+				// Let the program clean up routes, kill it if not exited in
+				// time. Signal fails on Windows.
+				if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+					cmd.Process.Kill()
+				}
+				select {
+				case <-done:
+				case <-time.After(tunRestartDelay):
+					cmd.Process.Kill()
+					<-done
+				}
+				return
+			}
+		}
+		select {
+		case <-time.After(tunRestartDelay):
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package cow
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTunArgs(t *testing.T) {
+	args := tunArgs([]string{"tun2socks", "-device", "tun://cow0", "-proxy", "{proxy}"}, "127.0.0.1:7777")
+	if !reflect.DeepEqual(args, []string{"tun2socks", "-device", "tun://cow0", "-proxy", "http://127.0.0.1:7777"}) {
+		t.Error("wrong args", args)
+	}
+}
+
+func TestRunTun(t *testing.T) {
+	savedTun, savedListen := config.Tun, listenProxy
+	defer func() { config.Tun, listenProxy = savedTun, savedListen }()
+	listenProxy = []Proxy{newHttpProxy("0.0.0.0:7777", "")}
+	config.Tun = []string{"sleep", "60"}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	quit := make(chan struct{})
+	go runTun(&wg, quit)
+	time.Sleep(100 * time.Millisecond)
+	close(quit)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("tun program should be killed on quit")
+	}
+}
@@ -0,0 +1,281 @@
+package cow
+
+// Self update: "cow update" downloads the binary for the running platform
+// from the latest GitHub release, verifies its signature and replaces the
+// running executable.
+//
+// Release archives (.gz, or .zip for Windows) are signed with ECDSA P-256
+// over SHA-256, the signature is the DER output of:
+//
+//   openssl dgst -sha256 -sign release-key.pem -out <archive>.sig <archive>
+//
+// The public key (base64 encoded DER) is embedded at build time with
+//
+//   go build -ldflags "-X github.com/cyfdecyf/cow.updatePubKey=<base64 key>" ./cmd/cow
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	releaseFeedURL = "https://api.github.com/repos/cyfdecyf/cow/releases/latest"
+	releaseBaseURL = "https://github.com/cyfdecyf/cow/releases/download/"
+)
+
+// Public key to verify release binaries, set by build script.
+var updatePubKey string
+
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+// releaseArch returns the binary name suffix used by build.sh and
+// install-cow.sh, e.g. linux64, mac64, linux-armv5tel.
+func releaseArch() (string, error) {
+	var osName string
+	switch runtime.GOOS {
+	case "darwin":
+		osName = "mac"
+	case "linux":
+		osName = "linux"
+	case "windows":
+		osName = "win"
+	default:
+		return "", errors.New(runtime.GOOS + " has no precompiled binary")
+	}
+
+	switch runtime.GOARCH {
+	case "amd64":
+		return osName + "64", nil
+	case "386":
+		return osName + "32", nil
+	case "mipsle":
+		return osName + "-mipsle", nil
+	case "arm":
+		// The binary is built for a specific GOARM, which is not available
+		// at run time, so detect like install-cow.sh.
+		out, err := exec.Command("uname", "-m").Output()
+		if err != nil {
+			return "", err
+		}
+		arch := strings.TrimSpace(string(out))
+		if arch == "armv5tel" {
+			return osName + "-armv5tel", nil
+		}
+		cpuinfo, err := ioutil.ReadFile("/proc/cpuinfo")
+		if err == nil && !bytes.Contains(cpuinfo, []byte("vfp")) {
+			// arm without vfp must use GOARM=5 binary
+			return osName + "-armv5tel", nil
+		}
+		return osName + "-" + arch, nil
+	}
+	return "", errors.New(runtime.GOARCH + " has no precompiled binary")
+}
+
+func httpGet(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func latestVersion() (string, error) {
+	b, err := httpGet(releaseFeedURL)
+	if err != nil {
+		return "", err
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err = json.Unmarshal(b, &release); err != nil {
+		return "", fmt.Errorf("decode release feed: %v", err)
+	}
+	if release.TagName == "" {
+		return "", errors.New("release feed has no tag name")
+	}
+	return release.TagName, nil
+}
+
+// versionNewer reports whether dotted version a is newer than b.
+func versionNewer(a, b string) bool {
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var na, nb int
+		if i < len(pa) {
+			fmt.Sscanf(pa[i], "%d", &na)
+		}
+		if i < len(pb) {
+			fmt.Sscanf(pb[i], "%d", &nb)
+		}
+		if na != nb {
+			return na > nb
+		}
+	}
+	return false
+}
+
+func verifySignature(data, sig []byte) error {
+	if updatePubKey == "" {
+		return errors.New("no public key built in, can't verify signature")
+	}
+	der, err := base64.StdEncoding.DecodeString(updatePubKey)
+	if err != nil {
+		return fmt.Errorf("decode public key: %v", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return fmt.Errorf("parse public key: %v", err)
+	}
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("public key is not ECDSA")
+	}
+	var rs struct {
+		R, S *big.Int
+	}
+	if _, err = asn1.Unmarshal(sig, &rs); err != nil {
+		return fmt.Errorf("parse signature: %v", err)
+	}
+	hash := sha256.Sum256(data)
+	if !ecdsa.Verify(pub, hash[:], rs.R, rs.S) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// extractBinary returns the executable inside the downloaded archive.
+func extractBinary(archive []byte) ([]byte, error) {
+	if runtime.GOOS == "windows" {
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if f.Name != "cow.exe" {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return ioutil.ReadAll(rc)
+		}
+		return nil, errors.New("no cow.exe in zip file")
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return ioutil.ReadAll(gr)
+}
+
+// replaceBinary puts the new binary in place of exe. The old binary is kept
+// as exe.old until the new one is checked to run, and is restored on any
+// failure.
+func replaceBinary(exe string, bin []byte, newVer string) (err error) {
+	newExe := exe + ".new"
+	oldExe := exe + ".old"
+	if err = ioutil.WriteFile(newExe, bin, 0755); err != nil {
+		return err
+	}
+	defer os.Remove(newExe)
+
+	// Windows don't allow rename to existing file, but renaming the running
+	// executable is fine.
+	os.Remove(oldExe)
+	if err = os.Rename(exe, oldExe); err != nil {
+		return fmt.Errorf("backup old binary: %v", err)
+	}
+	rollback := func(reason error) error {
+		os.Remove(exe)
+		if rerr := os.Rename(oldExe, exe); rerr != nil {
+			return fmt.Errorf("%v, rollback failed: %v, old binary is %s", reason, rerr, oldExe)
+		}
+		return fmt.Errorf("%v, rolled back", reason)
+	}
+	if err = os.Rename(newExe, exe); err != nil {
+		return rollback(fmt.Errorf("install new binary: %v", err))
+	}
+
+	out, err := exec.Command(exe, "-version").Output()
+	if err != nil {
+		return rollback(fmt.Errorf("run new binary: %v", err))
+	}
+	if !strings.Contains(string(out), strings.TrimPrefix(newVer, "v")) {
+		return rollback(fmt.Errorf("new binary reports wrong version: %s", bytes.TrimSpace(out)))
+	}
+	os.Remove(oldExe)
+	return nil
+}
+
+func selfUpdate() error {
+	exe, err := lookPath()
+	if err != nil {
+		return fmt.Errorf("can't find cow executable: %v", err)
+	}
+	arch, err := releaseArch()
+	if err != nil {
+		return err
+	}
+	newVer, err := latestVersion()
+	if err != nil {
+		return fmt.Errorf("check latest version: %v", err)
+	}
+	if !versionNewer(newVer, version) {
+		fmt.Println("cow", version, "is up to date")
+		return nil
+	}
+
+	name := "cow-" + arch + "-" + newVer
+	if runtime.GOOS == "windows" {
+		name += ".zip"
+	} else {
+		name += ".gz"
+	}
+	url := releaseBaseURL + newVer + "/" + name
+	fmt.Println("downloading", url)
+	archive, err := httpGet(url)
+	if err != nil {
+		return err
+	}
+	sig, err := httpGet(url + ".sig")
+	if err != nil {
+		return fmt.Errorf("download signature: %v", err)
+	}
+	if err = verifySignature(archive, sig); err != nil {
+		return fmt.Errorf("verify %s: %v", name, err)
+	}
+	bin, err := extractBinary(archive)
+	if err != nil {
+		return fmt.Errorf("extract %s: %v", name, err)
+	}
+	if err = replaceBinary(exe, bin, newVer); err != nil {
+		return err
+	}
+	fmt.Printf("updated %s from %s to %s\n", exe, version, newVer)
+	return nil
+}
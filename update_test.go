@@ -0,0 +1,69 @@
+package cow
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"testing"
+)
+
+func TestVersionNewer(t *testing.T) {
+	testData := []struct {
+		a, b  string
+		newer bool
+	}{
+		{"0.9.9", "0.9.8", true},
+		{"0.9.8", "0.9.8", false},
+		{"0.9.7", "0.9.8", false},
+		{"1.0", "0.9.8", true},
+		{"0.10.0", "0.9.8", true},
+		{"v0.9.9", "0.9.8", true},
+		{"0.9.8.1", "0.9.8", true},
+	}
+	for _, td := range testData {
+		if versionNewer(td.a, td.b) != td.newer {
+			t.Errorf("%s newer than %s should be %v\n", td.a, td.b, td.newer)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := updatePubKey
+	defer func() { updatePubKey = saved }()
+	updatePubKey = base64.StdEncoding.EncodeToString(der)
+
+	data := []byte("cow binary")
+	hash := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = verifySignature(data, sig); err != nil {
+		t.Error("valid signature should pass verification:", err)
+	}
+	if err = verifySignature([]byte("tampered binary"), sig); err == nil {
+		t.Error("signature of tampered data should fail verification")
+	}
+	updatePubKey = ""
+	if err = verifySignature(data, sig); err == nil {
+		t.Error("verification should fail without public key")
+	}
+}
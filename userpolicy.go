@@ -0,0 +1,307 @@
+package cow
+
+// Per-user access control and traffic quota.
+//
+// Each line in userPasswdFile may have policy options after
+// user:password[:port], separated by spaces:
+//
+//   alice:secret allow=example.com,github.com maxConn=8 daily=1G monthly=20G
+//   bob:secret deny=facebook.com,twitter.com
+//   carol:secret admin
+//
+// Options are:
+//
+//   allow=domain[,domain]  only these domains and their sub domains can be
+//                          visited
+//   deny=domain[,domain]   these domains and their sub domains are denied
+//   maxConn=n              max number of concurrent client connections
+//   daily=size             traffic quota of each day, e.g. 500M
+//   monthly=size           traffic quota of each calendar month
+//   admin                  can see usage of all users in /stats
+//
+// Traffic is counted as metrics: bytes sent and received on server
+// connections. Usage of the current day and month is saved in metricsFile,
+// so quotas hold across restarts, and is not cleared by "metrics reset".
+// Requests are rejected once a quota is used up, established tunnels are
+// not cut.
+//
+// GET /stats on the listen address shows usage of the user, or all users
+// for admin. It requires basic authentication with user name and password
+// (e.g. curl -u alice:secret http://127.0.0.1:7777/stats), or a client IP
+// already authenticated as proxy.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const statsPath = "/stats"
+
+type userPolicy struct {
+	allow   []string // lower case domains, empty allows all
+	deny    []string
+	maxConn int32 // 0 means no limit
+	daily   int64 // quota in bytes, 0 means no limit
+	monthly int64
+	admin   bool
+}
+
+// userUsage counts traffic of a user in the current day and month. Counters
+// are updated atomically and must be first for 64 bit alignment.
+type userUsage struct {
+	Daily   trafficCnt `json:"daily"`
+	Monthly trafficCnt `json:"monthly"`
+	Day     string     `json:"day"`   // 2006-01-02 of Daily
+	Month   string     `json:"month"` // 2006-01 of Monthly
+
+	sync.Mutex       // for rolling over Day and Month
+	conn       int32 // current client connections
+}
+
+func parseUserPolicy(opt []string) (*userPolicy, error) {
+	p := &userPolicy{}
+	for _, s := range opt {
+		if s == "admin" {
+			p.admin = true
+			continue
+		}
+		id := strings.IndexByte(s, '=')
+		if id <= 0 || id == len(s)-1 {
+			return nil, errors.New("invalid user policy " + s)
+		}
+		key, val := s[:id], s[id+1:]
+		switch key {
+		case "allow", "deny":
+			var domain []string
+			for _, d := range strings.Split(strings.ToLower(val), ",") {
+				if d = strings.TrimSpace(d); d != "" {
+					domain = append(domain, d)
+				}
+			}
+			if key == "allow" {
+				p.allow = append(p.allow, domain...)
+			} else {
+				p.deny = append(p.deny, domain...)
+			}
+		case "maxConn":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return nil, errors.New("maxConn should be a positive integer")
+			}
+			p.maxConn = int32(n)
+		case "daily", "monthly":
+			n, err := sizeValue(val)
+			if err != nil || n == 0 {
+				return nil, errors.New(key + " should be a size like 1G")
+			}
+			if key == "daily" {
+				p.daily = n
+			} else {
+				p.monthly = n
+			}
+		default:
+			return nil, errors.New("unknown user policy " + key)
+		}
+	}
+	return p, nil
+}
+
+func domainListMatch(host string, domain []string) bool {
+	for _, d := range domain {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostAllowed returns false if user with policy p can't visit host.
+func (p *userPolicy) hostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	if len(p.allow) > 0 && !domainListMatch(host, p.allow) {
+		return false
+	}
+	return !domainListMatch(host, p.deny)
+}
+
+func usageOf(user string) *userUsage {
+	metrics.Lock()
+	u, ok := metrics.data.Usage[user]
+	if !ok {
+		u = &userUsage{}
+		metrics.data.Usage[user] = u
+	}
+	metrics.Unlock()
+	return u
+}
+
+func (u *userUsage) add(sent, recv int) {
+	if u == nil {
+		return
+	}
+	u.Daily.add(sent, recv)
+	u.Monthly.add(sent, recv)
+}
+
+// used returns bytes transferred in the day and month of now, counters are
+// cleared when a new day or month starts.
+func (u *userUsage) used(now time.Time) (day, month int64) {
+	u.Lock()
+	if d := now.Format("2006-01-02"); d != u.Day {
+		u.Day = d
+		atomic.StoreInt64(&u.Daily.Sent, 0)
+		atomic.StoreInt64(&u.Daily.Recv, 0)
+	}
+	if m := now.Format("2006-01"); m != u.Month {
+		u.Month = m
+		atomic.StoreInt64(&u.Monthly.Sent, 0)
+		atomic.StoreInt64(&u.Monthly.Recv, 0)
+	}
+	u.Unlock()
+	dc, mc := u.Daily.load(), u.Monthly.load()
+	return dc.Sent + dc.Recv, mc.Sent + mc.Recv
+}
+
+// snapshot returns a copy of u for saving.
+func (u *userUsage) snapshot() *userUsage {
+	u.Lock()
+	defer u.Unlock()
+	return &userUsage{Daily: u.Daily.load(), Monthly: u.Monthly.load(), Day: u.Day, Month: u.Month}
+}
+
+// userPolicyDenied returns the reason and message if the authenticated
+// user can't visit host, empty strings if allowed.
+func (c *clientConn) userPolicyDenied(host string) (reason, msg string) {
+	if c.usage == nil {
+		c.usage = usageOf(c.user)
+		atomic.AddInt32(&c.usage.conn, 1)
+	}
+	day, month := c.usage.used(time.Now())
+	p := auth.policy[c.user]
+	if p == nil {
+		return "", ""
+	}
+	if p.maxConn > 0 && atomic.LoadInt32(&c.usage.conn) > p.maxConn {
+		errl.Printf("cli(%s) user %s exceeds %d connections\n", c.RemoteAddr(), c.user, p.maxConn)
+		return "Too many connections", "Too many concurrent connections for the user."
+	}
+	if !p.hostAllowed(host) {
+		debug.Printf("cli(%s) user %s not allowed to visit %s\n", c.RemoteAddr(), c.user, host)
+		return "Forbidden", "The site is not allowed for the user."
+	}
+	if (p.daily > 0 && day >= p.daily) || (p.monthly > 0 && month >= p.monthly) {
+		debug.Printf("cli(%s) user %s traffic quota used up\n", c.RemoteAddr(), c.user)
+		return "Traffic quota exceeded", "Traffic quota of the user is used up."
+	}
+	return "", ""
+}
+
+// checkUserPolicy enforces policy of the authenticated user before
+// forwarding request r to host. Error page is sent if the request is
+// rejected, unless tunnel is already established for peeking SNI.
+func (c *clientConn) checkUserPolicy(r *Request, host string) error {
+	reason, msg := c.userPolicyDenied(host)
+	if reason == "" {
+		return nil
+	}
+	if !c.tunnelEstablished {
+		sendErrorPage(c, statusForbidden, reason, genErrMsg(r, nil, msg))
+	}
+	return errPageSent
+}
+
+func (c *clientConn) releaseUsage() {
+	if c.usage != nil {
+		atomic.AddInt32(&c.usage.conn, -1)
+		c.usage = nil
+	}
+}
+
+// statsUser returns the user requesting /stats from basic authorization
+// header or authenticated client IP.
+func (c *clientConn) statsUser(r *Request) (string, bool) {
+	var v string
+	if r.raw != nil {
+		v = parseRawHeader(r.rawHeaderBody())["authorization"]
+	}
+	if v != "" {
+		arr := strings.SplitN(v, " ", 2)
+		if len(arr) != 2 || !strings.EqualFold(arr[0], "basic") {
+			return "", false
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(arr[1]))
+		if err != nil {
+			return "", false
+		}
+		up := strings.SplitN(string(b), ":", 2)
+		if len(up) != 2 {
+			return "", false
+		}
+		if au, ok := findAuthUser(up[0]); !ok || !au.passwdMatch(up[1]) {
+			return "", false
+		}
+		return up[0], true
+	}
+	clientIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	return auth.authed.get(clientIP)
+}
+
+func formatQuota(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// sendStats sends traffic usage of users, one line for each user.
+func (c *clientConn) sendStats(r *Request) {
+	user, ok := c.statsUser(r)
+	if !ok {
+		body := "authentication required\n"
+		c.Write([]byte(fmt.Sprintf("HTTP/1.1 401 Unauthorized\r\n"+
+			"WWW-Authenticate: Basic realm=\"%s\"\r\n"+
+			"Content-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+			authRealm, len(body), body)))
+		return
+	}
+	var users []string
+	if p := auth.policy[user]; p != nil && p.admin {
+		metrics.Lock()
+		for u := range metrics.data.Usage {
+			users = append(users, u)
+		}
+		metrics.Unlock()
+		sort.Strings(users)
+	} else {
+		users = []string{user}
+	}
+	now := time.Now()
+	var b bytes.Buffer
+	b.WriteString("user\tconns\tday\tmonth\tdaily quota\tmonthly quota\n")
+	for _, name := range users {
+		u := usageOf(name)
+		day, month := u.used(now)
+		var daily, monthly int64
+		if p := auth.policy[name]; p != nil {
+			daily, monthly = p.daily, p.monthly
+		}
+		fmt.Fprintf(&b, "%s\t%d\t%d\t%d\t%s\t%s\n", name, atomic.LoadInt32(&u.conn),
+			day, month, formatQuota(daily), formatQuota(monthly))
+	}
+	body := b.String()
+	header := fmt.Sprintf("HTTP/1.1 200 OK\r\nServer: cow-proxy\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n"+
+		"Cache-Control: no-cache\r\nConnection: close\r\n\r\n", len(body))
+	if _, err := c.Write([]byte(header + body)); err != nil {
+		debug.Printf("cli(%s) error sending stats: %v\n", c.RemoteAddr(), err)
+	}
+}
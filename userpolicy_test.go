@@ -0,0 +1,152 @@
+package cow
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUserPolicy(t *testing.T) {
+	p, err := parseUserPolicy(strings.Fields("allow=Example.com,github.com deny=gist.github.com maxConn=2 daily=1G monthly=20G admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.allow) != 2 || p.maxConn != 2 || p.daily != 1<<30 || p.monthly != 20<<30 || !p.admin {
+		t.Errorf("wrong policy %+v", p)
+	}
+	testData := []struct {
+		host    string
+		allowed bool
+	}{
+		{"example.com", true},
+		{"www.EXAMPLE.com", true},
+		{"notexample.com", false},
+		{"github.com", true},
+		{"gist.github.com", false},
+	}
+	for _, td := range testData {
+		if p.hostAllowed(td.host) != td.allowed {
+			t.Errorf("%s allowed should be %v", td.host, td.allowed)
+		}
+	}
+	for _, val := range []string{"maxConn=0", "daily=1X", "monthly=0", "quota=1G", "allow"} {
+		if _, err := parseUserPolicy([]string{val}); err == nil {
+			t.Error("should fail:", val)
+		}
+	}
+}
+
+func TestUserUsageRollover(t *testing.T) {
+	u := &userUsage{}
+	now := time.Date(2026, 1, 31, 23, 0, 0, 0, time.Local)
+	u.used(now)
+	u.add(100, 1000)
+	if day, month := u.used(now); day != 1100 || month != 1100 {
+		t.Errorf("usage should be 1100, got %d %d", day, month)
+	}
+	if day, month := u.used(now.Add(2 * time.Hour)); day != 0 || month != 0 {
+		t.Errorf("new day and month should clear usage, got %d %d", day, month)
+	}
+	u.add(10, 0)
+	if day, month := u.used(now.AddDate(0, 0, 2)); day != 0 || month != 10 {
+		t.Errorf("new day should only clear daily usage, got %d %d", day, month)
+	}
+}
+
+func TestCheckUserPolicy(t *testing.T) {
+	savedPolicy, savedUsage := auth.policy, metrics.data.Usage
+	defer func() { auth.policy, metrics.data.Usage = savedPolicy, savedUsage }()
+	p, _ := parseUserPolicy(strings.Fields("deny=blocked.com maxConn=1 daily=1K"))
+	auth.policy = map[string]*userPolicy{"alice": p}
+	metrics.data.Usage = make(map[string]*userUsage)
+
+	// check returns status sent to client, 0 if request is allowed.
+	check := func(c *clientConn, host string) int {
+		cli, srv := net.Pipe()
+		defer cli.Close()
+		c.Conn = srv
+		done := make(chan int)
+		go func() {
+			resp, err := http.ReadResponse(bufio.NewReader(cli), nil)
+			if err != nil {
+				done <- 0
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			done <- resp.StatusCode
+		}()
+		url, _ := ParseRequestURI("http://" + host + "/")
+		if err := c.checkUserPolicy(&Request{URL: url}, host); err == nil {
+			srv.Close()
+		}
+		return <-done
+	}
+	c1 := &clientConn{user: "alice"}
+	if status := check(c1, "example.com"); status != 0 {
+		t.Error("request should be allowed, got", status)
+	}
+	if status := check(c1, "www.blocked.com"); status != 403 {
+		t.Error("denied site should get 403, got", status)
+	}
+	c2 := &clientConn{user: "alice"}
+	if status := check(c2, "example.com"); status != 403 {
+		t.Error("second connection should exceed maxConn, got", status)
+	}
+	c2.releaseUsage()
+	c1.usage.add(1000, 100)
+	if status := check(c1, "example.com"); status != 403 {
+		t.Error("used up quota should get 403, got", status)
+	}
+	c1.releaseUsage()
+	if n := usageOf("alice").conn; n != 0 {
+		t.Error("connections should be released, got", n)
+	}
+}
+
+// TestUserPolicyFakeIP checks policy applies to host name of CONNECT to fake
+// address.
+func TestUserPolicyFakeIP(t *testing.T) {
+	savedRequired, savedAuthed, savedPolicy := auth.required, auth.authed, auth.policy
+	savedUsage, savedFake, savedPort := metrics.data.Usage, fakeDNS, config.TunnelAllowedPort
+	defer func() {
+		auth.required, auth.authed, auth.policy = savedRequired, savedAuthed, savedPolicy
+		metrics.data.Usage, fakeDNS, config.TunnelAllowedPort = savedUsage, savedFake, savedPort
+	}()
+	p, _ := parseUserPolicy([]string{"deny=blocked.com"})
+	auth.required = true
+	auth.authed = NewTimeoutSet(time.Hour)
+	auth.authed.add("127.0.0.1", "bob")
+	auth.policy = map[string]*userPolicy{"bob": p}
+	metrics.data.Usage = make(map[string]*userUsage)
+	config.TunnelAllowedPort = map[string]bool{"443": true}
+	pool, err := newFakeIPPool("10.0.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeDNS = &fakeIPDNS{pool: pool}
+	ip := pool.alloc("www.blocked.com")
+
+	proxy := testProxy(t)
+	defer proxy.Close()
+	c, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	hostPort := net.JoinHostPort(ip.String(), "443")
+	if _, err = c.Write([]byte("CONNECT " + hostPort + " HTTP/1.1\r\nHost: " + hostPort + "\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(c), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 403 {
+		t.Error("CONNECT to fake address of denied site should get 403, got", resp.StatusCode)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package cow
 
 import (
 	"bytes"
@@ -6,9 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -244,6 +246,73 @@ func expandTilde(pth string) string {
 	return pth
 }
 
+// linkFile is replaced in tests to simulate file systems without hard link.
+var linkFile = os.Link
+
+// writeFileAtomic writes data to a temp file in the same directory, syncs it
+// to disk and then renames it to fpath. So a crash or power loss leaves
+// either the old or the new content, never a truncated file. If backup is
+// true, the previous content is kept in fpath.bak, an existing backup is
+// kept if fpath doesn't exist.
+func writeFileAtomic(fpath string, data []byte, backup bool) (err error) {
+	dir := filepath.Dir(fpath)
+	// Create tmp file in the same directory to avoid cross FS rename.
+	f, err := ioutil.TempFile(dir, filepath.Base(fpath))
+	if err != nil {
+		return
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	bak := fpath + ".bak"
+	if isWindows {
+		// Windows don't allow rename to existing file.
+		if backup && isFileExists(fpath) == nil {
+			os.Remove(bak)
+			os.Rename(fpath, bak)
+		} else {
+			os.Remove(fpath)
+		}
+	} else if backup && isFileExists(fpath) == nil {
+		// Hard link keeps fpath in place until it's replaced by rename. Copy
+		// on file systems without hard link, e.g. vfat on USB storage.
+		os.Remove(bak)
+		if linkFile(fpath, bak) != nil {
+			if b, rerr := ioutil.ReadFile(fpath); rerr == nil {
+				if werr := ioutil.WriteFile(bak, b, 0600); werr != nil {
+					errl.Println("backup", fpath+":", werr)
+				}
+			}
+		}
+	}
+	if err = os.Rename(tmp, fpath); err != nil {
+		return
+	}
+	if !isWindows {
+		// Make sure the rename itself is on disk.
+		if d, derr := os.Open(dir); derr == nil {
+			d.Sync()
+			d.Close()
+		}
+	}
+	return
+}
+
 // copyN copys N bytes from src to dst, reading at most rdSize for each read.
 // rdSize should <= buffer size of the buffered reader.
 // Returns any encountered error.
@@ -1,8 +1,10 @@
-package main
+package cow
 
 import (
 	"bytes"
 	"errors"
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 
@@ -219,6 +221,58 @@ func TestIsFileExists(t *testing.T) {
 	}
 }
 
+func TestWriteFileAtomic(t *testing.T) {
+	const fpath = "testdata/atomic"
+	defer os.Remove(fpath)
+	defer os.Remove(fpath + ".bak")
+
+	if err := writeFileAtomic(fpath, []byte("first"), true); err != nil {
+		t.Fatal("write first:", err)
+	}
+	if err := writeFileAtomic(fpath, []byte("second"), true); err != nil {
+		t.Fatal("write second:", err)
+	}
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil || string(b) != "second" {
+		t.Errorf("file content should be second, got: %q %v\n", b, err)
+	}
+	b, err = ioutil.ReadFile(fpath + ".bak")
+	if err != nil || string(b) != "first" {
+		t.Errorf("backup content should be first, got: %q %v\n", b, err)
+	}
+
+	if err := writeFileAtomic(fpath, []byte("third"), false); err != nil {
+		t.Fatal("write third:", err)
+	}
+	b, _ = ioutil.ReadFile(fpath + ".bak")
+	if string(b) != "first" {
+		t.Errorf("backup should not change without backup, got: %q\n", b)
+	}
+
+	// File system without hard link.
+	linkFile = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.New("not supported")}
+	}
+	defer func() { linkFile = os.Link }()
+	if err := writeFileAtomic(fpath, []byte("fourth"), true); err != nil {
+		t.Fatal("write fourth:", err)
+	}
+	b, _ = ioutil.ReadFile(fpath + ".bak")
+	if string(b) != "third" {
+		t.Errorf("backup should be copied without hard link, got: %q\n", b)
+	}
+
+	// Backup is kept if the file is missing.
+	os.Remove(fpath)
+	if err := writeFileAtomic(fpath, []byte("fifth"), true); err != nil {
+		t.Fatal("write fifth:", err)
+	}
+	b, _ = ioutil.ReadFile(fpath + ".bak")
+	if string(b) != "third" {
+		t.Errorf("backup should be kept if file is missing, got: %q\n", b)
+	}
+}
+
 func TestNewNbitIPv4Mask(t *testing.T) {
 	mask := []byte(NewNbitIPv4Mask(32))
 	for i := 0; i < 4; i++ {